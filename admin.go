@@ -0,0 +1,164 @@
+package caddygcsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// proxies holds the provisioned handlers, so the admin API can act on the
+// running instances.
+var proxies = struct {
+	sync.Mutex
+	set map[*GcsProxy]struct{}
+}{set: make(map[*GcsProxy]struct{})}
+
+func registerProxy(p *GcsProxy) {
+	proxies.Lock()
+	defer proxies.Unlock()
+	proxies.set[p] = struct{}{}
+}
+
+func unregisterProxy(p *GcsProxy) {
+	proxies.Lock()
+	defer proxies.Unlock()
+	delete(proxies.set, p)
+}
+
+// runningProxies returns the currently provisioned handlers.
+func runningProxies() []*GcsProxy {
+	proxies.Lock()
+	defer proxies.Unlock()
+	running := make([]*GcsProxy, 0, len(proxies.set))
+	for p := range proxies.set {
+		running = append(running, p)
+	}
+	return running
+}
+
+// adminAPI is a module that serves the gcs proxy endpoints of the admin API,
+// under `/gcs-proxy/`.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.gcs_proxy",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes of the gcs proxy.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/gcs-proxy/mirror-check",
+			Handler: caddy.AdminHandlerFunc(a.handleMirrorCheck),
+		},
+		{
+			Pattern: "/gcs-proxy/purge",
+			Handler: caddy.AdminHandlerFunc(a.handlePurge),
+		},
+	}
+}
+
+// purgeRequest is the body of a `POST /gcs-proxy/purge` request. Exactly one
+// of Key and Prefix is set.
+type purgeRequest struct {
+	// Only purge the caches of handlers for this bucket. Empty means every
+	// bucket.
+	Bucket string `json:"bucket,omitempty"`
+
+	Key    string `json:"key,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// handlePurge drops a key, or every key under a prefix, from the caches of the
+// running handlers. Purging a release pointer makes its handlers switch
+// release right away.
+func (adminAPI) handlePurge(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+	if (req.Key == "") == (req.Prefix == "") {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("either key or prefix is required"),
+		}
+	}
+
+	purged := 0
+	for _, p := range runningProxies() {
+		if p.release != nil && (req.Bucket == "" || req.Bucket == p.Bucket) &&
+			(req.Key == p.ReleasePointer.Key || (req.Prefix != "" && strings.HasPrefix(p.ReleasePointer.Key, req.Prefix))) {
+			p.release.invalidate()
+			purged++
+		}
+		for bucket, cache := range p.bucketCaches() {
+			if req.Bucket != "" && req.Bucket != bucket {
+				continue
+			}
+			if req.Key != "" {
+				if cache.delete(req.Key) {
+					purged++
+				}
+				continue
+			}
+			purged += cache.deletePrefix(req.Prefix)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
+
+// handleMirrorCheck runs the mirror check of every handler with one configured
+// and responds with their reports.
+func (adminAPI) handleMirrorCheck(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	reports := []mirrorReport{}
+	for _, p := range runningProxies() {
+		if p.mirror == nil {
+			continue
+		}
+		report, err := p.mirror.check(r.Context())
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadGateway,
+				Err:        fmt.Errorf("checking mirror %s of %s: %v", p.MirrorCheck.Bucket, p.Bucket, err),
+			}
+		}
+		reports = append(reports, report)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(reports)
+}
+
+// Interface guard
+var _ caddy.AdminRouter = (*adminAPI)(nil)
@@ -0,0 +1,108 @@
+package caddygcsproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+const (
+	defaultAntivirusTimeout = 30 * time.Second
+	clamdChunkSize          = 64 * 1024
+)
+
+// Antivirus configures scanning of uploads with ClamAV before they are
+// written to the bucket.
+type Antivirus struct {
+	// Address of clamd, `tcp://<host>:<port>` or `unix://<socket path>`.
+	Address string `json:"address,omitempty"`
+
+	// Timeout for scanning a single upload. Default is 30s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// scanResult is the verdict of a scan, Signature is set when infected.
+type scanResult struct {
+	Infected  bool
+	Signature string
+}
+
+// scan streams body to clamd using the INSTREAM command.
+func (a Antivirus) scan(ctx context.Context, body io.Reader) (scanResult, error) {
+	network, address, ok := strings.Cut(a.Address, "://")
+	if !ok {
+		network, address = "tcp", a.Address
+	}
+
+	timeout := time.Duration(a.Timeout)
+	if timeout == 0 {
+		timeout = defaultAntivirusTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return scanResult{}, fmt.Errorf("connecting to clamd: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return scanResult{}, err
+	}
+
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return scanResult{}, err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return scanResult{}, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return scanResult{}, readErr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return scanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return scanResult{}, fmt.Errorf("reading clamd reply: %v", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply parses replies like `stream: OK` and
+// `stream: Eicar-Test-Signature FOUND`.
+func parseClamdReply(reply string) (scanResult, error) {
+	_, verdict, _ := strings.Cut(reply, ": ")
+	switch {
+	case verdict == "OK":
+		return scanResult{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return scanResult{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return scanResult{}, fmt.Errorf("clamd error: %s", reply)
+	}
+}
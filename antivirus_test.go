@@ -0,0 +1,33 @@
+package caddygcsproxy
+
+import (
+	"testing"
+)
+
+func TestParseClamdReply(t *testing.T) {
+	testCases := []struct {
+		reply     string
+		shouldErr bool
+		expected  scanResult
+	}{
+		{"stream: OK", false, scanResult{}},
+		{"stream: Eicar-Test-Signature FOUND", false, scanResult{Infected: true, Signature: "Eicar-Test-Signature"}},
+		{"INSTREAM size limit exceeded. ERROR", true, scanResult{}},
+	}
+
+	for _, tc := range testCases {
+		result, err := parseClamdReply(tc.reply)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Reply '%s' expected an err and did not get one", tc.reply)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Reply '%s' unexpected err '%s'", tc.reply, err.Error())
+		}
+		if result != tc.expected {
+			t.Errorf("Reply '%s' expected '%#v' but got '%#v'", tc.reply, tc.expected, result)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultAuditLogPrefix        = "audit/"
+	defaultAuditLogFlushInterval = time.Minute
+	defaultAuditLogMaxEvents     = 1000
+
+	// Events kept while the log bucket can't be written, in multiples of
+	// MaxEvents, before the oldest are dropped.
+	auditLogBacklog = 10
+
+	auditLogFlushTimeout = 30 * time.Second
+)
+
+// AuditLog configures writing the mutation events as NDJSON objects to a
+// logs bucket. Each flush writes a new object that is never overwritten, so
+// with a retention policy on the logs bucket the log is tamper-evident.
+type AuditLog struct {
+	// Bucket the log objects are written to. Default is Bucket, in which case
+	// Prefix should be hidden and protected.
+	Bucket string `json:"bucket,omitempty"`
+
+	// Key prefix of the log objects, which are named
+	// `<prefix><yyyy>/<mm>/<dd>/<time>-<id>.ndjson`. Default is `audit/`.
+	Prefix string `json:"prefix,omitempty"`
+
+	// How often buffered events are written. Default is 1m.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	// Number of buffered events that triggers a write before the interval is
+	// up. Default is 1000.
+	MaxEvents int `json:"max_events,omitempty"`
+}
+
+// auditLogSink buffers mutation events and writes them to the logs bucket.
+// Events that fail to be written are kept and retried on the next flush.
+type auditLogSink struct {
+	config AuditLog
+	bucket func() *storage.BucketHandle
+	log    *zap.Logger
+	full   chan struct{}
+
+	mu      sync.Mutex
+	pending []mutationEvent
+}
+
+func (p GcsProxy) newAuditLogSink() *auditLogSink {
+	config := *p.AuditLog
+	if config.Bucket == "" {
+		config.Bucket = p.Bucket
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultAuditLogPrefix
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = caddy.Duration(defaultAuditLogFlushInterval)
+	}
+	if config.MaxEvents <= 0 {
+		config.MaxEvents = defaultAuditLogMaxEvents
+	}
+	return &auditLogSink{
+		config: config,
+		bucket: func() *storage.BucketHandle { return p.gcs.client().Bucket(config.Bucket) },
+		log:    p.log,
+		full:   make(chan struct{}, 1),
+	}
+}
+
+func (s *auditLogSink) String() string {
+	return "audit log gs://" + s.config.Bucket + "/" + s.config.Prefix
+}
+
+// send buffers the event, waking up the flusher once MaxEvents are pending.
+func (s *auditLogSink) send(ctx context.Context, ev mutationEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, ev)
+	if backlog := s.config.MaxEvents * auditLogBacklog; len(s.pending) > backlog {
+		dropped := len(s.pending) - backlog
+		s.pending = s.pending[dropped:]
+		return fmt.Errorf("audit log backlog full, dropped %d events", dropped)
+	}
+	if len(s.pending) >= s.config.MaxEvents {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// run flushes the buffered events every FlushInterval, or sooner when
+// MaxEvents are pending, until ctx is done, then flushes one last time.
+func (s *auditLogSink) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.config.FlushInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// ctx is already done, give the last flush its own deadline
+			flushCtx, cancel := context.WithTimeout(context.Background(), auditLogFlushTimeout)
+			s.flush(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+		case <-s.full:
+		}
+		s.flush(ctx)
+	}
+}
+
+// flush writes the pending events to a new log object.
+func (s *auditLogSink) flush(ctx context.Context) {
+	s.mu.Lock()
+	events := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	name := auditLogObjectName(s.config.Prefix, time.Now().UTC(), newSpoolID())
+	if err := s.write(ctx, name, events); err != nil {
+		s.log.Error("could not write audit log, retrying on next flush",
+			zap.String("bucket", s.config.Bucket),
+			zap.String("key", name),
+			zap.Int("events", len(events)),
+			zap.String("err", err.Error()),
+		)
+		s.mu.Lock()
+		s.pending = append(events, s.pending...)
+		s.mu.Unlock()
+	}
+}
+
+func (s *auditLogSink) write(ctx context.Context, name string, events []mutationEvent) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := s.bucket().Object(name).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	writer.ContentType = "application/x-ndjson"
+	if _, err := writer.Write(body.Bytes()); err != nil {
+		cancel()
+		return err
+	}
+	return writer.Close()
+}
+
+// auditLogObjectName returns the key of a log object written at t.
+func auditLogObjectName(prefix string, t time.Time, id string) string {
+	return prefix + t.Format("2006/01/02/") + t.Format("20060102T150405Z") + "-" + id + ".ndjson"
+}
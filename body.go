@@ -0,0 +1,94 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+const defaultBufferMemoryThreshold = 1 << 20
+
+// BufferPuts configures buffering of complete PUT bodies before they are
+// written to GCS, so uploads can be retried and scanned without being held in
+// memory. Bodies up to MemoryThreshold are kept in memory, larger ones in a
+// temp file.
+type BufferPuts struct {
+	// Largest body kept in memory. Default is 1MiB.
+	MemoryThreshold int64 `json:"memory_threshold,omitempty"`
+
+	// Directory the temp files are created in. Default is the system temp
+	// directory.
+	Dir string `json:"dir,omitempty"`
+}
+
+// buffer reads r in full, into memory while it stays under the threshold and
+// into a temp file past it.
+func (b BufferPuts) buffer(r io.Reader) (replayable, func(), error) {
+	threshold := b.MemoryThreshold
+	if threshold <= 0 {
+		threshold = defaultBufferMemoryThreshold
+	}
+	head, err := io.ReadAll(io.LimitReader(r, threshold+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(head)) <= threshold {
+		return memoryBody(head), func() {}, nil
+	}
+
+	spooled, err := spoolBody(io.MultiReader(bytes.NewReader(head), r), b.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return spooled, func() { spooled.Close() }, nil
+}
+
+// spooledBody is a request body buffered to a temp file so that it can be
+// inspected and then read again for the upload.
+type spooledBody struct {
+	file *os.File
+	size int64
+}
+
+// spoolBody copies r to a temp file in dir (or the default temp directory).
+func spoolBody(r io.Reader, dir string) (*spooledBody, error) {
+	file, err := os.CreateTemp(dir, "gcsproxy-upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &spooledBody{file: file, size: size}, nil
+}
+
+// Reader rewinds the body and returns a reader over it from the start.
+func (b *spooledBody) Reader() (io.Reader, error) {
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return b.file, nil
+}
+
+// persist closes the body and moves it to name, after which Close is a no-op.
+func (b *spooledBody) persist(name string) error {
+	b.file.Close()
+	if err := os.Rename(b.file.Name(), name); err != nil {
+		return err
+	}
+	b.file = nil
+	return nil
+}
+
+// Close removes the temp file.
+func (b *spooledBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
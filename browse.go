@@ -2,20 +2,34 @@ package caddygcsproxy
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"hash"
 	"html/template"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
 	"google.golang.org/api/iterator"
 )
 
+// defaultMaxKeys is the browse page size if max_keys is not set.
+const defaultMaxKeys = 1000
+
 var bufPool = sync.Pool{
 	New: func() interface{} {
 		return new(bytes.Buffer)
@@ -26,6 +40,26 @@ type PageObj struct {
 	Count    int64  `json:"count"`
 	Items    []Item `json:"items"`
 	MoreLink string `json:"more"`
+
+	// Request path of the listed directory, the links to it and each of
+	// its parents starting at `/`, and the link to its parent, which is
+	// empty at `/`.
+	CurrentPath string       `json:"path"`
+	Breadcrumbs []Breadcrumb `json:"breadcrumbs"`
+	ParentUrl   string       `json:"parent,omitempty"`
+
+	// Content of the listed directory's HEADER.html and FOOTER.html, if
+	// BrowseHeaderFooter is set and they exist.
+	Header template.HTML `json:"-"`
+	Footer template.HTML `json:"-"`
+
+	etag string
+}
+
+// Breadcrumb links to one of the directories of the listed path.
+type Breadcrumb struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
 }
 
 type Item struct {
@@ -35,126 +69,375 @@ type Item struct {
 	Url          string `json:"url"`
 	Size         string `json:"size"`
 	LastModified string `json:"last_modified"`
-}
 
-func (po PageObj) GenerateJson(w http.ResponseWriter) error {
-	buf := bufPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bufPool.Put(buf)
+	// Size in bytes and modification time, for JSON listings. Size and
+	// LastModified are the human readable forms of them.
+	Bytes    int64     `json:"bytes"`
+	Modified time.Time `json:"modified,omitzero"`
 
-	err := json.NewEncoder(buf).Encode(po)
-	if err != nil {
-		return err
-	}
+	// Number of objects under a directory, if BrowseDirUsage is set. Size is
+	// then their total size. Truncated means there are more objects than
+	// were counted.
+	Objects   int64 `json:"objects,omitempty"`
+	Truncated bool  `json:"truncated,omitempty"`
+}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	_, err = buf.WriteTo(w)
-	return err
+func (po PageObj) GenerateJson(w http.ResponseWriter) error {
+	return po.generate(w, nil)
 }
 
 func (p GcsProxy) ConstructListParams(r *http.Request, key string) *storage.Query {
 	prefix := strings.TrimPrefix(key, "/")
 
 	query := &storage.Query{
-		Prefix:    prefix,
-		Delimiter: "/",
+		Prefix:                   prefix,
+		Delimiter:                "/",
+		IncludeTrailingDelimiter: true,
 	}
 
-	maxPerPage := r.URL.Query().Get("max")
-	if maxPerPage != "" {
-		// maxKeys, err := strconv.ParseInt(maxPerPage, 10, 64)
-		// if err == nil && maxKeys > 0 && maxKeys <= 1000 {
-		// 	query.MaxResults = int(maxKeys)
-		// }
+	// Filter server side with a glob relative to the directory, e.g.
+	// `?glob=**/*.parquet`. Globs spanning directories list recursively.
+	if glob := r.URL.Query().Get("glob"); glob != "" {
+		query.MatchGlob = prefix + glob
+		if strings.Contains(glob, "/") || strings.Contains(glob, "**") {
+			query.Delimiter = ""
+			query.IncludeTrailingDelimiter = false
+		}
 	}
 
-	if pageToken := r.URL.Query().Get("next"); pageToken != "" {
-		query.StartOffset = pageToken
+	return query
+}
+
+// pageSize returns the number of keys to list per browse page, from the
+// `max` query parameter capped at MaxKeys.
+func (p GcsProxy) pageSize(r *http.Request) int {
+	maxKeys := p.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxKeys
 	}
 
-	return query
+	maxPerPage := r.URL.Query().Get("max")
+	if maxPerPage != "" {
+		size, err := strconv.Atoi(maxPerPage)
+		if err == nil && size > 0 && size < maxKeys {
+			return size
+		}
+	}
+	return maxKeys
 }
 
 func (po PageObj) GenerateHtml(w http.ResponseWriter, template *template.Template) error {
+	return po.generate(w, template)
+}
+
+// generate writes the page to w as JSON, or as HTML with tpl if it isn't nil.
+func (po PageObj) generate(w http.ResponseWriter, tpl *template.Template) error {
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufPool.Put(buf)
 
-	err := template.Execute(buf, po)
+	contentType, err := po.render(buf, tpl)
 	if err != nil {
 		return err
 	}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Type", contentType)
 	_, err = buf.WriteTo(w)
 	return err
 }
 
+// render writes the page to buf as JSON, or as HTML with tpl if it isn't nil,
+// and returns its content type.
+func (po PageObj) render(buf *bytes.Buffer, tpl *template.Template) (string, error) {
+	if tpl == nil {
+		return "application/json; charset=utf-8", json.NewEncoder(buf).Encode(po)
+	}
+	return "text/html; charset=utf-8", tpl.Execute(buf, po)
+}
+
+// bodyEtag returns the ETag of the page rendered as body. It changes with the
+// listing, including what the rendering leaves out, and with the body itself.
+func (po PageObj) bodyEtag(body []byte) string {
+	sum := sha256.Sum256(append([]byte(po.etag), body...))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// MakePageObj reads a single page of the iterator, as sized by its PageInfo.
 func (p GcsProxy) MakePageObj(it *storage.ObjectIterator) (PageObj, error) {
-	po := PageObj{}
+	return p.makePageObj(it, "")
+}
 
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
+// makePageObj reads a single page of the iterator listing prefix. Files are
+// named relative to prefix, so recursive listings link to the right path.
+func (p GcsProxy) makePageObj(it *storage.ObjectIterator, prefix string) (PageObj, error) {
+	b := newPageBuilder(prefix, p.FolderMarkers)
+	var token string
+	if size := it.PageInfo().MaxSize; size > 0 {
+		// Read exactly one page of the listing. Entries that aren't listed,
+		// like repeated directories, leave the page short rather than pull
+		// in part of the next one, whose other entries would then be skipped.
+		var page []*storage.ObjectAttrs
+		var err error
+		token, err = iterator.NewPager(it, size, it.PageInfo().Token).NextPage(&page)
 		if err != nil {
 			return PageObj{}, err
 		}
-
-		// Increment count for each item
-		po.Count++
-
-		if attrs.Prefix != "" {
-			// This is a directory
-			name := path.Base(attrs.Prefix)
-			dirPath := "./" + name + "/"
-			po.Items = append(po.Items, Item{
-				Url:   dirPath,
-				Name:  name,
-				IsDir: true,
-			})
-		} else {
-			// This is a file
-			name := path.Base(attrs.Name)
-			itemPath := "./" + name
-			size := humanize.Bytes(uint64(attrs.Size))
-			timeAgo := humanize.Time(attrs.Updated)
-			po.Items = append(po.Items, Item{
-				Name:         name,
-				Key:          attrs.Name,
-				Url:          itemPath,
-				Size:         size,
-				LastModified: timeAgo,
-				IsDir:        false,
-			})
+		for _, attrs := range page {
+			b.add(attrs)
+		}
+	} else {
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return PageObj{}, err
+			}
+			b.add(attrs)
 		}
 	}
+	po := b.po
 
 	// If there's a next page token, create the MoreLink
-	if token := it.PageInfo().Token; token != "" {
+	if token != "" {
 		var nextUrl url.URL
 		queryItems := nextUrl.Query()
 		queryItems.Add("next", token)
-		if it.PageInfo().MaxSize > 0 {
-			queryItems.Add("max", strconv.FormatInt(int64(it.PageInfo().MaxSize), 10))
-		}
+		queryItems.Add("max", strconv.FormatInt(int64(it.PageInfo().MaxSize), 10))
 		nextUrl.RawQuery = queryItems.Encode()
 		po.MoreLink = nextUrl.String()
+		b.hash.Write([]byte(token))
 	}
 
+	po.etag = `"` + hex.EncodeToString(b.hash.Sum(nil)[:16]) + `"`
 	return po, nil
 }
 
+// browsePath returns the path the client requested the listing at, before
+// any rewrite or stripped prefix, so links made from it resolve.
+func browsePath(r *http.Request) string {
+	if orig, ok := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok {
+		return orig.URL.Path
+	}
+	return r.URL.Path
+}
+
+// setPath fills in CurrentPath, Breadcrumbs and ParentUrl for the directory
+// listed at reqPath.
+func (po *PageObj) setPath(reqPath string) {
+	po.CurrentPath = path.Clean("/" + reqPath)
+	if po.CurrentPath != "/" {
+		po.CurrentPath += "/"
+	}
+
+	link := "/"
+	po.Breadcrumbs = []Breadcrumb{{Name: "/", Url: link}}
+	for name := range strings.SplitSeq(strings.Trim(po.CurrentPath, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		link += url.PathEscape(name) + "/"
+		po.Breadcrumbs = append(po.Breadcrumbs, Breadcrumb{Name: name, Url: link})
+	}
+	if n := len(po.Breadcrumbs); n > 1 {
+		po.ParentUrl = po.Breadcrumbs[n-2].Url
+	}
+}
+
+// sortItems orders the items of a page by `name`, `size` or `time`, in
+// `asc` or `desc` order. GCS lists in name order, so only the items of the
+// page are sorted, not the whole directory. Unknown fields leave the order
+// as listed.
+func sortItems(items []Item, field, order string) {
+	if field == "" && order == "desc" {
+		field = "name"
+	}
+	var compare func(a, b Item) int
+	switch field {
+	case "name":
+		compare = func(a, b Item) int { return strings.Compare(a.Name, b.Name) }
+	case "size":
+		compare = func(a, b Item) int { return cmp.Compare(a.Bytes, b.Bytes) }
+	case "time":
+		compare = func(a, b Item) int { return a.Modified.Compare(b.Modified) }
+	default:
+		return
+	}
+	if order == "desc" {
+		slices.SortStableFunc(items, func(a, b Item) int { return compare(b, a) })
+	} else {
+		slices.SortStableFunc(items, compare)
+	}
+}
+
+// pageBuilder collects the items of a browse page.
+type pageBuilder struct {
+	po            PageObj
+	prefix        string
+	folderMarkers bool
+	// The listing ETag is a hash of the names and generations on the page
+	hash hash.Hash
+	// Directories listed so far, so explicit `dir/` objects and folder
+	// markers don't repeat them
+	dirs map[string]bool
+}
+
+func newPageBuilder(prefix string, folderMarkers bool) *pageBuilder {
+	return &pageBuilder{
+		prefix:        prefix,
+		folderMarkers: folderMarkers,
+		hash:          sha256.New(),
+		dirs:          make(map[string]bool),
+	}
+}
+
+// add lists an object or prefix returned by the iterator.
+func (b *pageBuilder) add(attrs *storage.ObjectAttrs) {
+	fmt.Fprintf(b.hash, "%s\x00%s\x00%d\n", attrs.Prefix, attrs.Name, attrs.Generation)
+	if item, ok := b.item(attrs); ok {
+		b.po.Count++
+		b.po.Items = append(b.po.Items, item)
+	}
+}
+
+// item returns the listing item for an object or prefix returned by the
+// iterator, or false if it isn't listed. Listings include trailing
+// delimiters, so an explicit `dir/` object, as created by the console, comes
+// back both as a prefix and as an object; both are listed as the one
+// directory, and the listed directory's own object is left out.
+func (b *pageBuilder) item(attrs *storage.ObjectAttrs) (Item, bool) {
+	dir := attrs.Prefix
+	if attrs.Prefix == "" {
+		switch {
+		case strings.HasSuffix(attrs.Name, "/"):
+			if attrs.Name == b.prefix {
+				return Item{}, false
+			}
+			dir = attrs.Name
+		case b.folderMarkers && strings.HasSuffix(attrs.Name, folderMarkerSuffix):
+			dir = strings.TrimSuffix(attrs.Name, folderMarkerSuffix) + "/"
+		}
+	}
+
+	if dir != "" {
+		// This is a directory
+		name := strings.TrimSuffix(strings.TrimPrefix(dir, b.prefix), "/")
+		if b.prefix == "" {
+			name = path.Base(dir)
+		}
+		if b.dirs[name] {
+			return Item{}, false
+		}
+		b.dirs[name] = true
+		return Item{
+			Url:   "./" + name + "/",
+			Name:  name,
+			Key:   dir,
+			IsDir: true,
+		}, true
+	}
+
+	// This is a file
+	name := path.Base(attrs.Name)
+	if b.prefix != "" {
+		name = strings.TrimPrefix(attrs.Name, b.prefix)
+	}
+	return Item{
+		Name:         name,
+		Key:          attrs.Name,
+		Url:          "./" + name,
+		Size:         humanize.Bytes(uint64(attrs.Size)),
+		LastModified: humanize.Time(attrs.Updated),
+		Bytes:        attrs.Size,
+		Modified:     attrs.Updated.UTC(),
+		IsDir:        false,
+	}, true
+}
+
+// maxHeaderFooterSize is the most read of a HEADER.html or FOOTER.html.
+const maxHeaderFooterSize = 1 << 20
+
+// clientWritable returns true if clients can store the object name in the
+// directory at dirPath, by uploading it, posting it to the directory or
+// moving another onto it.
+func (p GcsProxy) clientWritable(dirPath string, name string) bool {
+	reqPath := joinPath(dirPath, name)
+	return p.methodAllowed(http.MethodPut, reqPath) ||
+		p.methodAllowed(http.MethodPost, dirPath) ||
+		p.methodAllowed(methodMove, reqPath)
+}
+
+// addHeaderFooter fills in the page's Header and Footer from the HEADER.html
+// and FOOTER.html objects of the listed prefix, if they are on the page.
+// dirPath is the request path of the listing. Objects that can't be read are
+// logged and left out, and so are those clients can write, since they are
+// rendered as HTML.
+func (p GcsProxy) addHeaderFooter(ctx context.Context, po *PageObj, prefix string, dirPath string) {
+	for _, item := range po.Items {
+		var dest *template.HTML
+		switch item.Key {
+		case prefix + "HEADER.html":
+			dest = &po.Header
+		case prefix + "FOOTER.html":
+			dest = &po.Footer
+		default:
+			continue
+		}
+		if p.clientWritable(dirPath, path.Base(item.Key)) {
+			p.log.Warn("not showing browse header or footer clients can write", zap.String("key", item.Key))
+			continue
+		}
+
+		reader, _, err := p.openObject(ctx, item.Key)
+		if err != nil {
+			p.log.Warn("could not read browse header or footer", zap.String("key", item.Key), zap.String("err", err.Error()))
+			continue
+		}
+		content, err := io.ReadAll(io.LimitReader(reader, maxHeaderFooterSize))
+		reader.Close()
+		if err != nil {
+			p.log.Warn("could not read browse header or footer", zap.String("key", item.Key), zap.String("err", err.Error()))
+			continue
+		}
+		// The objects are trusted like templates, they are HTML fragments
+		*dest = template.HTML(content)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 // This is a lame ass default template - needs to get better
 const defaultBrowseTemplate = `<!DOCTYPE html>
 <html>
         <body>
+		<nav>
+		{{- range .Breadcrumbs }}
+		<a href="{{html .Url}}">{{html .Name}}</a>{{if ne .Name "/"}}/{{end}}
+		{{- end }}
+		</nav>
+		{{- if .Header }}
+		{{ .Header }}
+		{{- end }}
                 <ul>
-                {{- range .PageObj }}
+                {{- if .ParentUrl }}
+                <li><a href="{{html .ParentUrl}}">..</a></li>
+                {{- end }}
+                {{- range .Items }}
                 <li>
                 {{- if .IsDir}}
                 <a href="{{html .Url}}">{{html .Name}}</a>
+                {{- if .Size}} {{ .Objects }}{{if .Truncated}}+{{end}} items · {{html .Size}}{{end}}
                 {{- else}}
                 <a href="{{html .Url}}">{{html .Name}}</a> Size: {{html .Size}} Last Modified: {{html .LastModified}}
                 {{- end}}
@@ -165,5 +448,8 @@ const defaultBrowseTemplate = `<!DOCTYPE html>
 		{{- if .MoreLink }}
 		<a href="{{ html .MoreLink }}">more...</a>
 		{{- end }}
+		{{- if .Footer }}
+		{{ .Footer }}
+		{{- end }}
         </body>
 </html>`
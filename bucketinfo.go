@@ -0,0 +1,67 @@
+package caddygcsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// bucketInfo is the JSON document served at BucketInfoPath.
+type bucketInfo struct {
+	Name                  string           `json:"name"`
+	Location              string           `json:"location"`
+	LocationType          string           `json:"location_type,omitempty"`
+	StorageClass          string           `json:"storage_class"`
+	Versioning            bool             `json:"versioning"`
+	HierarchicalNamespace bool             `json:"hierarchical_namespace"`
+	RetentionPolicy       *bucketRetention `json:"retention_policy,omitempty"`
+	SoftDeleteRetention   string           `json:"soft_delete_retention,omitempty"`
+	Metageneration        int64            `json:"metageneration"`
+	Created               time.Time        `json:"created"`
+}
+
+type bucketRetention struct {
+	RetentionPeriod string    `json:"retention_period"`
+	EffectiveTime   time.Time `json:"effective_time"`
+	Locked          bool      `json:"locked"`
+}
+
+// BucketInfoHandler responds with selected attributes of the bucket as JSON.
+func (p GcsProxy) BucketInfoHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opGet)
+	defer cancelOp()
+
+	attrs, err := p.bucketFor(opGet).Attrs(ctx)
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+
+	info := bucketInfo{
+		Name:           attrs.Name,
+		Location:       attrs.Location,
+		LocationType:   attrs.LocationType,
+		StorageClass:   attrs.StorageClass,
+		Versioning:     attrs.VersioningEnabled,
+		Metageneration: attrs.MetaGeneration,
+		Created:        attrs.Created,
+	}
+	if attrs.HierarchicalNamespace != nil {
+		info.HierarchicalNamespace = attrs.HierarchicalNamespace.Enabled
+	}
+	if rp := attrs.RetentionPolicy; rp != nil {
+		info.RetentionPolicy = &bucketRetention{
+			RetentionPeriod: rp.RetentionPeriod.String(),
+			EffectiveTime:   rp.EffectiveTime,
+			Locked:          rp.IsLocked,
+		}
+	}
+	if sd := attrs.SoftDeletePolicy; sd != nil && sd.RetentionDuration > 0 {
+		info.SoftDeleteRetention = sd.RetentionDuration.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	return json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,187 @@
+package caddygcsproxy
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+// bucketNamePattern matches valid GCS bucket names.
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,220}[a-z0-9]$`)
+
+// bucketRoute maps requests under a path prefix to a bucket.
+type bucketRoute struct {
+	prefix string
+	bucket string
+}
+
+// bucketRouter picks the bucket of each request from BucketMap. Each mapped
+// bucket gets its own cache, since the caches are keyed by object key alone.
+type bucketRouter struct {
+	hosts     map[string]string
+	prefixes  []bucketRoute
+	caches    map[string]*objectCache
+	cacheKeys []string
+}
+
+// provisionBucketMap sets up the routes of BucketMap, along with a shared
+// cache for every mapped bucket if Cache is set.
+func (p *GcsProxy) provisionBucketMap() error {
+	router := &bucketRouter{
+		hosts:  make(map[string]string),
+		caches: make(map[string]*objectCache),
+	}
+	for match, bucket := range p.BucketMap {
+		if match == "" || bucket == "" {
+			return fmt.Errorf("bucket_map %q requires a host or path prefix and a bucket", match)
+		}
+		if strings.HasPrefix(match, "/") {
+			router.prefixes = append(router.prefixes, bucketRoute{prefix: match, bucket: bucket})
+		} else {
+			router.hosts[strings.ToLower(match)] = bucket
+		}
+
+		if p.Cache == nil || bucket == p.Bucket || router.caches[bucket] != nil {
+			continue
+		}
+		mapped := *p
+		mapped.Bucket = bucket
+		if err := mapped.loadCache(); err != nil {
+			return fmt.Errorf("loading cache of bucket %s: %v", bucket, err)
+		}
+		router.caches[bucket] = mapped.cache
+		router.cacheKeys = append(router.cacheKeys, mapped.cacheKey)
+	}
+	// The longest matching prefix wins
+	slices.SortFunc(router.prefixes, func(a, b bucketRoute) int {
+		return cmp.Compare(len(b.prefix), len(a.prefix))
+	})
+	p.buckets = router
+	return nil
+}
+
+// mappedBucket returns the bucket BucketMap routes the request to, by host
+// first and then by path prefix, or Bucket if no entry matches.
+func (p GcsProxy) mappedBucket(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if bucket, ok := p.buckets.hosts[strings.ToLower(host)]; ok {
+		return bucket
+	}
+	for _, route := range p.buckets.prefixes {
+		if strings.HasPrefix(r.URL.Path, route.prefix) {
+			return route.bucket
+		}
+	}
+	return p.Bucket
+}
+
+// bucketCaches returns the cache of each bucket the handler serves.
+func (p *GcsProxy) bucketCaches() map[string]*objectCache {
+	caches := make(map[string]*objectCache)
+	if p.cache != nil {
+		caches[p.Bucket] = p.cache
+	}
+	if p.buckets != nil {
+		for bucket, cache := range p.buckets.caches {
+			caches[bucket] = cache
+		}
+	}
+	return caches
+}
+
+// bucketTemplated returns true if Bucket contains placeholders, so that the
+// bucket is only known per request.
+func (p GcsProxy) bucketTemplated() bool {
+	return strings.Contains(p.Bucket, "{")
+}
+
+// resolveBucket evaluates the placeholders in Bucket for the current request.
+// Bucket names are lowercase, so the result is lowercased, e.g. for a host.
+// The name must match one of AllowedBuckets if any are set.
+func (p GcsProxy) resolveBucket(repl *caddy.Replacer) (string, error) {
+	bucket := strings.ToLower(repl.ReplaceAll(p.Bucket, ""))
+	if !bucketNamePattern.MatchString(bucket) {
+		return "", fmt.Errorf("%q is not a valid bucket name", bucket)
+	}
+	if len(p.AllowedBuckets) > 0 && !slices.ContainsFunc(p.AllowedBuckets, func(pattern string) bool {
+		matched, _ := path.Match(pattern, bucket)
+		return matched
+	}) {
+		return "", fmt.Errorf("bucket %q is not allowed", bucket)
+	}
+	return bucket, nil
+}
+
+// checkBucketTemplate returns an error if a placeholder in Bucket is combined
+// with a feature that needs the bucket at provision, or keeps state by key
+// without telling buckets apart, or if a placeholder only known per request
+// isn't restricted by AllowedBuckets. Any of them may carry a value the
+// client controls, such as a header or a claim of an unverified token.
+func (p GcsProxy) checkBucketTemplate() error {
+	unresolved := strings.Contains(caddy.NewReplacer().ReplaceKnown(p.Bucket, ""), "{")
+	if unresolved && len(p.AllowedBuckets) == 0 {
+		return errors.New("allowed_buckets is required with a per-request placeholder in the bucket name")
+	}
+	for _, pattern := range p.AllowedBuckets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid allowed_buckets pattern %q: %v", pattern, err)
+		}
+	}
+	_, _, gcsTemplate := gcsTemplateLocation(p.BrowseTemplate, "")
+	features := append([]bucketFeature{
+		{"cache", p.Cache != nil},
+		{"bucket_map", len(p.BucketMap) > 0},
+		{"a browse template in the bucket", gcsTemplate && !strings.HasPrefix(p.BrowseTemplate, "gs://")},
+	}, p.singleBucketFeatures()...)
+	for _, feature := range features {
+		if feature.set {
+			return fmt.Errorf("%s can't be used with a placeholder in the bucket name", feature.name)
+		}
+	}
+	return nil
+}
+
+// checkBucketMap returns an error if BucketMap is combined with a feature
+// that keeps its state for Bucket only. The cache is kept per bucket.
+func (p GcsProxy) checkBucketMap() error {
+	for _, feature := range p.singleBucketFeatures() {
+		if feature.set {
+			return fmt.Errorf("%s can't be used with bucket_map", feature.name)
+		}
+	}
+	return nil
+}
+
+type bucketFeature struct {
+	name string
+	set  bool
+}
+
+// singleBucketFeatures lists the features that track Bucket only, or keep
+// state by key or prefix without telling buckets apart.
+func (p GcsProxy) singleBucketFeatures() []bucketFeature {
+	return []bucketFeature{
+		{"release_pointer", p.ReleasePointer != nil},
+		{"quota", len(p.Quotas) > 0},
+		{"public_only", p.PublicOnly},
+		{"write_spool", p.WriteSpool != nil},
+		{"expire_uploads sweep", p.ExpireUploads != nil && p.ExpireUploads.SweepInterval > 0},
+		{"mirror_check", p.MirrorCheck != nil},
+		{"enable_folders", p.EnableFolders},
+		{"disk_usage", p.DiskUsage != nil},
+		{"stats", p.Stats != nil},
+		{"browse_dir_usage", p.BrowseDirUsage != nil},
+		{"audit_log without a bucket", p.AuditLog != nil && p.AuditLog.Bucket == ""},
+	}
+}
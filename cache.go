@@ -0,0 +1,535 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCacheMaxSize       = 64 << 20
+	defaultCacheMaxObjectSize = 1 << 20
+	defaultCacheTTL           = 5 * time.Minute
+)
+
+// Cache configures the in-memory cache of small objects. Handlers for the same
+// bucket with the same cache config share one cache, which is kept across
+// config reloads.
+type Cache struct {
+	// Maximum total bytes of object bodies held. Default is 64MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Largest object that will be cached. Default is 1MiB.
+	MaxObjectSize int64 `json:"max_object_size,omitempty"`
+
+	// How long an object is served from the cache. Default is 5m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// Size of the chunks objects larger than MaxObjectSize are cached in when
+	// read by range, so hot segments of large files are served from memory.
+	// At most MaxObjectSize. Default is 0, meaning ranges aren't cached.
+	ChunkSize int64 `json:"chunk_size,omitempty"`
+
+	// Memory budget shared by the caches of every handler in the process.
+	// Handlers configuring different budgets get the smallest. Default is
+	// 0, meaning only MaxSize applies.
+	GlobalMaxSize int64 `json:"global_max_size,omitempty"`
+
+	// Number of times an object must be requested within TTL before it is
+	// cached, so that cold objects don't evict hot ones. Default is 1.
+	MinHits int `json:"min_hits,omitempty"`
+
+	// Directory a second, larger cache tier is kept in on disk. Its index is
+	// persisted, so the cached objects survive restarts; they are checked
+	// against the current generation on their first hit.
+	DiskDir string `json:"disk_dir,omitempty"`
+
+	// Maximum total bytes kept in DiskDir. Default is 10GiB.
+	DiskMaxSize int64 `json:"disk_max_size,omitempty"`
+
+	// Largest object cached in DiskDir. Default is 256MiB.
+	DiskMaxObjectSize int64 `json:"disk_max_object_size,omitempty"`
+
+	// How long past TTL an object is still served from either tier while it
+	// is refreshed from GCS in the background, so requests for hot objects
+	// never wait on a revalidation. Default is 0, meaning expired objects are
+	// revalidated before they are served.
+	StaleWhileRevalidate caddy.Duration `json:"stale_while_revalidate,omitempty"`
+
+	// Request header that makes the request skip the cache and refill it
+	// from GCS when it holds BypassSecret, e.g. for editors checking an
+	// upload. Requests with `Cache-Control: no-cache` or `Pragma: no-cache`
+	// only revalidate the cached generation.
+	BypassHeader string `json:"bypass_header,omitempty"`
+	BypassSecret string `json:"bypass_secret,omitempty"`
+}
+
+// cacheMode is how a request uses the cache.
+type cacheMode int
+
+const (
+	cacheNormal cacheMode = iota
+	// The cached object is served if it is still the current generation
+	cacheRevalidate
+	// The object is read from GCS and the cache refilled
+	cacheBypass
+)
+
+type cacheModeCtxKey struct{}
+
+// requestCacheMode returns how the request asks for the cache to be used.
+func (p GcsProxy) requestCacheMode(r *http.Request) cacheMode {
+	if p.cache == nil {
+		return cacheNormal
+	}
+	if p.Cache.BypassHeader != "" && p.Cache.BypassSecret != "" {
+		value := r.Header.Get(p.Cache.BypassHeader)
+		if subtle.ConstantTimeCompare([]byte(value), []byte(p.Cache.BypassSecret)) == 1 {
+			return cacheBypass
+		}
+	}
+	for directive := range strings.SplitSeq(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache", "max-age=0":
+			return cacheRevalidate
+		}
+	}
+	if r.Header.Get("Cache-Control") == "" && strings.EqualFold(r.Header.Get("Pragma"), "no-cache") {
+		return cacheRevalidate
+	}
+	return cacheNormal
+}
+
+// cachePool shares caches between handler instances with the same bucket,
+// credentials and cache config, so they survive a config reload.
+var cachePool = caddy.NewUsagePool()
+
+// cachePoolKey identifies the cache a handler can share.
+func (p GcsProxy) cachePoolKey() string {
+	return fmt.Sprintf("%s|%s|%d|%d|%d|%d|%d|%s|%d|%d", p.Bucket, p.CredentialsFile, p.Cache.MaxSize, p.Cache.MaxObjectSize, p.Cache.TTL, p.Cache.ChunkSize, p.Cache.MinHits,
+		p.Cache.DiskDir, p.Cache.DiskMaxSize, p.Cache.DiskMaxObjectSize)
+}
+
+// loadCache takes a reference to the shared cache for the handler's config,
+// creating it if this is the first handler to use it.
+func (p *GcsProxy) loadCache() error {
+	key := p.cachePoolKey()
+	val, _, err := cachePool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		cache := newObjectCache(*p.Cache)
+		cache.bucket = p.Bucket
+		if p.Cache.DiskDir != "" {
+			disk, err := loadDiskCache(p.Cache.DiskDir, p.Cache.DiskMaxSize, p.Cache.DiskMaxObjectSize, p.log)
+			if err != nil {
+				return nil, fmt.Errorf("opening disk cache: %v", err)
+			}
+			cache.disk = disk
+		}
+		return cache, nil
+	})
+	if err != nil {
+		return err
+	}
+	p.cache = val.(*objectCache)
+	p.cacheKey = key
+	return nil
+}
+
+type cachedObject struct {
+	key     string
+	attrs   *storage.ObjectAttrs
+	body    []byte
+	expires time.Time
+}
+
+// objectCache holds object bodies and attrs, evicting the least recently used
+// entries once MaxSize or the global budget is reached.
+type objectCache struct {
+	mu       sync.Mutex
+	config   Cache
+	entries  map[string]*list.Element
+	order    *list.List
+	size     int64
+	budget   *cacheBudget
+	admitter *admissionFilter
+	disk     *diskCache
+	// Bucket of the cached objects, telling them apart from other buckets'
+	// in a shared disk cache
+	bucket string
+	// Keys being refreshed in the background
+	pending map[string]struct{}
+}
+
+func newObjectCache(config Cache) *objectCache {
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultCacheMaxSize
+	}
+	if config.MaxObjectSize <= 0 {
+		config.MaxObjectSize = defaultCacheMaxObjectSize
+	}
+	if config.TTL <= 0 {
+		config.TTL = caddy.Duration(defaultCacheTTL)
+	}
+	config.ChunkSize = min(config.ChunkSize, config.MaxObjectSize)
+	return &objectCache{
+		config:   config,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		budget:   globalCacheBudget,
+		admitter: newAdmissionFilter(config.MinHits, time.Duration(config.TTL)),
+		pending:  make(map[string]struct{}),
+	}
+}
+
+// Destruct implements caddy.Destructor. It gives the cache's memory back to
+// the global budget and releases the disk cache, which saves its index once
+// no cache uses it anymore.
+func (c *objectCache) Destruct() error {
+	c.clearMemory()
+	if c.disk != nil {
+		_, err := diskCachePool.Delete(c.disk.dir)
+		return err
+	}
+	return nil
+}
+
+// diskKey returns the key of the entry for key in the disk cache, which may
+// be shared with other buckets.
+func (c *objectCache) diskKey(key string) string {
+	return c.bucket + "/" + key
+}
+
+// admit returns true if an object of size bytes requested for key should be
+// cached.
+func (c *objectCache) admit(key string, size int64) bool {
+	if !c.cacheable(size) {
+		cacheRejections.WithLabelValues("size").Inc()
+		return false
+	}
+	if !c.admitter.admit(key) {
+		cacheRejections.WithLabelValues("cold").Inc()
+		return false
+	}
+	return true
+}
+
+// cacheable returns true if an object of size bytes may be cached.
+func (c *objectCache) cacheable(size int64) bool {
+	return size <= c.config.MaxObjectSize && size <= c.config.MaxSize
+}
+
+// get returns the entry for key, if any, and whether it is still fresh.
+// Expired entries are kept until evicted so they can be served while offline.
+func (c *objectCache) get(key string) (*cachedObject, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToBack(elem)
+	entry := elem.Value.(*cachedObject)
+	return entry, time.Now().Before(entry.expires)
+}
+
+func (c *objectCache) put(key string, attrs *storage.ObjectAttrs, body []byte) {
+	if !c.cacheable(int64(len(body))) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		// A slow fill of an older generation must not replace a newer one
+		if cached := elem.Value.(*cachedObject).attrs; cached != nil && attrs != nil && cached.Generation > attrs.Generation {
+			return
+		}
+		c.remove(elem)
+	}
+	size := int64(len(body))
+	for c.order.Len() > 0 && c.size+size > c.config.MaxSize {
+		c.evict("size")
+	}
+	for !c.budget.reserve(size) {
+		if c.order.Len() == 0 {
+			cacheRejections.WithLabelValues("budget").Inc()
+			return
+		}
+		c.evict("budget")
+	}
+
+	entry := &cachedObject{
+		key:     key,
+		attrs:   attrs,
+		body:    body,
+		expires: time.Now().Add(time.Duration(c.config.TTL)),
+	}
+	c.entries[key] = c.order.PushBack(entry)
+	c.size += size
+	cacheAllocatedBytes.Add(float64(size))
+}
+
+// evict drops the least recently used entry to make room. c.mu must be held.
+func (c *objectCache) evict(reason string) {
+	entry := c.order.Front().Value.(*cachedObject)
+	c.remove(c.order.Front())
+	cacheEvictions.WithLabelValues(reason).Inc()
+	cacheEvictedBytes.WithLabelValues(reason).Add(float64(len(entry.body)))
+}
+
+// startRefresh returns true and marks key as being refreshed unless a
+// refresh of it is already running.
+func (c *objectCache) startRefresh(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pending[key]; ok {
+		return false
+	}
+	c.pending[key] = struct{}{}
+	return true
+}
+
+func (c *objectCache) endRefresh(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, key)
+}
+
+// delete drops the entry for key from both tiers, returning true if there
+// was one.
+func (c *objectCache) delete(key string) bool {
+	deleted := c.disk != nil && c.disk.delete(c.diskKey(key))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+		deleted = true
+	}
+	return deleted
+}
+
+// deletePrefix drops every entry whose key starts with prefix and returns how
+// many were dropped.
+func (c *objectCache) deletePrefix(prefix string) int {
+	n := 0
+	if c.disk != nil {
+		n = c.disk.deletePrefix(c.diskKey(prefix))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(elem)
+			n++
+		}
+	}
+	return n
+}
+
+// clear drops every entry.
+func (c *objectCache) clear() {
+	if c.disk != nil {
+		c.disk.deletePrefix(c.diskKey(""))
+	}
+	c.clearMemory()
+}
+
+// clearMemory drops every entry held in memory.
+func (c *objectCache) clearMemory() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	c.order.Init()
+	c.budget.release(c.size)
+	c.size = 0
+}
+
+// remove drops an entry. c.mu must be held.
+func (c *objectCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cachedObject)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+	c.budget.release(int64(len(entry.body)))
+}
+
+// openObject returns a reader over the object at key along with its attrs,
+// served from the cache when possible and filling it otherwise.
+func (p GcsProxy) openObject(ctx context.Context, key string) (io.ReadCloser, *storage.ObjectAttrs, error) {
+	offline := p.offline != nil && p.offline.active()
+	mode, _ := ctx.Value(cacheModeCtxKey{}).(cacheMode)
+	if p.cache != nil && (mode != cacheBypass || offline) {
+		cached, fresh := p.cache.get(key)
+		if cached != nil && mode == cacheRevalidate && !offline {
+			fresh = p.revalidateCached(ctx, key, cached)
+		}
+		if cached != nil && !fresh && !offline {
+			fresh = p.serveStale(key, cached.attrs.Generation, cached.expires, mode)
+		}
+		if cached != nil && (fresh || offline) {
+			return io.NopCloser(bytes.NewReader(cached.body)), cached.attrs, nil
+		}
+		if p.cache.disk != nil {
+			if reader, attrs, ok := p.openDiskCached(ctx, key, mode, offline); ok {
+				return reader, attrs, nil
+			}
+		}
+	}
+	if offline {
+		return nil, nil, errOffline
+	}
+
+	defer recordPhase(ctx, "open", time.Now())
+	ctx, cancelOp := p.opContext(ctx, opGet)
+	ctx, cancelRead, firstByte := p.readContext(ctx)
+	cancel := func() {
+		cancelRead()
+		cancelOp()
+	}
+	// Read gzip-encoded objects as stored, so the body matches attrs.Size
+	obj := p.objectFor(opGet, key).ReadCompressed(true)
+	reader, gen, err := p.newObjectReader(ctx, obj)
+	if err != nil {
+		err = readError(ctx, err)
+		cancel()
+		p.recordReadError(err)
+		return nil, nil, err
+	}
+	// The attrs of the generation being read, the object may have been
+	// overwritten since
+	attrs, err := obj.Generation(gen).Attrs(ctx)
+	if err == nil && !firstByte() {
+		err = errFirstByteTimeout
+	}
+	if err != nil {
+		err = readError(ctx, err)
+		reader.Close()
+		cancel()
+		p.recordReadError(err)
+		return nil, nil, err
+	}
+	if p.offline != nil {
+		p.offline.success()
+	}
+
+	if p.cache != nil && p.cache.admit(key, attrs.Size) {
+		defer cancel()
+		defer reader.Close()
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.cache.put(key, attrs, body)
+		if p.cache.disk != nil && p.cache.disk.cacheable(attrs.Size) {
+			p.cache.disk.store(p.cache.diskKey(key), attrs, body)
+		}
+		return io.NopCloser(bytes.NewReader(body)), attrs, nil
+	}
+	if p.cache != nil && p.cache.disk != nil && p.cache.disk.cacheable(attrs.Size) {
+		return p.cache.disk.tee(p.cache.diskKey(key), attrs, cancelReadCloser{ReadCloser: reader, cancel: cancel}), attrs, nil
+	}
+
+	return cancelReadCloser{ReadCloser: reader, cancel: cancel}, attrs, nil
+}
+
+// revalidateCached returns true if the cached object is still the current
+// generation, in which case its TTL starts over.
+func (p GcsProxy) revalidateCached(ctx context.Context, key string, cached *cachedObject) bool {
+	defer recordPhase(ctx, "revalidate", time.Now())
+	ctx, cancel := p.opContext(ctx, opGet)
+	defer cancel()
+	attrs, err := p.objectFor(opGet, key).Attrs(ctx)
+	if err != nil || attrs.Generation != cached.attrs.Generation || attrs.Metageneration != cached.attrs.Metageneration {
+		return false
+	}
+	p.cache.put(key, attrs, cached.body)
+	return true
+}
+
+// serveStale returns true if an object cached at generation that expired at
+// expired may still be served, in which case it is refreshed in the
+// background.
+func (p GcsProxy) serveStale(key string, generation int64, expired time.Time, mode cacheMode) bool {
+	if p.Cache == nil || mode != cacheNormal || time.Since(expired) >= time.Duration(p.Cache.StaleWhileRevalidate) {
+		return false
+	}
+	if p.cache.startRefresh(key) {
+		go p.refreshStale(key, generation)
+	}
+	return true
+}
+
+// refreshStale brings the cached copies of key up to date: they are marked
+// fresh if generation is still current and refilled from GCS otherwise.
+func (p GcsProxy) refreshStale(key string, generation int64) {
+	defer p.cache.endRefresh(key)
+	ctx, cancel := p.opContext(context.Background(), opGet)
+	defer cancel()
+
+	attrs, err := p.objectFor(opGet, key).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		p.cache.delete(key)
+		return
+	}
+	if err != nil {
+		p.recordReadError(err)
+		p.log.Debug("could not refresh stale object", zap.String("key", key), zap.String("err", err.Error()))
+		return
+	}
+	if attrs.Generation == generation {
+		if cached, _ := p.cache.get(key); cached != nil && cached.attrs.Generation == generation {
+			p.cache.put(key, attrs, cached.body)
+		}
+		if p.cache.disk != nil {
+			p.cache.disk.validated(p.cache.diskKey(key), attrs)
+		}
+		return
+	}
+
+	// Bypassing the cache refills both tiers with the current generation
+	reader, _, err := p.openObject(context.WithValue(ctx, cacheModeCtxKey{}, cacheBypass), key)
+	if err != nil {
+		p.log.Debug("could not refresh stale object", zap.String("key", key), zap.String("err", err.Error()))
+		return
+	}
+	defer reader.Close()
+	io.Copy(io.Discard, reader)
+}
+
+// recordReadError counts transient GCS errors towards going offline.
+func (p GcsProxy) recordReadError(err error) {
+	if p.offline != nil && isTransient(err) {
+		p.offline.failure()
+	}
+}
+
+// cacheCapture buffers a copy of an upload body as it streams through, as
+// long as it stays small enough to be cached.
+type cacheCapture struct {
+	buf   bytes.Buffer
+	limit int64
+	over  bool
+}
+
+func (c *cacheCapture) Write(b []byte) (int, error) {
+	if !c.over {
+		if int64(c.buf.Len()+len(b)) > c.limit {
+			c.over = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(b)
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,157 @@
+package caddygcsproxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Keys tracked by the admission filter before it starts over.
+const maxAdmissionKeys = 100000
+
+var (
+	cacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "gcs_proxy",
+		Name:      "cache_bytes",
+		Help:      "Bytes of object bodies held by the caches of every handler.",
+	})
+	cacheBudgetBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "gcs_proxy",
+		Name:      "cache_budget_bytes",
+		Help:      "Global memory budget of the caches, 0 if there is none.",
+	})
+	cacheAllocatedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "gcs_proxy",
+		Name:      "cache_allocated_bytes_total",
+		Help:      "Bytes of object bodies added to the caches.",
+	})
+	cacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "gcs_proxy",
+		Name:      "cache_evictions_total",
+		Help:      "Entries evicted from the caches to make room, by whether the cache's max_size or the global budget was reached.",
+	}, []string{"reason"})
+	cacheEvictedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "gcs_proxy",
+		Name:      "cache_evicted_bytes_total",
+		Help:      "Bytes evicted from the caches to make room, by whether the cache's max_size or the global budget was reached.",
+	}, []string{"reason"})
+	cacheRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "gcs_proxy",
+		Name:      "cache_rejections_total",
+		Help:      "Objects not cached, by whether they were too large, too cold or didn't fit in the global budget.",
+	}, []string{"reason"})
+)
+
+// registerCacheMetrics adds the cache metrics to the config's registry, if
+// another handler hasn't already.
+func registerCacheMetrics(ctx caddy.Context) error {
+	registry := ctx.GetMetricsRegistry()
+	if registry == nil {
+		return nil
+	}
+	for _, c := range []prometheus.Collector{cacheBytes, cacheBudgetBytes, cacheAllocatedBytes, cacheEvictions, cacheEvictedBytes, cacheRejections} {
+		if err := registry.Register(c); err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheBudget is the memory shared by the caches of every handler.
+type cacheBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// globalCacheBudget is shared by every cache in the process.
+var globalCacheBudget = &cacheBudget{}
+
+// reserve takes n bytes of the budget, returning false if they don't fit.
+func (b *cacheBudget) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	cacheBytes.Set(float64(b.used))
+	return true
+}
+
+func (b *cacheBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	cacheBytes.Set(float64(b.used))
+}
+
+func (b *cacheBudget) setLimit(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+	cacheBudgetBytes.Set(float64(limit))
+}
+
+// updateCacheBudget sets the global budget to the smallest GlobalMaxSize of
+// the running handlers. A lowered budget is enforced as objects are cached.
+func updateCacheBudget() {
+	var limit int64
+	for _, p := range runningProxies() {
+		if p.Cache == nil || p.Cache.GlobalMaxSize <= 0 {
+			continue
+		}
+		if limit == 0 || p.Cache.GlobalMaxSize < limit {
+			limit = p.Cache.GlobalMaxSize
+		}
+	}
+	globalCacheBudget.setLimit(limit)
+}
+
+// admissionFilter counts requests for uncached keys, so that an object is
+// only cached once it has been requested MinHits times within TTL.
+type admissionFilter struct {
+	mu      sync.Mutex
+	minHits int
+	window  time.Duration
+	hits    map[string]int
+	reset   time.Time
+}
+
+func newAdmissionFilter(minHits int, window time.Duration) *admissionFilter {
+	return &admissionFilter{
+		minHits: minHits,
+		window:  window,
+		hits:    make(map[string]int),
+		reset:   time.Now(),
+	}
+}
+
+// admit records a request for key and returns true if it is now hot enough
+// to be cached.
+func (f *admissionFilter) admit(key string) bool {
+	if f.minHits <= 1 {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.reset) > f.window || len(f.hits) >= maxAdmissionKeys {
+		clear(f.hits)
+		f.reset = time.Now()
+	}
+	f.hits[key]++
+	if f.hits[key] < f.minHits {
+		return false
+	}
+	delete(f.hits, key)
+	return true
+}
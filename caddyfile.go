@@ -1,12 +1,17 @@
 package caddygcsproxy
 
 import (
+	"net/http"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 
 	caddy "github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 func init() {
@@ -19,14 +24,180 @@ func init() {
 //	gcsproxy [<matcher>] {
 //	    root   <path to prefix GCS key with>
 //	    bucket <gcs bucket name>
-//	    index  <files...>
+//	    allowed_buckets <bucket name patterns...>
+//	    normalize_keys [nfc|nfd]
+//	    bucket_map <host|/path prefix> <gcs bucket name>
+//	    release_pointer <key> [<ttl>]
+//	    regions <region placeholder> {
+//	        <region> <bucket>
+//	    }
+//	    client_prefixes [<identity placeholder>] {
+//	        <identity>|* <prefix> [write]
+//	    }
+//	    pin_generations [<max_age>] {
+//	        cookie <name>
+//	        param <name>
+//	    }
+//	    index  <files...>|off
 //	    hide   <file patterns...>
+//	    hide_status 404|403|pass_through
+//	    protect <key patterns...>
 //	    credentials_file <path to credentials file>
+//	    path_credentials <credentials file> <path patterns...>
 //	    project_id <gcp project id>
-//	    enable_put
-//	    enable_delete
+//	    scopes <read_only|read_write|full_control|scope url...>
+//	    quota_project <gcp project id>
+//	    enable_put [<path patterns...>]
+//	    enable_delete [<path patterns...>]
+//	    resumable_uploads [<staging dir>] {
+//	        chunk_size <size>
+//	        chunk_retry_deadline <duration>
+//	        max_age <duration>
+//	        max_size <size>
+//	    }
+//	    form_uploads {
+//	        field <name>
+//	        name_field <name>
+//	        max_files <n>
+//	    }
+//	    enable_compose
+//	    enable_patch [<path patterns...>]
+//	    enable_holds
+//	    decompress_uploads
+//	    soft_deleted
+//	    enable_folders
+//	    upload_metadata <name> <value>
+//	    expire_uploads <duration> [<path patterns...>] {
+//	        sweep <interval> [<prefix>]
+//	    }
+//	    quota <key prefix> {
+//	        max_bytes <size>
+//	        max_objects <count>
+//	    }
+//	    quota_refresh <duration>
+//	    signed_urls <secret> [<path patterns...>]
+//	    signed_cookie <secret> {
+//	        name <cookie name>
+//	        paths <path patterns...>
+//	        mint_path <path>
+//	        mint_prefixes <path prefixes...>
+//	        ttl <duration>
+//	    }
+//	    public_only [<cache ttl>]
+//	    rate_limit {
+//	        key <placeholder>
+//	        read <events>/<duration> [<burst>]
+//	        write <events>/<duration> [<burst>]
+//	    }
+//	    egress_budget <size> <window> [<path patterns...>] {
+//	        status <429|503>
+//	    }
+//	    webhook <url> {
+//	        secret <secret>
+//	        retries <count>
+//	        timeout <duration>
+//	    }
+//	    pubsub_topic <topic>
+//	    audit_log [<bucket> [<prefix>]] {
+//	        flush_interval <duration>
+//	        max_events <n>
+//	    }
+//	    antivirus <clamd address> [<timeout>]
+//	    upload_validator {
+//	        url <url>
+//	        command <command> [<args...>]
+//	        peek_bytes <count>
+//	        timeout <duration>
+//	    }
+//	    write_spool <dir> {
+//	        max_retry_interval <duration>
+//	        max_age <duration>
+//	    }
+//	    cache {
+//	        max_size <size>
+//	        max_object_size <size>
+//	        ttl <duration>
+//	        stale_while_revalidate <duration>
+//	        chunk_size <size>
+//	        global_max_size <size>
+//	        min_hits <n>
+//	        disk <dir> [<max_size> [<max_object_size>]]
+//	        bypass_header <header> <secret>
+//	    }
+//	    offline on|auto {
+//	        failure_threshold <n>
+//	        recheck <duration>
+//	        status 404|503
+//	    }
+//	    prewarm {
+//	        manifest <file>
+//	        prefix <prefix>
+//	        glob <pattern>
+//	        index_and_error_pages
+//	        interval <duration>
+//	    }
+//	    mirror_check <bucket> [<prefix>] {
+//	        interval <duration>
+//	        max_objects <n>
+//	    }
+//	    hedge_delay <duration>
+//	    first_byte_timeout <duration>
+//	    transfer_timeout <duration>
+//	    request_timeout <duration>
+//	    deadline_header [<header name>]
+//	    replayable_put [<max size> [<max attempts>]]
+//	    buffer_puts [<memory threshold> [<dir>]]
+//	    retry get|put|delete|list {
+//	        policy always|idempotent|never
+//	        max_attempts <n>
+//	        initial_backoff <duration>
+//	        max_backoff <duration>
+//	        timeout <duration>
+//	    }
+//	    methods <methods...>
+//	    read_only
+//	    method_override
 //	    errors [<http code>] [<gcs key to error page>|pass_through]
-//	    browse [<template file>]
+//	    browse [<template file or gs:// key> [<refresh interval>]]
+//	    browse_template <template file or gs:// key> <path patterns...>
+//	    browse_header_footer
+//	    robots {
+//	        txt [<disallowed paths...>]
+//	        sitemap <url>
+//	        noindex <path patterns...>
+//	        noindex_browse
+//	    }
+//	    browse_dir_usage {
+//	        max_objects <n>
+//	        max_dirs <n>
+//	        ttl <duration>
+//	    }
+//	    localize <language> {
+//	        browse <template file or gs:// key>
+//	        errors [<http code>] <gcs key to error page>
+//	    }
+//	    folder_markers
+//	    slow_request_threshold <duration>
+//	    bucket_info <path>
+//	    meta
+//	    disk_usage {
+//	        max_objects <n>
+//	        ttl <duration>
+//	    }
+//	    stats {
+//	        max_objects <n>
+//	        ttl <duration>
+//	        largest <n>
+//	    }
+//	    max_keys <count>
+//	    charset [<charset>]
+//	    default_content_type <type>
+//	    etag strong|weak|off [<path patterns...>]
+//	    expires [<duration>|max_age [<path patterns...>]]
+//	    immutable [<regexp>]
+//	    early_hints [<link values...>]
+//	    digest
+//	    no_index browse|403|404|redirect <target>|pass_through
 //	}
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	return parseCaddyfileWithDispenser(h.Dispenser)
@@ -46,11 +217,35 @@ parseLoop:
 				return nil, h.ArgErr()
 			}
 			b.CredentialsFile = replacer.ReplaceAll(b.CredentialsFile, "")
+		case "path_credentials":
+			args := h.RemainingArgs()
+			if len(args) < 2 {
+				return nil, h.ArgErr()
+			}
+			b.PathCredentials = append(b.PathCredentials, PathCredentials{
+				CredentialsFile: replacer.ReplaceAll(args[0], ""),
+				Paths:           args[1:],
+			})
 		case "project_id":
 			if !h.AllArgs(&b.ProjectID) {
 				return nil, h.ArgErr()
 			}
 			b.ProjectID = replacer.ReplaceAll(b.ProjectID, "")
+		case "scopes":
+			b.Scopes = h.RemainingArgs()
+			if len(b.Scopes) == 0 {
+				return nil, h.ArgErr()
+			}
+			for _, scope := range b.Scopes {
+				if _, err := oauthScope(scope); err != nil {
+					return nil, h.Err(err.Error())
+				}
+			}
+		case "quota_project":
+			if !h.AllArgs(&b.QuotaProject) {
+				return nil, h.ArgErr()
+			}
+			b.QuotaProject = replacer.ReplaceAll(b.QuotaProject, "")
 		case "root":
 			if !h.AllArgs(&b.Root) {
 				return nil, h.ArgErr()
@@ -60,32 +255,1363 @@ parseLoop:
 			if len(b.Hide) == 0 {
 				return nil, h.ArgErr()
 			}
+		case "protect":
+			b.Protect = h.RemainingArgs()
+			if len(b.Protect) == 0 {
+				return nil, h.ArgErr()
+			}
+		case "hide_status":
+			if !h.AllArgs(&b.HideStatus) {
+				return nil, h.ArgErr()
+			}
+			if b.HideStatus != "404" && b.HideStatus != "403" && b.HideStatus != "pass_through" {
+				return nil, h.Errf("hide_status must be 404, 403 or pass_through, got '%s'", b.HideStatus)
+			}
 		case "bucket":
 			if !h.AllArgs(&b.Bucket) {
 				return nil, h.ArgErr()
 			}
-			b.Bucket = replacer.ReplaceAll(b.Bucket, "")
+			// Request placeholders are left for ServeHTTP
+			b.Bucket = replacer.ReplaceKnown(b.Bucket, "")
 			if b.Bucket == "" {
 				break parseLoop
 			}
+		case "allowed_buckets":
+			b.AllowedBuckets = h.RemainingArgs()
+			if len(b.AllowedBuckets) == 0 {
+				return nil, h.ArgErr()
+			}
+		case "bucket_map":
+			var match, bucket string
+			if !h.AllArgs(&match, &bucket) {
+				return nil, h.ArgErr()
+			}
+			if b.BucketMap == nil {
+				b.BucketMap = make(map[string]string)
+			}
+			b.BucketMap[match] = replacer.ReplaceAll(bucket, "")
+		case "release_pointer":
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			b.ReleasePointer = &ReleasePointer{Key: args[0]}
+			if len(args) == 2 {
+				ttl, err := caddy.ParseDuration(args[1])
+				if err != nil || ttl <= 0 {
+					return nil, h.Errf("'%s' is not a valid duration", args[1])
+				}
+				b.ReleasePointer.TTL = caddy.Duration(ttl)
+			}
+		case "regions":
+			routing := &RegionRouting{Buckets: make(map[string]string)}
+			if !h.AllArgs(&routing.Region) {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				region := h.Val()
+				var bucket string
+				if !h.AllArgs(&bucket) {
+					return nil, h.ArgErr()
+				}
+				routing.Buckets[region] = bucket
+			}
+			if len(routing.Buckets) == 0 {
+				return nil, h.Err("regions requires at least one bucket")
+			}
+			b.Regions = routing
+		case "client_prefixes":
+			prefixes := &ClientPrefixes{Clients: make(map[string]ClientPrefix)}
+			args := h.RemainingArgs()
+			if len(args) > 1 {
+				return nil, h.ArgErr()
+			}
+			if len(args) == 1 {
+				prefixes.Identity = args[0]
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				identity := h.Val()
+				args := h.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return nil, h.ArgErr()
+				}
+				client := ClientPrefix{Prefix: args[0]}
+				if len(args) == 2 {
+					if args[1] != "write" {
+						return nil, h.Errf("'%s' is not a valid client permission", args[1])
+					}
+					client.Write = true
+				}
+				prefixes.Clients[identity] = client
+			}
+			if len(prefixes.Clients) == 0 {
+				return nil, h.Err("client_prefixes requires at least one client")
+			}
+			b.ClientPrefixes = prefixes
+		case "pin_generations":
+			pin := &PinGenerations{}
+			args := h.RemainingArgs()
+			if len(args) > 1 {
+				return nil, h.ArgErr()
+			}
+			if len(args) == 1 {
+				maxAge, err := caddy.ParseDuration(args[0])
+				if err != nil || maxAge <= 0 {
+					return nil, h.Errf("'%s' is not a valid duration", args[0])
+				}
+				pin.MaxAge = caddy.Duration(maxAge)
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "cookie":
+					if !h.AllArgs(&pin.Cookie) {
+						return nil, h.ArgErr()
+					}
+				case "param":
+					if !h.AllArgs(&pin.Param) {
+						return nil, h.ArgErr()
+					}
+				default:
+					return nil, h.Errf("%s not a valid pin_generations option", h.Val())
+				}
+			}
+			b.PinGenerations = pin
+		case "normalize_keys":
+			b.NormalizeKeys = "nfc"
+			args := h.RemainingArgs()
+			if len(args) > 1 {
+				return nil, h.ArgErr()
+			}
+			if len(args) == 1 {
+				b.NormalizeKeys = strings.ToLower(args[0])
+			}
+			if _, ok := normalizationForms[b.NormalizeKeys]; !ok {
+				return nil, h.Errf("normalize_keys must be nfc or nfd, got '%s'", args[0])
+			}
 		case "index":
 			b.IndexNames = h.RemainingArgs()
 			if len(b.IndexNames) == 0 {
 				return nil, h.ArgErr()
 			}
+			if len(b.IndexNames) == 1 && b.IndexNames[0] == "off" {
+				b.IndexNames = []string{}
+			}
 		case "enable_put":
 			b.EnablePut = true
+			b.PutPaths = append(b.PutPaths, h.RemainingArgs()...)
+		case "enable_patch":
+			b.EnablePatch = true
+			b.PatchPaths = append(b.PatchPaths, h.RemainingArgs()...)
+		case "enable_folders":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.EnableFolders = true
+		case "soft_deleted":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.EnableSoftDeleted = true
+		case "enable_holds":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.EnableHolds = true
+		case "decompress_uploads":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.DecompressUploads = true
+		case "resumable_uploads":
+			uploads := &ResumableUploads{}
+			args := h.RemainingArgs()
+			if len(args) > 1 {
+				return nil, h.ArgErr()
+			}
+			if len(args) == 1 {
+				uploads.Dir = args[0]
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "chunk_size":
+					var size string
+					if !h.AllArgs(&size) {
+						return nil, h.ArgErr()
+					}
+					bytes, err := humanize.ParseBytes(size)
+					if err != nil || bytes%uploadChunkMultiple != 0 {
+						return nil, h.Errf("'%s' is not a valid chunk size, it must be a multiple of 256KiB", size)
+					}
+					uploads.ChunkSize = int64(bytes)
+				case "max_size":
+					var size string
+					if !h.AllArgs(&size) {
+						return nil, h.ArgErr()
+					}
+					bytes, err := humanize.ParseBytes(size)
+					if err != nil || bytes == 0 {
+						return nil, h.Errf("'%s' is not a valid size", size)
+					}
+					uploads.MaxSize = int64(bytes)
+				case "chunk_retry_deadline", "max_age":
+					option := h.Val()
+					var value string
+					if !h.AllArgs(&value) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(value)
+					if err != nil || dur <= 0 {
+						return nil, h.Errf("'%s' is not a valid duration", value)
+					}
+					if option == "max_age" {
+						uploads.MaxAge = caddy.Duration(dur)
+					} else {
+						uploads.ChunkRetryDeadline = caddy.Duration(dur)
+					}
+				default:
+					return nil, h.Errf("%s not a valid resumable_uploads option", h.Val())
+				}
+			}
+			b.ResumableUploads = uploads
+		case "form_uploads":
+			uploads := &FormUploads{}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "field":
+					if !h.AllArgs(&uploads.Field) {
+						return nil, h.ArgErr()
+					}
+				case "name_field":
+					if !h.AllArgs(&uploads.NameField) {
+						return nil, h.ArgErr()
+					}
+				case "max_files":
+					var max string
+					if !h.AllArgs(&max) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.Atoi(max)
+					if err != nil || n <= 0 {
+						return nil, h.Errf("'%s' is not a valid max_files", max)
+					}
+					uploads.MaxFiles = n
+				default:
+					return nil, h.Errf("%s not a valid form_uploads option", h.Val())
+				}
+			}
+			b.FormUploads = uploads
+		case "enable_compose":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.EnableCompose = true
 		case "enable_delete":
 			b.EnableDelete = true
+			b.DeletePaths = append(b.DeletePaths, h.RemainingArgs()...)
+		case "expire_uploads":
+			e := &ExpireUploads{}
+			args := h.RemainingArgs()
+			if len(args) == 0 {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(args[0])
+			if err != nil || dur <= 0 {
+				return nil, h.Errf("'%s' is not a valid duration", args[0])
+			}
+			e.After = caddy.Duration(dur)
+			e.Paths = args[1:]
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "sweep":
+					args := h.RemainingArgs()
+					if len(args) < 1 || len(args) > 2 {
+						return nil, h.ArgErr()
+					}
+					interval, err := caddy.ParseDuration(args[0])
+					if err != nil || interval <= 0 {
+						return nil, h.Errf("'%s' is not a valid duration", args[0])
+					}
+					e.SweepInterval = caddy.Duration(interval)
+					if len(args) == 2 {
+						e.SweepPrefix = args[1]
+					}
+				default:
+					return nil, h.Errf("%s not a valid expire_uploads option", h.Val())
+				}
+			}
+			b.ExpireUploads = e
+		case "upload_metadata":
+			var name, value string
+			if !h.AllArgs(&name, &value) {
+				return nil, h.ArgErr()
+			}
+			if b.UploadMetadata == nil {
+				b.UploadMetadata = make(map[string]string)
+			}
+			b.UploadMetadata[name] = value
+		case "quota":
+			q := Quota{}
+			if !h.AllArgs(&q.Prefix) {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "max_bytes":
+					var size string
+					if !h.AllArgs(&size) {
+						return nil, h.ArgErr()
+					}
+					bytes, err := humanize.ParseBytes(size)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid size", size)
+					}
+					q.MaxBytes = int64(bytes)
+				case "max_objects":
+					var count string
+					if !h.AllArgs(&count) {
+						return nil, h.ArgErr()
+					}
+					objects, err := strconv.ParseInt(count, 10, 64)
+					if err != nil || objects < 0 {
+						return nil, h.Errf("'%s' is not a valid object count", count)
+					}
+					q.MaxObjects = objects
+				default:
+					return nil, h.Errf("%s not a valid quota option", h.Val())
+				}
+			}
+			if q.MaxBytes == 0 && q.MaxObjects == 0 {
+				return nil, h.Err("quota must set max_bytes or max_objects")
+			}
+			b.Quotas = append(b.Quotas, q)
+		case "quota_refresh":
+			var refresh string
+			if !h.AllArgs(&refresh) {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(refresh)
+			if err != nil {
+				return nil, h.Errf("'%s' is not a valid duration", refresh)
+			}
+			b.QuotaRefresh = caddy.Duration(dur)
+		case "signed_urls":
+			args := h.RemainingArgs()
+			if len(args) == 0 {
+				return nil, h.ArgErr()
+			}
+			b.SignedURLs = &SignedURLs{
+				Secret: replacer.ReplaceAll(args[0], ""),
+				Paths:  args[1:],
+			}
+			if b.SignedURLs.Secret == "" {
+				return nil, h.Err("signed_urls secret must not be empty")
+			}
+		case "signed_cookie":
+			c := &SignedCookie{}
+			if !h.AllArgs(&c.Secret) {
+				return nil, h.ArgErr()
+			}
+			c.Secret = replacer.ReplaceAll(c.Secret, "")
+			if c.Secret == "" {
+				return nil, h.Err("signed_cookie secret must not be empty")
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "name":
+					if !h.AllArgs(&c.Name) {
+						return nil, h.ArgErr()
+					}
+				case "paths":
+					c.Paths = h.RemainingArgs()
+					if len(c.Paths) == 0 {
+						return nil, h.ArgErr()
+					}
+				case "mint_path":
+					if !h.AllArgs(&c.MintPath) {
+						return nil, h.ArgErr()
+					}
+				case "mint_prefixes":
+					c.MintPrefixes = h.RemainingArgs()
+					if len(c.MintPrefixes) == 0 {
+						return nil, h.ArgErr()
+					}
+				case "ttl":
+					var ttl string
+					if !h.AllArgs(&ttl) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(ttl)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", ttl)
+					}
+					c.TTL = caddy.Duration(dur)
+				default:
+					return nil, h.Errf("%s not a valid signed_cookie option", h.Val())
+				}
+			}
+			b.SignedCookie = c
+		case "public_only":
+			b.PublicOnly = true
+			args := h.RemainingArgs()
+			if len(args) > 1 {
+				return nil, h.ArgErr()
+			}
+			if len(args) == 1 {
+				dur, err := caddy.ParseDuration(args[0])
+				if err != nil {
+					return nil, h.Errf("'%s' is not a valid duration", args[0])
+				}
+				b.PublicCacheTTL = caddy.Duration(dur)
+			}
+		case "rate_limit":
+			rl := &RateLimit{}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "key":
+					if !h.AllArgs(&rl.Key) {
+						return nil, h.ArgErr()
+					}
+				case "read", "write":
+					kind := h.Val()
+					args := h.RemainingArgs()
+					if len(args) == 0 || len(args) > 2 {
+						return nil, h.ArgErr()
+					}
+					perSecond, burst, err := parseRate(args[0])
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid rate: %v", args[0], err)
+					}
+					if len(args) == 2 {
+						burst, err = strconv.Atoi(args[1])
+						if err != nil || burst <= 0 {
+							return nil, h.Errf("'%s' is not a valid burst", args[1])
+						}
+					}
+					if kind == "read" {
+						rl.ReadRate, rl.ReadBurst = perSecond, burst
+					} else {
+						rl.WriteRate, rl.WriteBurst = perSecond, burst
+					}
+				default:
+					return nil, h.Errf("%s not a valid rate_limit option", h.Val())
+				}
+			}
+			b.RateLimit = rl
+		case "egress_budget":
+			args := h.RemainingArgs()
+			if len(args) < 2 {
+				return nil, h.ArgErr()
+			}
+			bytes, err := humanize.ParseBytes(args[0])
+			if err != nil || bytes == 0 {
+				return nil, h.Errf("'%s' is not a valid size", args[0])
+			}
+			window, err := caddy.ParseDuration(args[1])
+			if err != nil {
+				return nil, h.Errf("'%s' is not a valid duration", args[1])
+			}
+			budget := EgressBudget{
+				MaxBytes: int64(bytes),
+				Window:   caddy.Duration(window),
+			}
+			if len(args) > 2 {
+				budget.Paths = args[2:]
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "status":
+					var status string
+					if !h.AllArgs(&status) {
+						return nil, h.ArgErr()
+					}
+					budget.StatusCode, err = strconv.Atoi(status)
+					if err != nil || (budget.StatusCode != http.StatusTooManyRequests && budget.StatusCode != http.StatusServiceUnavailable) {
+						return nil, h.Errf("egress_budget status must be 429 or 503, got '%s'", status)
+					}
+				default:
+					return nil, h.Errf("%s not a valid egress_budget option", h.Val())
+				}
+			}
+			b.EgressBudgets = append(b.EgressBudgets, budget)
+		case "webhook":
+			hook := Webhook{}
+			if !h.AllArgs(&hook.URL) {
+				return nil, h.ArgErr()
+			}
+			hook.URL = replacer.ReplaceAll(hook.URL, "")
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "secret":
+					if !h.AllArgs(&hook.Secret) {
+						return nil, h.ArgErr()
+					}
+					hook.Secret = replacer.ReplaceAll(hook.Secret, "")
+				case "retries":
+					var retries string
+					if !h.AllArgs(&retries) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.Atoi(retries)
+					if err != nil || n < 0 {
+						return nil, h.Errf("'%s' is not a valid retry count", retries)
+					}
+					hook.Retries = n
+				case "timeout":
+					var timeout string
+					if !h.AllArgs(&timeout) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(timeout)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", timeout)
+					}
+					hook.Timeout = caddy.Duration(dur)
+				default:
+					return nil, h.Errf("%s not a valid webhook option", h.Val())
+				}
+			}
+			b.Webhooks = append(b.Webhooks, hook)
+		case "pubsub_topic":
+			if !h.AllArgs(&b.PubSubTopic) {
+				return nil, h.ArgErr()
+			}
+			b.PubSubTopic = replacer.ReplaceAll(b.PubSubTopic, "")
+		case "audit_log":
+			audit := &AuditLog{}
+			args := h.RemainingArgs()
+			if len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			if len(args) > 0 {
+				audit.Bucket = args[0]
+			}
+			if len(args) > 1 {
+				audit.Prefix = args[1]
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "flush_interval":
+					var interval string
+					if !h.AllArgs(&interval) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(interval)
+					if err != nil || dur <= 0 {
+						return nil, h.Errf("'%s' is not a valid duration", interval)
+					}
+					audit.FlushInterval = caddy.Duration(dur)
+				case "max_events":
+					var maxEvents string
+					if !h.AllArgs(&maxEvents) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.Atoi(maxEvents)
+					if err != nil || n <= 0 {
+						return nil, h.Errf("'%s' is not a valid event count", maxEvents)
+					}
+					audit.MaxEvents = n
+				default:
+					return nil, h.Errf("%s not a valid audit_log option", h.Val())
+				}
+			}
+			b.AuditLog = audit
+		case "antivirus":
+			args := h.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			b.Antivirus = &Antivirus{Address: replacer.ReplaceAll(args[0], "")}
+			if len(args) == 2 {
+				dur, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return nil, h.Errf("'%s' is not a valid duration", args[1])
+				}
+				b.Antivirus.Timeout = caddy.Duration(dur)
+			}
+		case "upload_validator":
+			v := &UploadValidator{}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "url":
+					if !h.AllArgs(&v.URL) {
+						return nil, h.ArgErr()
+					}
+					v.URL = replacer.ReplaceAll(v.URL, "")
+				case "command":
+					v.Command = h.RemainingArgs()
+					if len(v.Command) == 0 {
+						return nil, h.ArgErr()
+					}
+				case "peek_bytes":
+					var peek string
+					if !h.AllArgs(&peek) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.Atoi(peek)
+					if err != nil || n < 0 {
+						return nil, h.Errf("'%s' is not a valid byte count", peek)
+					}
+					v.PeekBytes = n
+				case "timeout":
+					var timeout string
+					if !h.AllArgs(&timeout) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(timeout)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", timeout)
+					}
+					v.Timeout = caddy.Duration(dur)
+				default:
+					return nil, h.Errf("%s not a valid upload_validator option", h.Val())
+				}
+			}
+			if (v.URL == "") == (len(v.Command) == 0) {
+				return nil, h.Err("upload_validator requires exactly one of url or command")
+			}
+			b.UploadValidator = v
+		case "write_spool":
+			spool := &WriteSpool{}
+			if !h.AllArgs(&spool.Dir) {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "max_retry_interval", "max_age":
+					option := h.Val()
+					var value string
+					if !h.AllArgs(&value) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(value)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", value)
+					}
+					if option == "max_age" {
+						spool.MaxAge = caddy.Duration(dur)
+					} else {
+						spool.MaxRetryInterval = caddy.Duration(dur)
+					}
+				default:
+					return nil, h.Errf("%s not a valid write_spool option", h.Val())
+				}
+			}
+			b.WriteSpool = spool
+		case "cache":
+			c := &Cache{}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "max_size", "max_object_size", "chunk_size", "global_max_size":
+					option := h.Val()
+					var size string
+					if !h.AllArgs(&size) {
+						return nil, h.ArgErr()
+					}
+					bytes, err := humanize.ParseBytes(size)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid size", size)
+					}
+					switch option {
+					case "max_size":
+						c.MaxSize = int64(bytes)
+					case "max_object_size":
+						c.MaxObjectSize = int64(bytes)
+					case "global_max_size":
+						c.GlobalMaxSize = int64(bytes)
+					default:
+						c.ChunkSize = int64(bytes)
+					}
+				case "disk":
+					args := h.RemainingArgs()
+					if len(args) < 1 || len(args) > 3 {
+						return nil, h.ArgErr()
+					}
+					c.DiskDir = args[0]
+					for i, size := range args[1:] {
+						bytes, err := humanize.ParseBytes(size)
+						if err != nil {
+							return nil, h.Errf("'%s' is not a valid size", size)
+						}
+						if i == 0 {
+							c.DiskMaxSize = int64(bytes)
+						} else {
+							c.DiskMaxObjectSize = int64(bytes)
+						}
+					}
+				case "min_hits":
+					var minHits string
+					if !h.AllArgs(&minHits) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.Atoi(minHits)
+					if err != nil || n <= 0 {
+						return nil, h.Errf("'%s' is not a valid min_hits", minHits)
+					}
+					c.MinHits = n
+				case "ttl":
+					var ttl string
+					if !h.AllArgs(&ttl) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(ttl)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", ttl)
+					}
+					c.TTL = caddy.Duration(dur)
+				case "stale_while_revalidate":
+					var swr string
+					if !h.AllArgs(&swr) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(swr)
+					if err != nil || dur <= 0 {
+						return nil, h.Errf("'%s' is not a valid duration", swr)
+					}
+					c.StaleWhileRevalidate = caddy.Duration(dur)
+				case "bypass_header":
+					if !h.AllArgs(&c.BypassHeader, &c.BypassSecret) {
+						return nil, h.ArgErr()
+					}
+					c.BypassSecret = replacer.ReplaceAll(c.BypassSecret, "")
+				default:
+					return nil, h.Errf("%s not a valid cache option", h.Val())
+				}
+			}
+			b.Cache = c
+		case "offline":
+			o := &Offline{}
+			if !h.AllArgs(&o.Mode) {
+				return nil, h.ArgErr()
+			}
+			if o.Mode != "on" && o.Mode != "auto" {
+				return nil, h.Errf("offline mode must be on or auto, got '%s'", o.Mode)
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "failure_threshold":
+					var threshold string
+					if !h.AllArgs(&threshold) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.Atoi(threshold)
+					if err != nil || n <= 0 {
+						return nil, h.Errf("'%s' is not a valid failure threshold", threshold)
+					}
+					o.FailureThreshold = n
+				case "recheck":
+					var recheck string
+					if !h.AllArgs(&recheck) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(recheck)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", recheck)
+					}
+					o.Recheck = caddy.Duration(dur)
+				case "status":
+					var status string
+					if !h.AllArgs(&status) {
+						return nil, h.ArgErr()
+					}
+					var err error
+					o.StatusCode, err = strconv.Atoi(status)
+					if err != nil || (o.StatusCode != http.StatusNotFound && o.StatusCode != http.StatusServiceUnavailable) {
+						return nil, h.Errf("offline status must be 404 or 503, got '%s'", status)
+					}
+				default:
+					return nil, h.Errf("%s not a valid offline option", h.Val())
+				}
+			}
+			b.Offline = o
+		case "prewarm":
+			pw := &Prewarm{}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "manifest":
+					if !h.AllArgs(&pw.Manifest) {
+						return nil, h.ArgErr()
+					}
+				case "prefix":
+					if !h.AllArgs(&pw.Prefix) {
+						return nil, h.ArgErr()
+					}
+				case "glob":
+					if !h.AllArgs(&pw.Glob) {
+						return nil, h.ArgErr()
+					}
+				case "index_and_error_pages":
+					if h.NextArg() {
+						return nil, h.ArgErr()
+					}
+					pw.IndexAndErrorPages = true
+				case "interval":
+					var interval string
+					if !h.AllArgs(&interval) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(interval)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", interval)
+					}
+					pw.Interval = caddy.Duration(dur)
+				default:
+					return nil, h.Errf("%s not a valid prewarm option", h.Val())
+				}
+			}
+			if pw.Manifest == "" && pw.Prefix == "" && pw.Glob == "" && !pw.IndexAndErrorPages {
+				return nil, h.Err("prewarm requires a manifest, prefix, glob or index_and_error_pages")
+			}
+			b.Prewarm = pw
+		case "first_byte_timeout", "transfer_timeout", "request_timeout":
+			option := h.Val()
+			var timeout string
+			if !h.AllArgs(&timeout) {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(timeout)
+			if err != nil || dur <= 0 {
+				return nil, h.Errf("'%s' is not a valid duration", timeout)
+			}
+			switch option {
+			case "first_byte_timeout":
+				b.FirstByteTimeout = caddy.Duration(dur)
+			case "transfer_timeout":
+				b.TransferTimeout = caddy.Duration(dur)
+			default:
+				b.RequestTimeout = caddy.Duration(dur)
+			}
+		case "mirror_check":
+			m := &MirrorCheck{}
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			m.Bucket = args[0]
+			if len(args) == 2 {
+				m.Prefix = args[1]
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "interval":
+					var interval string
+					if !h.AllArgs(&interval) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(interval)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", interval)
+					}
+					m.Interval = caddy.Duration(dur)
+				case "max_objects":
+					var maxObjects string
+					if !h.AllArgs(&maxObjects) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.ParseInt(maxObjects, 10, 64)
+					if err != nil || n <= 0 {
+						return nil, h.Errf("'%s' is not a valid max_objects", maxObjects)
+					}
+					m.MaxObjects = n
+				default:
+					return nil, h.Errf("%s not a valid mirror_check option", h.Val())
+				}
+			}
+			b.MirrorCheck = m
+		case "hedge_delay":
+			var delay string
+			if !h.AllArgs(&delay) {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(delay)
+			if err != nil || dur <= 0 {
+				return nil, h.Errf("'%s' is not a valid duration", delay)
+			}
+			b.HedgeDelay = caddy.Duration(dur)
+		case "retry":
+			var op string
+			if !h.AllArgs(&op) {
+				return nil, h.ArgErr()
+			}
+			if !slices.Contains(retryOps, op) {
+				return nil, h.Errf("retry operation must be get, put, delete or list, got '%s'", op)
+			}
+			rp := RetryPolicy{}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "policy":
+					if !h.AllArgs(&rp.Policy) {
+						return nil, h.ArgErr()
+					}
+					if rp.Policy != "always" && rp.Policy != "idempotent" && rp.Policy != "never" {
+						return nil, h.Errf("retry policy must be always, idempotent or never, got '%s'", rp.Policy)
+					}
+				case "max_attempts":
+					var attempts string
+					if !h.AllArgs(&attempts) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.Atoi(attempts)
+					if err != nil || n <= 0 {
+						return nil, h.Errf("'%s' is not a valid max_attempts", attempts)
+					}
+					rp.MaxAttempts = n
+				case "initial_backoff", "max_backoff", "timeout":
+					option := h.Val()
+					var value string
+					if !h.AllArgs(&value) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(value)
+					if err != nil || dur <= 0 {
+						return nil, h.Errf("'%s' is not a valid duration", value)
+					}
+					switch option {
+					case "initial_backoff":
+						rp.InitialBackoff = caddy.Duration(dur)
+					case "max_backoff":
+						rp.MaxBackoff = caddy.Duration(dur)
+					default:
+						rp.Timeout = caddy.Duration(dur)
+					}
+				default:
+					return nil, h.Errf("%s not a valid retry option", h.Val())
+				}
+			}
+			if b.RetryPolicies == nil {
+				b.RetryPolicies = make(map[string]RetryPolicy)
+			}
+			b.RetryPolicies[op] = rp
+		case "replayable_put":
+			rp := &ReplayablePut{}
+			args := h.RemainingArgs()
+			if len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			if len(args) > 0 {
+				size, err := humanize.ParseBytes(args[0])
+				if err != nil || size == 0 {
+					return nil, h.Errf("'%s' is not a valid size", args[0])
+				}
+				rp.MaxSize = int64(size)
+			}
+			if len(args) > 1 {
+				attempts, err := strconv.Atoi(args[1])
+				if err != nil || attempts <= 0 {
+					return nil, h.Errf("'%s' is not a valid number of attempts", args[1])
+				}
+				rp.MaxAttempts = attempts
+			}
+			b.ReplayablePut = rp
+		case "buffer_puts":
+			bp := &BufferPuts{}
+			args := h.RemainingArgs()
+			if len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			if len(args) > 0 {
+				size, err := humanize.ParseBytes(args[0])
+				if err != nil || size == 0 {
+					return nil, h.Errf("'%s' is not a valid size", args[0])
+				}
+				bp.MemoryThreshold = int64(size)
+			}
+			if len(args) > 1 {
+				bp.Dir = args[1]
+			}
+			b.BufferPuts = bp
+		case "deadline_header":
+			b.DeadlineHeader = defaultDeadlineHeader
+			args := h.RemainingArgs()
+			if len(args) == 1 {
+				b.DeadlineHeader = args[0]
+			}
+			if len(args) > 1 {
+				return nil, h.ArgErr()
+			}
+		case "methods":
+			args := h.RemainingArgs()
+			if len(args) == 0 {
+				return nil, h.ArgErr()
+			}
+			for _, method := range args {
+				method = strings.ToUpper(method)
+				if !slices.Contains(supportedMethods, method) {
+					return nil, h.Errf("'%s' is not a supported method", method)
+				}
+				b.Methods = append(b.Methods, method)
+			}
+		case "method_override":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.MethodOverride = true
+		case "read_only":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.Methods = []string{http.MethodGet, http.MethodHead}
 		case "browse":
 			b.EnableBrowse = true
 			args := h.RemainingArgs()
-			if len(args) == 1 {
+			if len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			if len(args) > 0 {
 				b.BrowseTemplate = args[0]
 			}
 			if len(args) > 1 {
+				refresh, err := caddy.ParseDuration(args[1])
+				if err != nil || refresh <= 0 {
+					return nil, h.Errf("'%s' is not a valid duration", args[1])
+				}
+				b.BrowseTemplateRefresh = caddy.Duration(refresh)
+			}
+		case "browse_header_footer":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.BrowseHeaderFooter = true
+		case "robots":
+			robots := &Robots{}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "txt":
+					robots.Txt = true
+					robots.Disallow = h.RemainingArgs()
+				case "sitemap":
+					if !h.AllArgs(&robots.Sitemap) {
+						return nil, h.ArgErr()
+					}
+				case "noindex":
+					robots.NoIndex = append(robots.NoIndex, h.RemainingArgs()...)
+					if len(robots.NoIndex) == 0 {
+						return nil, h.ArgErr()
+					}
+				case "noindex_browse":
+					if h.NextArg() {
+						return nil, h.ArgErr()
+					}
+					robots.NoIndexBrowse = true
+				default:
+					return nil, h.Errf("%s not a valid robots option", h.Val())
+				}
+			}
+			b.Robots = robots
+		case "browse_dir_usage":
+			usage := &BrowseDirUsage{}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "max_objects", "max_dirs":
+					option := h.Val()
+					var max string
+					if !h.AllArgs(&max) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.Atoi(max)
+					if err != nil || n <= 0 {
+						return nil, h.Errf("'%s' is not a valid %s", max, option)
+					}
+					if option == "max_objects" {
+						usage.MaxObjects = int64(n)
+					} else {
+						usage.MaxDirs = n
+					}
+				case "ttl":
+					var ttl string
+					if !h.AllArgs(&ttl) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(ttl)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", ttl)
+					}
+					usage.TTL = caddy.Duration(dur)
+				default:
+					return nil, h.Errf("%s not a valid browse_dir_usage option", h.Val())
+				}
+			}
+			b.BrowseDirUsage = usage
+		case "browse_template":
+			args := h.RemainingArgs()
+			if len(args) < 2 {
+				return nil, h.ArgErr()
+			}
+			b.BrowseTemplates = append(b.BrowseTemplates, BrowseTemplateRule{Template: args[0], Paths: args[1:]})
+		case "localize":
+			loc := Localization{}
+			if !h.AllArgs(&loc.Language) {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "browse":
+					if !h.AllArgs(&loc.BrowseTemplate) {
+						return nil, h.ArgErr()
+					}
+				case "errors", "error_page":
+					args := h.RemainingArgs()
+					switch len(args) {
+					case 1:
+						loc.DefaultErrorPage = args[0]
+					case 2:
+						status, err := strconv.Atoi(args[0])
+						if err != nil {
+							return nil, h.Errf("'%s' is not a valid HTTP status code", args[0])
+						}
+						if loc.ErrorPages == nil {
+							loc.ErrorPages = make(map[int]string)
+						}
+						loc.ErrorPages[status] = args[1]
+					default:
+						return nil, h.ArgErr()
+					}
+				default:
+					return nil, h.Errf("%s not a valid localize option", h.Val())
+				}
+			}
+			b.Localizations = append(b.Localizations, loc)
+		case "charset":
+			b.Charset = "utf-8"
+			args := h.RemainingArgs()
+			if len(args) == 1 {
+				b.Charset = args[0]
+			}
+			if len(args) > 1 {
+				return nil, h.ArgErr()
+			}
+		case "default_content_type":
+			if !h.AllArgs(&b.DefaultContentType) {
+				return nil, h.ArgErr()
+			}
+		case "etag":
+			args := h.RemainingArgs()
+			if len(args) == 0 {
+				return nil, h.ArgErr()
+			}
+			if args[0] != "strong" && args[0] != "weak" && args[0] != "off" {
+				return nil, h.Errf("etag must be strong, weak or off, got '%s'", args[0])
+			}
+			rule := ETagRule{Mode: args[0]}
+			if len(args) > 1 {
+				rule.Paths = args[1:]
+			}
+			b.ETags = append(b.ETags, rule)
+		case "expires":
+			args := h.RemainingArgs()
+			rule := ExpiresRule{}
+			if len(args) > 0 && args[0] != "max_age" {
+				dur, err := caddy.ParseDuration(args[0])
+				if err != nil || dur <= 0 {
+					return nil, h.Errf("'%s' is not a valid duration", args[0])
+				}
+				rule.Duration = caddy.Duration(dur)
+			}
+			if len(args) > 1 {
+				rule.Paths = args[1:]
+			}
+			b.Expires = append(b.Expires, rule)
+		case "immutable":
+			b.Immutable = defaultImmutablePattern
+			args := h.RemainingArgs()
+			if len(args) == 1 {
+				b.Immutable = args[0]
+			}
+			if len(args) > 1 {
+				return nil, h.ArgErr()
+			}
+			if _, err := regexp.Compile(b.Immutable); err != nil {
+				return nil, h.Errf("'%s' is not a valid regular expression: %v", b.Immutable, err)
+			}
+		case "early_hints":
+			b.EarlyHints = &EarlyHints{}
+			if args := h.RemainingArgs(); len(args) > 0 {
+				b.EarlyHints.Links = args
+			}
+		case "precompressed":
+			b.Precompressed = h.RemainingArgs()
+			if len(b.Precompressed) == 0 {
+				b.Precompressed = slices.Clone(defaultPrecompressed)
+			}
+		case "compress":
+			compress := &Compress{Encodings: h.RemainingArgs()}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "types":
+					compress.Types = h.RemainingArgs()
+					if len(compress.Types) == 0 {
+						return nil, h.ArgErr()
+					}
+				case "min_length":
+					var length string
+					if !h.AllArgs(&length) {
+						return nil, h.ArgErr()
+					}
+					bytes, err := humanize.ParseBytes(length)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid length", length)
+					}
+					compress.MinLength = int64(bytes)
+				default:
+					return nil, h.Errf("%s not a valid compress option", h.Val())
+				}
+			}
+			b.Compress = compress
+		case "digest":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.Digest = true
+		case "max_keys":
+			var maxKeys string
+			if !h.AllArgs(&maxKeys) {
+				return nil, h.ArgErr()
+			}
+			n, err := strconv.Atoi(maxKeys)
+			if err != nil || n <= 0 {
+				return nil, h.Errf("'%s' is not a valid max_keys", maxKeys)
+			}
+			b.MaxKeys = n
+		case "disk_usage":
+			du := &DiskUsage{}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "max_objects":
+					var maxObjects string
+					if !h.AllArgs(&maxObjects) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.ParseInt(maxObjects, 10, 64)
+					if err != nil || n <= 0 {
+						return nil, h.Errf("'%s' is not a valid max_objects", maxObjects)
+					}
+					du.MaxObjects = n
+				case "ttl":
+					var ttl string
+					if !h.AllArgs(&ttl) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(ttl)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", ttl)
+					}
+					du.TTL = caddy.Duration(dur)
+				default:
+					return nil, h.Errf("%s not a valid disk_usage option", h.Val())
+				}
+			}
+			b.DiskUsage = du
+		case "stats":
+			st := &PrefixStats{}
+			if h.NextArg() {
 				return nil, h.ArgErr()
 			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "max_objects":
+					var maxObjects string
+					if !h.AllArgs(&maxObjects) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.ParseInt(maxObjects, 10, 64)
+					if err != nil || n <= 0 {
+						return nil, h.Errf("'%s' is not a valid max_objects", maxObjects)
+					}
+					st.MaxObjects = n
+				case "ttl":
+					var ttl string
+					if !h.AllArgs(&ttl) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(ttl)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", ttl)
+					}
+					st.TTL = caddy.Duration(dur)
+				case "largest":
+					var largest string
+					if !h.AllArgs(&largest) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.Atoi(largest)
+					if err != nil || n <= 0 {
+						return nil, h.Errf("'%s' is not a valid largest count", largest)
+					}
+					st.Largest = n
+				default:
+					return nil, h.Errf("%s not a valid stats option", h.Val())
+				}
+			}
+			b.Stats = st
+		case "bucket_info":
+			if !h.AllArgs(&b.BucketInfoPath) {
+				return nil, h.ArgErr()
+			}
+			if !strings.HasPrefix(b.BucketInfoPath, "/") {
+				return nil, h.Errf("bucket_info path must start with /: %s", b.BucketInfoPath)
+			}
+		case "slow_request_threshold":
+			var threshold string
+			if !h.AllArgs(&threshold) {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(threshold)
+			if err != nil || dur <= 0 {
+				return nil, h.Errf("'%s' is not a valid duration", threshold)
+			}
+			b.SlowRequestThreshold = caddy.Duration(dur)
+		case "folder_markers":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.FolderMarkers = true
+		case "meta":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			b.EnableMeta = true
+		case "no_index":
+			args := h.RemainingArgs()
+			if len(args) == 0 {
+				return nil, h.ArgErr()
+			}
+			b.NoIndex = args[0]
+			switch b.NoIndex {
+			case "browse", "403", "404", "pass_through":
+				if len(args) != 1 {
+					return nil, h.ArgErr()
+				}
+			case "redirect":
+				if len(args) != 2 {
+					return nil, h.ArgErr()
+				}
+				b.NoIndexRedirect = args[1]
+			default:
+				return nil, h.Errf("'%s' is not a valid no_index policy", b.NoIndex)
+			}
 		case "error_page", "errors":
 			if b.ErrorPages == nil {
 				b.ErrorPages = make(map[int]string)
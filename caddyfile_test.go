@@ -3,7 +3,9 @@ package caddygcsproxy
 import (
 	"reflect"
 	"testing"
+	"time"
 
+	caddy "github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 )
 
@@ -115,65 +117,1610 @@ func TestParseCaddyfile(t *testing.T) {
 				EnableDelete: true,
 			},
 		},
+		{
+			desc: "enable put and delete scoped by path",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put /uploads/* /drop/*
+				enable_delete /tmp/*
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:       "mybucket",
+				EnablePut:    true,
+				PutPaths:     []string{"/uploads/*", "/drop/*"},
+				EnableDelete: true,
+				DeletePaths:  []string{"/tmp/*"},
+			},
+		},
 		{
 			desc: "enable error pages",
 			input: `gcsproxy {
 				bucket mybucket
-				errors 404 "path/to/404.html"
-				errors 403 "path/to/403.html"
-				errors "path/to/default_error.html"
+				errors 404 "path/to/404.html"
+				errors 403 "path/to/403.html"
+				errors "path/to/default_error.html"
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				ErrorPages: map[int]string{
+					403: "path/to/403.html",
+					404: "path/to/404.html",
+				},
+				DefaultErrorPage: "path/to/default_error.html",
+			},
+		},
+		{
+			desc: "hide files",
+			input: `gcsproxy {
+				bucket mybucket
+				hide foo.txt _*
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Hide:   []string{"foo.txt", "_*"},
+			},
+		},
+		{
+			desc: "hide files - missing arg",
+			input: `gcsproxy {
+				bucket mybucket
+				hide
+			}`,
+			shouldErr: true,
+			errString: "Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'hide'",
+		},
+		{
+			desc: "index test",
+			input: `gcsproxy {
+				bucket mybucket
+				index i.htm i.html
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:     "mybucket",
+				IndexNames: []string{"i.htm", "i.html"},
+			},
+		},
+		{
+			desc: "index - missing arg",
+			input: `gcsproxy {
+				bucket mybucket
+				index
+			}`,
+			shouldErr: true,
+			errString: "Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'index'",
+		},
+		{
+			desc: "methods",
+			input: `gcsproxy {
+				bucket mybucket
+				methods get HEAD put
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:  "mybucket",
+				Methods: []string{"GET", "HEAD", "PUT"},
+			},
+		},
+		{
+			desc: "methods - unsupported method",
+			input: `gcsproxy {
+				bucket mybucket
+				methods GET TRACE
+			}`,
+			shouldErr: true,
+			errString: "'TRACE' is not a supported method, at Testfile:3",
+		},
+		{
+			desc: "methods - missing arg",
+			input: `gcsproxy {
+				bucket mybucket
+				methods
+			}`,
+			shouldErr: true,
+			errString: "wrong argument count or unexpected line ending after 'methods', at Testfile:3",
+		},
+		{
+			desc: "upload metadata",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put
+				upload_metadata uploader {http.auth.user.id}
+				upload_metadata client-ip {http.request.remote.host}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:    "mybucket",
+				EnablePut: true,
+				UploadMetadata: map[string]string{
+					"uploader":  "{http.auth.user.id}",
+					"client-ip": "{http.request.remote.host}",
+				},
+			},
+		},
+		{
+			desc: "upload metadata - missing value",
+			input: `gcsproxy {
+				bucket mybucket
+				upload_metadata uploader
+			}`,
+			shouldErr: true,
+			errString: "wrong argument count or unexpected line ending after 'uploader', at Testfile:3",
+		},
+		{
+			desc: "quotas",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put
+				quota /home/{http.auth.user.id}/ {
+					max_bytes 1GiB
+					max_objects 1000
+				}
+				quota /shared/ {
+					max_bytes 10MB
+				}
+				quota_refresh 1m
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:    "mybucket",
+				EnablePut: true,
+				Quotas: []Quota{
+					{Prefix: "/home/{http.auth.user.id}/", MaxBytes: 1 << 30, MaxObjects: 1000},
+					{Prefix: "/shared/", MaxBytes: 10000000},
+				},
+				QuotaRefresh: caddy.Duration(time.Minute),
+			},
+		},
+		{
+			desc: "quota - no limits",
+			input: `gcsproxy {
+				bucket mybucket
+				quota /shared/ {
+				}
+			}`,
+			shouldErr: true,
+			errString: "quota must set max_bytes or max_objects, at Testfile:4",
+		},
+		{
+			desc: "quota - bad size",
+			input: `gcsproxy {
+				bucket mybucket
+				quota /shared/ {
+					max_bytes lots
+				}
+			}`,
+			shouldErr: true,
+			errString: "'lots' is not a valid size, at Testfile:4",
+		},
+		{
+			desc: "signed urls",
+			input: `gcsproxy {
+				bucket mybucket
+				signed_urls s3cret /private/*
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				SignedURLs: &SignedURLs{
+					Secret: "s3cret",
+					Paths:  []string{"/private/*"},
+				},
+			},
+		},
+		{
+			desc: "signed urls - missing secret",
+			input: `gcsproxy {
+				bucket mybucket
+				signed_urls
+			}`,
+			shouldErr: true,
+			errString: "wrong argument count or unexpected line ending after 'signed_urls', at Testfile:3",
+		},
+		{
+			desc: "signed cookie",
+			input: `gcsproxy {
+				bucket mybucket
+				signed_cookie s3cret {
+					name media_access
+					paths /media/*
+					mint_path /auth/media-cookie
+					mint_prefixes /media/{http.auth.user.id}/
+					ttl 30m
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				SignedCookie: &SignedCookie{
+					Secret:       "s3cret",
+					Name:         "media_access",
+					Paths:        []string{"/media/*"},
+					MintPath:     "/auth/media-cookie",
+					MintPrefixes: []string{"/media/{http.auth.user.id}/"},
+					TTL:          caddy.Duration(30 * time.Minute),
+				},
+			},
+		},
+		{
+			desc: "signed cookie - bad option",
+			input: `gcsproxy {
+				bucket mybucket
+				signed_cookie s3cret {
+					domain example.com
+				}
+			}`,
+			shouldErr: true,
+			errString: "domain not a valid signed_cookie option, at Testfile:4",
+		},
+		{
+			desc: "public only",
+			input: `gcsproxy {
+				bucket mybucket
+				public_only 5m
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:         "mybucket",
+				PublicOnly:     true,
+				PublicCacheTTL: caddy.Duration(5 * time.Minute),
+			},
+		},
+		{
+			desc: "rate limit",
+			input: `gcsproxy {
+				bucket mybucket
+				rate_limit {
+					key {http.auth.user.id}
+					read 100/1s
+					write 60/1m 5
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				RateLimit: &RateLimit{
+					Key:        "{http.auth.user.id}",
+					ReadRate:   100,
+					ReadBurst:  100,
+					WriteRate:  1,
+					WriteBurst: 5,
+				},
+			},
+		},
+		{
+			desc: "rate limit - bad rate",
+			input: `gcsproxy {
+				bucket mybucket
+				rate_limit {
+					read fast
+				}
+			}`,
+			shouldErr: true,
+			errString: "'fast' is not a valid rate: rate must be of the form <events>/<duration>, at Testfile:4",
+		},
+		{
+			desc: "egress budgets",
+			input: `gcsproxy {
+				bucket mybucket
+				egress_budget 100GB 24h
+				egress_budget 1GB 1h /videos/* {
+					status 503
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				EgressBudgets: []EgressBudget{
+					{MaxBytes: 100000000000, Window: caddy.Duration(24 * time.Hour)},
+					{MaxBytes: 1000000000, Window: caddy.Duration(time.Hour), Paths: []string{"/videos/*"}, StatusCode: 503},
+				},
+			},
+		},
+		{
+			desc: "egress budget - bad status",
+			input: `gcsproxy {
+				bucket mybucket
+				egress_budget 1GB 1h {
+					status 500
+				}
+			}`,
+			shouldErr: true,
+			errString: "egress_budget status must be 429 or 503, got '500', at Testfile:4",
+		},
+		{
+			desc: "webhook",
+			input: `gcsproxy {
+				bucket mybucket
+				webhook https://hooks.example.com/uploads {
+					secret s3cret
+					retries 5
+					timeout 2s
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Webhooks: []Webhook{
+					{
+						URL:     "https://hooks.example.com/uploads",
+						Secret:  "s3cret",
+						Retries: 5,
+						Timeout: caddy.Duration(2 * time.Second),
+					},
+				},
+			},
+		},
+		{
+			desc: "pubsub topic",
+			input: `gcsproxy {
+				bucket mybucket
+				pubsub_topic projects/myproject/topics/uploads
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:      "mybucket",
+				PubSubTopic: "projects/myproject/topics/uploads",
+			},
+		},
+		{
+			desc: "antivirus",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put
+				antivirus tcp://clamd:3310 1m
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:    "mybucket",
+				EnablePut: true,
+				Antivirus: &Antivirus{
+					Address: "tcp://clamd:3310",
+					Timeout: caddy.Duration(time.Minute),
+				},
+			},
+		},
+		{
+			desc: "upload validator",
+			input: `gcsproxy {
+				bucket mybucket
+				upload_validator {
+					command /usr/local/bin/check-upload --strict
+					peek_bytes 512
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				UploadValidator: &UploadValidator{
+					Command:   []string{"/usr/local/bin/check-upload", "--strict"},
+					PeekBytes: 512,
+				},
+			},
+		},
+		{
+			desc: "upload validator - url and command",
+			input: `gcsproxy {
+				bucket mybucket
+				upload_validator {
+					url http://validator/check
+					command check-upload
+				}
+			}`,
+			shouldErr: true,
+			errString: "upload_validator requires exactly one of url or command, at Testfile:6",
+		},
+		{
+			desc: "write spool",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put
+				write_spool /var/spool/gcsproxy {
+					max_age 12h
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:    "mybucket",
+				EnablePut: true,
+				WriteSpool: &WriteSpool{
+					Dir:    "/var/spool/gcsproxy",
+					MaxAge: caddy.Duration(12 * time.Hour),
+				},
+			},
+		},
+		{
+			desc: "cache",
+			input: `gcsproxy {
+				bucket mybucket
+				cache {
+					max_size 128MiB
+					max_object_size 256KiB
+					ttl 1m
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Cache: &Cache{
+					MaxSize:       128 << 20,
+					MaxObjectSize: 256 << 10,
+					TTL:           caddy.Duration(time.Minute),
+				},
+			},
+		},
+		{
+			desc: "cache chunk_size",
+			input: `gcsproxy {
+				bucket mybucket
+				cache {
+					chunk_size 512KiB
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Cache: &Cache{
+					ChunkSize: 512 << 10,
+				},
+			},
+		},
+		{
+			desc: "cache budget",
+			input: `gcsproxy {
+				bucket mybucket
+				cache {
+					global_max_size 1GiB
+					min_hits 2
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Cache: &Cache{
+					GlobalMaxSize: 1 << 30,
+					MinHits:       2,
+				},
+			},
+		},
+		{
+			desc: "cache disk",
+			input: `gcsproxy {
+				bucket mybucket
+				cache {
+					disk /var/cache/gcsproxy 50GiB 1GiB
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Cache: &Cache{
+					DiskDir:           "/var/cache/gcsproxy",
+					DiskMaxSize:       50 << 30,
+					DiskMaxObjectSize: 1 << 30,
+				},
+			},
+		},
+		{
+			desc: "cache stale_while_revalidate",
+			input: `gcsproxy {
+				bucket mybucket
+				cache {
+					ttl 1m
+					stale_while_revalidate 1h
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Cache: &Cache{
+					TTL:                  caddy.Duration(time.Minute),
+					StaleWhileRevalidate: caddy.Duration(time.Hour),
+				},
+			},
+		},
+		{
+			desc: "cache bypass_header",
+			input: `gcsproxy {
+				bucket mybucket
+				cache {
+					bypass_header X-Cache-Bypass s3cret
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Cache: &Cache{
+					BypassHeader: "X-Cache-Bypass",
+					BypassSecret: "s3cret",
+				},
+			},
+		},
+		{
+			desc: "offline",
+			input: `gcsproxy {
+				bucket mybucket
+				cache
+				offline auto {
+					failure_threshold 3
+					recheck 1m
+					status 404
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Cache:  &Cache{},
+				Offline: &Offline{
+					Mode:             "auto",
+					FailureThreshold: 3,
+					Recheck:          caddy.Duration(time.Minute),
+					StatusCode:       404,
+				},
+			},
+		},
+		{
+			desc: "offline bad mode",
+			input: `gcsproxy {
+				offline maybe
+			}`,
+			shouldErr: true,
+			errString: "offline mode must be on or auto, got 'maybe', at Testfile:2",
+		},
+		{
+			desc: "prewarm",
+			input: `gcsproxy {
+				bucket mybucket
+				cache
+				prewarm {
+					manifest /etc/caddy/hot.txt
+					prefix /static/
+					glob *.css
+					interval 1h
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Cache:  &Cache{},
+				Prewarm: &Prewarm{
+					Manifest: "/etc/caddy/hot.txt",
+					Prefix:   "/static/",
+					Glob:     "*.css",
+					Interval: caddy.Duration(time.Hour),
+				},
+			},
+		},
+		{
+			desc: "prewarm index and error pages",
+			input: `gcsproxy {
+				bucket mybucket
+				cache
+				prewarm {
+					index_and_error_pages
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:  "mybucket",
+				Cache:   &Cache{},
+				Prewarm: &Prewarm{IndexAndErrorPages: true},
+			},
+		},
+		{
+			desc: "prewarm without source",
+			input: `gcsproxy {
+				prewarm {
+					interval 1h
+				}
+			}`,
+			shouldErr: true,
+			errString: "prewarm requires a manifest, prefix, glob or index_and_error_pages, at Testfile:4",
+		},
+		{
+			desc: "index off",
+			input: `gcsproxy {
+				bucket mybucket
+				index off
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:     "mybucket",
+				IndexNames: []string{},
+			},
+		},
+		{
+			desc: "no_index redirect",
+			input: `gcsproxy {
+				bucket mybucket
+				no_index redirect /
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:          "mybucket",
+				NoIndex:         "redirect",
+				NoIndexRedirect: "/",
+			},
+		},
+		{
+			desc: "no_index bad policy",
+			input: `gcsproxy {
+				no_index 500
+			}`,
+			shouldErr: true,
+			errString: "'500' is not a valid no_index policy, at Testfile:2",
+		},
+		{
+			desc: "hide_status",
+			input: `gcsproxy {
+				bucket mybucket
+				hide .git
+				hide_status pass_through
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:     "mybucket",
+				Hide:       []string{".git"},
+				HideStatus: "pass_through",
+			},
+		},
+		{
+			desc: "charset default",
+			input: `gcsproxy {
+				bucket mybucket
+				charset
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:  "mybucket",
+				Charset: "utf-8",
+			},
+		},
+		{
+			desc: "charset",
+			input: `gcsproxy {
+				bucket mybucket
+				charset iso-8859-1
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:  "mybucket",
+				Charset: "iso-8859-1",
+			},
+		},
+		{
+			desc: "default_content_type",
+			input: `gcsproxy {
+				bucket mybucket
+				default_content_type application/octet-stream
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:             "mybucket",
+				DefaultContentType: "application/octet-stream",
+			},
+		},
+		{
+			desc: "etag",
+			input: `gcsproxy {
+				bucket mybucket
+				etag off /api/*
+				etag weak
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				ETags: []ETagRule{
+					{Mode: "off", Paths: []string{"/api/*"}},
+					{Mode: "weak"},
+				},
+			},
+		},
+		{
+			desc: "etag bad mode",
+			input: `gcsproxy {
+				etag maybe
+			}`,
+			shouldErr: true,
+			errString: "etag must be strong, weak or off, got 'maybe', at Testfile:2",
+		},
+		{
+			desc: "expires",
+			input: `gcsproxy {
+				bucket mybucket
+				expires 1h /static/*
+				expires max_age /docs/*
+				expires
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Expires: []ExpiresRule{
+					{Duration: caddy.Duration(time.Hour), Paths: []string{"/static/*"}},
+					{Paths: []string{"/docs/*"}},
+					{},
+				},
+			},
+		},
+		{
+			desc: "immutable default",
+			input: `gcsproxy {
+				bucket mybucket
+				immutable
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:    "mybucket",
+				Immutable: defaultImmutablePattern,
+			},
+		},
+		{
+			desc: "immutable",
+			input: `gcsproxy {
+				bucket mybucket
+				immutable ^/assets/
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:    "mybucket",
+				Immutable: "^/assets/",
+			},
+		},
+		{
+			desc: "early_hints",
+			input: `gcsproxy {
+				bucket mybucket
+				early_hints "</app.css>; rel=preload; as=style"
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				EarlyHints: &EarlyHints{
+					Links: []string{"</app.css>; rel=preload; as=style"},
+				},
+			},
+		},
+		{
+			desc: "digest",
+			input: `gcsproxy {
+				bucket mybucket
+				digest
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Digest: true,
+			},
+		},
+		{
+			desc: "max_keys",
+			input: `gcsproxy {
+				bucket mybucket
+				browse
+				max_keys 200
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:       "mybucket",
+				EnableBrowse: true,
+				MaxKeys:      200,
+			},
+		},
+		{
+			desc: "hedge_delay",
+			input: `gcsproxy {
+				bucket mybucket
+				hedge_delay 150ms
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:     "mybucket",
+				HedgeDelay: caddy.Duration(150 * time.Millisecond),
+			},
+		},
+		{
+			desc: "retry",
+			input: `gcsproxy {
+				bucket mybucket
+				retry get {
+					policy always
+					max_attempts 5
+					max_backoff 2s
+					timeout 30s
+				}
+				retry put {
+					policy never
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				RetryPolicies: map[string]RetryPolicy{
+					"get": {
+						Policy:      "always",
+						MaxAttempts: 5,
+						MaxBackoff:  caddy.Duration(2 * time.Second),
+						Timeout:     caddy.Duration(30 * time.Second),
+					},
+					"put": {Policy: "never"},
+				},
+			},
+		},
+		{
+			desc: "retry bad operation",
+			input: `gcsproxy {
+				retry head
+			}`,
+			shouldErr: true,
+			errString: "retry operation must be get, put, delete or list, got 'head', at Testfile:2",
+		},
+		{
+			desc: "replayable_put",
+			input: `gcsproxy {
+				bucket mybucket
+				replayable_put 4MiB 5
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				ReplayablePut: &ReplayablePut{
+					MaxSize:     4 << 20,
+					MaxAttempts: 5,
+				},
+			},
+		},
+		{
+			desc: "deadline_header",
+			input: `gcsproxy {
+				bucket mybucket
+				deadline_header
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:         "mybucket",
+				DeadlineHeader: "X-Request-Timeout",
+			},
+		},
+		{
+			desc: "request_timeout",
+			input: `gcsproxy {
+				bucket mybucket
+				request_timeout 30s
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:         "mybucket",
+				RequestTimeout: caddy.Duration(30 * time.Second),
+			},
+		},
+		{
+			desc: "meta",
+			input: `gcsproxy {
+				bucket mybucket
+				meta
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:     "mybucket",
+				EnableMeta: true,
+			},
+		},
+		{
+			desc: "enable_compose",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put
+				enable_compose
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:        "mybucket",
+				EnablePut:     true,
+				EnableCompose: true,
+			},
+		},
+		{
+			desc: "enable_patch",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_patch /archive/*
+				enable_holds
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:      "mybucket",
+				EnablePatch: true,
+				PatchPaths:  []string{"/archive/*"},
+				EnableHolds: true,
+			},
+		},
+		{
+			desc: "disk_usage",
+			input: `gcsproxy {
+				bucket mybucket
+				disk_usage {
+					max_objects 5000
+					ttl 30s
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				DiskUsage: &DiskUsage{
+					MaxObjects: 5000,
+					TTL:        caddy.Duration(30 * time.Second),
+				},
+			},
+		},
+		{
+			desc: "disk_usage - invalid max_objects",
+			input: `gcsproxy {
+				bucket mybucket
+				disk_usage {
+					max_objects lots
+				}
+			}`,
+			shouldErr: true,
+			errString: "'lots' is not a valid max_objects, at Testfile:4",
+		},
+		{
+			desc: "stats",
+			input: `gcsproxy {
+				bucket mybucket
+				stats {
+					max_objects 20000
+					ttl 10m
+					largest 25
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Stats: &PrefixStats{
+					MaxObjects: 20000,
+					TTL:        caddy.Duration(10 * time.Minute),
+					Largest:    25,
+				},
+			},
+		},
+		{
+			desc: "folder_markers",
+			input: `gcsproxy {
+				bucket mybucket
+				browse
+				folder_markers
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:        "mybucket",
+				EnableBrowse:  true,
+				FolderMarkers: true,
+			},
+		},
+		{
+			desc: "enable_folders",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_folders
+				methods GET MKCOL MOVE
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:        "mybucket",
+				EnableFolders: true,
+				Methods:       []string{"GET", "MKCOL", "MOVE"},
+			},
+		},
+		{
+			desc: "soft_deleted",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put
+				soft_deleted
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:            "mybucket",
+				EnablePut:         true,
+				EnableSoftDeleted: true,
+			},
+		},
+		{
+			desc: "bucket_info",
+			input: `gcsproxy {
+				bucket mybucket
+				bucket_info /_bucket
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:         "mybucket",
+				BucketInfoPath: "/_bucket",
+			},
+		},
+		{
+			desc: "bucket_info - relative path",
+			input: `gcsproxy {
+				bucket mybucket
+				bucket_info _bucket
+			}`,
+			shouldErr: true,
+			errString: "bucket_info path must start with /: _bucket, at Testfile:3",
+		},
+		{
+			desc: "slow_request_threshold",
+			input: `gcsproxy {
+				bucket mybucket
+				slow_request_threshold 2s
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:               "mybucket",
+				SlowRequestThreshold: caddy.Duration(2 * time.Second),
+			},
+		},
+		{
+			desc: "first byte and transfer timeouts",
+			input: `gcsproxy {
+				bucket mybucket
+				first_byte_timeout 5s
+				transfer_timeout 1h
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:           "mybucket",
+				FirstByteTimeout: caddy.Duration(5 * time.Second),
+				TransferTimeout:  caddy.Duration(time.Hour),
+			},
+		},
+		{
+			desc: "mirror_check",
+			input: `gcsproxy {
+				bucket mybucket
+				mirror_check mybucket-dr assets/ {
+					interval 6h
+					max_objects 50000
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				MirrorCheck: &MirrorCheck{
+					Bucket:     "mybucket-dr",
+					Prefix:     "assets/",
+					Interval:   caddy.Duration(6 * time.Hour),
+					MaxObjects: 50000,
+				},
+			},
+		},
+		{
+			desc: "expire_uploads",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put
+				expire_uploads 24h /drop/* {
+					sweep 10m drop/
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:    "mybucket",
+				EnablePut: true,
+				ExpireUploads: &ExpireUploads{
+					After:         caddy.Duration(24 * time.Hour),
+					Paths:         []string{"/drop/*"},
+					SweepInterval: caddy.Duration(10 * time.Minute),
+					SweepPrefix:   "drop/",
+				},
+			},
+		},
+		{
+			desc: "expire_uploads - invalid duration",
+			input: `gcsproxy {
+				bucket mybucket
+				expire_uploads soon
+			}`,
+			shouldErr: true,
+			errString: "'soon' is not a valid duration, at Testfile:3",
+		},
+		{
+			desc: "buffer_puts",
+			input: `gcsproxy {
+				bucket mybucket
+				buffer_puts 512KiB /var/tmp/uploads
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				BufferPuts: &BufferPuts{
+					MemoryThreshold: 512 << 10,
+					Dir:             "/var/tmp/uploads",
+				},
+			},
+		},
+		{
+			desc: "precompressed",
+			input: `gcsproxy {
+				bucket mybucket
+				precompressed gzip br
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:        "mybucket",
+				Precompressed: []string{"gzip", "br"},
+			},
+		},
+		{
+			desc: "precompressed - default encodings",
+			input: `gcsproxy {
+				bucket mybucket
+				precompressed
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:        "mybucket",
+				Precompressed: []string{"br", "gzip"},
+			},
+		},
+		{
+			desc: "compress",
+			input: `gcsproxy {
+				bucket mybucket
+				compress gzip {
+					types text/* application/json
+					min_length 1KB
+				}
 			}`,
 			shouldErr: false,
 			obj: GcsProxy{
 				Bucket: "mybucket",
-				ErrorPages: map[int]string{
-					403: "path/to/403.html",
-					404: "path/to/404.html",
+				Compress: &Compress{
+					Encodings: []string{"gzip"},
+					Types:     []string{"text/*", "application/json"},
+					MinLength: 1000,
 				},
-				DefaultErrorPage: "path/to/default_error.html",
 			},
 		},
 		{
-			desc: "hide files",
+			desc: "compress - invalid option",
 			input: `gcsproxy {
 				bucket mybucket
-				hide foo.txt _*
+				compress {
+					level 5
+				}
+			}`,
+			shouldErr: true,
+			errString: "level not a valid compress option, at Testfile:4",
+		},
+		{
+			desc: "decompress_uploads",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put
+				decompress_uploads
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:            "mybucket",
+				EnablePut:         true,
+				DecompressUploads: true,
+			},
+		},
+		{
+			desc: "normalize_keys",
+			input: `gcsproxy {
+				bucket mybucket
+				normalize_keys
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:        "mybucket",
+				NormalizeKeys: "nfc",
+			},
+		},
+		{
+			desc: "normalize_keys - invalid form",
+			input: `gcsproxy {
+				bucket mybucket
+				normalize_keys nfkc
+			}`,
+			shouldErr: true,
+			errString: "normalize_keys must be nfc or nfd, got 'nfkc', at Testfile:3",
+		},
+		{
+			desc: "protect",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put
+				enable_delete
+				protect errors/* _redirects .well-known/*
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:       "mybucket",
+				EnablePut:    true,
+				EnableDelete: true,
+				Protect:      []string{"errors/*", "_redirects", ".well-known/*"},
+			},
+		},
+		{
+			desc: "browse - template in gcs",
+			input: `gcsproxy {
+				bucket mybucket
+				browse gs:templates/listing.html 1m
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:                "mybucket",
+				EnableBrowse:          true,
+				BrowseTemplate:        "gs:templates/listing.html",
+				BrowseTemplateRefresh: caddy.Duration(time.Minute),
+			},
+		},
+		{
+			desc: "browse_template",
+			input: `gcsproxy {
+				bucket mybucket
+				browse
+				browse_template gs:templates/releases.html /downloads/*
+				browse_template /etc/caddy/dense.html /logs/* /audit/*
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:       "mybucket",
+				EnableBrowse: true,
+				BrowseTemplates: []BrowseTemplateRule{
+					{Template: "gs:templates/releases.html", Paths: []string{"/downloads/*"}},
+					{Template: "/etc/caddy/dense.html", Paths: []string{"/logs/*", "/audit/*"}},
+				},
+			},
+		},
+		{
+			desc: "browse_template - missing paths",
+			input: `gcsproxy {
+				bucket mybucket
+				browse_template /etc/caddy/dense.html
+			}`,
+			shouldErr: true,
+			errString: "wrong argument count or unexpected line ending after '/etc/caddy/dense.html', at Testfile:3",
+		},
+		{
+			desc: "localize",
+			input: `gcsproxy {
+				bucket mybucket
+				browse
+				localize de {
+					browse gs:templates/listing.de.html
+					errors 404 errors/404.de.html
+					errors errors/error.de.html
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:       "mybucket",
+				EnableBrowse: true,
+				Localizations: []Localization{
+					{
+						Language:         "de",
+						BrowseTemplate:   "gs:templates/listing.de.html",
+						ErrorPages:       map[int]string{404: "errors/404.de.html"},
+						DefaultErrorPage: "errors/error.de.html",
+					},
+				},
+			},
+		},
+		{
+			desc: "browse_header_footer",
+			input: `gcsproxy {
+				bucket mybucket
+				browse
+				browse_header_footer
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:             "mybucket",
+				EnableBrowse:       true,
+				BrowseHeaderFooter: true,
+			},
+		},
+		{
+			desc: "release_pointer",
+			input: `gcsproxy {
+				bucket mybucket
+				release_pointer releases/CURRENT 2s
 			}`,
 			shouldErr: false,
 			obj: GcsProxy{
 				Bucket: "mybucket",
-				Hide:   []string{"foo.txt", "_*"},
+				ReleasePointer: &ReleasePointer{
+					Key: "releases/CURRENT",
+					TTL: caddy.Duration(2 * time.Second),
+				},
 			},
 		},
 		{
-			desc: "hide files - missing arg",
+			desc: "pin_generations",
 			input: `gcsproxy {
 				bucket mybucket
-				hide
+				pin_generations 30m {
+					cookie deploy_pin
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				PinGenerations: &PinGenerations{
+					Cookie: "deploy_pin",
+					MaxAge: caddy.Duration(30 * time.Minute),
+				},
+			},
+		},
+		{
+			desc: "resumable_uploads",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_put
+				resumable_uploads /var/lib/gcsproxy/uploads {
+					chunk_size 32MiB
+					chunk_retry_deadline 2m
+					max_age 48h
+					max_size 1GiB
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:    "mybucket",
+				EnablePut: true,
+				ResumableUploads: &ResumableUploads{
+					Dir:                "/var/lib/gcsproxy/uploads",
+					ChunkSize:          32 << 20,
+					ChunkRetryDeadline: caddy.Duration(2 * time.Minute),
+					MaxAge:             caddy.Duration(48 * time.Hour),
+					MaxSize:            1 << 30,
+				},
+			},
+		},
+		{
+			desc: "resumable_uploads invalid chunk_size",
+			input: `gcsproxy {
+				resumable_uploads {
+					chunk_size 100KB
+				}
 			}`,
 			shouldErr: true,
-			errString: "Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'hide'",
+			errString: "'100KB' is not a valid chunk size, it must be a multiple of 256KiB, at Testfile:3",
 		},
 		{
-			desc: "index test",
+			desc: "form_uploads",
 			input: `gcsproxy {
 				bucket mybucket
-				index i.htm i.html
+				enable_put
+				form_uploads {
+					field file
+					name_field name
+					max_files 3
+				}
 			}`,
 			shouldErr: false,
 			obj: GcsProxy{
-				Bucket:     "mybucket",
-				IndexNames: []string{"i.htm", "i.html"},
+				Bucket:    "mybucket",
+				EnablePut: true,
+				FormUploads: &FormUploads{
+					Field:     "file",
+					NameField: "name",
+					MaxFiles:  3,
+				},
 			},
 		},
 		{
-			desc: "index - missing arg",
+			desc: "bucket placeholder",
+			input: `gcsproxy {
+				bucket {http.request.host}
+				allowed_buckets *.example.com
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:         "{http.request.host}",
+				AllowedBuckets: []string{"*.example.com"},
+			},
+		},
+		{
+			desc: "bucket_map",
 			input: `gcsproxy {
 				bucket mybucket
-				index
+				bucket_map assets.example.com assets-bucket
+				bucket_map /media/ media-bucket
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				BucketMap: map[string]string{
+					"assets.example.com": "assets-bucket",
+					"/media/":            "media-bucket",
+				},
+			},
+		},
+		{
+			desc: "regions",
+			input: `gcsproxy {
+				bucket mybucket
+				regions {http.request.header.X-Client-Region} {
+					eu mybucket-eu
+					asia mybucket-asia
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Regions: &RegionRouting{
+					Region: "{http.request.header.X-Client-Region}",
+					Buckets: map[string]string{
+						"eu":   "mybucket-eu",
+						"asia": "mybucket-asia",
+					},
+				},
+			},
+		},
+		{
+			desc: "client_prefixes",
+			input: `gcsproxy {
+				bucket mybucket
+				client_prefixes {http.request.tls.client.san.dns_names.0} {
+					backup.internal backups/ write
+					* clients/{http.request.tls.client.san.dns_names.0}
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				ClientPrefixes: &ClientPrefixes{
+					Identity: "{http.request.tls.client.san.dns_names.0}",
+					Clients: map[string]ClientPrefix{
+						"backup.internal": {Prefix: "backups/", Write: true},
+						"*":               {Prefix: "clients/{http.request.tls.client.san.dns_names.0}"},
+					},
+				},
+			},
+		},
+		{
+			desc: "client_prefixes invalid permission",
+			input: `gcsproxy {
+				client_prefixes {
+					backup.internal backups/ admin
+				}
 			}`,
 			shouldErr: true,
-			errString: "Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'index'",
+			errString: "'admin' is not a valid client permission, at Testfile:3",
+		},
+		{
+			desc: "path_credentials",
+			input: `gcsproxy {
+				bucket mybucket
+				credentials_file /etc/gcs/reader.json
+				path_credentials /etc/gcs/writer.json /admin/* /uploads/*
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:          "mybucket",
+				CredentialsFile: "/etc/gcs/reader.json",
+				PathCredentials: []PathCredentials{
+					{CredentialsFile: "/etc/gcs/writer.json", Paths: []string{"/admin/*", "/uploads/*"}},
+				},
+			},
+		},
+		{
+			desc: "scopes and quota_project",
+			input: `gcsproxy {
+				bucket mybucket
+				scopes read_only
+				quota_project billing-project
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:       "mybucket",
+				Scopes:       []string{"read_only"},
+				QuotaProject: "billing-project",
+			},
+		},
+		{
+			desc: "scopes unknown",
+			input: `gcsproxy {
+				bucket mybucket
+				scopes read_mostly
+			}`,
+			shouldErr: true,
+			errString: `unknown OAuth scope "read_mostly", expected read_only, read_write, full_control or a scope URL, at Testfile:3`,
+		},
+		{
+			desc: "audit_log",
+			input: `gcsproxy {
+				bucket mybucket
+				audit_log mylogs proxy/ {
+					flush_interval 30s
+					max_events 500
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				AuditLog: &AuditLog{
+					Bucket:        "mylogs",
+					Prefix:        "proxy/",
+					FlushInterval: caddy.Duration(30 * time.Second),
+					MaxEvents:     500,
+				},
+			},
+		},
+		{
+			desc: "browse_dir_usage",
+			input: `gcsproxy {
+				bucket mybucket
+				browse
+				browse_dir_usage {
+					max_objects 5000
+					max_dirs 20
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:       "mybucket",
+				EnableBrowse: true,
+				BrowseDirUsage: &BrowseDirUsage{
+					MaxObjects: 5000,
+					MaxDirs:    20,
+				},
+			},
+		},
+		{
+			desc: "robots",
+			input: `gcsproxy {
+				bucket mybucket
+				robots {
+					txt /private/
+					sitemap https://example.com/sitemap.xml
+					noindex /drafts/*
+					noindex_browse
+				}
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket: "mybucket",
+				Robots: &Robots{
+					Txt:           true,
+					Disallow:      []string{"/private/"},
+					Sitemap:       "https://example.com/sitemap.xml",
+					NoIndex:       []string{"/drafts/*"},
+					NoIndexBrowse: true,
+				},
+			},
+		},
+		{
+			desc: "method override",
+			input: `gcsproxy {
+				bucket mybucket
+				enable_delete
+				method_override
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:         "mybucket",
+				EnableDelete:   true,
+				MethodOverride: true,
+			},
+		},
+		{
+			desc: "read only",
+			input: `gcsproxy {
+				bucket mybucket
+				read_only
+			}`,
+			shouldErr: false,
+			obj: GcsProxy{
+				Bucket:  "mybucket",
+				Methods: []string{"GET", "HEAD"},
+			},
 		},
 	}
 
@@ -205,3 +1752,24 @@ func TestParseCaddyfile(t *testing.T) {
 		}
 	}
 }
+
+func TestParseCaddyfileEnvPlaceholders(t *testing.T) {
+	t.Setenv("GCSPROXY_TEST_PROJECT", "my-project")
+	t.Setenv("GCSPROXY_TEST_QUOTA_PROJECT", "billing-project")
+
+	d := caddyfile.NewTestDispenser(`gcsproxy {
+		bucket mybucket
+		quota_project {env.GCSPROXY_TEST_QUOTA_PROJECT}
+		project_id {env.GCSPROXY_TEST_PROJECT}
+	}`)
+	prox, err := parseCaddyfileWithDispenser(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prox.ProjectID != "my-project" {
+		t.Errorf("got project_id %q, want my-project", prox.ProjectID)
+	}
+	if prox.QuotaProject != "billing-project" {
+		t.Errorf("got quota_project %q, want billing-project", prox.QuotaProject)
+	}
+}
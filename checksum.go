@@ -0,0 +1,100 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errChecksumMismatch is returned by the body reader when an upload doesn't
+// match the checksum the client sent in a trailer.
+var errChecksumMismatch = errors.New("upload does not match its checksum")
+
+// checksumTrailers are the trailers a client may send an upload's checksum
+// in, in the formats of the headers of the same name.
+var checksumTrailers = []string{"X-Goog-Hash", "Content-MD5"}
+
+// checksumReader hashes an upload as it streams through and, once the body
+// has been read in full, checks it against the checksum trailers the client
+// sent. A mismatch is returned instead of io.EOF, so the write to GCS is
+// aborted rather than finalized.
+type checksumReader struct {
+	r       io.Reader
+	trailer http.Header
+	md5     hash.Hash
+	crc32c  hash.Hash32
+}
+
+// newChecksumReader returns a reader validating the body of r against its
+// checksum trailers, or r.Body if the client declared none.
+func newChecksumReader(r *http.Request) io.Reader {
+	for _, name := range checksumTrailers {
+		if _, ok := r.Trailer[http.CanonicalHeaderKey(name)]; ok {
+			return &checksumReader{
+				r:       r.Body,
+				trailer: r.Trailer,
+				md5:     md5.New(),
+				crc32c:  crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+			}
+		}
+	}
+	return r.Body
+}
+
+func (c *checksumReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.md5.Write(b[:n])
+	c.crc32c.Write(b[:n])
+	if err == io.EOF {
+		// Trailers are only available once the body has been read
+		if verr := c.verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// verify compares the hashes with every checksum trailer sent.
+func (c *checksumReader) verify() error {
+	sums := make(map[string]string)
+	if value := c.trailer.Get("Content-MD5"); value != "" {
+		sums["md5"] = value
+	}
+	for _, value := range c.trailer.Values("X-Goog-Hash") {
+		for part := range strings.SplitSeq(value, ",") {
+			name, sum, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok {
+				return fmt.Errorf("%w: invalid X-Goog-Hash %q", errChecksumMismatch, value)
+			}
+			sums[strings.ToLower(name)] = sum
+		}
+	}
+
+	for name, sum := range sums {
+		expected, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s checksum %q", errChecksumMismatch, name, sum)
+		}
+		var actual []byte
+		switch name {
+		case "md5":
+			actual = c.md5.Sum(nil)
+		case "crc32c":
+			actual = binary.BigEndian.AppendUint32(nil, c.crc32c.Sum32())
+		default:
+			continue
+		}
+		if !bytes.Equal(expected, actual) {
+			return fmt.Errorf("%w: %s is %s, trailer says %s", errChecksumMismatch, name, base64.StdEncoding.EncodeToString(actual), sum)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package caddygcsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+const defaultClientIdentity = "{http.request.tls.client.subject}"
+
+// ClientPrefixes gives each client authenticated with a TLS client
+// certificate its own prefix under the root, so machine clients sharing a
+// bucket can't read or write each other's objects. Requests without a known
+// identity are rejected.
+type ClientPrefixes struct {
+	// Placeholder resolving to the client's identity, e.g.
+	// `{http.request.tls.client.san.dns_names.0}`. Default is
+	// `{http.request.tls.client.subject}`.
+	Identity string `json:"identity,omitempty"`
+
+	// Prefix and permissions of each identity. The identity `*` matches any
+	// client with an identity not listed.
+	Clients map[string]ClientPrefix `json:"clients,omitempty"`
+}
+
+// ClientPrefix is the part of the bucket a client may access.
+type ClientPrefix struct {
+	// Prefix joined with the root. May contain placeholders, such as the
+	// identity placeholder itself for a `*` entry.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Flag to allow methods other than GET and HEAD (default false).
+	Write bool `json:"write,omitempty"`
+}
+
+var errUnknownClient = errors.New("unknown client identity")
+
+// requestRoot returns the root the keys of the request are made under: Root
+// joined with the prefix of the request's client if ClientPrefixes is set.
+// Handlers resolving a second key, like a compose source or a move
+// destination, use it so the key stays within the client's prefix.
+func (p GcsProxy) requestRoot(r *http.Request, repl *caddy.Replacer) (string, error) {
+	root, err := p.resolveRoot(repl)
+	if err != nil || p.ClientPrefixes == nil {
+		return root, err
+	}
+	return p.clientRoot(r, repl, root)
+}
+
+// clientRoot returns root joined with the prefix of the request's client.
+func (p GcsProxy) clientRoot(r *http.Request, repl *caddy.Replacer, root string) (string, error) {
+	identity := repl.ReplaceAll(p.ClientPrefixes.Identity, "")
+	if identity == "" {
+		return "", errUnknownClient
+	}
+	client, ok := p.ClientPrefixes.Clients[identity]
+	if !ok {
+		if client, ok = p.ClientPrefixes.Clients["*"]; !ok {
+			return "", fmt.Errorf("%w %q", errUnknownClient, identity)
+		}
+	}
+	if !client.Write && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", fmt.Errorf("client %q may not %s", identity, r.Method)
+	}
+
+	prefix, err := p.resolveKeyTemplate(repl, client.Prefix)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(root, prefix), nil
+}
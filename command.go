@@ -0,0 +1,415 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "gcs-proxy",
+		Usage: "<command>",
+		Short: "Commands for working with the gcs proxy and its buckets",
+		CobraFunc: func(cmd *cobra.Command) {
+			syncCmd := &cobra.Command{
+				Use:   "sync [--credentials <file>] [--concurrency <n>] [--delete] [--dry-run] <localdir> <bucket>[/<prefix>]",
+				Short: "Uploads the changed files of a directory to a bucket",
+				Long: `
+Uploads the files of a local directory, such as a built static site, to a
+bucket, optionally under a key prefix. Only files whose content differs from
+the object at their key, compared by MD5 hash, are uploaded.
+
+--credentials is a service account key file, the application default
+credentials are used if it is omitted.
+
+--concurrency is the number of files uploaded at the same time.
+
+--delete removes objects under the prefix that have no local file.
+
+--dry-run prints what would be changed without changing anything.
+`,
+				Args: cobra.ExactArgs(2),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdSync),
+			}
+			syncCmd.Flags().String("credentials", "", "Service account key file")
+			syncCmd.Flags().Int("concurrency", 8, "Number of concurrent uploads")
+			syncCmd.Flags().Bool("delete", false, "Delete objects without a local file")
+			syncCmd.Flags().Bool("dry-run", false, "Only print the changes")
+			cmd.AddCommand(syncCmd)
+
+			checkCmd := &cobra.Command{
+				Use:   "check [--config <path> [--adapter <name>]]",
+				Short: "Verifies the gcs proxy handlers of a config before deployment",
+				Long: `
+Loads a config and, for every gcsproxy handler in it, creates its GCS client
+and verifies the credentials, that the bucket can be read, that the error page
+keys exist and that the browse template parses. Each problem is reported and
+the command exits with a non-zero status if there are any.
+
+--config and --adapter work as for 'caddy run'.
+`,
+				Args: cobra.NoArgs,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdCheck),
+			}
+			checkCmd.Flags().StringP("config", "c", "", "Configuration file")
+			checkCmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			cmd.AddCommand(checkCmd)
+
+			purgeCmd := &cobra.Command{
+				Use:   "purge [--address <interface>] [--config <path> [--adapter <name>]] [--bucket <bucket>] [--prefix] <key>",
+				Short: "Purges a key or prefix from the caches of a running instance",
+				Long: `
+Drops an object key, or with --prefix every key starting with it, from the
+caches of the gcs proxy handlers of a running instance, through its admin API.
+A key ending in / is always treated as a prefix.
+
+--bucket only purges the caches of handlers for that bucket.
+
+--address, --config and --adapter locate the admin API as for 'caddy reload'.
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdPurge),
+			}
+			purgeCmd.Flags().String("address", "", "The address to use to reach the admin API endpoint, if not the default")
+			purgeCmd.Flags().StringP("config", "c", "", "Configuration file to use to parse the admin address, if --address is not used")
+			purgeCmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply (when --config is used)")
+			purgeCmd.Flags().String("bucket", "", "Only purge handlers for this bucket")
+			purgeCmd.Flags().Bool("prefix", false, "Purge every key starting with the argument")
+			cmd.AddCommand(purgeCmd)
+		},
+	})
+}
+
+// newCommandClient creates a storage client for a command.
+func newCommandClient(ctx context.Context, credentials string) (*storage.Client, error) {
+	var opts []option.ClientOption
+	if credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(credentials))
+	}
+	return storage.NewClient(ctx, opts...)
+}
+
+func cmdSync(fl caddycmd.Flags) (int, error) {
+	dir := fl.Arg(0)
+	bucket, prefix, _ := strings.Cut(fl.Arg(1), "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	concurrency := fl.Int("concurrency")
+	if concurrency <= 0 {
+		return caddy.ExitCodeFailedStartup, errors.New("concurrency must be positive")
+	}
+	dryRun := fl.Bool("dry-run")
+
+	ctx := context.Background()
+	client, err := newCommandClient(ctx, fl.String("credentials"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("creating GCS client: %v", err)
+	}
+	defer client.Close()
+	bkt := client.Bucket(bucket)
+
+	remote, err := listMD5s(ctx, bkt, prefix)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("listing gs://%s/%s: %v", bucket, prefix, err)
+	}
+
+	var uploaded, unchanged, deleted atomic.Int64
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(concurrency)
+	err = filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.ToSlash(rel)
+		remoteMD5, exists := remote[key]
+		delete(remote, key)
+
+		group.Go(func() error {
+			sum, err := fileMD5(name)
+			if err != nil {
+				return err
+			}
+			if exists && remoteMD5 == sum {
+				unchanged.Add(1)
+				return nil
+			}
+			fmt.Printf("upload %s -> gs://%s/%s\n", name, bucket, key)
+			uploaded.Add(1)
+			if dryRun {
+				return nil
+			}
+			return uploadFile(groupCtx, bkt.Object(key), name)
+		})
+		return nil
+	})
+	if waitErr := group.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if fl.Bool("delete") {
+		group, groupCtx = errgroup.WithContext(ctx)
+		group.SetLimit(concurrency)
+		for key := range remote {
+			fmt.Printf("delete gs://%s/%s\n", bucket, key)
+			deleted.Add(1)
+			if dryRun {
+				continue
+			}
+			group.Go(func() error {
+				return bkt.Object(key).Delete(groupCtx)
+			})
+		}
+		if err := group.Wait(); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+
+	fmt.Printf("%d uploaded, %d unchanged, %d deleted\n", uploaded.Load(), unchanged.Load(), deleted.Load())
+	return caddy.ExitCodeSuccess, nil
+}
+
+// listMD5s returns the MD5 hash of every object under prefix by key. Composite
+// objects have no MD5 and so are always uploaded again.
+func listMD5s(ctx context.Context, bkt *storage.BucketHandle, prefix string) (map[string]string, error) {
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "MD5"}); err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	it := bkt.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sums[attrs.Name] = string(attrs.MD5)
+	}
+}
+
+func fileMD5(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return string(hash.Sum(nil)), nil
+}
+
+func uploadFile(ctx context.Context, obj *storage.ObjectHandle, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := obj.NewWriter(ctx)
+	writer.ContentType = mime.TypeByExtension(filepath.Ext(name))
+	if _, err := io.Copy(writer, file); err != nil {
+		cancel()
+		return fmt.Errorf("uploading %s: %v", name, err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("uploading %s: %v", name, err)
+	}
+	return nil
+}
+
+func cmdCheck(fl caddycmd.Flags) (int, error) {
+	config, configFile, err := caddycmd.LoadConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if config == nil {
+		return caddy.ExitCodeFailedStartup, errors.New("no config file to check")
+	}
+
+	var doc any
+	if err := json.Unmarshal(config, &doc); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding config: %v", err)
+	}
+	handlers, err := findGcsProxies(doc)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if len(handlers) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no gcsproxy handlers in %s", configFile)
+	}
+
+	ctx := context.Background()
+	failures := 0
+	for _, p := range handlers {
+		fmt.Printf("bucket %s:\n", p.Bucket)
+		problems := p.check(ctx)
+		for _, problem := range problems {
+			fmt.Printf("  FAIL %s\n", problem)
+		}
+		if len(problems) == 0 {
+			fmt.Println("  ok")
+		}
+		failures += len(problems)
+	}
+
+	if failures > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d problems found", failures)
+	}
+	fmt.Println("all checks passed")
+	return caddy.ExitCodeSuccess, nil
+}
+
+// findGcsProxies returns every gcsproxy handler in a decoded JSON config.
+func findGcsProxies(doc any) ([]GcsProxy, error) {
+	var handlers []GcsProxy
+	switch v := doc.(type) {
+	case map[string]any:
+		if v["handler"] == "gcsproxy" {
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			var p GcsProxy
+			if err := json.Unmarshal(raw, &p); err != nil {
+				return nil, fmt.Errorf("decoding gcsproxy handler: %v", err)
+			}
+			return []GcsProxy{p}, nil
+		}
+		for _, child := range v {
+			found, err := findGcsProxies(child)
+			if err != nil {
+				return nil, err
+			}
+			handlers = append(handlers, found...)
+		}
+	case []any:
+		for _, child := range v {
+			found, err := findGcsProxies(child)
+			if err != nil {
+				return nil, err
+			}
+			handlers = append(handlers, found...)
+		}
+	}
+	return handlers, nil
+}
+
+// check verifies what the handler needs at runtime and returns the problems
+// found.
+func (p GcsProxy) check(ctx context.Context) []string {
+	var problems []string
+	if p.Bucket == "" {
+		return []string{"no bucket configured"}
+	}
+
+	client, err := newCommandClient(ctx, p.CredentialsFile)
+	if err != nil {
+		return append(problems, fmt.Sprintf("could not create GCS client, check the credentials: %v", err))
+	}
+	defer client.Close()
+
+	templates := []string{p.BrowseTemplate}
+	for _, rule := range p.BrowseTemplates {
+		templates = append(templates, rule.Template)
+	}
+	for _, loc := range p.Localizations {
+		templates = append(templates, loc.BrowseTemplate)
+	}
+	for _, location := range templates {
+		if location == "" {
+			continue
+		}
+		if _, err := readBrowseTemplate(ctx, client, location, p.Bucket); err != nil {
+			problems = append(problems, fmt.Sprintf("browse template %s does not parse: %v", location, err))
+		}
+	}
+	bkt := client.Bucket(p.Bucket)
+
+	// Listing needs only object read permissions, unlike reading the bucket's
+	// attributes
+	var prefix string
+	if root, ok := p.staticRoot(); ok {
+		prefix = strings.TrimPrefix(root, "/")
+	}
+	if _, err := bkt.Objects(ctx, &storage.Query{Prefix: prefix}).Next(); err != nil && err != iterator.Done {
+		return append(problems, fmt.Sprintf("could not read bucket %s, check it exists and the credentials can list it: %v", p.Bucket, err))
+	}
+
+	for _, page := range p.errorPageKeys() {
+		if strings.ToLower(page) == "pass_through" {
+			continue
+		}
+		if _, err := bkt.Object(page).Attrs(ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("error page %s: %v", page, err))
+		}
+	}
+	return problems
+}
+
+func cmdPurge(fl caddycmd.Flags) (int, error) {
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(fl.String("address"), nil, fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("couldn't determine admin API address: %v", err)
+	}
+
+	req := purgeRequest{Bucket: fl.String("bucket")}
+	if key := fl.Arg(0); fl.Bool("prefix") || strings.HasSuffix(key, "/") {
+		req.Prefix = key
+	} else {
+		req.Key = key
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	headers := http.Header{"Content-Type": []string{"application/json"}}
+	resp, err := caddycmd.AdminAPIRequest(adminAddr, http.MethodPost, "/gcs-proxy/purge", headers, bytes.NewReader(body))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Purged int `json:"purged"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding response: %v", err)
+	}
+	fmt.Printf("%d cached objects purged\n", result.Purged)
+	return caddy.ExitCodeSuccess, nil
+}
@@ -0,0 +1,116 @@
+package caddygcsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// maxComposeSources is the most source objects GCS composes in one call.
+const maxComposeSources = 32
+
+// composeRequest is the body of a `POST <path>?compose` request.
+type composeRequest struct {
+	// Request paths of the source objects, in order.
+	Sources []string `json:"sources"`
+
+	// Content-Type of the composed object.
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// ComposeHandler concatenates the source objects listed in the request body
+// into the object at key, server side.
+func (p GcsProxy) ComposeHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	var req composeRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid compose request: %v", err))
+	}
+	if len(req.Sources) == 0 || len(req.Sources) > maxComposeSources {
+		err := fmt.Errorf("compose needs between 1 and %d sources, got %d", maxComposeSources, len(req.Sources))
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	root, err := p.requestRoot(r, repl)
+	if err != nil {
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opPut)
+	defer cancelOp()
+
+	sources := make([]*storage.ObjectHandle, 0, len(req.Sources))
+	var sourcesSize int64
+	for _, src := range req.Sources {
+		if src == "" || src[len(src)-1] == '/' {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid compose source: %q", src))
+		}
+		srcPath := cleanPath(src)
+		srcKey := p.keyFor(root, srcPath)
+		// The request's credentials only cover the destination
+		if fileHidden(srcKey, p.Hide) || p.requiresSignedAccess(srcPath) {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("compose source not allowed: %s", src))
+		}
+		if err := p.checkProtected(r, srcKey); err != nil {
+			return err
+		}
+		obj := p.objectFor(opGet, srcKey)
+		if p.quotas != nil {
+			attrs, err := obj.Attrs(ctx)
+			if err != nil {
+				return convertToCaddyError(err)
+			}
+			sourcesSize += attrs.Size
+		}
+		sources = append(sources, obj)
+	}
+	replaced := int64(-1)
+	if p.quotas != nil {
+		qw, err := p.checkQuotas(ctx, w, r, key, sourcesSize)
+		if err != nil {
+			return err
+		}
+		defer qw.release()
+		replaced = qw.replaced
+	}
+
+	composer := p.objectFor(opPut, key).ComposerFrom(sources...)
+	composer.ContentType = req.ContentType
+	attrs, err := composer.Run(ctx)
+	if err != nil {
+		p.log.Error("failed to compose object",
+			zap.String("bucket", p.Bucket),
+			zap.String("key", key),
+			zap.String("err", err.Error()),
+		)
+		return convertToCaddyError(err)
+	}
+
+	if p.quotas != nil {
+		p.recordQuotaWrite(r, key, attrs.Size, replaced)
+	}
+	if p.cache != nil {
+		p.cache.delete(key)
+	}
+	p.notify(p.newMutationEvent(r, key, attrs))
+
+	if etag := p.etag(r.URL.Path, attrs.Generation); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(newObjectMeta(attrs))
+}
+
+// requiresSignedAccess returns true if reqPath needs a signed URL or cookie.
+func (p GcsProxy) requiresSignedAccess(reqPath string) bool {
+	return p.SignedURLs != nil && p.SignedURLs.requiresSignature(reqPath) ||
+		p.SignedCookie != nil && p.SignedCookie.protects(reqPath)
+}
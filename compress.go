@@ -0,0 +1,139 @@
+package caddygcsproxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
+	"github.com/klauspost/compress/zstd"
+)
+
+const defaultCompressMinLength = 512
+
+// compressEncodings are the encodings objects can be compressed with on the
+// fly, in the default order of preference.
+var compressEncodings = []string{"zstd", "gzip"}
+
+// defaultCompressTypes are the content types compressed if Compress doesn't
+// list any.
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/ld+json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xhtml+xml",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// Compress configures compressing object bodies on the fly for clients that
+// accept it. Objects stored with a Content-Encoding, such as precompressed
+// sidecars, and responses with `Cache-Control: no-transform` are served as
+// they are.
+type Compress struct {
+	// Encodings to compress with, in order of preference: `zstd` and/or
+	// `gzip`. Default is both, zstd first.
+	Encodings []string `json:"encodings,omitempty"`
+
+	// Content types to compress, e.g. `application/json`, or `text/*` for
+	// every type under text. Default is text, JSON, JavaScript, XML, SVG and
+	// WebAssembly.
+	Types []string `json:"types,omitempty"`
+
+	// Smallest object size in bytes worth compressing. Default is 512.
+	MinLength int64 `json:"min_length,omitempty"`
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+var zstdWriterPool = sync.Pool{
+	New: func() any {
+		// Streams are compressed one at a time per writer, and with zero
+		// frames an empty object still gets a valid body
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithZeroFrames(true))
+		return w
+	},
+}
+
+// compressible returns true if objects of contentType are compressed.
+func (c *Compress) compressible(contentType string) bool {
+	// ParseMediaType lowercases the type
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.Types {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible returns true if the response for attrs is compressed for
+// clients accepting one of the encodings, so it varies by Accept-Encoding.
+func (p GcsProxy) compressible(attrs *storage.ObjectAttrs) bool {
+	return p.Compress != nil &&
+		attrs.ContentEncoding == "" &&
+		attrs.Size >= p.Compress.MinLength &&
+		!strings.Contains(strings.ToLower(attrs.CacheControl), "no-transform") &&
+		p.Compress.compressible(p.contentType(attrs))
+}
+
+// compressEncoding returns the encoding to compress the response for attrs
+// with, or an empty string to serve it as stored. Range requests are served
+// as stored, since ranges are of the stored bytes, and so is the whole body
+// sent when If-Range doesn't match.
+func (p GcsProxy) compressEncoding(r *http.Request, attrs *storage.ObjectAttrs) string {
+	if !p.compressible(attrs) || r.Header.Get("Range") != "" {
+		return ""
+	}
+	for _, encoding := range encode.AcceptedEncodings(r, p.Compress.Encodings) {
+		if slices.Contains(p.Compress.Encodings, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressTo copies reader to w compressed with encoding.
+func compressTo(w io.Writer, reader io.Reader, encoding string) error {
+	var enc io.WriteCloser
+	switch encoding {
+	case "gzip":
+		gz := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(gz)
+		gz.Reset(w)
+		enc = gz
+	case "zstd":
+		zw := zstdWriterPool.Get().(*zstd.Encoder)
+		defer zstdWriterPool.Put(zw)
+		zw.Reset(w)
+		enc = zw
+	default:
+		_, err := io.Copy(w, reader)
+		return err
+	}
+
+	if _, err := io.Copy(enc, reader); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
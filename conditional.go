@@ -0,0 +1,61 @@
+package caddygcsproxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// checkPreconditions evaluates the conditional headers of a GET or HEAD
+// request against the object in the order RFC 9110 section 13.2.2 sets. It
+// returns a 412 error if a precondition fails, or a 304 error after writing
+// the object's headers if the client's copy is still current.
+func (p GcsProxy) checkPreconditions(w http.ResponseWriter, r *http.Request, attrs *storage.ObjectAttrs) error {
+	etag := p.etag(r.URL.Path, attrs.Generation)
+	modified := attrs.Updated.Truncate(time.Second)
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !strongETagMatches(ifMatch, etag) {
+			return caddyhttp.Error(http.StatusPreconditionFailed, errors.New("If-Match precondition failed"))
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && !attrs.Updated.IsZero() {
+		if modified.After(since) {
+			return caddyhttp.Error(http.StatusPreconditionFailed, errors.New("If-Unmodified-Since precondition failed"))
+		}
+	}
+
+	notModified := false
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		notModified = etagMatches(ifNoneMatch, etag) && (etag != "" || strings.TrimSpace(ifNoneMatch) == "*")
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !attrs.Updated.IsZero() {
+		notModified = !modified.After(since)
+	}
+	if !notModified {
+		return nil
+	}
+
+	if err := p.writeResponseFromGetObject(w, r, nil, attrs); err != nil {
+		return err
+	}
+	return caddyhttp.Error(http.StatusNotModified, nil)
+}
+
+// strongETagMatches reports whether an If-Match header value matches etag,
+// using the strong comparison RFC 9110 requires for If-Match. Weak ETags
+// never match.
+func strongETagMatches(ifMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if etag != "" && !strings.HasPrefix(etag, "W/") && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
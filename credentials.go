@@ -0,0 +1,268 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+)
+
+const (
+	credentialsPollInterval = 10 * time.Second
+
+	// How long a replaced client is kept open for requests still using it.
+	retiredClientGrace = time.Minute
+
+	// Most bucket handles kept per client, for buckets chosen per request.
+	maxBucketHandles = 1024
+)
+
+// clientHolder holds the storage client so it can be swapped when the
+// credentials file changes.
+type clientHolder struct {
+	current atomic.Pointer[storage.Client]
+
+	mu sync.Mutex
+	// Bucket handles made on handlesOf, by bucket name
+	handles   map[string]*storage.BucketHandle
+	handlesOf *storage.Client
+	// Replaced clients not closed yet
+	retired []*storage.Client
+}
+
+func (h *clientHolder) client() *storage.Client {
+	return h.current.Load()
+}
+
+// swap makes client the current one. The replaced client is closed after
+// retiredClientGrace, or by close if that comes first.
+func (h *clientHolder) swap(client *storage.Client) {
+	old := h.current.Swap(client)
+	h.mu.Lock()
+	h.retired = append(h.retired, old)
+	h.mu.Unlock()
+	time.AfterFunc(retiredClientGrace, func() { h.closeRetired(old) })
+}
+
+// closeRetired closes a replaced client unless close already has.
+func (h *clientHolder) closeRetired(client *storage.Client) {
+	h.mu.Lock()
+	i := slices.Index(h.retired, client)
+	if i >= 0 {
+		h.retired = slices.Delete(h.retired, i, i+1)
+	}
+	h.mu.Unlock()
+	if i >= 0 {
+		client.Close()
+	}
+}
+
+// close closes the current client and the replaced ones still open.
+func (h *clientHolder) close() error {
+	h.mu.Lock()
+	retired := h.retired
+	h.retired = nil
+	h.mu.Unlock()
+	for _, client := range retired {
+		client.Close()
+	}
+	return h.client().Close()
+}
+
+// bucket returns a handle to the named bucket on the current client, reusing
+// the one made for an earlier request.
+func (h *clientHolder) bucket(name string) *storage.BucketHandle {
+	client := h.client()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.handlesOf != client || len(h.handles) >= maxBucketHandles {
+		h.handles = make(map[string]*storage.BucketHandle)
+		h.handlesOf = client
+	}
+	handle, ok := h.handles[name]
+	if !ok {
+		handle = client.Bucket(name)
+		h.handles[name] = handle
+	}
+	return handle
+}
+
+// PathCredentials binds a service account key file to the requests whose
+// path matches one of Paths, e.g. a read-only account for `/public/*` and a
+// read-write one for `/admin/*`.
+type PathCredentials struct {
+	// Service account key file. It is checked for changes like
+	// CredentialsFile.
+	CredentialsFile string `json:"credentials_file,omitempty"`
+
+	// Path patterns the credentials are used for. The first rule with a
+	// matching pattern wins.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// newPathClient creates the client holder for a path credentials file and
+// watches the file until ctx is done.
+func (p GcsProxy) newPathClient(ctx context.Context, credentialsFile string) (*clientHolder, error) {
+	p.CredentialsFile = credentialsFile
+	client, err := p.newStorageClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	p.gcs = &clientHolder{}
+	p.gcs.current.Store(client)
+	go p.watchCredentials(ctx)
+	return p.gcs, nil
+}
+
+// clientFor returns the client holder for the credentials bound to reqPath.
+func (p GcsProxy) clientFor(reqPath string) *clientHolder {
+	for i, rule := range p.PathCredentials {
+		if pathMatches(rule.Paths, reqPath) {
+			return p.pathClients[i]
+		}
+	}
+	return p.gcs
+}
+
+// bucketHandle returns a handle to the configured bucket on the current client.
+func (p GcsProxy) bucketHandle() *storage.BucketHandle {
+	return p.gcs.bucket(p.Bucket)
+}
+
+// oauthScopes maps the short scope names accepted in the config to scopes.
+var oauthScopes = map[string]string{
+	"read_only":    storage.ScopeReadOnly,
+	"read_write":   storage.ScopeReadWrite,
+	"full_control": storage.ScopeFullControl,
+}
+
+// oauthScope returns the scope for a configured scope name or URL.
+func oauthScope(name string) (string, error) {
+	if scope, ok := oauthScopes[name]; ok {
+		return scope, nil
+	}
+	if !strings.HasPrefix(name, "https://") {
+		return "", fmt.Errorf("unknown OAuth scope %q, expected read_only, read_write, full_control or a scope URL", name)
+	}
+	return name, nil
+}
+
+// clientOptions returns the options shared by every Google API client: the
+// credentials and quota project.
+func (p GcsProxy) clientOptions() []option.ClientOption {
+	var opts []option.ClientOption
+	if p.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(p.CredentialsFile))
+	}
+	if p.QuotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(p.QuotaProject))
+	}
+	return opts
+}
+
+// storageOptions returns the options of the storage clients, which also get
+// the configured scopes. Scopes were validated at provision.
+func (p GcsProxy) storageOptions() []option.ClientOption {
+	opts := p.clientOptions()
+	if len(p.Scopes) > 0 {
+		scopes := make([]string, len(p.Scopes))
+		for i, name := range p.Scopes {
+			scopes[i], _ = oauthScope(name)
+		}
+		opts = append(opts, option.WithScopes(scopes...))
+	}
+	return opts
+}
+
+// newStorageClient creates a storage client with the configured credentials.
+func (p GcsProxy) newStorageClient(ctx context.Context) (*storage.Client, error) {
+	return storage.NewClient(ctx, p.storageOptions()...)
+}
+
+// credentialsHash returns a hash of the credentials file's content.
+func credentialsHash(name string) ([]byte, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	return sum[:], nil
+}
+
+// watchCredentials watches the credentials file until ctx is done and swaps
+// in a new storage client whenever its content changes.
+//
+// The directory holding the file is watched rather than the file: secrets
+// mounted by Kubernetes are replaced by swapping a symlink to a new
+// directory, which a watch on the file never sees. Hashing the content skips
+// events that leave the key as it was. Network and FUSE mounts don't deliver
+// events at all, so the file is also polled every credentialsPollInterval.
+func (p GcsProxy) watchCredentials(ctx context.Context) {
+	hash, err := credentialsHash(p.CredentialsFile)
+	if err != nil {
+		p.log.Warn("could not read credentials file", zap.String("file", p.CredentialsFile), zap.String("err", err.Error()))
+	}
+
+	var events chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		err = watcher.Add(filepath.Dir(p.CredentialsFile))
+	}
+	if err != nil {
+		p.log.Warn("could not watch credentials file, polling it only",
+			zap.String("file", p.CredentialsFile),
+			zap.String("err", err.Error()),
+		)
+	} else {
+		events = watcher.Events
+	}
+
+	ticker := time.NewTicker(credentialsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+
+		newHash, err := credentialsHash(p.CredentialsFile)
+		if err != nil || bytes.Equal(hash, newHash) {
+			continue
+		}
+
+		// The client is created with a background context as it outlives ctx
+		client, err := p.newStorageClient(context.Background())
+		if err != nil {
+			// Keep the old client, the file may be mid-write
+			p.log.Error("could not create GCS client from rotated credentials",
+				zap.String("file", p.CredentialsFile),
+				zap.String("err", err.Error()),
+			)
+			continue
+		}
+		if ctx.Err() != nil {
+			// Cleanup may already have closed the current client
+			client.Close()
+			return
+		}
+		hash = newHash
+
+		p.gcs.swap(client)
+		p.log.Info("rotated GCS client after credentials file change", zap.String("file", p.CredentialsFile))
+	}
+}
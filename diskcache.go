@@ -0,0 +1,477 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDiskCacheMaxSize       = 10 << 30
+	defaultDiskCacheMaxObjectSize = 256 << 20
+
+	diskCacheIndexName     = "index.json"
+	diskCacheIndexInterval = 30 * time.Second
+
+	// Version of the index format. Indexes of another version are dropped
+	// along with the bodies they refer to.
+	diskCacheIndexVersion = 1
+)
+
+// diskCachePool shares one disk cache per directory between the caches of
+// every handler and mapped bucket using it, so they don't overwrite each
+// other's index or sweep each other's bodies. The sizes of the first one to
+// open the directory apply.
+var diskCachePool = caddy.NewUsagePool()
+
+// loadDiskCache takes a reference to the disk cache in dir, opening it if
+// this is the first cache to use it.
+func loadDiskCache(dir string, maxSize int64, maxObjectSize int64, log *zap.Logger) (*diskCache, error) {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	val, _, err := diskCachePool.LoadOrNew(dir, func() (caddy.Destructor, error) {
+		return openDiskCache(dir, maxSize, maxObjectSize, log)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*diskCache), nil
+}
+
+// diskEntry is an object body kept in the disk cache, as persisted in its
+// index.
+type diskEntry struct {
+	// The bucket and object key, as `<bucket>/<key>`
+	Key        string    `json:"key"`
+	Generation int64     `json:"generation"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+
+	// The attrs needed to serve the object, so it can be served while
+	// offline right after a restart.
+	Attrs *storage.ObjectAttrs `json:"attrs"`
+
+	// When the generation was last checked against GCS. Entries loaded from
+	// the index haven't been checked yet.
+	validated time.Time
+}
+
+// diskCacheIndex is the document the index is persisted as.
+type diskCacheIndex struct {
+	Version int          `json:"version"`
+	Entries []*diskEntry `json:"entries"`
+}
+
+// diskCache is a second cache tier on local disk, for objects too large or
+// too many for memory. Its index is persisted so cached objects survive a
+// restart; entries are validated against GCS on their first hit.
+type diskCache struct {
+	dir           string
+	maxSize       int64
+	maxObjectSize int64
+	log           *zap.Logger
+	stop          chan struct{}
+	done          chan struct{}
+
+	mu      sync.Mutex
+	entries map[string]*diskEntry
+	size    int64
+	dirty   bool
+}
+
+// openDiskCache loads the cache in dir, dropping index entries whose body is
+// missing and bodies no entry refers to, and starts persisting the index.
+func openDiskCache(dir string, maxSize int64, maxObjectSize int64, log *zap.Logger) (*diskCache, error) {
+	if maxSize <= 0 {
+		maxSize = defaultDiskCacheMaxSize
+	}
+	if maxObjectSize <= 0 {
+		maxObjectSize = defaultDiskCacheMaxObjectSize
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	d := &diskCache{
+		dir:           dir,
+		maxSize:       maxSize,
+		maxObjectSize: min(maxObjectSize, maxSize),
+		log:           log,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		entries:       make(map[string]*diskEntry),
+	}
+
+	var index diskCacheIndex
+	doc, err := os.ReadFile(filepath.Join(dir, diskCacheIndexName))
+	if err == nil {
+		err = json.Unmarshal(doc, &index)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warn("could not read disk cache index, starting empty", zap.String("dir", dir), zap.String("err", err.Error()))
+	}
+	if err == nil && index.Version != diskCacheIndexVersion {
+		log.Info("dropping disk cache index of an older version", zap.String("dir", dir), zap.Int("version", index.Version))
+		index.Entries = nil
+	}
+	for _, entry := range index.Entries {
+		info, err := os.Stat(d.path(entry.Key, entry.Generation))
+		if err != nil || info.Size() != entry.Size || entry.Attrs == nil {
+			continue
+		}
+		d.entries[entry.Key] = entry
+		d.size += entry.Size
+	}
+
+	// Remove bodies left behind by a crash or by a lost index
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	known := make(map[string]bool, len(d.entries))
+	for _, entry := range d.entries {
+		known[d.path(entry.Key, entry.Generation)] = true
+	}
+	for _, name := range names {
+		if !known[name] && isDiskCacheFile(filepath.Base(name)) {
+			os.Remove(name)
+		}
+	}
+	log.Info("loaded disk cache", zap.String("dir", dir), zap.Int("objects", len(d.entries)), zap.Int64("bytes", d.size))
+
+	go d.run()
+	return d, nil
+}
+
+// Destruct implements caddy.Destructor, closing the cache once the last cache
+// using it is gone.
+func (d *diskCache) Destruct() error {
+	return d.close()
+}
+
+// path returns the file holding the body of a generation of key.
+func (d *diskCache) path(key string, generation int64) string {
+	sum := sha256.Sum256([]byte(key + "\x00" + strconv.FormatInt(generation, 10)))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+// isDiskCacheFile returns true for the names of bodies and temporary files
+// written by the disk cache, leaving anything else in the directory alone.
+func isDiskCacheFile(name string) bool {
+	if strings.HasSuffix(name, ".tmp") {
+		return true
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && len(name) == 2*sha256.Size
+}
+
+// cacheable returns true if an object of size bytes may be cached on disk.
+func (d *diskCache) cacheable(size int64) bool {
+	return size <= d.maxObjectSize
+}
+
+// get returns a copy of the entry for key, if any.
+func (d *diskCache) get(key string) (diskEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry, ok := d.entries[key]
+	if !ok {
+		return diskEntry{}, false
+	}
+	return *entry, true
+}
+
+// validated records that the entry for key is still the current generation,
+// with the current attrs.
+func (d *diskCache) validated(key string, attrs *storage.ObjectAttrs) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if entry, ok := d.entries[key]; ok && entry.Generation == attrs.Generation {
+		entry.Attrs = servedAttrs(attrs)
+		entry.validated = time.Now()
+		d.dirty = true
+	}
+}
+
+// open returns a reader over the cached body of entry and marks it used.
+func (d *diskCache) open(entry diskEntry) (io.ReadCloser, error) {
+	file, err := os.Open(d.path(entry.Key, entry.Generation))
+	if err != nil {
+		d.delete(entry.Key)
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if current, ok := d.entries[entry.Key]; ok {
+		current.LastAccess = time.Now()
+		d.dirty = true
+	}
+	return file, nil
+}
+
+// store caches a body that was read whole under key.
+func (d *diskCache) store(key string, attrs *storage.ObjectAttrs, body []byte) {
+	file, err := os.CreateTemp(d.dir, "*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = file.Write(body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return
+	}
+	d.commit(key, attrs, file.Name(), int64(len(body)))
+}
+
+// tee returns a reader that caches reader's content on disk under key as it
+// is read, if it is read to the end.
+func (d *diskCache) tee(key string, attrs *storage.ObjectAttrs, reader io.ReadCloser) io.ReadCloser {
+	file, err := os.CreateTemp(d.dir, "*.tmp")
+	if err != nil {
+		return reader
+	}
+	return &diskTee{ReadCloser: reader, disk: d, key: key, attrs: attrs, file: file}
+}
+
+// commit moves a fully written temporary body into place and adds its entry,
+// evicting the least recently used entries beyond maxSize.
+func (d *diskCache) commit(key string, attrs *storage.ObjectAttrs, tmp string, size int64) {
+	name := d.path(key, attrs.Generation)
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.entries[key]; ok {
+		d.remove(old, old.Generation != attrs.Generation)
+	}
+	d.entries[key] = &diskEntry{
+		Key:        key,
+		Generation: attrs.Generation,
+		Size:       size,
+		LastAccess: time.Now(),
+		Attrs:      servedAttrs(attrs),
+		validated:  time.Now(),
+	}
+	d.size += size
+	d.dirty = true
+
+	for d.size > d.maxSize {
+		var oldest *diskEntry
+		for _, entry := range d.entries {
+			if entry.Key != key && (oldest == nil || entry.LastAccess.Before(oldest.LastAccess)) {
+				oldest = entry
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		d.remove(oldest, true)
+	}
+}
+
+// delete drops the entry for key, returning true if there was one.
+func (d *diskCache) delete(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry, ok := d.entries[key]
+	if ok {
+		d.remove(entry, true)
+	}
+	return ok
+}
+
+// deletePrefix drops every entry whose key starts with prefix and returns how
+// many were dropped.
+func (d *diskCache) deletePrefix(prefix string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for key, entry := range d.entries {
+		if strings.HasPrefix(key, prefix) {
+			d.remove(entry, true)
+			n++
+		}
+	}
+	return n
+}
+
+// remove drops an entry, and its body if removeBody is set. d.mu must be held.
+func (d *diskCache) remove(entry *diskEntry, removeBody bool) {
+	delete(d.entries, entry.Key)
+	d.size -= entry.Size
+	d.dirty = true
+	if removeBody {
+		os.Remove(d.path(entry.Key, entry.Generation))
+	}
+}
+
+// run saves the index every diskCacheIndexInterval while it has changed,
+// until the cache is closed.
+func (d *diskCache) run() {
+	defer close(d.done)
+	ticker := time.NewTicker(diskCacheIndexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := d.saveIndex(); err != nil {
+			d.log.Error("could not save disk cache index", zap.String("dir", d.dir), zap.String("err", err.Error()))
+		}
+	}
+}
+
+// close stops the index saver and saves the index one last time.
+func (d *diskCache) close() error {
+	close(d.stop)
+	<-d.done
+	return d.saveIndex()
+}
+
+func (d *diskCache) saveIndex() error {
+	d.mu.Lock()
+	if !d.dirty {
+		d.mu.Unlock()
+		return nil
+	}
+	index := diskCacheIndex{Version: diskCacheIndexVersion, Entries: make([]*diskEntry, 0, len(d.entries))}
+	for _, entry := range d.entries {
+		copied := *entry
+		index.Entries = append(index.Entries, &copied)
+	}
+	d.dirty = false
+	d.mu.Unlock()
+
+	doc, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(d.dir, diskCacheIndexName)
+	if err := os.WriteFile(name+".tmp", doc, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// servedAttrs returns a copy of the attrs used to serve an object.
+func servedAttrs(attrs *storage.ObjectAttrs) *storage.ObjectAttrs {
+	return &storage.ObjectAttrs{
+		Name:               attrs.Name,
+		ContentType:        attrs.ContentType,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentDisposition: attrs.ContentDisposition,
+		CacheControl:       attrs.CacheControl,
+		Metadata:           attrs.Metadata,
+		Size:               attrs.Size,
+		MD5:                attrs.MD5,
+		CRC32C:             attrs.CRC32C,
+		Generation:         attrs.Generation,
+		Metageneration:     attrs.Metageneration,
+		Created:            attrs.Created,
+		Updated:            attrs.Updated,
+	}
+}
+
+// diskTee writes what is read from an object to a temporary file, which is
+// committed to the disk cache if the whole object was read.
+type diskTee struct {
+	io.ReadCloser
+	disk  *diskCache
+	key   string
+	attrs *storage.ObjectAttrs
+	file  *os.File
+	n     int64
+}
+
+func (t *diskTee) Read(b []byte) (int, error) {
+	n, err := t.ReadCloser.Read(b)
+	if t.file == nil {
+		return n, err
+	}
+	if n > 0 {
+		if _, werr := t.file.Write(b[:n]); werr != nil {
+			t.discard()
+			return n, err
+		}
+		t.n += int64(n)
+	}
+	if err == io.EOF {
+		name := t.file.Name()
+		closeErr := t.file.Close()
+		t.file = nil
+		// Transcoded objects don't match their size and aren't cached
+		if closeErr != nil || t.n != t.attrs.Size {
+			os.Remove(name)
+		} else {
+			t.disk.commit(t.key, t.attrs, name, t.n)
+		}
+	}
+	return n, err
+}
+
+// discard drops the partial body.
+func (t *diskTee) discard() {
+	t.file.Close()
+	os.Remove(t.file.Name())
+	t.file = nil
+}
+
+func (t *diskTee) Close() error {
+	if t.file != nil {
+		t.discard()
+	}
+	return t.ReadCloser.Close()
+}
+
+// openDiskCached returns a reader over the object at key from the disk cache
+// along with its attrs. Entries that weren't validated against GCS within
+// the cache TTL, such as those loaded after a restart, are checked first and
+// dropped if the object changed.
+func (p GcsProxy) openDiskCached(ctx context.Context, key string, mode cacheMode, offline bool) (io.ReadCloser, *storage.ObjectAttrs, bool) {
+	disk, diskKey := p.cache.disk, p.cache.diskKey(key)
+	entry, ok := disk.get(diskKey)
+	if !ok {
+		return nil, nil, false
+	}
+	attrs := entry.Attrs
+	expired := entry.validated.Add(time.Duration(p.cache.config.TTL))
+	if !offline && (mode == cacheRevalidate || time.Now().After(expired)) && !p.serveStale(key, entry.Generation, expired, mode) {
+		defer recordPhase(ctx, "revalidate", time.Now())
+		ctx, cancel := p.opContext(ctx, opGet)
+		defer cancel()
+		current, err := p.objectFor(opGet, key).Attrs(ctx)
+		if err != nil || current.Generation != entry.Generation {
+			if err == nil || err == storage.ErrObjectNotExist {
+				disk.delete(diskKey)
+			}
+			return nil, nil, false
+		}
+		disk.validated(diskKey, current)
+		attrs = current
+	}
+	reader, err := disk.open(entry)
+	if err != nil {
+		return nil, nil, false
+	}
+	return reader, attrs, true
+}
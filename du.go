@@ -0,0 +1,184 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultDiskUsageMaxObjects = 100000
+	defaultDiskUsageTTL        = time.Minute
+
+	defaultBrowseDirUsageMaxObjects = 10000
+	defaultBrowseDirUsageMaxDirs    = 100
+	defaultBrowseDirUsageTTL        = 5 * time.Minute
+
+	// Directories of a browse page scanned at once.
+	browseDirUsageConcurrency = 8
+)
+
+// DiskUsage configures `GET <dir>/?du=1` requests, which sum up the size of
+// every object under the directory's prefix.
+type DiskUsage struct {
+	// Most objects counted per request. Beyond it the result is marked as
+	// truncated. Default is 100000.
+	MaxObjects int64 `json:"max_objects,omitempty"`
+
+	// How long a result is reused for the same prefix. Default is 1m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+// BrowseDirUsage configures the number of objects and total size shown for
+// each directory of a browse listing.
+type BrowseDirUsage struct {
+	// Most objects counted per directory. Beyond it the count is shown as a
+	// lower bound. Default is 10000.
+	MaxObjects int64 `json:"max_objects,omitempty"`
+
+	// Most directories of a page that are counted. Default is 100.
+	MaxDirs int `json:"max_dirs,omitempty"`
+
+	// How long the count of a directory is reused. Default is 5m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+// diskUsage is the JSON document served for `?du=1` requests.
+type diskUsage struct {
+	Prefix    string    `json:"prefix"`
+	Bytes     int64     `json:"bytes"`
+	Objects   int64     `json:"objects"`
+	Truncated bool      `json:"truncated"`
+	Scanned   time.Time `json:"scanned"`
+}
+
+// usageTracker caches the disk usage of each prefix for TTL.
+type usageTracker struct {
+	mu     sync.Mutex
+	config DiskUsage
+	usage  map[string]diskUsage
+}
+
+func newUsageTracker(config DiskUsage) *usageTracker {
+	if config.MaxObjects <= 0 {
+		config.MaxObjects = defaultDiskUsageMaxObjects
+	}
+	if config.TTL <= 0 {
+		config.TTL = caddy.Duration(defaultDiskUsageTTL)
+	}
+	return &usageTracker{
+		config: config,
+		usage:  make(map[string]diskUsage),
+	}
+}
+
+// get returns the usage of prefix, scanning the bucket if the cached value
+// is missing or stale. Hidden objects are not counted.
+func (t *usageTracker) get(ctx context.Context, bucket *storage.BucketHandle, prefix string, hide []string) (diskUsage, error) {
+	t.mu.Lock()
+	u, ok := t.usage[prefix]
+	t.mu.Unlock()
+	if ok && time.Since(u.Scanned) < time.Duration(t.config.TTL) {
+		return u, nil
+	}
+
+	scanned := diskUsage{Prefix: prefix, Scanned: time.Now().UTC()}
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size"}); err != nil {
+		return diskUsage{}, err
+	}
+	it := bucket.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return diskUsage{}, err
+		}
+		if fileHidden(attrs.Name, hide) {
+			continue
+		}
+		if scanned.Objects >= t.config.MaxObjects {
+			scanned.Truncated = true
+			break
+		}
+		scanned.Bytes += attrs.Size
+		scanned.Objects++
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.usage[prefix] = scanned
+	return scanned, nil
+}
+
+// DiskUsageHandler responds with the total size and number of objects under
+// the directory prefix as JSON.
+func (p GcsProxy) DiskUsageHandler(w http.ResponseWriter, r *http.Request, prefix string) error {
+	if p.offline != nil && p.offline.active() {
+		return p.offlineError()
+	}
+
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opList)
+	defer cancelOp()
+
+	if err := p.checkPublicListing(ctx); err != nil {
+		return err
+	}
+
+	usage, err := p.usage.get(ctx, p.bucketFor(opList), prefix, p.Hide)
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	return json.NewEncoder(w).Encode(usage)
+}
+
+// addDirUsage fills in the number of objects and total size of the first
+// MaxDirs directories on the page. Directories that can't be scanned are
+// logged and left blank.
+func (p GcsProxy) addDirUsage(ctx context.Context, po *PageObj, prefix string) {
+	sem := make(chan struct{}, browseDirUsageConcurrency)
+	var wg sync.WaitGroup
+	dirs := 0
+	for i := range po.Items {
+		item := &po.Items[i]
+		if !item.IsDir {
+			continue
+		}
+		if dirs >= p.BrowseDirUsage.MaxDirs {
+			break
+		}
+		dirs++
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			usage, err := p.dirUsage.get(ctx, p.bucketFor(opList), prefix+item.Name+"/", p.Hide)
+			if err != nil {
+				p.log.Warn("could not count directory",
+					zap.String("prefix", prefix+item.Name+"/"),
+					zap.String("err", err.Error()),
+				)
+				return
+			}
+			item.Objects = usage.Objects
+			item.Truncated = usage.Truncated
+			item.Size = humanize.Bytes(uint64(usage.Bytes))
+			item.Bytes = usage.Bytes
+		})
+	}
+	wg.Wait()
+}
@@ -0,0 +1,119 @@
+package caddygcsproxy
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// EgressBudget caps the number of bytes served within a time window, so a
+// traffic spike can't run up an unbounded GCS network bill.
+type EgressBudget struct {
+	// Request path patterns the budget applies to. Empty means the budget is
+	// global to the handler.
+	Paths []string `json:"paths,omitempty"`
+
+	// Maximum bytes served per window.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// Length of the window. Default is 1h.
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// Status returned once the budget is exhausted, 429 (default) or 503.
+	StatusCode int `json:"status_code,omitempty"`
+}
+
+const defaultEgressWindow = time.Hour
+
+// egressCounter tracks the bytes served against one budget in fixed windows.
+type egressCounter struct {
+	mu          sync.Mutex
+	budget      EgressBudget
+	windowStart time.Time
+	used        int64
+}
+
+func newEgressCounters(budgets []EgressBudget) []*egressCounter {
+	counters := make([]*egressCounter, 0, len(budgets))
+	for _, budget := range budgets {
+		if budget.Window <= 0 {
+			budget.Window = caddy.Duration(defaultEgressWindow)
+		}
+		if budget.StatusCode == 0 {
+			budget.StatusCode = http.StatusTooManyRequests
+		}
+		counters = append(counters, &egressCounter{budget: budget, windowStart: time.Now()})
+	}
+	return counters
+}
+
+func (c *egressCounter) applies(reqPath string) bool {
+	return len(c.budget.Paths) == 0 || pathMatches(c.budget.Paths, reqPath)
+}
+
+// roll starts a new window if the current one has ended. c.mu must be held.
+func (c *egressCounter) roll(now time.Time) {
+	if now.Sub(c.windowStart) >= time.Duration(c.budget.Window) {
+		c.windowStart = now
+		c.used = 0
+	}
+}
+
+// exhausted returns true if the budget is spent, along with how long until
+// the window ends.
+func (c *egressCounter) exhausted(now time.Time) (bool, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roll(now)
+	return c.used >= c.budget.MaxBytes, c.windowStart.Add(time.Duration(c.budget.Window)).Sub(now)
+}
+
+func (c *egressCounter) add(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roll(time.Now())
+	c.used += n
+}
+
+// checkEgress returns an error if any budget covering the request is spent.
+func (p GcsProxy) checkEgress(w http.ResponseWriter, r *http.Request) error {
+	now := time.Now()
+	for _, c := range p.egress {
+		if !c.applies(r.URL.Path) {
+			continue
+		}
+		if spent, reset := c.exhausted(now); spent {
+			setRateLimitHeaders(w.Header(), c.budget.MaxBytes, 0, reset)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+			return caddyhttp.Error(c.budget.StatusCode, errors.New("egress budget exhausted"))
+		}
+	}
+	return nil
+}
+
+// recordEgress charges n served bytes to every budget covering the request.
+func (p GcsProxy) recordEgress(r *http.Request, n int64) {
+	for _, c := range p.egress {
+		if c.applies(r.URL.Path) {
+			c.add(n)
+		}
+	}
+}
+
+// countingWriter counts the body bytes written through it.
+type countingWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriterWrapper.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,57 @@
+package caddygcsproxy
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
+)
+
+// gzipContentTypes are the types clients label a gzip body with when they
+// mean the compression rather than the content.
+var gzipContentTypes = []string{"application/gzip", "application/x-gzip"}
+
+// gzipEncoded returns true if the body of r is gzip-encoded.
+func gzipEncoded(r *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "gzip")
+}
+
+// isGzipError returns true if err comes from decompressing an invalid gzip
+// body.
+func isGzipError(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, &corrupt)
+}
+
+// applyContentEncoding stores a gzip-encoded upload with Content-Encoding
+// gzip. It is read back as stored and decompressed by the proxy for clients
+// that don't accept gzip, see decompressStored. The
+// object is typed as its decompressed content, from the key's extension with
+// any `.gz` stripped, if the client typed it as gzip or not at all.
+func applyContentEncoding(r *http.Request, attrs *storage.ObjectAttrs) {
+	if !gzipEncoded(r) {
+		return
+	}
+	attrs.ContentEncoding = "gzip"
+
+	// ParseMediaType lowercases the type
+	mediaType, _, _ := mime.ParseMediaType(attrs.ContentType)
+	if attrs.ContentType == "" || slices.Contains(gzipContentTypes, mediaType) {
+		attrs.ContentType = mime.TypeByExtension(path.Ext(strings.TrimSuffix(attrs.Name, ".gz")))
+	}
+}
+
+// decompressStored returns true if the object described by attrs is stored
+// gzip-encoded but r doesn't accept gzip, so it must be served decompressed.
+// Objects are always read compressed so the cached bodies match attrs.Size.
+func decompressStored(r *http.Request, attrs *storage.ObjectAttrs) bool {
+	return strings.EqualFold(attrs.ContentEncoding, "gzip") &&
+		!slices.Contains(encode.AcceptedEncodings(r, []string{"gzip"}), "gzip")
+}
@@ -0,0 +1,229 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const (
+	defaultWebhookRetries = 3
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+// mutationEvent describes a successful write or delete made through the proxy.
+// A MOVE is described by an event for the key moved from and one for the key
+// moved to, with Source set.
+type mutationEvent struct {
+	Bucket     string    `json:"bucket"`
+	Key        string    `json:"key"`
+	Source     string    `json:"source,omitempty"`
+	Method     string    `json:"method"`
+	Size       int64     `json:"size,omitempty"`
+	Generation int64     `json:"generation,omitempty"`
+	Client     string    `json:"client,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// newMutationEvent builds the event for a request, attrs may be nil for deletes.
+func (p GcsProxy) newMutationEvent(r *http.Request, key string, attrs *storage.ObjectAttrs) mutationEvent {
+	ev := mutationEvent{
+		Bucket: p.Bucket,
+		Key:    key,
+		Method: r.Method,
+		Time:   time.Now().UTC(),
+	}
+	if attrs != nil {
+		ev.Size = attrs.Size
+		ev.Generation = attrs.Generation
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ev.Client = host
+	}
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		ev.User, _ = repl.GetString("http.auth.user.id")
+	}
+	return ev
+}
+
+// eventSink is a destination for mutation events.
+type eventSink interface {
+	send(ctx context.Context, ev mutationEvent) error
+	String() string
+}
+
+// notify delivers the event to every configured sink in the background.
+func (p GcsProxy) notify(ev mutationEvent) {
+	for _, sink := range p.sinks {
+		go func(sink eventSink) {
+			if err := sink.send(p.ctx, ev); err != nil {
+				p.log.Error("could not deliver mutation event",
+					zap.String("sink", sink.String()),
+					zap.String("key", ev.Key),
+					zap.String("err", err.Error()),
+				)
+			}
+		}(sink)
+	}
+}
+
+// Webhook configures an HTTP endpoint that is POSTed a JSON event after every
+// successful PUT or DELETE.
+type Webhook struct {
+	// The URL to POST events to.
+	URL string `json:"url,omitempty"`
+
+	// Secret used to sign each delivery, sent as
+	// `X-Gcsproxy-Signature: sha256=<hex>`. The signature is of
+	// `<timestamp>.<body>`, with the Unix timestamp sent as
+	// `X-Gcsproxy-Timestamp`, so receivers can reject replayed deliveries.
+	Secret string `json:"secret,omitempty"`
+
+	// Number of times a failed delivery is retried. Default is 3.
+	Retries int `json:"retries,omitempty"`
+
+	// Timeout for each delivery attempt. Default is 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+type webhookSink struct {
+	Webhook
+	client *http.Client
+}
+
+func newWebhookSink(hook Webhook) *webhookSink {
+	if hook.Retries == 0 {
+		hook.Retries = defaultWebhookRetries
+	}
+	if hook.Timeout == 0 {
+		hook.Timeout = caddy.Duration(defaultWebhookTimeout)
+	}
+	return &webhookSink{
+		Webhook: hook,
+		client:  &http.Client{Timeout: time.Duration(hook.Timeout)},
+	}
+}
+
+func (s *webhookSink) String() string {
+	return "webhook " + s.URL
+}
+
+func (s *webhookSink) send(ctx context.Context, ev mutationEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = s.post(ctx, body)
+		if err == nil || attempt >= s.Retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (s *webhookSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Gcsproxy-Timestamp", timestamp)
+		req.Header.Set("X-Gcsproxy-Signature", "sha256="+webhookSignature(s.Secret, timestamp, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of a delivery of body at
+// timestamp.
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pubsubSink publishes mutation events to a Pub/Sub topic.
+type pubsubSink struct {
+	topic   string
+	service *pubsub.Service
+}
+
+// newPubsubSink creates a sink for topic, which is either a full
+// `projects/<project>/topics/<topic>` name or a topic in projectID.
+func newPubsubSink(ctx context.Context, topic string, projectID string, opts ...option.ClientOption) (*pubsubSink, error) {
+	if !strings.HasPrefix(topic, "projects/") {
+		if projectID == "" {
+			return nil, fmt.Errorf("project_id is required for pubsub topic %s", topic)
+		}
+		topic = "projects/" + projectID + "/topics/" + topic
+	}
+
+	service, err := pubsub.NewService(ctx, append(opts, option.WithScopes(pubsub.PubsubScope))...)
+	if err != nil {
+		return nil, err
+	}
+	return &pubsubSink{topic: topic, service: service}, nil
+}
+
+func (s *pubsubSink) String() string {
+	return "pubsub " + s.topic
+}
+
+func (s *pubsubSink) send(ctx context.Context, ev mutationEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	eventType := "OBJECT_FINALIZE"
+	if ev.Method == http.MethodDelete {
+		eventType = "OBJECT_DELETE"
+	}
+	_, err = s.service.Projects.Topics.Publish(s.topic, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data: base64.StdEncoding.EncodeToString(data),
+			Attributes: map[string]string{
+				"eventType": eventType,
+				"bucketId":  ev.Bucket,
+				"objectId":  ev.Key,
+			},
+		}},
+	}).Context(ctx).Do()
+	return err
+}
@@ -0,0 +1,116 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+// expiresAtMetadata is the metadata key holding the deletion deadline of an
+// expiring upload, in RFC 3339 format.
+const expiresAtMetadata = "expires-at"
+
+// ExpireUploads configures uploads that are deleted some time after they are
+// written, e.g. for temporary share or drop-box prefixes. Expiring uploads
+// get their deletion deadline as Custom-Time, so a bucket lifecycle rule with
+// `daysSinceCustomTime: 0` can delete them, and in the `expires-at` metadata.
+type ExpireUploads struct {
+	// How long after the upload the object is deleted.
+	After caddy.Duration `json:"after,omitempty"`
+
+	// Request path patterns whose uploads expire. Empty means every upload.
+	Paths []string `json:"paths,omitempty"`
+
+	// How often the sweeper deletes expired uploads. Default is 0, meaning no
+	// sweeper, leaving it to a lifecycle rule.
+	SweepInterval caddy.Duration `json:"sweep_interval,omitempty"`
+
+	// Key prefix the sweeper looks for expired uploads under. Empty means the
+	// whole bucket.
+	SweepPrefix string `json:"sweep_prefix,omitempty"`
+}
+
+// applyExpiry stamps the deletion deadline on the attrs of an upload to
+// reqPath, if its uploads expire.
+func (p GcsProxy) applyExpiry(reqPath string, attrs *storage.ObjectAttrs) {
+	if p.ExpireUploads == nil || (len(p.ExpireUploads.Paths) > 0 && !pathMatches(p.ExpireUploads.Paths, reqPath)) {
+		return
+	}
+	deadline := time.Now().Add(time.Duration(p.ExpireUploads.After)).UTC().Truncate(time.Second)
+	attrs.CustomTime = deadline
+	if attrs.Metadata == nil {
+		attrs.Metadata = make(map[string]string)
+	}
+	attrs.Metadata[expiresAtMetadata] = deadline.Format(time.RFC3339)
+}
+
+// runExpirySweeper deletes expired uploads every SweepInterval until ctx is
+// done.
+func (p GcsProxy) runExpirySweeper(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(p.ExpireUploads.SweepInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		deleted, err := p.sweepExpired(ctx)
+		if err != nil && ctx.Err() == nil {
+			p.log.Error("could not sweep expired uploads",
+				zap.String("prefix", p.ExpireUploads.SweepPrefix),
+				zap.String("err", err.Error()),
+			)
+		}
+		if deleted > 0 {
+			p.log.Info("deleted expired uploads", zap.Int("objects", deleted))
+		}
+	}
+}
+
+// sweepExpired deletes the uploads under SweepPrefix whose deadline has
+// passed. Only objects stamped by the proxy are deleted, and only the
+// generation that was stamped.
+func (p GcsProxy) sweepExpired(ctx context.Context) (int, error) {
+	query := &storage.Query{Prefix: p.ExpireUploads.SweepPrefix}
+	if err := query.SetAttrSelection([]string{"Name", "Generation", "CustomTime", "Metadata"}); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	it := p.bucketFor(opList).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return deleted, nil
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if _, stamped := attrs.Metadata[expiresAtMetadata]; !stamped || attrs.CustomTime.IsZero() || time.Now().Before(attrs.CustomTime) {
+			continue
+		}
+
+		obj := p.objectFor(opDelete, attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+		if err := obj.Delete(ctx); err != nil {
+			p.log.Warn("could not delete expired upload", zap.String("key", attrs.Name), zap.String("err", err.Error()))
+			continue
+		}
+		deleted++
+		if p.cache != nil {
+			p.cache.delete(attrs.Name)
+		}
+		p.notify(mutationEvent{
+			Bucket:     p.Bucket,
+			Key:        attrs.Name,
+			Method:     http.MethodDelete,
+			Generation: attrs.Generation,
+			Time:       time.Now().UTC(),
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"cloud.google.com/go/storage/control/apiv2/controlpb"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// folderMarkerSuffix is appended to a directory name by older tools (e.g. the
+// Hadoop connector) to mark an otherwise empty directory.
+const folderMarkerSuffix = "_$folder$"
+
+// isFolder returns true if a folder marker exists for the directory key.
+func (p GcsProxy) isFolder(ctx context.Context, key string) bool {
+	ctx, cancel := p.opContext(ctx, opGet)
+	defer cancel()
+
+	for _, marker := range []string{key + "/", key + folderMarkerSuffix} {
+		if _, err := p.objectFor(opGet, marker).Attrs(ctx); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectToFolder redirects a request for a directory missing its trailing
+// slash to the directory.
+func redirectToFolder(w http.ResponseWriter, r *http.Request) {
+	target := *r.URL
+	target.Path += "/"
+	target.RawPath = ""
+	http.Redirect(w, r, target.RequestURI(), http.StatusMovedPermanently)
+}
+
+// Methods for directory and rename operations, as in WebDAV.
+const (
+	methodMkcol = "MKCOL"
+	methodMove  = "MOVE"
+)
+
+// MkcolHandler creates the directory at key, as a folder if the bucket has
+// hierarchical namespace enabled and as a zero-byte `<dir>/` marker otherwise.
+func (p GcsProxy) MkcolHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	dir := strings.TrimSuffix(key, "/") + "/"
+	if dir == "/" {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("cannot create the root directory"))
+	}
+	if fileHidden(dir, p.Hide) {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("directory not allowed"))
+	}
+
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opPut)
+	defer cancelOp()
+
+	if p.hierarchical(ctx) {
+		_, err := p.hns.control.CreateFolder(ctx, &controlpb.CreateFolderRequest{
+			Parent:    p.folderParent(),
+			FolderId:  dir,
+			Recursive: true,
+		})
+		if status.Code(err) == codes.AlreadyExists {
+			return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("directory already exists"))
+		}
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+	} else {
+		writer := p.objectFor(opPut, dir).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+		if err := writer.Close(); err != nil {
+			var apiErr *googleapi.Error
+			if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+				return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("directory already exists"))
+			}
+			return convertToCaddyError(err)
+		}
+	}
+
+	p.notify(p.newMutationEvent(r, dir, nil))
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// MoveHandler renames the object or directory at key to the path in the
+// Destination header. Folders of a hierarchical namespace bucket are renamed
+// atomically, in a flat bucket every object under the directory is copied
+// and then deleted. Existing objects are only replaced if the Overwrite
+// header isn't `F`.
+func (p GcsProxy) MoveHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	if fileHidden(key, p.Hide) {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	destination, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || destination.Path == "" {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("missing or invalid Destination header"))
+	}
+	destPath := cleanPath(destination.Path)
+	if !p.methodAllowed(methodMove, destPath) || fileHidden(destPath, p.Hide) {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("destination not allowed"))
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	root, err := p.requestRoot(r, repl)
+	if err != nil {
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+	destKey := p.keyFor(root, destPath)
+	if err := p.checkProtected(r, destKey); err != nil {
+		return err
+	}
+
+	isDir := strings.HasSuffix(key, "/")
+	if isDir != strings.HasSuffix(destKey, "/") || destKey == key {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("destination must be a different path of the same kind"))
+	}
+	var conds storage.Conditions
+	if r.Header.Get("Overwrite") == "F" {
+		conds.DoesNotExist = true
+	}
+
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opPut)
+	defer cancelOp()
+
+	size, qw, err := p.checkMoveQuotas(ctx, w, r, key, destKey)
+	if err != nil {
+		return err
+	}
+	defer qw.release()
+
+	hierarchical := p.hierarchical(ctx)
+	switch {
+	case isDir && hierarchical:
+		err = p.renameFolder(ctx, key, destKey)
+	case isDir:
+		err = p.moveObjects(ctx, key, destKey, conds)
+	default:
+		err = p.moveObject(ctx, key, destKey, conds, hierarchical)
+	}
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			return caddyhttp.Error(http.StatusPreconditionFailed, errors.New("destination exists"))
+		}
+		p.log.Error("failed to move",
+			zap.String("bucket", p.Bucket),
+			zap.String("key", key),
+			zap.String("destination", destKey),
+			zap.String("err", err.Error()),
+		)
+		return convertToCaddyError(err)
+	}
+
+	if !isDir && size >= 0 {
+		p.recordQuotaWrite(r, destKey, size, qw.replaced)
+	} else {
+		p.recordQuotaDelete(r, destKey)
+	}
+	p.recordQuotaDelete(r, key)
+
+	p.notify(p.newMutationEvent(r, key, nil))
+	moved := p.newMutationEvent(r, destKey, nil)
+	moved.Source = key
+	p.notify(moved)
+	w.Header().Set("Location", destPath)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// renameFolder renames a hierarchical namespace folder, waiting for the
+// long running operation to complete.
+func (p GcsProxy) renameFolder(ctx context.Context, dir string, destDir string) error {
+	op, err := p.hns.control.RenameFolder(ctx, &controlpb.RenameFolderRequest{
+		Name:                p.folderName(dir),
+		DestinationFolderId: destDir,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := op.Wait(ctx); err != nil {
+		return err
+	}
+	if p.cache != nil {
+		p.cache.clear()
+	}
+	return nil
+}
+
+// moveObjects moves every object under dir to destDir.
+func (p GcsProxy) moveObjects(ctx context.Context, dir string, destDir string, conds storage.Conditions) error {
+	it := p.bucketFor(opList).Objects(ctx, &storage.Query{Prefix: dir})
+	moved := 0
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.moveObject(ctx, attrs.Name, destDir+strings.TrimPrefix(attrs.Name, dir), conds, false); err != nil {
+			return err
+		}
+		moved++
+	}
+	if moved == 0 {
+		return storage.ErrObjectNotExist
+	}
+	return nil
+}
+
+// moveObject moves a single object, atomically in a hierarchical namespace
+// bucket and with a copy and delete otherwise.
+func (p GcsProxy) moveObject(ctx context.Context, key string, destKey string, conds storage.Conditions, hierarchical bool) error {
+	if hierarchical {
+		dest := storage.MoveObjectDestination{Object: destKey}
+		if conds.DoesNotExist {
+			dest.Conditions = &conds
+		}
+		if _, err := p.objectFor(opPut, key).Move(ctx, dest); err != nil {
+			return err
+		}
+	} else {
+		dst := p.objectFor(opPut, destKey)
+		if conds.DoesNotExist {
+			dst = dst.If(conds)
+		}
+		if _, err := dst.CopierFrom(p.objectFor(opGet, key)).Run(ctx); err != nil {
+			return err
+		}
+		if err := p.objectFor(opDelete, key).Delete(ctx); err != nil {
+			return err
+		}
+	}
+
+	if p.cache != nil {
+		p.cache.delete(key)
+		p.cache.delete(destKey)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package caddygcsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const defaultFormUploadsMaxFiles = 10
+
+// FormUploads configures POSTs of `multipart/form-data` bodies to a directory,
+// as sent by plain HTML forms. Each file in the form is stored in the
+// directory under its filename. Requires EnablePut.
+type FormUploads struct {
+	// Form field holding the files. Default is every field with a file.
+	Field string `json:"field,omitempty"`
+
+	// Form field whose value names the object instead of the filename. It
+	// must come before the file in the form, and names one file only.
+	NameField string `json:"name_field,omitempty"`
+
+	// Most files stored per request. Default is 10.
+	MaxFiles int `json:"max_files,omitempty"`
+}
+
+// formUpload is an object stored from a form upload.
+type formUpload struct {
+	Key      string `json:"key"`
+	Location string `json:"location"`
+}
+
+// isFormUpload returns true if r is a form upload the handler accepts.
+func (p GcsProxy) isFormUpload(r *http.Request) bool {
+	if p.FormUploads == nil {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// FormUploadHandler stores the files of a multipart form POSTed to dir and
+// answers 201 with the stored objects as JSON.
+func (p GcsProxy) FormUploadHandler(w http.ResponseWriter, r *http.Request, dir string) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	var name string
+	uploaded := []formUpload{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+
+		field := part.FormName()
+		if p.FormUploads.NameField != "" && field == p.FormUploads.NameField {
+			value, err := io.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
+				return caddyhttp.Error(http.StatusBadRequest, err)
+			}
+			name = string(value)
+			continue
+		}
+		if part.FileName() == "" || (p.FormUploads.Field != "" && field != p.FormUploads.Field) {
+			continue
+		}
+		if len(uploaded) >= p.FormUploads.MaxFiles {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("more than %d files in form", p.FormUploads.MaxFiles))
+		}
+
+		if name == "" {
+			name = part.FileName()
+		}
+		name, err = formObjectName(name)
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		key, location, err := p.postedObject(r, dir, name)
+		if err != nil {
+			return err
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		sub := r.Clone(r.Context())
+		sub.Method = http.MethodPut
+		sub.URL.Path = location
+		sub.Body = io.NopCloser(part)
+		sub.ContentLength = -1
+		sub.Trailer = nil
+		sub.Header.Set("Content-Type", contentType)
+		sub.Header.Del("Content-Encoding")
+		sub.Header.Del("Content-Length")
+
+		sw := &statusWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+		if err := p.PutHandler(sw, sub, key); err != nil {
+			return err
+		}
+		if sw.wroteHeader {
+			// The upload was spooled for a retry, which already answered
+			return nil
+		}
+		uploaded = append(uploaded, formUpload{Key: key, Location: location})
+		name = ""
+	}
+	if len(uploaded) == 0 {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("no files in form"))
+	}
+
+	if len(uploaded) == 1 {
+		w.Header().Set("Location", uploaded[0].Location)
+	} else {
+		w.Header().Del("ETag")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(uploaded)
+}
+
+// formObjectName returns the object name for a file named name in a form.
+// Only the last segment of a path is kept, since some browsers send the full
+// path of the file on the client.
+func formObjectName(name string) (string, error) {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("%q is not a valid object name", name)
+	}
+	return name, nil
+}
@@ -1,15 +1,26 @@
 package caddygcsproxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"maps"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"context"
 
@@ -17,43 +28,418 @@ import (
 	caddy "github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"go.uber.org/zap"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
+	"google.golang.org/api/googleapi"
 )
 
 var defaultIndexNames = []string{"index.html", "index.txt"}
 
+// defaultImmutablePattern matches file names with a content hash of at least
+// 8 hex digits before the extension, e.g. `app.3f2a9c1b.js`.
+const defaultImmutablePattern = `[.-][0-9a-fA-F]{8,}\.[0-9A-Za-z]+$`
+
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// supportedMethods are the HTTP methods the handler knows how to serve.
+var supportedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPut,
+	http.MethodPost,
+	http.MethodDelete,
+	http.MethodPatch,
+	methodMkcol,
+	methodMove,
+}
+
 func init() {
 	caddy.RegisterModule(GcsProxy{})
 }
 
+// ETagRule sets how ETags are emitted for some or all request paths.
+type ETagRule struct {
+	// One of `strong` (default), `weak` or `off`.
+	Mode string `json:"mode,omitempty"`
+
+	// Request path patterns the rule applies to. Empty means every path.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// ExpiresRule sets the Expires header for some or all request paths.
+type ExpiresRule struct {
+	// How far in the future responses expire. Zero means it is computed from
+	// the max-age of the response's Cache-Control.
+	Duration caddy.Duration `json:"duration,omitempty"`
+
+	// Request path patterns the rule applies to. Empty means every path.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// EarlyHints configures 103 Early Hints for index pages.
+type EarlyHints struct {
+	// Link header values sent for GET requests of a directory with an index
+	// page, e.g. `</app.css>; rel=preload; as=style`, along with the index
+	// object's `link` metadata. They are sent once the index is found.
+	Links []string `json:"links,omitempty"`
+}
+
 // GcsProxy implements a proxy to return, set, delete or browse objects from GCS
 type GcsProxy struct {
 	// The path to the root of the site. Default is `{http.vars.root}` if set,
 	// Or if not set the value is "" - meaning use the whole path as a key.
+	// Request placeholders such as `{http.auth.user.id}` are evaluated per
+	// request and escaped to a single path segment.
 	Root string `json:"root,omitempty"`
 
-	// The name of the GCS bucket
+	// The name of the GCS bucket. Request placeholders such as
+	// `{http.request.host}` are evaluated per request, for multi-tenant
+	// deployments. Features keeping state per bucket can't be combined with
+	// them.
 	Bucket string `json:"bucket,omitempty"`
 
+	// Patterns, e.g. `tenant-*`, that a bucket name resolved from
+	// placeholders in Bucket must match. Required if Bucket has a
+	// placeholder only known per request, since clients may control it, e.g.
+	// the Host header, and could otherwise pick any bucket the credentials
+	// reach.
+	AllowedBuckets []string `json:"allowed_buckets,omitempty"`
+
+	// Buckets serving requests for a host, e.g. `assets.example.com`, or a
+	// path prefix starting with `/`, instead of Bucket. Hosts are matched
+	// first, then the longest prefix. The request path is the key in the
+	// mapped bucket as well. Regions only apply to Bucket.
+	BucketMap map[string]string `json:"bucket_map,omitempty"`
+
+	// Object naming the active release prefix, which is appended to Root, for
+	// blue/green deploys.
+	ReleasePointer *ReleasePointer `json:"release_pointer,omitempty"`
+
+	// Confine clients authenticated by TLS client certificate to their own
+	// prefixes under Root.
+	ClientPrefixes *ClientPrefixes `json:"client_prefixes,omitempty"`
+
+	// Serve reads from region-specific buckets chosen per request.
+	Regions *RegionRouting `json:"regions,omitempty"`
+
+	// Pin browsing sessions to the object generations live when their first
+	// page was served.
+	PinGenerations *PinGenerations `json:"pin_generations,omitempty"`
+
+	// Unicode normalization form, `nfc` or `nfd`, object keys are converted
+	// to before lookups and writes, so clients sending decomposed accented
+	// filenames (e.g. macOS) find objects written in composed form and vice
+	// versa. Empty leaves keys as sent.
+	NormalizeKeys string `json:"normalize_keys,omitempty"`
+
 	// The names of files to try as index files if a folder is requested.
-	IndexNames []string `json:"index_names,omitempty"`
+	// An empty list disables index lookup, so directories go straight to
+	// browse or a 403.
+	IndexNames []string `json:"index_names"`
 
 	// A glob pattern used to hide matching key paths (returning a 404)
 	Hide []string
 
-	// Flag to determine if PUT operations are allowed (default false)
+	// Response for hidden keys: `404` (default), `403` or `pass_through` to
+	// the next handler.
+	HideStatus string `json:"hide_status,omitempty"`
+
+	// Key patterns that PUT, POST, DELETE, PATCH and MOVE may never write
+	// to, even where they are enabled, e.g. error pages, `_redirects` or
+	// `.well-known/*`. Writes to them get a 403.
+	Protect []string `json:"protect,omitempty"`
+
+	// Flag to determine if PUT operations are allowed (default false). This
+	// also allows POSTing to a directory to store an object under a generated
+	// key.
 	EnablePut bool
 
+	// Request path patterns PUT is confined to. Empty means any path.
+	PutPaths []string `json:"put_paths,omitempty"`
+
+	// Chunking of uploads to GCS, and uploads sent in chunks with
+	// Content-Range.
+	ResumableUploads *ResumableUploads `json:"resumable_uploads,omitempty"`
+
+	// Store the files of `multipart/form-data` bodies POSTed to a directory
+	// under their filenames, for uploads from plain HTML forms.
+	FormUploads *FormUploads `json:"form_uploads,omitempty"`
+
+	// Flag to allow `POST <path>?compose` requests, which concatenate the
+	// source objects listed in the JSON body into the object at path
+	// server side. Requires EnablePut (default false)
+	EnableCompose bool `json:"enable_compose,omitempty"`
+
+	// Flag to list the soft-deleted objects under a directory as JSON for
+	// `GET <dir>/?deleted=1` requests, and to restore them with
+	// `POST <path>?restore=<generation>` if EnablePut is set, on buckets with
+	// soft delete retention (default false)
+	EnableSoftDeleted bool `json:"enable_soft_deleted,omitempty"`
+
 	// Flag to determine if DELETE operations are allowed (default false)
 	EnableDelete bool
 
-	// Flag to enable browsing of "directories" in GCS (paths that end with a /)
+	// Request path patterns DELETE is confined to. Empty means any path.
+	DeletePaths []string `json:"delete_paths,omitempty"`
+
+	// Flag to allow PATCH requests, which change an existing object in place,
+	// e.g. rewriting it to the storage class in `X-Storage-Class` (default
+	// false)
+	EnablePatch bool `json:"enable_patch,omitempty"`
+
+	// Request path patterns PATCH is confined to. Empty means any path.
+	PatchPaths []string `json:"patch_paths,omitempty"`
+
+	// Flag to let PUT and PATCH requests set or clear temporary and event
+	// based holds with the `X-Temporary-Hold` and `X-Event-Based-Hold`
+	// headers (default false)
+	EnableHolds bool `json:"enable_holds,omitempty"`
+
+	// Flag to decompress PUT bodies sent with `Content-Encoding: gzip`, so
+	// clients can compress on the wire and still store plain objects
+	// (default false)
+	DecompressUploads bool `json:"decompress_uploads,omitempty"`
+
+	// Flag to allow MKCOL requests creating directories and MOVE requests
+	// renaming objects and directories to the path in the Destination header.
+	// On buckets with hierarchical namespace enabled these use the folders
+	// API, so directories are real folders renamed atomically, and browse
+	// lists empty folders too (default false)
+	EnableFolders bool `json:"enable_folders,omitempty"`
+
+	// Custom metadata stamped onto objects written by PUT, keyed by metadata
+	// name. Values may contain placeholders such as `{http.auth.user.id}`,
+	// `{http.request.remote.host}` or `{time.now.unix}`. Names are stored
+	// with a `gcsproxy-` prefix, and metadata with that prefix isn't sent to
+	// clients reading the object.
+	UploadMetadata map[string]string `json:"upload_metadata,omitempty"`
+
+	// Delete uploads some time after they are written.
+	ExpireUploads *ExpireUploads `json:"expire_uploads,omitempty"`
+
+	// Storage quotas enforced on PUT, per key prefix.
+	Quotas []Quota `json:"quotas,omitempty"`
+
+	// How long cached quota usage is trusted before the prefix is rescanned.
+	// Default is 5m.
+	QuotaRefresh caddy.Duration `json:"quota_refresh,omitempty"`
+
+	// Require proxy-issued signed URLs for some or all request paths.
+	SignedURLs *SignedURLs `json:"signed_urls,omitempty"`
+
+	// Require a signed cookie for some or all request paths.
+	SignedCookie *SignedCookie `json:"signed_cookie,omitempty"`
+
+	// Flag to only serve objects that are publicly readable through bucket
+	// IAM or object ACLs, returning a 403 for anything else (default false).
+	// Listings, disk usage and stats are only served if bucket IAM makes
+	// every object public, and soft-deleted objects never are.
+	PublicOnly bool `json:"public_only,omitempty"`
+
+	// How long the public readability of objects is cached. Default is 1m.
+	PublicCacheTTL caddy.Duration `json:"public_cache_ttl,omitempty"`
+
+	// Per-client rate limits applied before any GCS call.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+
+	// Budgets capping the bytes served per time window.
+	EgressBudgets []EgressBudget `json:"egress_budgets,omitempty"`
+
+	// HTTP endpoints notified of every successful PUT and DELETE.
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+
+	// Pub/Sub topic published an event for every successful PUT and DELETE,
+	// either `projects/<project>/topics/<topic>` or a topic in ProjectID.
+	PubSubTopic string `json:"pubsub_topic,omitempty"`
+
+	// Periodically write the PUT and DELETE events as NDJSON objects to a
+	// logs bucket.
+	AuditLog *AuditLog `json:"audit_log,omitempty"`
+
+	// External check that can veto uploads before they are written.
+	UploadValidator *UploadValidator `json:"upload_validator,omitempty"`
+
+	// Scan uploads with ClamAV, rejecting infected ones with a 422.
+	Antivirus *Antivirus `json:"antivirus,omitempty"`
+
+	// Local disk spool that accepts uploads while GCS is unavailable.
+	WriteSpool *WriteSpool `json:"write_spool,omitempty"`
+
+	// In-memory cache of small objects, filled by reads and by uploads.
+	Cache *Cache `json:"cache,omitempty"`
+
+	// Serve reads from the cache only, either always or after sustained GCS
+	// failures. Requires Cache.
+	Offline *Offline `json:"offline,omitempty"`
+
+	// Objects fetched into the cache at provision and optionally on a
+	// schedule. Requires Cache.
+	Prewarm *Prewarm `json:"prewarm,omitempty"`
+
+	// Issue a second identical read if GCS hasn't responded to the first
+	// within this delay, using whichever responds first. Default is 0, meaning
+	// no hedging.
+	HedgeDelay caddy.Duration `json:"hedge_delay,omitempty"`
+
+	// How long a read waits for GCS to start answering before it fails with
+	// a 504. Default is 0, meaning no limit.
+	FirstByteTimeout caddy.Duration `json:"first_byte_timeout,omitempty"`
+
+	// How long a read may take in total, including streaming the body to the
+	// client. Default is 0, meaning no limit, so large downloads aren't cut
+	// off mid-stream.
+	TransferTimeout caddy.Duration `json:"transfer_timeout,omitempty"`
+
+	// Periodically compare the bucket with a mirror bucket and report drift.
+	MirrorCheck *MirrorCheck `json:"mirror_check,omitempty"`
+
+	// Retry and timeout policies per kind of GCS operation: `get`, `put`,
+	// `delete` or `list`.
+	RetryPolicies map[string]RetryPolicy `json:"retry_policies,omitempty"`
+
+	// Buffer small PUT bodies so uploads failing with a transient GCS error
+	// are retried by the proxy.
+	ReplayablePut *ReplayablePut `json:"replayable_put,omitempty"`
+
+	// Buffer complete PUT bodies, in memory or a temp file, before writing
+	// them to GCS. Buffered uploads are retried regardless of their size if
+	// ReplayablePut is set.
+	BufferPuts *BufferPuts `json:"buffer_puts,omitempty"`
+
+	// Upper bound on the time spent on GCS operations for a request,
+	// streaming the response included. Default is 0, meaning none.
+	RequestTimeout caddy.Duration `json:"request_timeout,omitempty"`
+
+	// Request header clients can set a deadline for the request's GCS
+	// operations with, e.g. `X-Request-Timeout: 2s`.
+	DeadlineHeader string `json:"deadline_header,omitempty"`
+
+	// Explicit allowlist of HTTP methods. When set it is authoritative and any
+	// other method is rejected with a 405, otherwise the allowed methods are
+	// derived from EnablePut, EnableDelete and EnablePatch.
+	Methods []string `json:"methods,omitempty"`
+
+	// Flag to honor the X-HTTP-Method-Override header on POST requests so
+	// clients limited to GET/POST can still issue PUT and DELETE (default false)
+	MethodOverride bool `json:"method_override,omitempty"`
+
+	// Flag to enable browsing of "directories" in GCS (paths that end with a /).
+	// A directory's whole listing can also be streamed as newline delimited
+	// JSON with `?format=ndjson`.
 	EnableBrowse bool
 
-	// Path to a template file to use for generating browse dir html page
+	// How ETags are emitted per request path. The first rule matching the
+	// path applies, otherwise strong ETags are used.
+	ETags []ETagRule `json:"etags,omitempty"`
+
+	// Emit an Expires header per request path. The first rule matching the
+	// path applies.
+	Expires []ExpiresRule `json:"expires,omitempty"`
+
+	// Regular expression matching fingerprinted request paths, which are
+	// served with `Cache-Control: public, max-age=31536000, immutable`.
+	Immutable string `json:"immutable,omitempty"`
+
+	// Send a 103 Early Hints response with preload links for index pages
+	// before the index object body is streamed.
+	EarlyHints *EarlyHints `json:"early_hints,omitempty"`
+
+	// Flag to emit a `Digest` header with the MD5 and CRC32C GCS stores for
+	// each object (default false)
+	Digest bool `json:"digest,omitempty"`
+
+	// Charset appended to text/* and application/json Content-Types that
+	// lack one, e.g. `utf-8`.
+	Charset string `json:"charset,omitempty"`
+
+	// Content-Type for objects whose metadata and extension don't give one,
+	// e.g. `application/octet-stream`.
+	DefaultContentType string `json:"default_content_type,omitempty"`
+
+	// Encodings to serve precompressed sidecar objects for, in order of
+	// preference: `br`, `gzip` or `zstd`. A GET for `<key>` from a client
+	// accepting one of them is served `<key>.br`, `<key>.gz` or `<key>.zst`
+	// with the matching Content-Encoding if it exists, and `<key>`
+	// otherwise. Range requests are always served from `<key>`.
+	Precompressed []string `json:"precompressed,omitempty"`
+
+	// Compresses the bodies of objects stored uncompressed for clients
+	// accepting gzip or zstd.
+	Compress *Compress `json:"compress,omitempty"`
+
+	// Flag to serve an object's attributes as JSON for `?meta=json` requests
+	// (default false)
+	EnableMeta bool `json:"enable_meta,omitempty"`
+
+	// Serve the total size and number of objects under a directory as JSON
+	// for `GET <dir>/?du=1` requests.
+	DiskUsage *DiskUsage `json:"disk_usage,omitempty"`
+
+	// Serve a breakdown of the objects under a directory by content type and
+	// storage class, along with the largest, newest and oldest of them, as
+	// JSON for `GET <dir>/?stats=1` requests.
+	Stats *PrefixStats `json:"stats,omitempty"`
+
+	// Flag to treat `<dir>_$folder$` marker objects as directories in
+	// listings, and to redirect requests for a directory missing its trailing
+	// slash when it has a `<dir>/` or `<dir>_$folder$` marker (default false)
+	FolderMarkers bool `json:"folder_markers,omitempty"`
+
+	// Request path at which the bucket's location, storage class, versioning,
+	// retention policy and metageneration are served as JSON, e.g.
+	// `/_bucket`. Empty means no such endpoint.
+	BucketInfoPath string `json:"bucket_info_path,omitempty"`
+
+	// Requests taking longer than this are logged as a warning, with the key,
+	// the time spent in each GCS phase and the bytes transferred. Default is
+	// 0, meaning no slow request logging.
+	SlowRequestThreshold caddy.Duration `json:"slow_request_threshold,omitempty"`
+
+	// Path to a template file to use for generating browse dir html page.
+	// The template can also be kept in GCS as `gs://<bucket>/<key>`, or
+	// `gs:<key>` for a key in Bucket. It is reloaded whenever it changes,
+	// without a config reload.
 	BrowseTemplate string
 
+	// How often the browse templates are checked for changes. Default is 10s
+	// for a local file and 5m for a GCS key.
+	BrowseTemplateRefresh caddy.Duration `json:"browse_template_refresh,omitempty"`
+
+	// Flag to show the HTML of a listed directory's HEADER.html and
+	// FOOTER.html objects above and below the listing, like Apache's
+	// autoindex (default false). Templates get it as `.Header` and `.Footer`.
+	// The objects are rendered unescaped and trusted like templates, so
+	// anyone who can write them can run script on the site. They are left
+	// out of listings where clients may PUT, POST or MOVE them.
+	BrowseHeaderFooter bool `json:"browse_header_footer,omitempty"`
+
+	// Show the number of objects and total size of each directory of a
+	// browse listing.
+	BrowseDirUsage *BrowseDirUsage `json:"browse_dir_usage,omitempty"`
+
+	// Generate a robots.txt and mark paths as not to be indexed.
+	Robots *Robots `json:"robots,omitempty"`
+
+	// Browse templates and error pages served to visitors preferring other
+	// languages, picked by the request's Accept-Language.
+	Localizations []Localization `json:"localizations,omitempty"`
+
+	// Browse templates for some request paths, e.g. a release-style listing
+	// for `/downloads/*`. The first matching rule wins, BrowseTemplate is
+	// used for the other paths.
+	BrowseTemplates []BrowseTemplateRule `json:"browse_templates,omitempty"`
+
+	// Default and maximum number of keys listed per browse page, clients can
+	// ask for fewer with the `max` query parameter. Default is 1000.
+	MaxKeys int `json:"max_keys,omitempty"`
+
+	// What to do for a directory without an index object: `browse`, `403`,
+	// `404`, `redirect` to NoIndexRedirect or `pass_through` to the next
+	// handler. Default is browse if EnableBrowse is set, otherwise 403.
+	NoIndex string `json:"no_index,omitempty"`
+
+	// Redirect target for the `redirect` no_index policy, placeholders are
+	// evaluated per request.
+	NoIndexRedirect string `json:"no_index_redirect,omitempty"`
+
 	// Mapping of HTTP error status to GCS keys or pass through option.
 	ErrorPages map[int]string `json:"error_pages,omitempty"`
 
@@ -61,12 +447,48 @@ type GcsProxy struct {
 	DefaultErrorPage string `json:"default_error_page,omitempty"`
 
 	// Add GCS-specific fields
-	ProjectID       string `json:"project_id,omitempty"`
+	ProjectID string `json:"project_id,omitempty"`
+
+	// Service account key file. Its directory is watched for changes, and
+	// it is checked every 10s where that isn't possible. The GCS client is
+	// rebuilt with the new key when it is rotated.
 	CredentialsFile string `json:"credentials_file,omitempty"`
 
-	client      *storage.Client
-	bucket      *storage.BucketHandle
-	dirTemplate *template.Template
+	// Service account key files used instead of CredentialsFile for requests
+	// to some paths, so each path only gets the IAM permissions it needs.
+	PathCredentials []PathCredentials `json:"path_credentials,omitempty"`
+
+	// OAuth scopes of the GCS client's token: `read_only`, `read_write`,
+	// `full_control` or full scope URLs. Default is full control.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Project API calls are billed and counted against for quota, instead of
+	// the credentials' project.
+	QuotaProject string `json:"quota_project,omitempty"`
+
+	gcs         *clientHolder
+	pathClients []*clientHolder
+	dirTemplate *templateHolder
+	languages   *languageSet
+	release     *releaseState
+	templates   []*templateHolder
+	quotas      *quotaTracker
+	publicCheck *publicChecker
+	limiter     *rateLimiter
+	egress      []*egressCounter
+	sinks       []eventSink
+	cache       *objectCache
+	cacheKey    string
+	staged      *stagedUploads
+	buckets     *bucketRouter
+	immutable   *regexp.Regexp
+	offline     *offlineState
+	usage       *usageTracker
+	dirUsage    *usageTracker
+	stats       *statsTracker
+	hns         *hnsState
+	mirror      *mirrorChecker
+	ctx         context.Context
 	log         *zap.Logger
 }
 
@@ -79,6 +501,7 @@ func (GcsProxy) CaddyModule() caddy.ModuleInfo {
 }
 
 func (p *GcsProxy) Provision(ctx caddy.Context) (err error) {
+	p.ctx = ctx
 	p.log = ctx.Logger(p)
 
 	if p.Root == "" {
@@ -89,35 +512,197 @@ func (p *GcsProxy) Provision(ctx caddy.Context) (err error) {
 		p.IndexNames = defaultIndexNames
 	}
 
+	if p.bucketTemplated() {
+		if err := p.checkBucketTemplate(); err != nil {
+			return err
+		}
+	}
+	if len(p.BucketMap) > 0 {
+		if err := p.checkBucketMap(); err != nil {
+			return err
+		}
+	}
+
 	if p.ErrorPages == nil {
 		p.ErrorPages = make(map[int]string)
 	}
 
-	if p.EnableBrowse {
-		var tpl *template.Template
-		var err error
+	if _, ok := normalizationForms[p.NormalizeKeys]; p.NormalizeKeys != "" && !ok {
+		return fmt.Errorf("unsupported key normalization form: %s", p.NormalizeKeys)
+	}
 
-		if p.BrowseTemplate != "" {
-			tpl, err = template.ParseFiles(p.BrowseTemplate)
-			if err != nil {
-				return fmt.Errorf("parsing browse template file: %v", err)
-			}
-		} else {
-			tpl, err = template.New("default_listing").Parse(defaultBrowseTemplate)
-			if err != nil {
-				return fmt.Errorf("parsing default browse template: %v", err)
+	for i, method := range p.Methods {
+		method = strings.ToUpper(method)
+		if !slices.Contains(supportedMethods, method) {
+			return fmt.Errorf("unsupported method: %s", method)
+		}
+		p.Methods[i] = method
+	}
+
+	if p.SignedURLs != nil && p.SignedURLs.Secret == "" {
+		return errors.New("signed_urls requires a secret")
+	}
+	if p.SignedCookie != nil {
+		if p.SignedCookie.Secret == "" {
+			return errors.New("signed_cookie requires a secret")
+		}
+		if p.SignedCookie.MintPath != "" && len(p.SignedCookie.MintPrefixes) == 0 {
+			return errors.New("signed_cookie mint_path requires mint_prefixes")
+		}
+		if p.SignedCookie.Name == "" {
+			p.SignedCookie.Name = defaultSignedCookieName
+		}
+		if p.SignedCookie.TTL == 0 {
+			p.SignedCookie.TTL = caddy.Duration(defaultSignedCookieTTL)
+		}
+	}
+
+	if p.PublicOnly {
+		p.publicCheck = newPublicChecker(time.Duration(p.PublicCacheTTL), p.log)
+	}
+
+	if p.RateLimit != nil {
+		p.limiter = newRateLimiter(*p.RateLimit)
+	}
+
+	if len(p.EgressBudgets) > 0 {
+		p.egress = newEgressCounters(p.EgressBudgets)
+	}
+
+	for _, hook := range p.Webhooks {
+		p.sinks = append(p.sinks, newWebhookSink(hook))
+	}
+
+	if p.Cache != nil {
+		if err := registerCacheMetrics(ctx); err != nil {
+			return fmt.Errorf("registering cache metrics: %v", err)
+		}
+		if err := p.loadCache(); err != nil {
+			return fmt.Errorf("loading cache: %v", err)
+		}
+	}
+
+	if len(p.BucketMap) > 0 {
+		if err := p.provisionBucketMap(); err != nil {
+			return err
+		}
+	}
+
+	if p.Offline != nil {
+		if p.cache == nil {
+			return errors.New("offline requires cache to be configured")
+		}
+		if p.Offline.Mode != "on" && p.Offline.Mode != "auto" {
+			return fmt.Errorf("invalid offline mode: %s", p.Offline.Mode)
+		}
+		p.offline = newOfflineState(*p.Offline, p.log)
+	}
+
+	if p.DiskUsage != nil {
+		p.usage = newUsageTracker(*p.DiskUsage)
+	}
+	if p.Stats != nil {
+		p.stats = newStatsTracker(*p.Stats)
+	}
+	if p.BrowseDirUsage != nil {
+		if p.BrowseDirUsage.MaxObjects <= 0 {
+			p.BrowseDirUsage.MaxObjects = defaultBrowseDirUsageMaxObjects
+		}
+		if p.BrowseDirUsage.MaxDirs <= 0 {
+			p.BrowseDirUsage.MaxDirs = defaultBrowseDirUsageMaxDirs
+		}
+		if p.BrowseDirUsage.TTL <= 0 {
+			p.BrowseDirUsage.TTL = caddy.Duration(defaultBrowseDirUsageTTL)
+		}
+		p.dirUsage = newUsageTracker(DiskUsage{MaxObjects: p.BrowseDirUsage.MaxObjects, TTL: p.BrowseDirUsage.TTL})
+	}
+
+	if p.ReplayablePut != nil && p.ReplayablePut.MaxSize <= 0 {
+		p.ReplayablePut.MaxSize = defaultReplayMaxSize
+	}
+
+	if p.Prewarm != nil && p.cache == nil {
+		return errors.New("prewarm requires cache to be configured")
+	}
+
+	if len(p.Quotas) > 0 {
+		p.quotas = newQuotaTracker(time.Duration(p.QuotaRefresh))
+	}
+
+	if p.HideStatus == "" {
+		p.HideStatus = "404"
+	}
+
+	for _, encoding := range p.Precompressed {
+		if _, ok := precompressedSuffixes[encoding]; !ok {
+			return fmt.Errorf("unsupported precompressed encoding: %s", encoding)
+		}
+	}
+
+	if p.Compress != nil {
+		if len(p.Compress.Encodings) == 0 {
+			p.Compress.Encodings = compressEncodings
+		}
+		for _, encoding := range p.Compress.Encodings {
+			if !slices.Contains(compressEncodings, encoding) {
+				return fmt.Errorf("unsupported compress encoding: %s", encoding)
 			}
 		}
-		p.dirTemplate = tpl
+		if len(p.Compress.Types) == 0 {
+			p.Compress.Types = defaultCompressTypes
+		}
+		if p.Compress.MinLength <= 0 {
+			p.Compress.MinLength = defaultCompressMinLength
+		}
+	}
+	switch p.HideStatus {
+	case "403", "404", "pass_through":
+	default:
+		return fmt.Errorf("invalid hide_status: %s", p.HideStatus)
+	}
+
+	if p.Immutable != "" {
+		p.immutable, err = regexp.Compile(p.Immutable)
+		if err != nil {
+			return fmt.Errorf("parsing immutable pattern: %v", err)
+		}
 	}
 
-	// Create GCS client
-	var opts []option.ClientOption
-	if p.CredentialsFile != "" {
-		opts = append(opts, option.WithCredentialsFile(p.CredentialsFile))
+	for op, rp := range p.RetryPolicies {
+		if !slices.Contains(retryOps, op) {
+			return fmt.Errorf("invalid retry operation: %s", op)
+		}
+		if rp.Policy != "" && rp.Policy != "always" && rp.Policy != "idempotent" && rp.Policy != "never" {
+			return fmt.Errorf("invalid retry policy for %s: %s", op, rp.Policy)
+		}
 	}
 
-	client, err := storage.NewClient(context.Background(), opts...)
+	for _, rule := range p.ETags {
+		if rule.Mode != "strong" && rule.Mode != "weak" && rule.Mode != "off" {
+			return fmt.Errorf("invalid etag mode: %s", rule.Mode)
+		}
+	}
+
+	switch p.NoIndex {
+	case "", "403", "404", "pass_through":
+	case "browse":
+		p.EnableBrowse = true
+	case "redirect":
+		if p.NoIndexRedirect == "" {
+			return errors.New("no_index redirect requires a target")
+		}
+	default:
+		return fmt.Errorf("invalid no_index policy: %s", p.NoIndex)
+	}
+
+	for _, scope := range p.Scopes {
+		if _, err := oauthScope(scope); err != nil {
+			return err
+		}
+	}
+
+	// Create GCS client
+	client, err := p.newStorageClient(context.Background())
 	if err != nil {
 		p.log.Error("could not create GCS client",
 			zap.String("error", err.Error()),
@@ -125,16 +710,198 @@ func (p *GcsProxy) Provision(ctx caddy.Context) (err error) {
 		return err
 	}
 
-	p.client = client
-	p.bucket = client.Bucket(p.Bucket)
+	if p.PubSubTopic != "" {
+		sink, err := newPubsubSink(ctx, p.PubSubTopic, p.ProjectID, p.clientOptions()...)
+		if err != nil {
+			return fmt.Errorf("creating pubsub client: %v", err)
+		}
+		p.sinks = append(p.sinks, sink)
+	}
+
+	p.hns = &hnsState{}
+	p.gcs = &clientHolder{}
+	p.gcs.current.Store(client)
+	if p.CredentialsFile != "" {
+		go p.watchCredentials(ctx)
+	}
+	if p.AuditLog != nil {
+		audit := p.newAuditLogSink()
+		p.sinks = append(p.sinks, audit)
+		go audit.run(ctx)
+	}
+	for _, rule := range p.PathCredentials {
+		if rule.CredentialsFile == "" || len(rule.Paths) == 0 {
+			return errors.New("path credentials require a credentials file and path patterns")
+		}
+		holder, err := p.newPathClient(ctx, rule.CredentialsFile)
+		if err != nil {
+			return fmt.Errorf("creating GCS client for %s: %v", rule.CredentialsFile, err)
+		}
+		p.pathClients = append(p.pathClients, holder)
+	}
+
+	if p.EnableBrowse {
+		if p.dirTemplate, err = p.loadBrowseTemplate(ctx, client, p.BrowseTemplate); err != nil {
+			return fmt.Errorf("parsing browse template: %v", err)
+		}
+		for _, rule := range p.BrowseTemplates {
+			if rule.Template == "" || len(rule.Paths) == 0 {
+				return errors.New("browse template rules require a template and path patterns")
+			}
+			h, err := p.loadBrowseTemplate(ctx, client, rule.Template)
+			if err != nil {
+				return fmt.Errorf("parsing browse template %s: %v", rule.Template, err)
+			}
+			p.templates = append(p.templates, h)
+		}
+	}
+
+	if len(p.Localizations) > 0 {
+		if p.languages, err = p.newLanguageSet(ctx, client); err != nil {
+			return err
+		}
+	}
+
+	if p.FormUploads != nil && p.FormUploads.MaxFiles <= 0 {
+		p.FormUploads.MaxFiles = defaultFormUploadsMaxFiles
+	}
+
+	if p.ReleasePointer != nil {
+		if p.ReleasePointer.Key == "" {
+			return errors.New("release_pointer requires a key")
+		}
+		if p.ReleasePointer.TTL <= 0 {
+			p.ReleasePointer.TTL = caddy.Duration(defaultReleaseTTL)
+		}
+		p.release = &releaseState{}
+	}
+
+	if p.Regions != nil && (p.Regions.Region == "" || len(p.Regions.Buckets) == 0) {
+		return errors.New("regions requires a region placeholder and at least one bucket")
+	}
+
+	if p.ClientPrefixes != nil {
+		if len(p.ClientPrefixes.Clients) == 0 {
+			return errors.New("client_prefixes requires at least one client")
+		}
+		if p.ClientPrefixes.Identity == "" {
+			p.ClientPrefixes.Identity = defaultClientIdentity
+		}
+	}
+
+	if p.PinGenerations != nil {
+		if p.PinGenerations.Cookie == "" {
+			p.PinGenerations.Cookie = defaultPinCookie
+		}
+		if p.PinGenerations.Param == "" {
+			p.PinGenerations.Param = defaultPinParam
+		}
+		if p.PinGenerations.MaxAge <= 0 {
+			p.PinGenerations.MaxAge = caddy.Duration(defaultPinMaxAge)
+		}
+	}
+
+	if p.WriteSpool != nil {
+		if p.WriteSpool.MaxRetryInterval == 0 {
+			p.WriteSpool.MaxRetryInterval = caddy.Duration(defaultSpoolMaxRetryInterval)
+		}
+		if p.WriteSpool.MaxAge == 0 {
+			p.WriteSpool.MaxAge = caddy.Duration(defaultSpoolMaxAge)
+		}
+		if err := os.MkdirAll(p.WriteSpool.Dir, 0o700); err != nil {
+			return fmt.Errorf("creating write spool directory: %v", err)
+		}
+		go p.runSpool(ctx)
+	}
+
+	if p.ResumableUploads != nil {
+		if p.ResumableUploads.ChunkSize%uploadChunkMultiple != 0 {
+			return errors.New("resumable_uploads chunk_size must be a multiple of 256KiB")
+		}
+		if p.ResumableUploads.Dir != "" {
+			if p.ResumableUploads.MaxAge <= 0 {
+				p.ResumableUploads.MaxAge = caddy.Duration(defaultStagedUploadMaxAge)
+			}
+			if p.ResumableUploads.MaxSize <= 0 {
+				p.ResumableUploads.MaxSize = defaultStagedUploadMaxSize
+			}
+			if err := os.MkdirAll(p.ResumableUploads.Dir, 0o700); err != nil {
+				return fmt.Errorf("creating resumable upload directory: %v", err)
+			}
+			p.staged = &stagedUploads{active: make(map[string]bool)}
+			go p.runStagedUploadSweeper(ctx)
+		}
+	}
+
+	if p.Prewarm != nil {
+		go p.runPrewarm(ctx)
+	}
+
+	if p.ExpireUploads != nil {
+		if p.ExpireUploads.After <= 0 {
+			return errors.New("expire_uploads requires a positive duration")
+		}
+		if p.ExpireUploads.SweepInterval > 0 {
+			go p.runExpirySweeper(ctx)
+		}
+	}
+
+	if p.MirrorCheck != nil {
+		if p.MirrorCheck.Bucket == "" {
+			return errors.New("mirror_check requires a mirror bucket")
+		}
+		if err := registerMirrorMetrics(ctx); err != nil {
+			return fmt.Errorf("registering mirror metrics: %v", err)
+		}
+		p.mirror = p.newMirrorChecker()
+		go p.mirror.run(ctx)
+	}
+
+	registerProxy(p)
+	if p.Cache != nil {
+		updateCacheBudget()
+	}
+
 	p.log.Info("GCS proxy initialized for bucket: " + p.Bucket)
 
 	return nil
 }
 
-func (p GcsProxy) getGcsObject(bucket string, path string, headers http.Header) (*storage.Reader, error) {
-	ctx := context.Background()
-	obj := p.bucket.Object(path)
+// Cleanup removes the handler from those the admin API acts on, closes the
+// storage control client, if one was created, and releases the handler's
+// reference to its shared cache.
+func (p *GcsProxy) Cleanup() error {
+	unregisterProxy(p)
+	if p.Cache != nil {
+		updateCacheBudget()
+	}
+	if p.gcs != nil {
+		p.gcs.close()
+	}
+	for _, holder := range p.pathClients {
+		holder.close()
+	}
+	if p.hns != nil {
+		if err := p.hns.close(); err != nil {
+			return err
+		}
+	}
+	if p.buckets != nil {
+		for _, key := range p.buckets.cacheKeys {
+			if _, err := cachePool.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	if p.cacheKey != "" {
+		_, err := cachePool.Delete(p.cacheKey)
+		return err
+	}
+	return nil
+}
+
+func (p GcsProxy) getGcsObject(ctx context.Context, bucket string, path string, headers http.Header) (*storage.Reader, error) {
+	obj := p.bucketHandle().Object(path)
 	if ifMatch := headers.Get("If-Match"); ifMatch != "" {
 		// Parse generation from ETag which is in format "\"<generation>\""
 		if len(ifMatch) > 2 {
@@ -149,116 +916,576 @@ func (p GcsProxy) getGcsObject(bucket string, path string, headers http.Header)
 	return obj.NewReader(ctx)
 }
 
-func joinPath(root string, uriPath string) string {
-	isDir := uriPath[len(uriPath)-1:] == "/"
-	newPath := path.Join(root, uriPath)
-	if isDir && newPath != "/" {
-		// Join will strip the ending /
-		// add it back if it was there as it implies a dir view
-		return newPath + "/"
+// resolveRoot evaluates the placeholders in Root for the current request.
+// Request derived values are escaped so each one can only ever fill a single
+// path segment, which keeps a root like `/home/{http.auth.user.id}/` confined
+// to that user's prefix.
+func (p GcsProxy) resolveRoot(repl *caddy.Replacer) (string, error) {
+	root, err := p.resolveKeyTemplate(repl, p.Root)
+	if err != nil || p.release == nil {
+		return root, err
+	}
+	release, err := p.releasePrefix()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(root, release), nil
+}
+
+// staticRoot returns the root for requests when it doesn't depend on them.
+// The `{http.vars.root}` placeholder, the default root, is taken as empty,
+// as it is without a `root` directive. It returns false if the root has any
+// other placeholder.
+func (p GcsProxy) staticRoot() (string, bool) {
+	repl := caddy.NewEmptyReplacer()
+	repl.Set("http.vars.root", "")
+	root := repl.ReplaceKnown(p.Root, "")
+	return root, !strings.Contains(root, "{")
+}
+
+// resolveKeyTemplate evaluates the placeholders in a key or key prefix
+// template with the same escaping rules as the root.
+func (p GcsProxy) resolveKeyTemplate(repl *caddy.Replacer, tmpl string) (string, error) {
+	return resolvePathTemplate(repl, tmpl)
+}
+
+// resolvePathTemplate evaluates the placeholders in a path template, escaping
+// request derived values so each one fills a single path segment.
+func resolvePathTemplate(repl *caddy.Replacer, tmpl string) (string, error) {
+	return repl.ReplaceFunc(tmpl, func(placeholder string, val any) (any, error) {
+		if !strings.HasPrefix(placeholder, "http.") || placeholder == "http.vars.root" {
+			return val, nil
+		}
+		segment := caddy.ToString(val)
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, fmt.Errorf("placeholder {%s} is not a valid path segment: %q", placeholder, segment)
+		}
+		return url.PathEscape(segment), nil
+	})
+}
+
+// cleanPath returns uriPath with `.` and `..` elements and repeated
+// slashes resolved the way joinPath resolves them, keeping a trailing slash.
+func cleanPath(uriPath string) string {
+	if uriPath == "" {
+		return "/"
+	}
+	return joinPath("/", uriPath)
+}
+
+// withCleanPath returns r, or a copy of it whose URL path is cleaned, so path
+// rules are matched against the path the key is made from and
+// `/uploads/../index.html` can't pass a rule for `/uploads/*`.
+func withCleanPath(r *http.Request) *http.Request {
+	cleaned := cleanPath(r.URL.Path)
+	if cleaned == r.URL.Path {
+		return r
+	}
+	r = r.WithContext(r.Context())
+	u := *r.URL
+	u.Path, u.RawPath = cleaned, ""
+	r.URL = &u
+	return r
+}
+
+func joinPath(root string, uriPath string) string {
+	isDir := uriPath[len(uriPath)-1:] == "/"
+	// Clean the request path on its own first so it can never climb above root
+	newPath := path.Join(root, path.Clean("/"+uriPath))
+	if isDir && newPath != "/" {
+		// Join will strip the ending /
+		// add it back if it was there as it implies a dir view
+		return newPath + "/"
+	}
+	return newPath
+}
+
+func (p GcsProxy) PutHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	if p.staged != nil && r.Header.Get("Content-Range") != "" {
+		return p.ChunkedPutHandler(w, r, key)
+	}
+
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opPut)
+	defer cancelOp()
+
+	body := newChecksumReader(r)
+	decompress := p.DecompressUploads && gzipEncoded(r)
+	if decompress {
+		gunzipped, err := gzip.NewReader(body)
+		if err != nil {
+			return uploadError(err)
+		}
+		defer gunzipped.Close()
+		body = gunzipped
+
+		// The decompressed length is only known once the body has been read
+		r = r.WithContext(r.Context())
+		r.ContentLength = -1
+	}
+	replaced := int64(-1)
+	if p.quotas != nil {
+		qw, err := p.checkQuotas(ctx, w, r, key, r.ContentLength)
+		if err != nil {
+			return err
+		}
+		defer qw.release()
+		if qw.remaining >= 0 {
+			body = &quotaReader{r: body, remaining: qw.remaining}
+		}
+		replaced = qw.replaced
+	}
+
+	var buffered replayable
+	if p.BufferPuts != nil {
+		var release func()
+		var err error
+		if buffered, release, err = p.BufferPuts.buffer(body); err != nil {
+			return uploadError(err)
+		}
+		defer release()
+		if body, err = buffered.Reader(); err != nil {
+			return err
+		}
+	}
+
+	if p.UploadValidator != nil {
+		info := p.newUploadInfo(r, key)
+		validated, err := p.UploadValidator.validate(ctx, info, body)
+		if verr, isRejected := err.(validationError); isRejected {
+			p.log.Info("upload rejected by validator",
+				zap.String("key", key),
+				zap.String("reason", verr.reason),
+			)
+			return caddyhttp.Error(http.StatusForbidden, err)
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusServiceUnavailable, err)
+		}
+		body = validated
+	}
+
+	if p.Antivirus != nil {
+		scanned := buffered
+		if scanned == nil {
+			spooled, err := spoolBody(body, "")
+			if err != nil {
+				return uploadError(err)
+			}
+			defer spooled.Close()
+			scanned = spooled
+		}
+
+		var err error
+		if body, err = scanned.Reader(); err != nil {
+			return err
+		}
+		result, err := p.Antivirus.scan(ctx, body)
+		if err != nil {
+			p.log.Error("could not scan upload",
+				zap.String("key", key),
+				zap.String("err", err.Error()),
+			)
+			return caddyhttp.Error(http.StatusServiceUnavailable, err)
+		}
+		if result.Infected {
+			p.log.Warn("rejected infected upload",
+				zap.String("key", key),
+				zap.String("signature", result.Signature),
+			)
+			err = fmt.Errorf("upload rejected: %s", result.Signature)
+			return caddyhttp.Error(http.StatusUnprocessableEntity, err)
+		}
+		if body, err = scanned.Reader(); err != nil {
+			return err
+		}
+	}
+
+	var spooled *spooledBody
+	if p.WriteSpool != nil {
+		var err error
+		if spooled, err = spoolBody(body, p.WriteSpool.Dir); err != nil {
+			return uploadError(err)
+		}
+		defer spooled.Close()
+		if body, err = spooled.Reader(); err != nil {
+			return err
+		}
+	}
+
+	var replay replayable
+	if spooled != nil {
+		replay = spooled
+	} else if buffered != nil {
+		replay = buffered
+	} else if p.ReplayablePut != nil && r.ContentLength >= 0 && r.ContentLength <= p.ReplayablePut.MaxSize {
+		buffered, release, err := bufferBody(body, r.ContentLength)
+		if err != nil {
+			return uploadError(err)
+		}
+		defer release()
+		replay = buffered
 	}
-	return newPath
-}
 
-func (p GcsProxy) PutHandler(w http.ResponseWriter, r *http.Request, key string) error {
-	ctx := context.Background()
-	obj := p.bucket.Object(key)
-	writer := obj.NewWriter(ctx)
+	obj := p.objectFor(opPut, key)
+	objAttrs := storage.ObjectAttrs{Name: key}
 
 	// Copy headers
 	if contentType := r.Header.Get("Content-Type"); contentType != "" {
-		writer.ContentType = contentType
+		objAttrs.ContentType = contentType
 	}
 	// ... copy other relevant headers ...
+	applyContentEncoding(r, &objAttrs)
+	if decompress {
+		objAttrs.ContentEncoding = ""
+	}
 
-	if _, err := io.Copy(writer, r.Body); err != nil {
-		return convertToCaddyError(err)
+	if err := p.applyHolds(r, &objAttrs); err != nil {
+		return err
 	}
-	if err := writer.Close(); err != nil {
-		return convertToCaddyError(err)
+
+	if len(p.UploadMetadata) > 0 {
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		objAttrs.Metadata = make(map[string]string, len(p.UploadMetadata))
+		for name, value := range p.UploadMetadata {
+			if value = repl.ReplaceAll(value, ""); value != "" {
+				objAttrs.Metadata[privateMetadataPrefix+name] = value
+			}
+		}
+	}
+	p.applyExpiry(r.URL.Path, &objAttrs)
+
+	// The cache capture restarts with every attempt at the upload
+	var capture *cacheCapture
+	tee := func(body io.Reader) io.Reader {
+		if p.cache == nil {
+			return body
+		}
+		capture = &cacheCapture{limit: p.cache.config.MaxObjectSize}
+		return io.TeeReader(body, capture)
+	}
+
+	var written *storage.ObjectAttrs
+	var err error
+	start := time.Now()
+	if replay != nil && p.ReplayablePut != nil {
+		written, err = p.writeReplayable(ctx, obj, objAttrs, replay, tee)
+	} else {
+		written, err = p.writeObject(ctx, obj, objAttrs, tee(body))
+	}
+	recordPhase(ctx, "upload", start)
+	if err != nil {
+		if spooled != nil && isTransient(err) {
+			return p.spoolFailedUpload(w, spooled, objAttrs, err)
+		}
+		return uploadError(err)
+	}
+
+	if p.quotas != nil {
+		p.recordQuotaWrite(r, key, written.Size, replaced)
 	}
 
+	if capture != nil {
+		if capture.over {
+			p.cache.delete(key)
+		} else {
+			p.cache.put(key, written, capture.buf.Bytes())
+		}
+	}
+
+	p.notify(p.newMutationEvent(r, key, written))
+
 	// Set ETag header from object generation
-	attrs, err := obj.Attrs(ctx)
-	if err == nil {
-		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", attrs.Generation))
+	if etag := p.etag(r.URL.Path, written.Generation); etag != "" {
+		w.Header().Set("ETag", etag)
 	}
 
 	return nil
 }
 
+// newUploadInfo describes the upload in r for an upload validator.
+func (p GcsProxy) newUploadInfo(r *http.Request, key string) uploadInfo {
+	ev := p.newMutationEvent(r, key, nil)
+	return uploadInfo{
+		Bucket:        p.Bucket,
+		Key:           key,
+		ContentType:   r.Header.Get("Content-Type"),
+		ContentLength: r.ContentLength,
+		Client:        ev.Client,
+		User:          ev.User,
+	}
+}
+
+// uploadError converts an error reading an upload body to a caddy error.
+func uploadError(err error) error {
+	if err == errQuotaExceeded {
+		return caddyhttp.Error(http.StatusInsufficientStorage, err)
+	}
+	if errors.Is(err, errChecksumMismatch) || isGzipError(err) {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	return convertToCaddyError(err)
+}
+
 func (p GcsProxy) DeleteHandler(w http.ResponseWriter, r *http.Request, key string) error {
 	isDir := strings.HasSuffix(key, "/")
-	if isDir || !p.EnableDelete {
+	if isDir || !p.methodAllowed(http.MethodDelete, r.URL.Path) {
 		err := errors.New("method not allowed")
 		return caddyhttp.Error(http.StatusMethodNotAllowed, err)
 	}
-	ctx := context.Background()
-	obj := p.bucket.Object(key)
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opDelete)
+	defer cancelOp()
+	start := time.Now()
+	obj := p.objectFor(opDelete, key)
 	err := obj.Delete(ctx)
+	recordPhase(ctx, "delete", start)
 	if err != nil {
 		return convertToCaddyError(err)
 	}
 
+	if p.quotas != nil {
+		p.recordQuotaDelete(r, key)
+	}
+
+	if p.cache != nil {
+		p.cache.delete(key)
+	}
+
+	p.notify(p.newMutationEvent(r, key, nil))
+
 	return nil
 }
 
 func (p GcsProxy) BrowseHandler(w http.ResponseWriter, r *http.Request, key string) error {
-	ctx := context.Background()
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opList)
+	defer cancelOp()
+
+	if err := p.checkPublicListing(ctx); err != nil {
+		return err
+	}
 
 	// Create a prefix iterator
-	it := p.bucket.Objects(ctx, &storage.Query{
-		Prefix:    key,
-		Delimiter: "/",
-	})
+	query := p.ConstructListParams(r, key)
+	if p.EnableFolders && p.hierarchical(ctx) {
+		// Lists empty folders too
+		query.IncludeFoldersAsPrefixes = true
+	}
+	defer recordPhase(ctx, "list", time.Now())
+	it := p.bucketFor(opList).Objects(ctx, query)
+	it.PageInfo().MaxSize = p.pageSize(r)
+	it.PageInfo().Token = r.URL.Query().Get("next")
+
+	po, err := p.makePageObj(it, query.Prefix)
+	if err != nil {
+		var apiErr *googleapi.Error
+		if query.MatchGlob != "" && errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		return convertToCaddyError(err)
+	}
+	if po.MoreLink != "" {
+		for _, param := range []string{"glob", "sort", "order", "format"} {
+			if value := r.URL.Query().Get(param); value != "" {
+				po.MoreLink += "&" + param + "=" + url.QueryEscape(value)
+			}
+		}
+	}
+
+	if p.BrowseDirUsage != nil {
+		p.addDirUsage(ctx, &po, query.Prefix)
+	}
+	sortItems(po.Items, r.URL.Query().Get("sort"), r.URL.Query().Get("order"))
+	po.setPath(browsePath(r))
+	if p.Robots != nil && p.Robots.NoIndexBrowse {
+		w.Header().Set("X-Robots-Tag", "noindex")
+	}
+	w.Header().Add("Vary", "Accept")
+	var tpl *template.Template
+	if r.URL.Query().Get("format") != "json" && !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		if p.BrowseHeaderFooter {
+			p.addHeaderFooter(ctx, &po, query.Prefix, r.URL.Path)
+		}
+		if p.languages != nil {
+			w.Header().Add("Vary", "Accept-Language")
+		}
+		tpl = p.browseTemplateFor(r)
+	}
+
+	// The page is rendered before the conditional check, so its ETag covers
+	// the representation, template, header, footer and usage as well
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	contentType, err := po.render(buf, tpl)
+	if err != nil {
+		return err
+	}
+	etag := po.bodyEtag(buf.Bytes())
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		return caddyhttp.Error(http.StatusNotModified, nil)
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, err = buf.WriteTo(w)
+	return err
+}
 
-	var result []storage.ObjectAttrs
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
+// etag returns the ETag for an object generation served at reqPath, or an
+// empty string if ETags are turned off for it.
+func (p GcsProxy) etag(reqPath string, generation int64) string {
+	mode := "strong"
+	for _, rule := range p.ETags {
+		if len(rule.Paths) == 0 || pathMatches(rule.Paths, reqPath) {
+			mode = rule.Mode
 			break
 		}
-		if err != nil {
-			return convertToCaddyError(err)
+	}
+
+	switch mode {
+	case "off":
+		return ""
+	case "weak":
+		return fmt.Sprintf("W/\"%d\"", generation)
+	}
+	return fmt.Sprintf("\"%d\"", generation)
+}
+
+// expires returns the Expires time for a response to reqPath, from the first
+// matching rule's duration or else the max-age in cacheControl.
+func (p GcsProxy) expires(reqPath string, cacheControl string) (time.Time, bool) {
+	for _, rule := range p.Expires {
+		if len(rule.Paths) > 0 && !pathMatches(rule.Paths, reqPath) {
+			continue
+		}
+		if rule.Duration > 0 {
+			return time.Now().Add(time.Duration(rule.Duration)), true
+		}
+		for _, directive := range strings.Split(cacheControl, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if strings.ToLower(name) == "max-age" {
+				if seconds, err := strconv.Atoi(value); err == nil {
+					return time.Now().Add(time.Duration(seconds) * time.Second), true
+				}
+			}
 		}
-		result = append(result, *attrs)
+		return time.Time{}, false
 	}
+	return time.Time{}, false
+}
 
-	// Convert result to your page object format and generate response
-	// ... existing response generation code ...
+// objectDigest returns an RFC 3230 Digest header value from the hashes GCS
+// stores for an object. Composite objects have no MD5.
+func objectDigest(attrs *storage.ObjectAttrs) string {
+	var digests []string
+	if len(attrs.MD5) > 0 {
+		digests = append(digests, "md5="+base64.StdEncoding.EncodeToString(attrs.MD5))
+	}
+	if attrs.CRC32C != 0 {
+		crc := binary.BigEndian.AppendUint32(nil, attrs.CRC32C)
+		digests = append(digests, "crc32c="+base64.StdEncoding.EncodeToString(crc))
+	}
+	return strings.Join(digests, ",")
+}
 
-	return nil
+// contentType returns the Content-Type to serve an object with. It falls back
+// to the type for the key's extension and then DefaultContentType, and
+// appends Charset to textual types that lack one.
+func (p GcsProxy) contentType(attrs *storage.ObjectAttrs) string {
+	contentType := attrs.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(attrs.Name))
+	}
+	if contentType == "" {
+		contentType = p.DefaultContentType
+	}
+	if contentType == "" || p.Charset == "" || strings.Contains(strings.ToLower(contentType), "charset=") {
+		return contentType
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" {
+		contentType += "; charset=" + p.Charset
+	}
+	return contentType
 }
 
-func (p GcsProxy) writeResponseFromGetObject(w http.ResponseWriter, reader *storage.Reader, attrs *storage.ObjectAttrs) error {
+func (p GcsProxy) writeResponseFromGetObject(w http.ResponseWriter, r *http.Request, reader io.Reader, attrs *storage.ObjectAttrs) error {
+	compress := p.compressEncoding(r, attrs)
+	decompress := decompressStored(r, attrs)
+	if p.compressible(attrs) || strings.EqualFold(attrs.ContentEncoding, "gzip") {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
 	// Copy headers from GCS response to our response
 	if attrs.CacheControl != "" {
 		w.Header().Set("Cache-Control", attrs.CacheControl)
 	}
+	if p.immutable != nil && p.immutable.MatchString(r.URL.Path) {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	}
 	if attrs.ContentDisposition != "" {
 		w.Header().Set("Content-Disposition", attrs.ContentDisposition)
 	}
-	if attrs.ContentEncoding != "" {
+	if attrs.ContentEncoding != "" && !decompress {
 		w.Header().Set("Content-Encoding", attrs.ContentEncoding)
 	}
+	if compress != "" {
+		w.Header().Set("Content-Encoding", compress)
+	}
 	if attrs.ContentLanguage != "" {
 		w.Header().Set("Content-Language", attrs.ContentLanguage)
 	}
-	if attrs.ContentType != "" {
-		w.Header().Set("Content-Type", attrs.ContentType)
+	if contentType := p.contentType(attrs); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if attrs.ContentEncoding == "" && compress == "" {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	if etag := p.etag(r.URL.Path, attrs.Generation); etag != "" {
+		// The compressed or decompressed body differs byte for byte from
+		// the stored one, so it only gets a weak ETag
+		if (compress != "" || decompress) && !strings.HasPrefix(etag, "W/") {
+			etag = "W/" + etag
+		}
+		w.Header().Set("ETag", etag)
+	}
+	// The digest is of the stored bytes
+	if p.Digest && compress == "" && !decompress {
+		if digest := objectDigest(attrs); digest != "" {
+			w.Header().Set("Digest", digest)
+		}
 	}
-	w.Header().Set("ETag", fmt.Sprintf("\"%d\"", attrs.Generation))
 	if !attrs.Updated.IsZero() {
 		w.Header().Set("Last-Modified", attrs.Updated.UTC().Format(http.TimeFormat))
 	}
 
 	// Copy metadata
-	for key, value := range attrs.Metadata {
+	for key, value := range publicMetadata(attrs.Metadata) {
 		w.Header().Set(key, value)
 	}
 
+	if expires, ok := p.expires(r.URL.Path, w.Header().Get("Cache-Control")); ok {
+		w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+	}
+
 	// Copy the body
 	if reader != nil {
+		defer recordPhase(r.Context(), "transfer", time.Now())
+		if compress != "" {
+			return compressTo(w, reader, compress)
+		}
+		if decompress {
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			reader = gz
+		}
 		_, err := io.Copy(w, reader)
 		return err
 	}
@@ -266,45 +1493,102 @@ func (p GcsProxy) writeResponseFromGetObject(w http.ResponseWriter, reader *stor
 	return nil
 }
 
-func (p GcsProxy) serveErrorPage(w http.ResponseWriter, gcsKey string) error {
-	ctx := context.Background()
-	obj := p.bucket.Object(gcsKey)
+func (p GcsProxy) serveErrorPage(w http.ResponseWriter, r *http.Request, gcsKey string) error {
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
 
-	reader, err := obj.NewReader(ctx)
+	reader, attrs, err := p.openObject(ctx, gcsKey)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
 
-	attrs, err := obj.Attrs(ctx)
-	if err != nil {
-		return err
-	}
-
-	return p.writeResponseFromGetObject(w, reader, attrs)
+	return p.writeResponseFromGetObject(w, r, reader, attrs)
 }
 
 // ServeHTTP implements the main entry point for a request for the caddyhttp.Handler interface.
 func (p GcsProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 
-	fullPath := joinPath(repl.ReplaceAll(p.Root, ""), r.URL.Path)
+	if p.MethodOverride && r.Method == http.MethodPost {
+		if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+			p.log.Debug("method override",
+				zap.String("method", r.Method),
+				zap.String("override", override),
+			)
+			r = r.WithContext(r.Context())
+			r.Method = strings.ToUpper(override)
+		}
+	}
+	passThrough := r
+	r = withCleanPath(r)
 
-	var err error
-	switch r.Method {
-	case http.MethodGet:
-		err = p.GetHandler(w, r, fullPath)
-	case http.MethodPut:
-		err = p.PutHandler(w, r, fullPath)
-	case http.MethodDelete:
-		err = p.DeleteHandler(w, r, fullPath)
-	default:
-		err = caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	if p.SignedCookie != nil && p.SignedCookie.MintPath != "" && r.URL.Path == p.SignedCookie.MintPath {
+		return p.SignedCookie.mintCookie(w, r)
+	}
+
+	if p.buckets != nil {
+		if bucket := p.mappedBucket(r); bucket != p.Bucket {
+			p.Bucket, p.Regions = bucket, nil
+			p.cache = p.buckets.caches[bucket]
+		}
+	}
+
+	root, rootErr := p.requestRoot(r, repl)
+	if rootErr == nil && p.bucketTemplated() {
+		p.Bucket, rootErr = p.resolveBucket(repl)
+	}
+	fullPath := p.keyFor(root, r.URL.Path)
+	p.gcs = p.clientFor(r.URL.Path)
+
+	if p.SlowRequestThreshold > 0 {
+		var slow *slowRequestLogger
+		w, r, slow = p.trackSlowRequest(w, r)
+		defer p.finishSlowRequest(slow, r, fullPath)
+	}
+
+	err := p.checkRequest(w, r, rootErr)
+	if err == nil {
+		err = p.checkProtected(r, fullPath)
+	}
+	if err == nil {
+		p.setRobotsTag(w, r.URL.Path)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if p.BucketInfoPath != "" && r.URL.Path == p.BucketInfoPath {
+				err = p.BucketInfoHandler(w, r)
+				break
+			}
+			if len(p.egress) > 0 {
+				cw := &countingWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+				err = p.regionalGetHandler(cw, r, fullPath)
+				p.recordEgress(r, cw.n)
+				break
+			}
+			err = p.regionalGetHandler(w, r, fullPath)
+		case http.MethodPut:
+			err = p.PutHandler(w, r, fullPath)
+		case http.MethodPost:
+			err = p.PostHandler(w, r, fullPath)
+		case http.MethodDelete:
+			err = p.DeleteHandler(w, r, fullPath)
+		case http.MethodPatch:
+			err = p.PatchHandler(w, r, fullPath)
+		case methodMkcol:
+			err = p.MkcolHandler(w, r, fullPath)
+		case methodMove:
+			err = p.MoveHandler(w, r, fullPath)
+		default:
+			err = caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
 	}
 	if err == nil {
 		// Success!
 		return nil
 	}
+	if err == errPassThrough {
+		return next.ServeHTTP(w, passThrough)
+	}
 
 	// Make the err a caddyErr if it is not already
 	caddyErr, isCaddyErr := err.(caddyhttp.HandlerError)
@@ -312,8 +1596,8 @@ func (p GcsProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		caddyErr = caddyhttp.Error(http.StatusInternalServerError, err)
 	}
 
-	// If non OK status code - WriteHeader - except for GET method, where we still need to process more
-	if r.Method != http.MethodGet {
+	// If non OK status code - WriteHeader - except for GET and HEAD methods, where we still need to process more
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		if caddyErr.StatusCode != 0 {
 			w.WriteHeader(caddyErr.StatusCode)
 		}
@@ -329,16 +1613,19 @@ func (p GcsProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	}
 
 	// process errors directive
-	doPassThrough, doGCSErrorPage, key := p.determineErrorsAction(caddyErr.StatusCode)
+	doPassThrough, doGCSErrorPage, key := p.determineErrorsAction(r, caddyErr.StatusCode)
 	if doPassThrough {
-		return next.ServeHTTP(w, r)
+		return next.ServeHTTP(w, passThrough)
 	}
 
+	if doGCSErrorPage && p.languages != nil {
+		w.Header().Add("Vary", "Accept-Language")
+	}
 	if caddyErr.StatusCode != 0 {
 		w.WriteHeader(caddyErr.StatusCode)
 	}
 	if doGCSErrorPage {
-		if err := p.serveErrorPage(w, key); err != nil {
+		if err := p.serveErrorPage(w, r, key); err != nil {
 			// Just log the error as we don't want to swallow the parent error.
 			p.log.Error("error serving error page",
 				zap.String("bucket", p.Bucket),
@@ -350,13 +1637,112 @@ func (p GcsProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	return caddyErr
 }
 
-func (p GcsProxy) determineErrorsAction(statusCode int) (bool, bool, string) {
-	var key string
-	if errorPageGCSKey, hasErrorPageForCode := p.ErrorPages[statusCode]; hasErrorPageForCode {
-		key = errorPageGCSKey
-	} else if p.DefaultErrorPage != "" {
-		key = p.DefaultErrorPage
+// checkRequest applies the access policies that must pass before any GCS
+// call is made for the request.
+func (p GcsProxy) checkRequest(w http.ResponseWriter, r *http.Request, rootErr error) error {
+	if err := p.authorize(r); err != nil {
+		p.log.Debug("unauthorized request",
+			zap.String("path", r.URL.Path),
+			zap.String("err", err.Error()),
+		)
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+
+	if rootErr != nil {
+		p.log.Debug("could not resolve root",
+			zap.String("root", p.Root),
+			zap.String("err", rootErr.Error()),
+		)
+		if errors.Is(rootErr, errNoRelease) {
+			return caddyhttp.Error(http.StatusServiceUnavailable, rootErr)
+		}
+		return caddyhttp.Error(http.StatusForbidden, rootErr)
+	}
+
+	if !p.methodAllowed(r.Method, r.URL.Path) {
+		w.Header().Set("Allow", strings.Join(p.allowedMethods(r.URL.Path), ", "))
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+
+	if p.limiter != nil {
+		if err := p.limiter.allow(w, r); err != nil {
+			return err
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		if err := p.checkEgress(w, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// allowedMethods returns the HTTP methods this handler will serve for
+// the given request path.
+func (p GcsProxy) allowedMethods(reqPath string) []string {
+	methods := p.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead}
+		if p.EnablePut {
+			methods = append(methods, http.MethodPut, http.MethodPost)
+		}
+		if p.EnableDelete {
+			methods = append(methods, http.MethodDelete)
+		}
+		if p.EnablePatch {
+			methods = append(methods, http.MethodPatch)
+		}
+		if p.EnableFolders {
+			methods = append(methods, methodMkcol, methodMove)
+		}
+	}
+
+	return slices.DeleteFunc(slices.Clone(methods), func(method string) bool {
+		switch method {
+		case http.MethodPut:
+			return len(p.PutPaths) > 0 && !pathMatches(p.PutPaths, reqPath)
+		case http.MethodPost:
+			// POST stores a new object in a directory, composes one or
+			// restores one
+			if !strings.HasSuffix(reqPath, "/") && !p.EnableCompose && !p.EnableSoftDeleted {
+				return true
+			}
+			return len(p.PutPaths) > 0 && !pathMatches(p.PutPaths, reqPath)
+		case http.MethodDelete:
+			return len(p.DeletePaths) > 0 && !pathMatches(p.DeletePaths, reqPath)
+		case http.MethodPatch:
+			return len(p.PatchPaths) > 0 && !pathMatches(p.PatchPaths, reqPath)
+		case methodMkcol, methodMove:
+			return len(p.PutPaths) > 0 && !pathMatches(p.PutPaths, reqPath)
+		}
+		return false
+	})
+}
+
+func (p GcsProxy) methodAllowed(method string, reqPath string) bool {
+	return slices.Contains(p.allowedMethods(reqPath), method)
+}
+
+// errorPageKeys returns the keys of every configured error page, localized
+// ones included.
+func (p GcsProxy) errorPageKeys() []string {
+	pages := slices.Collect(maps.Values(p.ErrorPages))
+	if p.DefaultErrorPage != "" {
+		pages = append(pages, p.DefaultErrorPage)
 	}
+	for _, loc := range p.Localizations {
+		pages = slices.AppendSeq(pages, maps.Values(loc.ErrorPages))
+		if loc.DefaultErrorPage != "" {
+			pages = append(pages, loc.DefaultErrorPage)
+		}
+	}
+	return pages
+}
+
+func (p GcsProxy) determineErrorsAction(r *http.Request, statusCode int) (bool, bool, string) {
+	key := p.errorPageFor(r, statusCode)
 
 	if strings.ToLower(key) == "pass_through" {
 		return true, false, ""
@@ -365,59 +1751,217 @@ func (p GcsProxy) determineErrorsAction(statusCode int) (bool, bool, string) {
 	return false, key != "", key
 }
 
+// privateMetadataPrefix starts the names of object metadata written by the
+// proxy for operators only, such as who uploaded an object.
+const privateMetadataPrefix = "gcsproxy-"
+
+// publicMetadata returns the object metadata that may be sent to clients,
+// leaving out names starting with privateMetadataPrefix.
+func publicMetadata(metadata map[string]string) map[string]string {
+	public := maps.Clone(metadata)
+	maps.DeleteFunc(public, func(name string, _ string) bool {
+		return strings.HasPrefix(strings.ToLower(name), privateMetadataPrefix)
+	})
+	return public
+}
+
+// earlyHintsMetadata is the object metadata key read for index page preload
+// links. It is also copied into the final response as the Link header.
+const earlyHintsMetadata = "link"
+
+// sendEarlyHints sends a 103 Early Hints response with the given Link values.
+func (p GcsProxy) sendEarlyHints(w http.ResponseWriter, links []string) {
+	for _, link := range links {
+		w.Header().Add("Link", link)
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+}
+
+// errPassThrough is returned by handlers that want the request passed on to
+// the next handler.
+var errPassThrough = errors.New("pass through")
+
+// serveNoIndex applies the no_index policy to a directory without an index.
+func (p GcsProxy) serveNoIndex(w http.ResponseWriter, r *http.Request, dir string) error {
+	switch p.NoIndex {
+	case "browse":
+		return p.BrowseHandler(w, r, dir)
+	case "404":
+		return caddyhttp.Error(http.StatusNotFound, errors.New("directory has no index"))
+	case "redirect":
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		http.Redirect(w, r, repl.ReplaceAll(p.NoIndexRedirect, ""), http.StatusFound)
+		return nil
+	case "pass_through":
+		return errPassThrough
+	case "":
+		if p.EnableBrowse {
+			return p.BrowseHandler(w, r, dir)
+		}
+	}
+	return caddyhttp.Error(http.StatusForbidden, errors.New("cannot view a directory"))
+}
+
+type indexResult struct {
+	reader io.ReadCloser
+	attrs  *storage.ObjectAttrs
+	err    error
+}
+
+// cancelReadCloser cancels the context a reader was opened with once closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelReadCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// findIndex probes every index name under dir concurrently and returns the
+// first one, in configured order, that exists.
+func (p GcsProxy) findIndex(ctx context.Context, dir string) (io.ReadCloser, *storage.ObjectAttrs, bool) {
+	results := make([]chan indexResult, len(p.IndexNames))
+	cancels := make([]context.CancelFunc, len(p.IndexNames))
+	for i, indexPage := range p.IndexNames {
+		var probeCtx context.Context
+		probeCtx, cancels[i] = context.WithCancel(ctx)
+		results[i] = make(chan indexResult, 1)
+		go func(ch chan<- indexResult, key string) {
+			reader, attrs, err := p.openObject(probeCtx, key)
+			ch <- indexResult{reader: reader, attrs: attrs, err: err}
+		}(results[i], path.Join(dir, indexPage))
+	}
+
+	for i, indexPage := range p.IndexNames {
+		res := <-results[i]
+		if res.err == nil {
+			// Abandon the lower priority candidates still in flight
+			for j := i + 1; j < len(results); j++ {
+				cancels[j]()
+				go func(ch <-chan indexResult) {
+					if res := <-ch; res.err == nil {
+						res.reader.Close()
+					}
+				}(results[j])
+			}
+			return cancelReadCloser{ReadCloser: res.reader, cancel: cancels[i]}, res.attrs, true
+		}
+		cancels[i]()
+
+		if res.err != storage.ErrObjectNotExist && res.err != errOffline {
+			p.log.Warn("error when looking for index",
+				zap.String("bucket", p.Bucket),
+				zap.String("key", path.Join(dir, indexPage)),
+				zap.String("err", res.err.Error()),
+			)
+		}
+	}
+	return nil, nil, false
+}
+
 func (p GcsProxy) GetHandler(w http.ResponseWriter, r *http.Request, fullPath string) error {
 	if fileHidden(fullPath, p.Hide) {
+		p.log.Debug("hidden key requested",
+			zap.String("key", fullPath),
+			zap.String("hide_status", p.HideStatus),
+		)
+		switch p.HideStatus {
+		case "403":
+			return caddyhttp.Error(http.StatusForbidden, nil)
+		case "pass_through":
+			return errPassThrough
+		}
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+
+	if p.FolderMarkers && strings.HasSuffix(fullPath, folderMarkerSuffix) {
 		return caddyhttp.Error(http.StatusNotFound, nil)
 	}
 
 	isDir := strings.HasSuffix(fullPath, "/")
-	var reader *storage.Reader
+	if p.EnableMeta && !isDir && r.URL.Query().Get("meta") == "json" {
+		return p.MetaHandler(w, r, fullPath)
+	}
+	if p.DiskUsage != nil && isDir && r.URL.Query().Get("du") == "1" {
+		return p.DiskUsageHandler(w, r, fullPath)
+	}
+	if p.Stats != nil && isDir && r.URL.Query().Get("stats") == "1" {
+		return p.StatsHandler(w, r, fullPath)
+	}
+	if p.EnableSoftDeleted && isDir && r.URL.Query().Get("deleted") == "1" {
+		return p.DeletedHandler(w, r, fullPath)
+	}
+	if p.EnableBrowse && isDir && r.URL.Query().Get("format") == "ndjson" {
+		return p.NDJSONListHandler(w, r, fullPath)
+	}
+
+	var reader io.ReadCloser
 	var attrs *storage.ObjectAttrs
 	var err error
-	ctx := context.Background()
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
 
 	if isDir && len(p.IndexNames) > 0 {
-		for _, indexPage := range p.IndexNames {
-			indexPath := path.Join(fullPath, indexPage)
-			obj := p.bucket.Object(indexPath)
-
-			reader, err = obj.NewReader(ctx)
-			if err == nil {
-				attrs, err = obj.Attrs(ctx)
-				if err == nil {
-					isDir = false
-					break
+		var found bool
+		reader, attrs, found = p.findIndex(ctx, fullPath)
+		if found {
+			isDir = false
+			defer reader.Close()
+
+			// Only once the index is found, as a 103 commits the response
+			// to a page the hints are for
+			if p.EarlyHints != nil && r.Method == http.MethodGet {
+				links := slices.Clone(p.EarlyHints.Links)
+				if link := attrs.Metadata[earlyHintsMetadata]; link != "" {
+					links = append(links, link)
 				}
-				reader.Close()
-			}
-
-			if err != nil {
-				if err == storage.ErrObjectNotExist {
-					continue
+				if len(links) > 0 {
+					p.sendEarlyHints(w, links)
 				}
-				p.log.Warn("error when looking for index",
-					zap.String("bucket", p.Bucket),
-					zap.String("key", indexPath),
-					zap.String("err", err.Error()),
-				)
 			}
 		}
 	}
 
 	if isDir {
-		if p.EnableBrowse {
-			return p.BrowseHandler(w, r, fullPath)
-		} else {
-			err = errors.New("cannot view a directory")
-			return caddyhttp.Error(http.StatusForbidden, err)
+		if p.offline != nil && p.offline.active() {
+			return p.offlineError()
 		}
+		return p.serveNoIndex(w, r, fullPath)
 	}
 
-	if reader == nil {
-		obj := p.bucket.Object(fullPath)
-		reader, err = obj.NewReader(ctx)
+	// HEAD requests and ranges only need the attrs up front
+	headOnly := r.Method == http.MethodHead
+	ranged := reader == nil && !headOnly && r.Header.Get("Range") != ""
+	if len(p.Precompressed) > 0 && reader == nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !ranged {
+			var found bool
+			reader, attrs, found = p.openPrecompressed(ctx, r, fullPath, headOnly)
+			if found && reader != nil {
+				defer reader.Close()
+			}
+		}
+	}
+	if attrs == nil {
+		if ranged || headOnly {
+			attrs, err = p.objectAttrs(ctx, fullPath)
+		} else {
+			reader, attrs, err = p.openObject(ctx, fullPath)
+		}
 		if err != nil {
+			if err == errOffline {
+				return p.offlineError()
+			}
 			if err == storage.ErrObjectNotExist {
+				if p.Robots != nil && p.Robots.Txt && r.URL.Path == "/robots.txt" {
+					return p.serveRobotsTxt(w)
+				}
+				if p.FolderMarkers && p.isFolder(ctx, fullPath) {
+					redirectToFolder(w, r)
+					return nil
+				}
 				p.log.Debug("not found",
 					zap.String("bucket", p.Bucket),
 					zap.String("key", fullPath),
@@ -431,15 +1975,37 @@ func (p GcsProxy) GetHandler(w http.ResponseWriter, r *http.Request, fullPath st
 			)
 			return convertToCaddyError(err)
 		}
-		defer reader.Close()
+		if reader != nil {
+			defer reader.Close()
+		}
+	}
 
-		attrs, err = obj.Attrs(ctx)
-		if err != nil {
-			return convertToCaddyError(err)
+	if p.PinGenerations != nil {
+		if pinnedReader, pinnedAttrs := p.pinnedObject(ctx, w, r, attrs); pinnedReader != nil {
+			defer pinnedReader.Close()
+			reader, attrs = pinnedReader, pinnedAttrs
 		}
 	}
 
-	return p.writeResponseFromGetObject(w, reader, attrs)
+	if p.publicCheck != nil && !p.publicCheck.isPublic(ctx, p.bucketHandle(), attrs.Name) {
+		err = errors.New("object is not publicly readable")
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+
+	if err := p.checkPreconditions(w, r, attrs); err != nil {
+		return err
+	}
+
+	if ranged {
+		return p.serveRange(ctx, w, r, attrs)
+	}
+	if headOnly {
+		if attrs.ContentEncoding == "" && p.compressEncoding(r, attrs) == "" {
+			w.Header().Set("Content-Length", strconv.FormatInt(attrs.Size, 10))
+		}
+		return p.writeResponseFromGetObject(w, r, nil, attrs)
+	}
+	return p.writeResponseFromGetObject(w, r, reader, attrs)
 }
 
 // fileHidden returns true if filename is hidden
@@ -483,6 +2049,25 @@ func fileHidden(filename string, hide []string) bool {
 	return false
 }
 
+// pathMatches returns true if reqPath matches any of the patterns.
+// A pattern ending in "*" is a prefix match, so "/uploads/*" matches
+// "/uploads/a/b.txt", anything else is matched as a glob.
+func pathMatches(patterns []string, reqPath string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && !strings.ContainsAny(prefix, "*?[") {
+			if strings.HasPrefix(reqPath, prefix) {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(pattern, reqPath); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
 func convertToCaddyError(err error) error {
 	if err == nil {
 		return nil
@@ -492,6 +2077,10 @@ func convertToCaddyError(err error) error {
 		return caddyhttp.Error(http.StatusNotFound, err)
 	}
 
+	if errors.Is(err, context.DeadlineExceeded) {
+		return caddyhttp.Error(http.StatusGatewayTimeout, err)
+	}
+
 	// Add more specific error conversions as needed
 	return caddyhttp.Error(http.StatusInternalServerError, err)
 }
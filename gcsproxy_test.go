@@ -0,0 +1,3798 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+)
+
+func TestResolveRoot(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		root      string
+		user      string
+		shouldErr bool
+		expected  string
+	}{
+		{
+			desc:     "static root",
+			root:     "site",
+			expected: "site",
+		},
+		{
+			desc:     "user root",
+			root:     "/home/{http.auth.user.id}/",
+			user:     "alice",
+			expected: "/home/alice/",
+		},
+		{
+			desc:     "user id with a slash is escaped",
+			root:     "/home/{http.auth.user.id}/",
+			user:     "alice/../bob",
+			expected: "/home/alice%2F..%2Fbob/",
+		},
+		{
+			desc:      "user id of .. is rejected",
+			root:      "/home/{http.auth.user.id}/",
+			user:      "..",
+			shouldErr: true,
+		},
+		{
+			desc:      "missing user id is rejected",
+			root:      "/home/{http.auth.user.id}/",
+			shouldErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		repl := caddy.NewReplacer()
+		if tc.user != "" {
+			repl.Set("http.auth.user.id", tc.user)
+		}
+
+		root, err := GcsProxy{Root: tc.root}.resolveRoot(repl)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test case '%s' expected an err and did not get one", tc.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test case '%s' unexpected err '%s'", tc.desc, err.Error())
+		}
+		if root != tc.expected {
+			t.Errorf("Test case '%s' expected root '%s' but got '%s'", tc.desc, tc.expected, root)
+		}
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	testCases := []struct {
+		root     string
+		uriPath  string
+		expected string
+	}{
+		{"", "/", "/"},
+		{"site", "/foo/bar.txt", "site/foo/bar.txt"},
+		{"site", "/foo/", "site/foo/"},
+		{"/home/alice/", "/../bob/secret.txt", "/home/alice/bob/secret.txt"},
+	}
+
+	for _, tc := range testCases {
+		if actual := joinPath(tc.root, tc.uriPath); actual != tc.expected {
+			t.Errorf("joinPath(%q, %q) expected '%s' but got '%s'", tc.root, tc.uriPath, tc.expected, actual)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		charset     string
+		defaultType string
+		name        string
+		contentType string
+		expected    string
+	}{
+		{
+			desc:        "no charset configured",
+			contentType: "text/html",
+			expected:    "text/html",
+		},
+		{
+			desc:        "text type",
+			charset:     "utf-8",
+			contentType: "text/html",
+			expected:    "text/html; charset=utf-8",
+		},
+		{
+			desc:        "json",
+			charset:     "utf-8",
+			contentType: "application/json",
+			expected:    "application/json; charset=utf-8",
+		},
+		{
+			desc:        "existing charset is kept",
+			charset:     "utf-8",
+			contentType: "text/plain; charset=iso-8859-1",
+			expected:    "text/plain; charset=iso-8859-1",
+		},
+		{
+			desc:     "type from extension",
+			charset:  "utf-8",
+			name:     "/site/style.css",
+			expected: "text/css; charset=utf-8",
+		},
+		{
+			desc:        "default type",
+			defaultType: "application/octet-stream",
+			name:        "/site/LICENSE",
+			expected:    "application/octet-stream",
+		},
+		{
+			desc:     "no type at all",
+			name:     "/site/LICENSE",
+			expected: "",
+		},
+		{
+			desc:        "binary type",
+			charset:     "utf-8",
+			contentType: "image/png",
+			expected:    "image/png",
+		},
+	}
+
+	for _, tc := range testCases {
+		p := GcsProxy{Charset: tc.charset, DefaultContentType: tc.defaultType}
+		contentType := p.contentType(&storage.ObjectAttrs{Name: tc.name, ContentType: tc.contentType})
+		if contentType != tc.expected {
+			t.Errorf("Test case '%s' expected '%s' but got '%s'", tc.desc, tc.expected, contentType)
+		}
+	}
+}
+
+func TestObjectDigest(t *testing.T) {
+	attrs := &storage.ObjectAttrs{
+		MD5:    []byte{0xd4, 0x1d, 0x8c, 0xd9, 0x8f, 0x00, 0xb2, 0x04, 0xe9, 0x80, 0x09, 0x98, 0xec, 0xf8, 0x42, 0x7e},
+		CRC32C: 0x01020304,
+	}
+	expected := "md5=1B2M2Y8AsgTpgAmY7PhCfg==,crc32c=AQIDBA=="
+	if digest := objectDigest(attrs); digest != expected {
+		t.Errorf("expected '%s' but got '%s'", expected, digest)
+	}
+
+	if digest := objectDigest(&storage.ObjectAttrs{CRC32C: 0x01020304}); digest != "crc32c=AQIDBA==" {
+		t.Errorf("expected only a crc32c digest for a composite object, got '%s'", digest)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	testCases := []struct {
+		ifNoneMatch string
+		expected    bool
+	}{
+		{ifNoneMatch: `"abc"`, expected: true},
+		{ifNoneMatch: `W/"abc"`, expected: true},
+		{ifNoneMatch: `"xyz", "abc"`, expected: true},
+		{ifNoneMatch: `*`, expected: true},
+		{ifNoneMatch: `"xyz"`, expected: false},
+	}
+
+	for _, tc := range testCases {
+		if matched := etagMatches(tc.ifNoneMatch, `"abc"`); matched != tc.expected {
+			t.Errorf("If-None-Match '%s' expected %v but got %v", tc.ifNoneMatch, tc.expected, matched)
+		}
+	}
+}
+
+func TestUploadExtension(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		disposition string
+		contentType string
+		expected    string
+	}{
+		{
+			desc:        "from filename",
+			disposition: `attachment; filename="report.pdf"`,
+			expected:    ".pdf",
+		},
+		{
+			desc:        "from content type",
+			contentType: "image/png",
+			expected:    ".png",
+		},
+		{
+			desc:        "unsafe extension is dropped",
+			disposition: `attachment; filename="x.p/df"`,
+			expected:    "",
+		},
+		{
+			desc:     "nothing to go on",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodPost, "/uploads/", nil)
+		if tc.disposition != "" {
+			r.Header.Set("Content-Disposition", tc.disposition)
+		}
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		if ext := uploadExtension(r); ext != tc.expected {
+			t.Errorf("Test case '%s' expected '%s' but got '%s'", tc.desc, tc.expected, ext)
+		}
+	}
+}
+
+func TestPrefixStatsAdd(t *testing.T) {
+	s := &prefixStats{
+		ContentTypes:   make(map[string]*groupStats),
+		StorageClasses: make(map[string]*groupStats),
+	}
+	now := time.Now()
+	for i, size := range []int64{5, 50, 1, 20, 50} {
+		s.add(&storage.ObjectAttrs{
+			Name:         fmt.Sprintf("obj%d", i),
+			Size:         size,
+			ContentType:  "text/plain",
+			StorageClass: "STANDARD",
+			Updated:      now.Add(time.Duration(i) * time.Minute),
+		}, 3)
+	}
+
+	if s.Objects != 5 || s.Bytes != 126 {
+		t.Errorf("got %d objects and %d bytes, want 5 and 126", s.Objects, s.Bytes)
+	}
+	if g := s.ContentTypes["text/plain"]; g == nil || g.Objects != 5 {
+		t.Errorf("content type group = %+v", g)
+	}
+	var largest []int64
+	for _, obj := range s.Largest {
+		largest = append(largest, obj.Size)
+	}
+	if !slices.Equal(largest, []int64{50, 50, 20}) {
+		t.Errorf("largest = %v, want [50 50 20]", largest)
+	}
+	if s.Oldest.Key != "obj0" || s.Newest.Key != "obj4" {
+		t.Errorf("oldest %s and newest %s, want obj0 and obj4", s.Oldest.Key, s.Newest.Key)
+	}
+}
+
+func TestPageBuilderConsoleFolders(t *testing.T) {
+	// A listing of docs/ in a bucket whose folders were created in the
+	// console, returned with trailing delimiters included
+	listing := []*storage.ObjectAttrs{
+		{Name: "docs/"},
+		{Name: "docs/guide/"},
+		{Name: "docs/intro.md", Size: 10},
+		{Name: "docs/old_$folder$"},
+		{Prefix: "docs/api/"},
+		{Prefix: "docs/guide/"},
+	}
+	testCases := []struct {
+		desc          string
+		folderMarkers bool
+		want          []string
+	}{
+		{desc: "default", want: []string{"guide/", "intro.md", "old_$folder$", "api/"}},
+		{desc: "folder markers", folderMarkers: true, want: []string{"guide/", "intro.md", "old/", "api/"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b := newPageBuilder("docs/", tc.folderMarkers)
+			for _, attrs := range listing {
+				b.add(attrs)
+			}
+			var got []string
+			for _, item := range b.po.Items {
+				got = append(got, strings.TrimPrefix(item.Url, "./"))
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got items %v, want %v", got, tc.want)
+			}
+			if b.po.Count != int64(len(tc.want)) {
+				t.Errorf("got count %d, want %d", b.po.Count, len(tc.want))
+			}
+		})
+	}
+}
+
+func TestConstructListParamsGlob(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		query     string
+		matchGlob string
+		delimiter string
+	}{
+		{desc: "no glob", query: "", matchGlob: "", delimiter: "/"},
+		{desc: "single level", query: "?glob=*.csv", matchGlob: "data/*.csv", delimiter: "/"},
+		{desc: "recursive", query: "?glob=**/*.parquet", matchGlob: "data/**/*.parquet", delimiter: ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/data/"+tc.query, nil)
+			q := GcsProxy{}.ConstructListParams(r, "data/")
+			if q.MatchGlob != tc.matchGlob || q.Delimiter != tc.delimiter {
+				t.Errorf("got glob %q delimiter %q, want %q and %q", q.MatchGlob, q.Delimiter, tc.matchGlob, tc.delimiter)
+			}
+		})
+	}
+}
+
+func TestRecordPhase(t *testing.T) {
+	r, timings := withTimings(httptest.NewRequest(http.MethodGet, "/", nil))
+	start := time.Now().Add(-time.Second)
+	recordPhase(r.Context(), "open", start)
+	recordPhase(r.Context(), "transfer", start)
+	recordPhase(r.Context(), "open", start)
+
+	if len(timings.phases) != 2 {
+		t.Fatalf("got %d phases, want 2", len(timings.phases))
+	}
+	if open := timings.phases[0]; open.name != "open" || open.duration < 2*time.Second {
+		t.Errorf("repeated phase not added up: %+v", open)
+	}
+
+	// Without timings in the context recording is a no-op
+	recordPhase(httptest.NewRequest(http.MethodGet, "/", nil).Context(), "open", start)
+}
+
+func TestReadContextFirstByteTimeout(t *testing.T) {
+	p := GcsProxy{FirstByteTimeout: caddy.Duration(10 * time.Millisecond)}
+
+	ctx, cancel, firstByte := p.readContext(context.Background())
+	defer cancel()
+	<-ctx.Done()
+	if firstByte() {
+		t.Error("stopping an expired first byte timeout returned true")
+	}
+	if err := readError(ctx, context.Canceled); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want a deadline exceeded error", err)
+	}
+
+	ctx, cancel, firstByte = p.readContext(context.Background())
+	defer cancel()
+	if !firstByte() {
+		t.Fatal("stopping the first byte timeout in time returned false")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Errorf("context canceled after the first byte: %v", ctx.Err())
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	base := storage.ObjectAttrs{Size: 3, CRC32C: 42, MD5: []byte{1, 2, 3}}
+	testCases := []struct {
+		desc   string
+		mirror storage.ObjectAttrs
+		want   bool
+	}{
+		{desc: "identical", mirror: base, want: true},
+		{desc: "different size", mirror: storage.ObjectAttrs{Size: 4, CRC32C: 42, MD5: []byte{1, 2, 3}}, want: false},
+		{desc: "different crc32c", mirror: storage.ObjectAttrs{Size: 3, CRC32C: 7, MD5: []byte{1, 2, 3}}, want: false},
+		{desc: "composite without md5", mirror: storage.ObjectAttrs{Size: 3, CRC32C: 42}, want: true},
+		{desc: "different md5", mirror: storage.ObjectAttrs{Size: 3, CRC32C: 42, MD5: []byte{3, 2, 1}}, want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := sameContent(&base, &tc.mirror); got != tc.want {
+				t.Errorf("sameContent() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindGcsProxies(t *testing.T) {
+	config := `{"apps": {"http": {"servers": {"srv0": {"routes": [
+		{"handle": [{"handler": "subroute", "routes": [
+			{"handle": [{"handler": "gcsproxy", "bucket": "site", "default_error_page": "404.html"}]}
+		]}]},
+		{"handle": [{"handler": "gcsproxy", "bucket": "uploads"}, {"handler": "file_server"}]}
+	]}}}}}`
+
+	var doc any
+	if err := json.Unmarshal([]byte(config), &doc); err != nil {
+		t.Fatal(err)
+	}
+	handlers, err := findGcsProxies(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buckets []string
+	for _, p := range handlers {
+		buckets = append(buckets, p.Bucket)
+	}
+	slices.Sort(buckets)
+	if !slices.Equal(buckets, []string{"site", "uploads"}) {
+		t.Errorf("got buckets %v, want [site uploads]", buckets)
+	}
+}
+func TestCmdSync(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a.txt": "same", "b.txt": "changed", "sub/c.txt": "new"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	md5Of := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	var mu sync.Mutex
+	var changes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/test/o":
+			if r.URL.Query().Get("prefix") != "site/" {
+				t.Errorf("got list prefix %q, want site/", r.URL.Query().Get("prefix"))
+			}
+			fmt.Fprintf(w, `{"items":[{"name":"site/a.txt","md5Hash":%q},{"name":"site/b.txt","md5Hash":%q},{"name":"site/old.txt","md5Hash":%q}]}`,
+				md5Of("same"), md5Of("stale"), md5Of("old"))
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/test/o":
+			io.Copy(io.Discard, r.Body)
+			name := r.URL.Query().Get("name")
+			mu.Lock()
+			changes = append(changes, "upload "+name)
+			mu.Unlock()
+			fmt.Fprintf(w, `{"name":%q,"bucket":"test","generation":"1"}`, name)
+		case r.Method == http.MethodDelete:
+			mu.Lock()
+			changes = append(changes, "delete "+strings.TrimPrefix(r.URL.Path, "/storage/v1/b/test/o/"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			http.Error(w, "unexpected", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", srv.URL)
+
+	testCases := []struct {
+		desc string
+		args []string
+		want []string
+	}{
+		{desc: "changed files", args: nil, want: []string{"upload site/b.txt", "upload site/sub/c.txt"}},
+		{desc: "delete", args: []string{"--delete"}, want: []string{"delete site/old.txt", "upload site/b.txt", "upload site/sub/c.txt"}},
+		{desc: "dry run", args: []string{"--delete", "--dry-run"}, want: nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			changes = nil
+			cmd := &cobra.Command{}
+			cmd.Flags().String("credentials", "", "")
+			cmd.Flags().Int("concurrency", 2, "")
+			cmd.Flags().Bool("delete", false, "")
+			cmd.Flags().Bool("dry-run", false, "")
+			if err := cmd.Flags().Parse(append(tc.args, dir, "test/site")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cmdSync(caddycmd.Flags{FlagSet: cmd.Flags()}); err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(changes)
+			if !slices.Equal(changes, tc.want) {
+				t.Errorf("got changes %q, want %q", changes, tc.want)
+			}
+		})
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	p := &GcsProxy{Bucket: "site", cache: newObjectCache(Cache{})}
+	for _, key := range []string{"docs/a.html", "docs/b.html", "index.html"} {
+		p.cache.put(key, &storage.ObjectAttrs{Name: key}, []byte("x"))
+	}
+	registerProxy(p)
+	defer unregisterProxy(p)
+
+	testCases := []struct {
+		body   string
+		purged int
+	}{
+		{body: `{"prefix": "docs/"}`, purged: 2},
+		{body: `{"key": "index.html", "bucket": "other"}`, purged: 0},
+		{body: `{"key": "index.html"}`, purged: 1},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/gcs-proxy/purge", strings.NewReader(tc.body))
+		if err := (adminAPI{}).handlePurge(w, r); err != nil {
+			t.Fatalf("%s: %v", tc.body, err)
+		}
+		var result map[string]int
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result["purged"] != tc.purged {
+			t.Errorf("%s: purged %d, want %d", tc.body, result["purged"], tc.purged)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/gcs-proxy/purge", strings.NewReader(`{}`))
+	if err := (adminAPI{}).handlePurge(httptest.NewRecorder(), r); err == nil {
+		t.Error("purge without a key or prefix succeeded")
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	l := newRateLimiter(RateLimit{ReadRate: 1, ReadBurst: 2})
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.remote.host", "10.0.0.1")
+		return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	}
+
+	for range 2 {
+		if err := l.allow(httptest.NewRecorder(), newRequest()); err != nil {
+			t.Fatalf("request within burst rejected: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if err := l.allow(w, newRequest()); err == nil {
+		t.Fatal("request over burst allowed")
+	}
+	expected := map[string]string{
+		"X-RateLimit-Limit":     "2",
+		"X-RateLimit-Remaining": "0",
+		"X-RateLimit-Reset":     "1",
+		"Retry-After":           "1",
+	}
+	for name, value := range expected {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestBufferPuts(t *testing.T) {
+	b := BufferPuts{MemoryThreshold: 4, Dir: t.TempDir()}
+	for _, body := range []string{"abc", "abcd", "abcdefgh"} {
+		buffered, release, err := b.buffer(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("%q: %v", body, err)
+		}
+		_, inMemory := buffered.(memoryBody)
+		if inMemory != (len(body) <= 4) {
+			t.Errorf("%q: buffered in memory = %t", body, inMemory)
+		}
+		for range 2 {
+			reader, err := buffered.Reader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, _ := io.ReadAll(reader)
+			if string(read) != body {
+				t.Errorf("read %q, want %q", read, body)
+			}
+		}
+		release()
+	}
+}
+
+func TestChecksumReader(t *testing.T) {
+	// MD5 and CRC32C of "hello world"
+	const md5 = "XrY7u+Ae7tCTyyK7j1rNww=="
+	const crc32c = "yZRlqg=="
+
+	testCases := []struct {
+		desc      string
+		trailer   http.Header
+		shouldErr bool
+	}{
+		{
+			desc:    "no trailer declared",
+			trailer: nil,
+		},
+		{
+			desc:    "matching goog hash",
+			trailer: http.Header{"X-Goog-Hash": {"crc32c=" + crc32c + ",md5=" + md5}},
+		},
+		{
+			desc:    "matching content md5",
+			trailer: http.Header{"Content-Md5": {md5}},
+		},
+		{
+			desc:      "mismatching crc32c",
+			trailer:   http.Header{"X-Goog-Hash": {"crc32c=AAAAAA=="}},
+			shouldErr: true,
+		},
+		{
+			desc:      "invalid base64",
+			trailer:   http.Header{"Content-Md5": {"not base64"}},
+			shouldErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/file.txt", strings.NewReader("hello world"))
+			r.Trailer = tc.trailer
+			_, err := io.ReadAll(newChecksumReader(r))
+			if tc.shouldErr != (err != nil) {
+				t.Fatalf("err = %v, shouldErr %t", err, tc.shouldErr)
+			}
+			if err != nil && !errors.Is(err, errChecksumMismatch) {
+				t.Errorf("err = %v, want a checksum mismatch", err)
+			}
+		})
+	}
+}
+
+func TestApplyContentEncoding(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		key         string
+		encoding    string
+		contentType string
+		expected    storage.ObjectAttrs
+	}{
+		{
+			desc:        "not encoded",
+			key:         "logs.gz",
+			contentType: "application/gzip",
+			expected:    storage.ObjectAttrs{ContentType: "application/gzip"},
+		},
+		{
+			desc:        "gzip type replaced by the extension's",
+			key:         "app.js",
+			encoding:    "gzip",
+			contentType: "application/gzip",
+			expected:    storage.ObjectAttrs{ContentType: "text/javascript; charset=utf-8", ContentEncoding: "gzip"},
+		},
+		{
+			desc:     ".gz suffix stripped",
+			key:      "data.json.gz",
+			encoding: "GZIP",
+			expected: storage.ObjectAttrs{ContentType: "application/json", ContentEncoding: "gzip"},
+		},
+		{
+			desc:        "explicit type kept",
+			key:         "page",
+			encoding:    "gzip",
+			contentType: "text/html",
+			expected:    storage.ObjectAttrs{ContentType: "text/html", ContentEncoding: "gzip"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/"+tc.key, nil)
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+			attrs := storage.ObjectAttrs{Name: tc.key, ContentType: tc.contentType}
+			applyContentEncoding(r, &attrs)
+			if attrs.ContentType != tc.expected.ContentType || attrs.ContentEncoding != tc.expected.ContentEncoding {
+				t.Errorf("got type %q encoding %q, want %q %q", attrs.ContentType, attrs.ContentEncoding, tc.expected.ContentType, tc.expected.ContentEncoding)
+			}
+		})
+	}
+}
+
+func TestKeyForNormalization(t *testing.T) {
+	const composed, decomposed = "caf\u00e9.txt", "cafe\u0301.txt"
+	testCases := []struct {
+		form     string
+		reqPath  string
+		expected string
+	}{
+		{form: "", reqPath: "/" + decomposed, expected: "site/" + decomposed},
+		{form: "nfc", reqPath: "/" + decomposed, expected: "site/" + composed},
+		{form: "nfc", reqPath: "/" + composed, expected: "site/" + composed},
+		{form: "nfd", reqPath: "/" + composed, expected: "site/" + decomposed},
+	}
+	for _, tc := range testCases {
+		p := GcsProxy{NormalizeKeys: tc.form}
+		if got := p.keyFor("site", tc.reqPath); got != tc.expected {
+			t.Errorf("%s %q: got %q, want %q", tc.form, tc.reqPath, got, tc.expected)
+		}
+	}
+}
+
+func TestWriteProtected(t *testing.T) {
+	p := GcsProxy{Protect: []string{"site/errors/*", "site/_redirects"}}
+	testCases := []struct {
+		key      string
+		expected bool
+	}{
+		{key: "site/_redirects", expected: true},
+		{key: "site/errors/404.html", expected: true},
+		{key: "site/errors/", expected: true},
+		{key: "site/", expected: true},
+		{key: "site/docs/", expected: false},
+		{key: "site/index.html", expected: false},
+	}
+	for _, tc := range testCases {
+		if got := p.writeProtected(tc.key); got != tc.expected {
+			t.Errorf("%s: got %t, want %t", tc.key, got, tc.expected)
+		}
+	}
+}
+
+func TestGcsTemplateLocation(t *testing.T) {
+	testCases := []struct {
+		location string
+		bucket   string
+		key      string
+		inGCS    bool
+	}{
+		{location: "gs://assets/templates/listing.html", bucket: "assets", key: "templates/listing.html", inGCS: true},
+		{location: "gs:templates/listing.html", bucket: "site", key: "templates/listing.html", inGCS: true},
+		{location: "/etc/caddy/listing.html"},
+	}
+	for _, tc := range testCases {
+		bucket, key, inGCS := gcsTemplateLocation(tc.location, "site")
+		if bucket != tc.bucket || key != tc.key || inGCS != tc.inGCS {
+			t.Errorf("%s: got %q %q %t, want %q %q %t", tc.location, bucket, key, inGCS, tc.bucket, tc.key, tc.inGCS)
+		}
+	}
+}
+
+func TestWatchBrowseTemplate(t *testing.T) {
+	name := t.TempDir() + "/listing.html"
+	if err := os.WriteFile(name, []byte("v1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	p := GcsProxy{
+		BrowseTemplateRefresh: caddy.Duration(10 * time.Millisecond),
+		gcs:                   &clientHolder{},
+		log:                   zap.NewNop(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if p.dirTemplate, err = p.loadBrowseTemplate(ctx, nil, name); err != nil {
+		t.Fatal(err)
+	}
+
+	render := func() string {
+		var b strings.Builder
+		p.dirTemplate.get().Execute(&b, nil)
+		return b.String()
+	}
+	waitFor := func(expected string) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if render() == expected {
+				return
+			}
+		}
+		t.Fatalf("template renders %q, want %q", render(), expected)
+	}
+
+	// The size changes too, in case the modification time does not
+	os.WriteFile(name, []byte("version 2"), 0o600)
+	waitFor("version 2")
+
+	// An invalid template keeps the last good one
+	os.WriteFile(name, []byte("{{ .Broken"), 0o600)
+	time.Sleep(50 * time.Millisecond)
+	waitFor("version 2")
+}
+
+func TestBrowseTemplateFor(t *testing.T) {
+	holder := func(text string) *templateHolder {
+		h := &templateHolder{}
+		h.current.Store(template.Must(template.New(text).Parse(text)))
+		return h
+	}
+	p := GcsProxy{
+		BrowseTemplates: []BrowseTemplateRule{
+			{Template: "releases.html", Paths: []string{"/downloads/*"}},
+			{Template: "dense.html", Paths: []string{"/logs/*"}},
+		},
+		dirTemplate: holder("default"),
+		templates:   []*templateHolder{holder("releases"), holder("dense")},
+	}
+	testCases := map[string]string{
+		"/downloads/v1/": "releases",
+		"/logs/":         "dense",
+		"/docs/":         "default",
+	}
+	for reqPath, expected := range testCases {
+		r := httptest.NewRequest(http.MethodGet, reqPath, nil)
+		if got := p.browseTemplateFor(r).Name(); got != expected {
+			t.Errorf("%s: got template %q, want %q", reqPath, got, expected)
+		}
+	}
+}
+
+func TestLocalization(t *testing.T) {
+	p := GcsProxy{
+		ErrorPages:       map[int]string{404: "errors/404.html", 403: "errors/403.html"},
+		DefaultErrorPage: "errors/error.html",
+		Localizations: []Localization{
+			{Language: "de", ErrorPages: map[int]string{404: "errors/404.de.html"}, DefaultErrorPage: "errors/error.de.html"},
+			{Language: "pt-BR", DefaultErrorPage: "errors/error.pt.html"},
+		},
+	}
+	var err error
+	if p.languages, err = p.newLanguageSet(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		acceptLanguage string
+		status         int
+		expected       string
+	}{
+		{acceptLanguage: "", status: 404, expected: "errors/404.html"},
+		{acceptLanguage: "de-AT, en;q=0.5", status: 404, expected: "errors/404.de.html"},
+		{acceptLanguage: "de", status: 403, expected: "errors/403.html"},
+		{acceptLanguage: "de", status: 500, expected: "errors/error.de.html"},
+		{acceptLanguage: "pt", status: 500, expected: "errors/error.pt.html"},
+		{acceptLanguage: "fr", status: 500, expected: "errors/error.html"},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/missing", nil)
+		r.Header.Set("Accept-Language", tc.acceptLanguage)
+		if got := p.errorPageFor(r, tc.status); got != tc.expected {
+			t.Errorf("%q %d: got %q, want %q", tc.acceptLanguage, tc.status, got, tc.expected)
+		}
+	}
+}
+
+func TestAddHeaderFooter(t *testing.T) {
+	p := GcsProxy{cache: newObjectCache(Cache{}), log: zap.NewNop()}
+	p.cache.put("dl/HEADER.html", &storage.ObjectAttrs{Name: "dl/HEADER.html"}, []byte("<h1>Releases</h1>"))
+	p.cache.put("dl/sub/FOOTER.html", &storage.ObjectAttrs{Name: "dl/sub/FOOTER.html"}, []byte("<p>nested</p>"))
+
+	po := PageObj{Items: []Item{
+		{Name: "HEADER.html", Key: "dl/HEADER.html"},
+		{Name: "sub", IsDir: true},
+		{Name: "sub/FOOTER.html", Key: "dl/sub/FOOTER.html"},
+	}}
+	p.addHeaderFooter(context.Background(), &po, "dl/", "/dl/")
+	if po.Header != "<h1>Releases</h1>" {
+		t.Errorf("header = %q", po.Header)
+	}
+	if po.Footer != "" {
+		t.Errorf("footer of a subdirectory used: %q", po.Footer)
+	}
+
+	tpl := template.Must(template.New("default_listing").Parse(defaultBrowseTemplate))
+	var b strings.Builder
+	if err := tpl.Execute(&b, po); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "<h1>Releases</h1>") {
+		t.Errorf("header not rendered unescaped: %s", b.String())
+	}
+
+	for _, writable := range []GcsProxy{
+		{EnablePut: true},
+		{EnablePut: true, PutPaths: []string{"/dl/*"}},
+		{EnableFolders: true, PutPaths: []string{"/dl/HEADER.html"}},
+	} {
+		writable.cache, writable.log = p.cache, p.log
+		po := PageObj{Items: []Item{{Name: "HEADER.html", Key: "dl/HEADER.html"}}}
+		writable.addHeaderFooter(context.Background(), &po, "dl/", "/dl/")
+		if po.Header != "" {
+			t.Errorf("header clients can write used with %+v: %q", writable, po.Header)
+		}
+	}
+
+	uploads := GcsProxy{EnablePut: true, PutPaths: []string{"/uploads/*"}, cache: p.cache, log: p.log}
+	po = PageObj{Items: []Item{{Name: "HEADER.html", Key: "dl/HEADER.html"}}}
+	uploads.addHeaderFooter(context.Background(), &po, "dl/", "/dl/")
+	if po.Header != "<h1>Releases</h1>" {
+		t.Errorf("header outside put_paths = %q", po.Header)
+	}
+}
+
+func TestCleanReleasePrefix(t *testing.T) {
+	testCases := []struct {
+		content   string
+		expected  string
+		shouldErr bool
+	}{
+		{content: "releases/2024-06-01/\n", expected: "releases/2024-06-01/"},
+		{content: "/releases/2024-06-01", expected: "releases/2024-06-01/"},
+		{content: "releases//blue/./", expected: "releases/blue/"},
+		{content: "  ", shouldErr: true},
+		{content: "releases/../secrets/", shouldErr: true},
+		{content: "releases/{http.request.host}/", shouldErr: true},
+	}
+	for _, tc := range testCases {
+		prefix, err := cleanReleasePrefix(tc.content)
+		if tc.shouldErr != (err != nil) {
+			t.Errorf("%q: err = %v, shouldErr %t", tc.content, err, tc.shouldErr)
+			continue
+		}
+		if prefix != tc.expected {
+			t.Errorf("%q: got %q, want %q", tc.content, prefix, tc.expected)
+		}
+	}
+}
+
+func TestParsePin(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		value  string
+		pinned bool
+	}{
+		{value: strconv.FormatInt(now.Add(-time.Minute).UnixMicro(), 10), pinned: true},
+		{value: strconv.FormatInt(now.Add(-2*time.Hour).UnixMicro(), 10), pinned: false},
+		{value: strconv.FormatInt(now.Add(time.Hour).UnixMicro(), 10), pinned: false},
+		{value: "yesterday", pinned: false},
+		{value: "", pinned: false},
+	}
+	for _, tc := range testCases {
+		pin, ok := parsePin(tc.value, time.Hour)
+		if ok != tc.pinned {
+			t.Errorf("%q: pinned = %t, want %t", tc.value, ok, tc.pinned)
+			continue
+		}
+		if ok && strconv.FormatInt(pin.UnixMicro(), 10) != tc.value {
+			t.Errorf("%q: got pin %d", tc.value, pin.UnixMicro())
+		}
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	cache := newObjectCache(Cache{MaxObjectSize: 4, ChunkSize: 4})
+	attrs := &storage.ObjectAttrs{Name: "video.mp4", Size: 10, Generation: 7}
+	for i, chunk := range []string{"0123", "4567", "89"} {
+		cache.put(chunkKey(attrs.Name, attrs.Generation, int64(i)), nil, []byte(chunk))
+	}
+
+	testCases := []struct {
+		offset   int64
+		length   int64
+		expected string
+	}{
+		{offset: 0, length: 10, expected: "0123456789"},
+		{offset: 3, length: 6, expected: "345678"},
+		{offset: 4, length: 4, expected: "4567"},
+		{offset: 9, length: 1, expected: "9"},
+	}
+	for _, tc := range testCases {
+		r := &chunkReader{
+			ctx:   context.Background(),
+			cache: cache,
+			attrs: attrs,
+			pos:   tc.offset,
+			end:   tc.offset + tc.length,
+		}
+		body, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("%d-%d: %v", tc.offset, tc.length, err)
+			continue
+		}
+		if string(body) != tc.expected {
+			t.Errorf("%d-%d: got %q, want %q", tc.offset, tc.length, body, tc.expected)
+		}
+	}
+}
+
+func TestRegionBucket(t *testing.T) {
+	p := GcsProxy{
+		Bucket: "mybucket",
+		Regions: &RegionRouting{
+			Region:  "{http.request.header.X-Client-Region}",
+			Buckets: map[string]string{"eu": "mybucket-eu"},
+		},
+	}
+	testCases := []struct {
+		region   string
+		expected string
+	}{
+		{region: "eu", expected: "mybucket-eu"},
+		{region: "us", expected: "mybucket"},
+		{region: "", expected: "mybucket"},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+		r.Header.Set("X-Client-Region", tc.region)
+		repl := caddyhttp.NewTestReplacer(r)
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+		if bucket := p.regionBucket(r); bucket != tc.expected {
+			t.Errorf("%q: got %q, want %q", tc.region, bucket, tc.expected)
+		}
+	}
+
+	if !regionFallback(caddyhttp.Error(http.StatusNotFound, nil)) {
+		t.Error("expected fallback on 404")
+	}
+	if regionFallback(caddyhttp.Error(http.StatusForbidden, nil)) || regionFallback(errors.New("write failed")) {
+		t.Error("expected no fallback")
+	}
+}
+
+func TestRegionalFallback(t *testing.T) {
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "mybucket-eu") || strings.HasSuffix(r.URL.Path, ".gz") {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"name":"site/a.txt","bucket":"mybucket","generation":"1","size":"5"}`)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", "1")
+		io.WriteString(w, "hello")
+	})
+	p := GcsProxy{
+		Bucket:        "mybucket",
+		Precompressed: []string{"gzip"},
+		Regions: &RegionRouting{
+			Region:  "{http.request.header.X-Client-Region}",
+			Buckets: map[string]string{"eu": "mybucket-eu"},
+		},
+		gcs: gcs,
+		log: zap.NewNop(),
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+	r.Header.Set("X-Client-Region", "eu")
+	repl := caddyhttp.NewTestReplacer(r)
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	w := httptest.NewRecorder()
+	if err := p.regionalGetHandler(w, r, "site/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "hello" {
+		t.Errorf("got body %q, want the object from the primary bucket", w.Body.String())
+	}
+	// Headers set while trying the regional bucket are dropped
+	if got := w.Header().Values("Vary"); len(got) != 1 {
+		t.Errorf("got Vary %q, want it once", got)
+	}
+
+	// Once the regional response is written it isn't retried
+	rw := &regionalWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: httptest.NewRecorder()}, header: http.Header{}}
+	rw.Header().Set("Link", "</app.css>; rel=preload")
+	rw.WriteHeader(http.StatusEarlyHints)
+	if !rw.written || rw.ResponseWriterWrapper.Header().Get("Link") == "" {
+		t.Error("early hints not written through")
+	}
+}
+
+func TestClientFor(t *testing.T) {
+	reader, writer := &clientHolder{}, &clientHolder{}
+	p := GcsProxy{
+		PathCredentials: []PathCredentials{
+			{CredentialsFile: "writer.json", Paths: []string{"/admin/*"}},
+		},
+		gcs:         reader,
+		pathClients: []*clientHolder{writer},
+	}
+	if p.clientFor("/admin/users.json") != writer {
+		t.Error("expected the path client for /admin/users.json")
+	}
+	if p.clientFor("/public/index.html") != reader {
+		t.Error("expected the default client for /public/index.html")
+	}
+}
+
+func TestAuditLogSink(t *testing.T) {
+	s := (GcsProxy{Bucket: "mybucket", AuditLog: &AuditLog{MaxEvents: 2}, log: zap.NewNop()}).newAuditLogSink()
+	if s.config.Bucket != "mybucket" || s.config.Prefix != defaultAuditLogPrefix {
+		t.Errorf("unexpected defaults: %+v", s.config)
+	}
+
+	s.send(context.Background(), mutationEvent{Key: "a.txt"})
+	select {
+	case <-s.full:
+		t.Error("flush triggered before max events")
+	default:
+	}
+	s.send(context.Background(), mutationEvent{Key: "b.txt"})
+	select {
+	case <-s.full:
+	default:
+		t.Error("flush not triggered at max events")
+	}
+
+	for i := range 2 * auditLogBacklog {
+		s.send(context.Background(), mutationEvent{Key: fmt.Sprintf("%d.txt", i)})
+	}
+	if len(s.pending) != 2*auditLogBacklog || s.pending[0].Key != "0.txt" {
+		t.Errorf("expected the oldest events to be dropped, first pending is %s of %d", s.pending[0].Key, len(s.pending))
+	}
+
+	name := auditLogObjectName("audit/", time.Date(2024, 6, 1, 12, 30, 5, 0, time.UTC), "abc")
+	if name != "audit/2024/06/01/20240601T123005Z-abc.ndjson" {
+		t.Errorf("unexpected object name %s", name)
+	}
+}
+
+func TestAddDirUsage(t *testing.T) {
+	client, err := storage.NewClient(context.Background(), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	p := GcsProxy{
+		Bucket:         "mybucket",
+		BrowseDirUsage: &BrowseDirUsage{MaxDirs: 1},
+		gcs:            &clientHolder{},
+		dirUsage:       newUsageTracker(DiskUsage{}),
+		log:            zap.NewNop(),
+	}
+	p.gcs.current.Store(client)
+
+	// Fresh counts are served without listing the bucket
+	p.dirUsage.usage["dl/videos/"] = diskUsage{Bytes: 3_200_000_000, Objects: 1204, Scanned: time.Now()}
+	po := PageObj{Items: []Item{
+		{Name: "readme.txt", Key: "dl/readme.txt", Size: "1 kB"},
+		{Name: "videos", IsDir: true},
+		{Name: "images", IsDir: true},
+	}}
+	p.addDirUsage(context.Background(), &po, "dl/")
+	if item := po.Items[1]; item.Objects != 1204 || item.Size != "3.2 GB" {
+		t.Errorf("unexpected usage of videos/: %+v", item)
+	}
+	if item := po.Items[2]; item.Size != "" {
+		t.Errorf("directory beyond max_dirs counted: %+v", item)
+	}
+
+	tpl := template.Must(template.New("default_listing").Parse(defaultBrowseTemplate))
+	var b strings.Builder
+	if err := tpl.Execute(&b, po); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "1204 items · 3.2 GB") {
+		t.Errorf("usage not rendered: %s", b.String())
+	}
+}
+
+func TestRequestCacheMode(t *testing.T) {
+	p := GcsProxy{
+		Cache: &Cache{BypassHeader: "X-Cache-Bypass", BypassSecret: "s3cret"},
+		cache: newObjectCache(Cache{}),
+	}
+	testCases := []struct {
+		headers  map[string]string
+		expected cacheMode
+	}{
+		{headers: nil, expected: cacheNormal},
+		{headers: map[string]string{"Cache-Control": "no-cache"}, expected: cacheRevalidate},
+		{headers: map[string]string{"Cache-Control": "private, max-age=0"}, expected: cacheRevalidate},
+		{headers: map[string]string{"Cache-Control": "max-age=60"}, expected: cacheNormal},
+		{headers: map[string]string{"Pragma": "no-cache"}, expected: cacheRevalidate},
+		{headers: map[string]string{"X-Cache-Bypass": "s3cret"}, expected: cacheBypass},
+		{headers: map[string]string{"X-Cache-Bypass": "guess"}, expected: cacheNormal},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+		for name, value := range tc.headers {
+			r.Header.Set(name, value)
+		}
+		if mode := p.requestCacheMode(r); mode != tc.expected {
+			t.Errorf("%v: got mode %d, want %d", tc.headers, mode, tc.expected)
+		}
+	}
+}
+
+func TestRobots(t *testing.T) {
+	if txt := (Robots{}).robotsTxt(); txt != "User-agent: *\nDisallow:\n" {
+		t.Errorf("unexpected robots.txt allowing everything: %q", txt)
+	}
+	rb := Robots{Disallow: []string{"/private/", "/tmp/"}, Sitemap: "https://example.com/sitemap.xml"}
+	expected := "User-agent: *\nDisallow: /private/\nDisallow: /tmp/\n\nSitemap: https://example.com/sitemap.xml\n"
+	if txt := rb.robotsTxt(); txt != expected {
+		t.Errorf("got robots.txt %q, want %q", txt, expected)
+	}
+
+	p := GcsProxy{Robots: &Robots{NoIndex: []string{"/drafts/*"}}}
+	w := httptest.NewRecorder()
+	p.setRobotsTag(w, "/drafts/post.html")
+	if tag := w.Header().Get("X-Robots-Tag"); tag != "noindex" {
+		t.Errorf("X-Robots-Tag = %q for a draft", tag)
+	}
+	w = httptest.NewRecorder()
+	p.setRobotsTag(w, "/posts/post.html")
+	if tag := w.Header().Get("X-Robots-Tag"); tag != "" {
+		t.Errorf("X-Robots-Tag = %q for a published post", tag)
+	}
+}
+
+func TestCacheBudget(t *testing.T) {
+	budget := &cacheBudget{limit: 10}
+	a := newObjectCache(Cache{MaxSize: 8})
+	b := newObjectCache(Cache{MaxSize: 8})
+	a.budget, b.budget = budget, budget
+
+	a.put("a1", &storage.ObjectAttrs{}, []byte("1234"))
+	a.put("a2", &storage.ObjectAttrs{}, []byte("5678"))
+	// b has nothing of its own to evict, so it can't take more than is left
+	b.put("b1", &storage.ObjectAttrs{}, []byte("abcd"))
+	if entry, _ := b.get("b1"); entry != nil {
+		t.Error("object cached beyond the global budget")
+	}
+	b.put("b2", &storage.ObjectAttrs{}, []byte("ab"))
+	if entry, _ := b.get("b2"); entry == nil {
+		t.Error("object fitting in the global budget not cached")
+	}
+	// a evicts its own oldest entry to stay within the budget
+	a.put("a3", &storage.ObjectAttrs{}, []byte("9012"))
+	if entry, _ := a.get("a1"); entry != nil {
+		t.Error("oldest entry not evicted for the budget")
+	}
+	if budget.used != 10 {
+		t.Errorf("budget used = %d, want 10", budget.used)
+	}
+
+	a.Destruct()
+	if budget.used != 2 {
+		t.Errorf("budget used = %d after destructing a cache, want 2", budget.used)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := newObjectCache(Cache{MaxSize: 8})
+	c.put("a", &storage.ObjectAttrs{Generation: 1}, []byte("1234"))
+	c.put("b", &storage.ObjectAttrs{Generation: 1}, []byte("5678"))
+	c.get("a")
+	c.put("c", &storage.ObjectAttrs{Generation: 1}, []byte("9012"))
+	if entry, _ := c.get("a"); entry == nil {
+		t.Error("recently used entry evicted")
+	}
+	if entry, _ := c.get("b"); entry != nil {
+		t.Error("least recently used entry not evicted")
+	}
+
+	c.put("c", &storage.ObjectAttrs{Generation: 2}, []byte("new"))
+	c.put("c", &storage.ObjectAttrs{Generation: 1}, []byte("old"))
+	if entry, _ := c.get("c"); entry == nil || string(entry.body) != "new" {
+		t.Error("newer generation replaced by an older one")
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	p := GcsProxy{Cache: &Cache{StaleWhileRevalidate: caddy.Duration(time.Hour)}, cache: newObjectCache(Cache{})}
+	// Pretend a refresh is already running, so none is started
+	if !p.cache.startRefresh("a.txt") {
+		t.Fatal("refresh of a.txt already running")
+	}
+
+	if !p.serveStale("a.txt", 1, time.Now().Add(-time.Minute), cacheNormal) {
+		t.Error("object within stale_while_revalidate not served")
+	}
+	if p.serveStale("a.txt", 1, time.Now().Add(-2*time.Hour), cacheNormal) {
+		t.Error("object past stale_while_revalidate served")
+	}
+	if p.serveStale("a.txt", 1, time.Now().Add(-time.Minute), cacheRevalidate) {
+		t.Error("stale object served to a request revalidating the cache")
+	}
+	if p.cache.startRefresh("a.txt") {
+		t.Error("second refresh of a.txt started")
+	}
+	p.cache.endRefresh("a.txt")
+	if !p.cache.startRefresh("a.txt") {
+		t.Error("refresh of a.txt not started after the last one ended")
+	}
+}
+
+func TestAdmissionFilter(t *testing.T) {
+	f := newAdmissionFilter(2, time.Minute)
+	if f.admit("cold.txt") {
+		t.Error("object admitted on its first request")
+	}
+	if !f.admit("cold.txt") {
+		t.Error("object not admitted on its second request")
+	}
+	if !newAdmissionFilter(1, time.Minute).admit("any.txt") {
+		t.Error("object not admitted with min_hits 1")
+	}
+}
+
+func TestDiskCacheIndex(t *testing.T) {
+	dir := t.TempDir()
+	d, err := openDiskCache(dir, 0, 0, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := &storage.ObjectAttrs{Name: "kept.bin", Size: 5, Generation: 1, ContentType: "application/octet-stream"}
+	d.store(kept.Name, kept, []byte("12345"))
+	lost := &storage.ObjectAttrs{Name: "lost.bin", Size: 3, Generation: 2}
+	d.store(lost.Name, lost, []byte("abc"))
+
+	// A streamed object is only cached once read to the end
+	streamed := &storage.ObjectAttrs{Name: "streamed.bin", Size: 6, Generation: 3}
+	r := d.tee(streamed.Name, streamed, io.NopCloser(strings.NewReader("stream")))
+	io.ReadAll(r)
+	r.Close()
+	partial := &storage.ObjectAttrs{Name: "partial.bin", Size: 7, Generation: 4}
+	r = d.tee(partial.Name, partial, io.NopCloser(strings.NewReader("partial")))
+	r.Read(make([]byte, 3))
+	r.Close()
+	if err := d.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove(d.path("lost.bin", 2))
+	orphan := filepath.Join(dir, strings.Repeat("ab", sha256.Size))
+	os.WriteFile(orphan, []byte("orphan"), 0o600)
+	unrelated := filepath.Join(dir, "README")
+	os.WriteFile(unrelated, []byte("not ours"), 0o600)
+
+	d, err = openDiskCache(dir, 0, 0, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+	entry, ok := d.get("kept.bin")
+	if !ok || entry.Generation != 1 || entry.Attrs.ContentType != "application/octet-stream" {
+		t.Fatalf("entry not restored from the index: %+v", entry)
+	}
+	if !entry.validated.IsZero() {
+		t.Error("restored entry marked as validated")
+	}
+	if _, ok := d.get("streamed.bin"); !ok {
+		t.Error("streamed object not restored from the index")
+	}
+	for _, key := range []string{"lost.bin", "partial.bin"} {
+		if _, ok := d.get(key); ok {
+			t.Errorf("%s restored without its body", key)
+		}
+	}
+	if _, err := os.Stat(orphan); err == nil {
+		t.Error("orphaned body not removed")
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Error("unrelated file removed")
+	}
+
+	reader, err := d.open(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if body, _ := io.ReadAll(reader); string(body) != "12345" {
+		t.Errorf("got body %q", body)
+	}
+}
+
+func TestDiskCacheSharedDir(t *testing.T) {
+	dir := t.TempDir()
+	load := func(bucket string) *GcsProxy {
+		p := &GcsProxy{Bucket: bucket, Cache: &Cache{DiskDir: dir}, log: zap.NewNop()}
+		if err := p.loadCache(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	a, b := load("bucket-a"), load("bucket-b")
+	if a.cache.disk != b.cache.disk {
+		t.Fatal("buckets sharing a disk_dir got separate disk caches")
+	}
+
+	attrs := &storage.ObjectAttrs{Name: "same.txt", Size: 5, Generation: 1}
+	a.cache.disk.store(a.cache.diskKey("same.txt"), attrs, []byte("aaaaa"))
+	if _, _, ok := b.openDiskCached(context.Background(), "same.txt", cacheNormal, true); ok {
+		t.Error("bucket-b served bucket-a's object from the disk cache")
+	}
+	b.cache.clear()
+	if _, _, ok := a.openDiskCached(context.Background(), "same.txt", cacheNormal, true); !ok {
+		t.Error("clearing bucket-b's cache dropped bucket-a's object")
+	}
+
+	for _, p := range []*GcsProxy{a, b} {
+		if _, err := cachePool.Delete(p.cacheKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := openDiskCache(dir, 0, 0, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+	if _, ok := d.get("bucket-a/same.txt"); !ok {
+		t.Error("index not saved once the last cache released the directory")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected []byteRange
+		err      error
+	}{
+		{header: "bytes=0-4", expected: []byteRange{{0, 5}}},
+		{header: "bytes=5-", expected: []byteRange{{5, 5}}},
+		{header: "bytes=-3", expected: []byteRange{{7, 3}}},
+		{header: "bytes=-20", expected: []byteRange{{0, 10}}},
+		{header: "bytes=8-20", expected: []byteRange{{8, 2}}},
+		{header: "bytes=0-1, 4-5", expected: []byteRange{{0, 2}, {4, 2}}},
+		{header: "bytes=20-, 2-3", expected: []byteRange{{2, 2}}},
+		{header: "bytes=10-", err: errRangeNotSatisfiable},
+		{header: "bytes=-0", err: errRangeNotSatisfiable},
+		{header: "bytes=4-2"},
+		{header: "bytes=a-b"},
+		{header: "items=0-1"},
+	}
+	for _, tc := range testCases {
+		ranges, err := parseRange(tc.header, 10)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%q: got error %v, want %v", tc.header, err, tc.err)
+			continue
+		}
+		if !slices.Equal(ranges, tc.expected) {
+			t.Errorf("%q: got %v, want %v", tc.header, ranges, tc.expected)
+		}
+	}
+}
+
+func TestServeRange(t *testing.T) {
+	attrs := &storage.ObjectAttrs{Name: "file.txt", Size: 10, Generation: 3, ContentType: "text/plain"}
+	p := GcsProxy{cache: newObjectCache(Cache{}), log: zap.NewNop()}
+	p.cache.put(attrs.Name, attrs, []byte("0123456789"))
+
+	testCases := []struct {
+		desc    string
+		header  http.Header
+		status  int
+		body    string
+		errCode int
+	}{
+		{desc: "single range", header: http.Header{"Range": {"bytes=2-5"}}, status: http.StatusPartialContent, body: "2345"},
+		{desc: "whole object", header: http.Header{"Range": {"bytes=0-"}}, status: http.StatusOK, body: "0123456789"},
+		{desc: "invalid range", header: http.Header{"Range": {"bytes=x"}}, status: http.StatusOK, body: "0123456789"},
+		{desc: "stale if-range", header: http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"stale"`}}, status: http.StatusOK, body: "0123456789"},
+		{desc: "unsatisfiable", header: http.Header{"Range": {"bytes=20-"}}, errCode: http.StatusRequestedRangeNotSatisfiable},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+		r.Header = tc.header
+		w := httptest.NewRecorder()
+		err := p.serveRange(context.Background(), w, r, attrs)
+		if tc.errCode != 0 {
+			var handlerErr caddyhttp.HandlerError
+			if !errors.As(err, &handlerErr) || handlerErr.StatusCode != tc.errCode {
+				t.Errorf("%s: got error %v, want status %d", tc.desc, err, tc.errCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("%s: got %d %q, want %d %q", tc.desc, w.Code, w.Body.String(), tc.status, tc.body)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+	r.Header.Set("Range", "bytes=0-1,8-")
+	w := httptest.NewRecorder()
+	if err := p.serveRange(context.Background(), w, r, attrs); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPartialContent || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges; boundary=") {
+		t.Fatalf("got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, part := range []string{"Content-Range: bytes 0-1/10\r\nContent-Type: text/plain\r\n\r\n01\r\n", "Content-Range: bytes 8-9/10\r\nContent-Type: text/plain\r\n\r\n89\r\n"} {
+		if !strings.Contains(w.Body.String(), part) {
+			t.Errorf("multipart body %q lacks %q", w.Body.String(), part)
+		}
+	}
+}
+
+func TestClientRoot(t *testing.T) {
+	p := GcsProxy{ClientPrefixes: &ClientPrefixes{
+		Identity: "{http.request.tls.client.san.dns_names.0}",
+		Clients: map[string]ClientPrefix{
+			"backup.internal": {Prefix: "backups", Write: true},
+			"*":               {Prefix: "clients/{http.request.tls.client.san.dns_names.0}"},
+		},
+	}}
+
+	testCases := []struct {
+		desc      string
+		identity  string
+		method    string
+		expected  string
+		shouldErr bool
+	}{
+		{desc: "listed client writes", identity: "backup.internal", method: http.MethodPut, expected: "/site/backups"},
+		{desc: "other client reads", identity: "app.internal", method: http.MethodGet, expected: "/site/clients/app.internal"},
+		{desc: "other client may not write", identity: "app.internal", method: http.MethodPut, shouldErr: true},
+		{desc: "no certificate", method: http.MethodGet, shouldErr: true},
+	}
+	for _, tc := range testCases {
+		repl := caddy.NewReplacer()
+		if tc.identity != "" {
+			repl.Set("http.request.tls.client.san.dns_names.0", tc.identity)
+		}
+		r := httptest.NewRequest(tc.method, "/file.txt", nil)
+		root, err := p.clientRoot(r, repl, "/site")
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("%s: expected an err and did not get one", tc.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected err '%s'", tc.desc, err.Error())
+			continue
+		}
+		if root != tc.expected {
+			t.Errorf("%s: got root %q, want %q", tc.desc, root, tc.expected)
+		}
+	}
+}
+
+func TestHeadRequest(t *testing.T) {
+	attrs := &storage.ObjectAttrs{Name: "file.txt", Size: 10, Generation: 3, ContentType: "text/plain", Updated: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	p := GcsProxy{Cache: &Cache{}, cache: newObjectCache(Cache{}), log: zap.NewNop()}
+	p.cache.put(attrs.Name, attrs, []byte("0123456789"))
+
+	if !p.methodAllowed(http.MethodHead, "/file.txt") {
+		t.Fatal("HEAD is not allowed by default")
+	}
+
+	r := httptest.NewRequest(http.MethodHead, "/file.txt", nil)
+	w := httptest.NewRecorder()
+	if err := p.GetHandler(w, r, attrs.Name); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("got body %q", w.Body.String())
+	}
+	expected := map[string]string{
+		"Content-Length": "10",
+		"Content-Type":   "text/plain",
+		"Last-Modified":  "Wed, 01 May 2024 12:00:00 GMT",
+	}
+	for name, value := range expected {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s: got %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	attrs := &storage.ObjectAttrs{Name: "file.txt", Generation: 3, Updated: time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)}
+	p := GcsProxy{log: zap.NewNop()}
+
+	testCases := []struct {
+		desc     string
+		header   http.Header
+		expected int
+	}{
+		{desc: "no conditions", header: http.Header{}},
+		{desc: "etag matches", header: http.Header{"If-None-Match": {`"1", W/"3"`}}, expected: http.StatusNotModified},
+		{desc: "etag changed", header: http.Header{"If-None-Match": {`"2"`}}},
+		{desc: "not modified since", header: http.Header{"If-Modified-Since": {"Wed, 01 May 2024 12:00:00 GMT"}}, expected: http.StatusNotModified},
+		{desc: "modified since", header: http.Header{"If-Modified-Since": {"Wed, 01 May 2024 11:59:59 GMT"}}},
+		{desc: "if-none-match wins over date", header: http.Header{"If-None-Match": {`"2"`}, "If-Modified-Since": {"Wed, 01 May 2024 12:00:00 GMT"}}},
+		{desc: "if-match fails", header: http.Header{"If-Match": {`"2"`}}, expected: http.StatusPreconditionFailed},
+		{desc: "if-match weak fails", header: http.Header{"If-Match": {`W/"3"`}}, expected: http.StatusPreconditionFailed},
+		{desc: "if-match holds", header: http.Header{"If-Match": {`"3"`}}},
+		{desc: "unmodified since fails", header: http.Header{"If-Unmodified-Since": {"Wed, 01 May 2024 11:00:00 GMT"}}, expected: http.StatusPreconditionFailed},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+		r.Header = tc.header
+		w := httptest.NewRecorder()
+		err := p.checkPreconditions(w, r, attrs)
+		status := 0
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			status = handlerErr.StatusCode
+		}
+		if status != tc.expected {
+			t.Errorf("%s: got status %d, want %d", tc.desc, status, tc.expected)
+		}
+		if status == http.StatusNotModified && w.Header().Get("ETag") != `"3"` {
+			t.Errorf("%s: got ETag %q on 304", tc.desc, w.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestMappedBucket(t *testing.T) {
+	p := GcsProxy{Bucket: "default", BucketMap: map[string]string{
+		"assets.example.com": "assets",
+		"/media/":            "media",
+		"/media/video/":      "video",
+	}}
+	if err := p.provisionBucketMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		url      string
+		expected string
+	}{
+		{url: "http://Assets.example.com:8080/media/a.png", expected: "assets"},
+		{url: "http://example.com/media/a.png", expected: "media"},
+		{url: "http://example.com/media/video/a.mp4", expected: "video"},
+		{url: "http://example.com/index.html", expected: "default"},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		if bucket := p.mappedBucket(r); bucket != tc.expected {
+			t.Errorf("%s: got bucket %q, want %q", tc.url, bucket, tc.expected)
+		}
+	}
+
+	single := []GcsProxy{
+		{PublicOnly: true},
+		{WriteSpool: &WriteSpool{Dir: "/tmp/spool"}},
+		{Quotas: []Quota{{Prefix: "users/"}}},
+		{ReleasePointer: &ReleasePointer{Key: "current"}},
+		{ExpireUploads: &ExpireUploads{SweepInterval: caddy.Duration(time.Hour)}},
+		{MirrorCheck: &MirrorCheck{}},
+		{AuditLog: &AuditLog{}},
+	}
+	for _, q := range single {
+		q.BucketMap = p.BucketMap
+		if err := q.checkBucketMap(); err == nil {
+			t.Errorf("bucket_map allowed with %+v", q)
+		}
+	}
+	if err := (GcsProxy{BucketMap: p.BucketMap, Cache: &Cache{}, AuditLog: &AuditLog{Bucket: "logs"}}).checkBucketMap(); err != nil {
+		t.Errorf("bucket_map not allowed with a cache and an audit log bucket: %v", err)
+	}
+}
+
+func TestResolveBucket(t *testing.T) {
+	p := GcsProxy{Bucket: "{http.request.host}", AllowedBuckets: []string{"*.example.com", "tenant-?"}}
+	testCases := []struct {
+		host      string
+		expected  string
+		shouldErr bool
+	}{
+		{host: "Assets.Example.com", expected: "assets.example.com"},
+		{host: "tenant-a", expected: "tenant-a"},
+		{host: "", shouldErr: true},
+		{host: "a", shouldErr: true},
+		{host: "bad/bucket", shouldErr: true},
+		{host: "other-company-private", shouldErr: true},
+		{host: "tenant-ab", shouldErr: true},
+	}
+	for _, tc := range testCases {
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.host", tc.host)
+		bucket, err := p.resolveBucket(repl)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("%q: expected an err and did not get one", tc.host)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected err '%s'", tc.host, err.Error())
+			continue
+		}
+		if bucket != tc.expected {
+			t.Errorf("%q: got bucket %q, want %q", tc.host, bucket, tc.expected)
+		}
+	}
+
+	allowed := []string{"tenant-*"}
+	if err := (GcsProxy{Bucket: "{http.request.host}", AllowedBuckets: allowed, Cache: &Cache{}}).checkBucketTemplate(); err == nil {
+		t.Error("cache allowed with a placeholder in the bucket name")
+	}
+	if err := (GcsProxy{Bucket: "{http.request.host}", AllowedBuckets: allowed, EnableBrowse: true}).checkBucketTemplate(); err != nil {
+		t.Errorf("browse not allowed with a placeholder in the bucket name: %v", err)
+	}
+	if err := (GcsProxy{Bucket: "{http.request.host}"}).checkBucketTemplate(); err == nil {
+		t.Error("request placeholder in the bucket name allowed without allowed_buckets")
+	}
+	if err := (GcsProxy{Bucket: "tenant-{http.auth.user.id}"}).checkBucketTemplate(); err == nil {
+		t.Error("per-request placeholder in the bucket name allowed without allowed_buckets")
+	}
+	t.Setenv("GCS_TEST_BUCKET", "assets")
+	if err := (GcsProxy{Bucket: "{env.GCS_TEST_BUCKET}"}).checkBucketTemplate(); err != nil {
+		t.Errorf("env placeholder in the bucket name not allowed without allowed_buckets: %v", err)
+	}
+	if err := (GcsProxy{Bucket: "{http.request.host}", AllowedBuckets: []string{"tenant-["}}).checkBucketTemplate(); err == nil {
+		t.Error("invalid allowed_buckets pattern accepted")
+	}
+}
+
+func TestFormObjectName(t *testing.T) {
+	testCases := []struct {
+		name      string
+		expected  string
+		shouldErr bool
+	}{
+		{name: "report.pdf", expected: "report.pdf"},
+		{name: `C:\Users\me\report.pdf`, expected: "report.pdf"},
+		{name: "../../etc/passwd", expected: "passwd"},
+		{name: "dir/", shouldErr: true},
+		{name: "..", shouldErr: true},
+		{name: " ", shouldErr: true},
+	}
+	for _, tc := range testCases {
+		name, err := formObjectName(tc.name)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("%q: expected an err and did not get one", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected err '%s'", tc.name, err.Error())
+			continue
+		}
+		if name != tc.expected {
+			t.Errorf("%q: got %q, want %q", tc.name, name, tc.expected)
+		}
+	}
+
+	p := GcsProxy{FormUploads: &FormUploads{}}
+	r := httptest.NewRequest(http.MethodPost, "/uploads/", nil)
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	if !p.isFormUpload(r) {
+		t.Error("multipart form not taken as a form upload")
+	}
+	r.Header.Set("Content-Type", "image/png")
+	if p.isFormUpload(r) {
+		t.Error("image taken as a form upload")
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	testCases := []struct {
+		header    string
+		expected  contentRange
+		shouldErr bool
+	}{
+		{header: "bytes 0-99/1000", expected: contentRange{first: 0, last: 99, total: 1000}},
+		{header: "bytes 100-199/*", expected: contentRange{first: 100, last: 199, total: -1}},
+		{header: "bytes */1000", expected: contentRange{first: -1, last: -1, total: 1000}},
+		{header: "bytes */*", shouldErr: true},
+		{header: "bytes 99-0/1000", shouldErr: true},
+		{header: "bytes 0-1000/1000", shouldErr: true},
+		{header: "items 0-1/2", shouldErr: true},
+	}
+	for _, tc := range testCases {
+		cr, err := parseContentRange(tc.header)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("%q: expected an err and did not get one", tc.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected err '%s'", tc.header, err.Error())
+			continue
+		}
+		if cr != tc.expected {
+			t.Errorf("%q: got %+v, want %+v", tc.header, cr, tc.expected)
+		}
+	}
+}
+
+func TestChunkedPut(t *testing.T) {
+	p := GcsProxy{
+		Bucket:           "mybucket",
+		ResumableUploads: &ResumableUploads{Dir: t.TempDir(), MaxSize: 100},
+		staged:           &stagedUploads{active: make(map[string]bool)},
+		log:              zap.NewNop(),
+	}
+
+	put := func(contentRange, session, body string) (*httptest.ResponseRecorder, error) {
+		r := httptest.NewRequest(http.MethodPut, "/video.mp4", strings.NewReader(body))
+		r.Header.Set("Content-Range", contentRange)
+		if session != "" {
+			r.Header.Set(uploadSessionHeader, session)
+		}
+		w := httptest.NewRecorder()
+		return w, p.PutHandler(w, r, "video.mp4")
+	}
+
+	w, err := put("bytes 0-3/10", "", "0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := w.Header().Get(uploadSessionHeader)
+	if session == "" {
+		t.Fatal("first chunk answered without a session")
+	}
+
+	testCases := []struct {
+		desc         string
+		contentRange string
+		body         string
+		expected     string
+	}{
+		{desc: "chunk out of order", contentRange: "bytes 6-9/10", body: "6789", expected: "bytes=0-3"},
+		{desc: "status query", contentRange: "bytes */10", expected: "bytes=0-3"},
+		{desc: "next chunk", contentRange: "bytes 4-5/*", body: "45", expected: "bytes=0-5"},
+	}
+	for _, tc := range testCases {
+		w, err := put(tc.contentRange, session, tc.body)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if w.Code != statusResumeIncomplete || w.Header().Get("Range") != tc.expected {
+			t.Errorf("%s: got %d with Range %q, want %d with %q", tc.desc, w.Code, w.Header().Get("Range"), statusResumeIncomplete, tc.expected)
+		}
+	}
+
+	// Checksum trailers cover the chunk they are sent with
+	putSum := func(contentRange, session, body, sum string) (*httptest.ResponseRecorder, error) {
+		r := httptest.NewRequest(http.MethodPut, "/video.mp4", strings.NewReader(body))
+		r.Header.Set("Content-Range", contentRange)
+		r.Header.Set(uploadSessionHeader, session)
+		digest := md5.Sum([]byte(sum))
+		r.Trailer = http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(digest[:])}}
+		w := httptest.NewRecorder()
+		return w, p.PutHandler(w, r, "video.mp4")
+	}
+	_, err = putSum("bytes 6-9/*", session, "6789", "0123456789")
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusBadRequest || !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("chunk not matching its checksum: got %v, want 400", err)
+	}
+
+	// Another upload to the same key gets a staged file of its own
+	w, err = put("bytes 0-1/10", "", "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := w.Header().Get(uploadSessionHeader)
+	if other == "" || other == session {
+		t.Errorf("second upload got session %q, want a new one", other)
+	}
+	if w, err := putSum("bytes 2-3/*", other, "cd", "cd"); err != nil || w.Header().Get("Range") != "bytes=0-3" {
+		t.Errorf("chunk matching its checksum: got %v with Range %q, want bytes=0-3", err, w.Header().Get("Range"))
+	}
+
+	staged, err := os.ReadFile(p.stagedUploadPath("video.mp4", session))
+	if err != nil || string(staged) != "012345" {
+		t.Errorf("got staged upload %q (%v), want %q", staged, err, "012345")
+	}
+
+	errorCases := []struct {
+		desc         string
+		contentRange string
+		session      string
+		expected     int
+	}{
+		{desc: "chunk without session", contentRange: "bytes 6-9/10", expected: http.StatusBadRequest},
+		{desc: "status query without session", contentRange: "bytes */10", expected: http.StatusBadRequest},
+		{desc: "unknown session", contentRange: "bytes 6-9/10", session: "0123abcd", expected: http.StatusNotFound},
+		{desc: "larger than max_size", contentRange: "bytes 6-9/200", session: session, expected: http.StatusRequestEntityTooLarge},
+		{desc: "chunk past max_size", contentRange: "bytes 6-100/*", session: session, expected: http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range errorCases {
+		_, err := put(tc.contentRange, tc.session, "6789")
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != tc.expected {
+			t.Errorf("%s: got %v, want %d", tc.desc, err, tc.expected)
+		}
+	}
+
+	// Each chunk is checked against the quota with the upload's size so far
+	p.Quotas = []Quota{{Prefix: "", MaxBytes: 12}}
+	p.quotas = newQuotaTracker(time.Hour)
+	p.quotas.usage[""] = &quotaUsage{bytes: 4, scanned: time.Now()}
+	p.gcs = newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	r := clientRequest(http.MethodPut, "/video.mp4", "", strings.NewReader("6789"))
+	r.Header.Set("Content-Range", "bytes 6-9/*")
+	r.Header.Set(uploadSessionHeader, session)
+	err = p.PutHandler(httptest.NewRecorder(), r, "video.mp4")
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("chunk over quota: got %v, want 507", err)
+	}
+	if staged, _ := os.ReadFile(p.stagedUploadPath("video.mp4", session)); string(staged) != "012345" {
+		t.Errorf("chunk over quota staged: got %q", staged)
+	}
+}
+
+func TestGcsContext(t *testing.T) {
+	p := GcsProxy{RequestTimeout: caddy.Duration(time.Minute), DeadlineHeader: "X-Request-Timeout", log: zap.NewNop()}
+
+	testCases := []struct {
+		desc     string
+		header   string
+		expected time.Duration
+	}{
+		{desc: "request timeout", expected: time.Minute},
+		{desc: "shorter deadline header", header: "2s", expected: 2 * time.Second},
+		{desc: "longer deadline header", header: "300", expected: time.Minute},
+		{desc: "invalid deadline header", header: "soon", expected: time.Minute},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+		if tc.header != "" {
+			r.Header.Set("X-Request-Timeout", tc.header)
+		}
+		ctx, cancel := p.gcsContext(r)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if !ok {
+			t.Errorf("%s: no deadline", tc.desc)
+			continue
+		}
+		if remaining := time.Until(deadline); remaining > tc.expected || remaining < tc.expected-time.Second {
+			t.Errorf("%s: deadline in %s, want %s", tc.desc, remaining, tc.expected)
+		}
+	}
+
+	// GCS operations stop once the client goes away
+	clientCtx, disconnect := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/file.txt", nil).WithContext(clientCtx)
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	disconnect()
+	if ctx.Err() == nil {
+		t.Error("GCS context not cancelled with the request")
+	}
+}
+
+func TestPageBuilderJSON(t *testing.T) {
+	updated := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	b := newPageBuilder("docs/", false)
+	b.add(&storage.ObjectAttrs{Prefix: "docs/api/"})
+	b.add(&storage.ObjectAttrs{Name: "docs/intro.md", Size: 2048, Updated: updated})
+
+	rec := httptest.NewRecorder()
+	if err := b.po.GenerateJson(rec); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Items []struct {
+			Key      string `json:"key"`
+			IsDir    bool   `json:"is_dir"`
+			Bytes    int64  `json:"bytes"`
+			Modified string `json:"modified"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Items) != 2 {
+		t.Fatalf("got %d items, want 2", len(got.Items))
+	}
+	if dir := got.Items[0]; dir.Key != "docs/api/" || !dir.IsDir || dir.Modified != "" {
+		t.Errorf("got directory %+v, want key docs/api/ and no modified time", dir)
+	}
+	if file := got.Items[1]; file.Key != "docs/intro.md" || file.Bytes != 2048 || file.Modified != "2024-05-01T12:30:00Z" {
+		t.Errorf("got file %+v, want key docs/intro.md, 2048 bytes modified 2024-05-01T12:30:00Z", file)
+	}
+}
+
+func TestSortItems(t *testing.T) {
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	items := []Item{
+		{Name: "b", Bytes: 1, Modified: newer},
+		{Name: "a", Bytes: 3, Modified: older},
+		{Name: "c", Bytes: 2},
+	}
+	testCases := []struct {
+		desc  string
+		field string
+		order string
+		want  string
+	}{
+		{desc: "listed order", want: "bac"},
+		{desc: "name", field: "name", want: "abc"},
+		{desc: "name descending", order: "desc", want: "cba"},
+		{desc: "size", field: "size", want: "bca"},
+		{desc: "size descending", field: "size", order: "desc", want: "acb"},
+		{desc: "time", field: "time", want: "cab"},
+		{desc: "unknown field", field: "owner", order: "desc", want: "bac"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			sorted := slices.Clone(items)
+			sortItems(sorted, tc.field, tc.order)
+			var got string
+			for _, item := range sorted {
+				got += item.Name
+			}
+			if got != tc.want {
+				t.Errorf("got order %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMakePageObjPagination(t *testing.T) {
+	// Two pages of two entries each; the first repeats the docs/ directory,
+	// once as a prefix and once as its console folder object
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("pageToken")
+		tokens = append(tokens, token)
+		w.Header().Set("Content-Type", "application/json")
+		switch token {
+		case "":
+			io.WriteString(w, `{"prefixes":["docs/"],"items":[{"name":"docs/"}],"nextPageToken":"page2"}`)
+		case "page2":
+			io.WriteString(w, `{"items":[{"name":"intro.md","size":"10"},{"name":"notes.md","size":"20"}]}`)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := storage.NewClient(context.Background(), option.WithoutAuthentication(), option.WithEndpoint(srv.URL+"/storage/v1/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := GcsProxy{}
+
+	it := client.Bucket("test").Objects(context.Background(), &storage.Query{Delimiter: "/"})
+	it.PageInfo().MaxSize = 2
+	po, err := p.makePageObj(it, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if po.Count != 1 || po.Items[0].Key != "docs/" {
+		t.Errorf("got first page %+v, want only docs/", po.Items)
+	}
+	if po.MoreLink != "?max=2&next=page2" {
+		t.Errorf("got more link %q, want ?max=2&next=page2", po.MoreLink)
+	}
+
+	it = client.Bucket("test").Objects(context.Background(), &storage.Query{Delimiter: "/"})
+	it.PageInfo().MaxSize = 2
+	it.PageInfo().Token = "page2"
+	po, err = p.makePageObj(it, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if po.Count != 2 || po.MoreLink != "" {
+		t.Errorf("got second page %+v with more link %q, want two items and no more link", po.Items, po.MoreLink)
+	}
+	if !slices.Equal(tokens, []string{"", "page2"}) {
+		t.Errorf("got page tokens %q, want one request per page", tokens)
+	}
+}
+
+func TestPageObjSetPath(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		path    string
+		current string
+		crumbs  []string
+		parent  string
+	}{
+		{desc: "root", path: "/", current: "/", crumbs: []string{"/"}},
+		{desc: "nested", path: "/docs/api/", current: "/docs/api/", crumbs: []string{"/", "/docs/", "/docs/api/"}, parent: "/docs/"},
+		{desc: "escaped", path: "/my docs/a#b", current: "/my docs/a#b/", crumbs: []string{"/", "/my%20docs/", "/my%20docs/a%23b/"}, parent: "/my%20docs/"},
+		{desc: "unclean", path: "//docs/../img", current: "/img/", crumbs: []string{"/", "/img/"}, parent: "/"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var po PageObj
+			po.setPath(tc.path)
+			var crumbs []string
+			for _, crumb := range po.Breadcrumbs {
+				crumbs = append(crumbs, crumb.Url)
+			}
+			if po.CurrentPath != tc.current || !slices.Equal(crumbs, tc.crumbs) || po.ParentUrl != tc.parent {
+				t.Errorf("got path %q, breadcrumbs %v, parent %q, want %q, %v, %q",
+					po.CurrentPath, crumbs, po.ParentUrl, tc.current, tc.crumbs, tc.parent)
+			}
+		})
+	}
+}
+
+func TestPrecompressedSidecars(t *testing.T) {
+	p := GcsProxy{Precompressed: []string{"br", "gzip"}}
+	testCases := []struct {
+		desc           string
+		acceptEncoding string
+		want           []string
+	}{
+		{desc: "none accepted", acceptEncoding: "", want: nil},
+		{desc: "server preference", acceptEncoding: "gzip, deflate, br", want: []string{"app.js.br", "app.js.gz"}},
+		{desc: "client preference", acceptEncoding: "br;q=0.5, gzip", want: []string{"app.js.gz", "app.js.br"}},
+		{desc: "refused", acceptEncoding: "br;q=0, gzip", want: []string{"app.js.gz"}},
+		{desc: "not configured", acceptEncoding: "zstd, deflate", want: nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+			if tc.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			var got []string
+			for _, sidecar := range p.precompressedSidecars(r, "app.js") {
+				got = append(got, sidecar.key)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got sidecars %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSidecarAttrs(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		contentType string
+		want        string
+	}{
+		{desc: "untyped", contentType: "", want: "text/javascript; charset=utf-8"},
+		{desc: "typed as compressed file", contentType: "application/x-gzip", want: "text/javascript; charset=utf-8"},
+		{desc: "typed as content", contentType: "application/javascript", want: "application/javascript"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			attrs := &storage.ObjectAttrs{Name: "app.js.gz", ContentType: tc.contentType, Generation: 7}
+			served := sidecarAttrs(attrs, "app.js", "gzip")
+			if served.ContentType != tc.want || served.ContentEncoding != "gzip" || served.Generation != 7 {
+				t.Errorf("got type %q, encoding %q, generation %d, want %q, gzip, 7",
+					served.ContentType, served.ContentEncoding, served.Generation, tc.want)
+			}
+			if attrs.ContentEncoding != "" {
+				t.Error("sidecar attrs were modified")
+			}
+		})
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	p := GcsProxy{Compress: &Compress{
+		Encodings: compressEncodings,
+		Types:     defaultCompressTypes,
+		MinLength: defaultCompressMinLength,
+	}}
+	body := strings.Repeat("compress me please ", 100)
+	testCases := []struct {
+		desc           string
+		acceptEncoding string
+		attrs          storage.ObjectAttrs
+		wantEncoding   string
+		wantVary       bool
+	}{
+		{desc: "gzip", acceptEncoding: "gzip", attrs: storage.ObjectAttrs{ContentType: "text/plain"}, wantEncoding: "gzip", wantVary: true},
+		{desc: "zstd preferred", acceptEncoding: "gzip, zstd", attrs: storage.ObjectAttrs{ContentType: "application/json"}, wantEncoding: "zstd", wantVary: true},
+		{desc: "not accepted", acceptEncoding: "br", attrs: storage.ObjectAttrs{ContentType: "text/css"}, wantVary: true},
+		{desc: "type by extension", acceptEncoding: "gzip", attrs: storage.ObjectAttrs{Name: "index.html"}, wantEncoding: "gzip", wantVary: true},
+		{desc: "incompressible type", acceptEncoding: "gzip", attrs: storage.ObjectAttrs{ContentType: "image/png"}},
+		{desc: "no-transform", acceptEncoding: "gzip", attrs: storage.ObjectAttrs{ContentType: "text/plain", CacheControl: "public, no-transform"}},
+		{desc: "stored compressed", acceptEncoding: "gzip, zstd", attrs: storage.ObjectAttrs{ContentType: "text/plain", ContentEncoding: "br"}, wantEncoding: "br"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tc.attrs.Size = int64(len(body))
+			tc.attrs.Generation = 1
+			r := httptest.NewRequest(http.MethodGet, "/object", nil)
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			w := httptest.NewRecorder()
+			if err := p.writeResponseFromGetObject(w, r, strings.NewReader(body), &tc.attrs); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := w.Header().Get("Content-Encoding"); got != tc.wantEncoding {
+				t.Errorf("got Content-Encoding %q, want %q", got, tc.wantEncoding)
+			}
+			if got := w.Header().Get("Vary") == "Accept-Encoding"; got != tc.wantVary {
+				t.Errorf("got Vary %q, want Accept-Encoding: %t", w.Header().Get("Vary"), tc.wantVary)
+			}
+
+			var got []byte
+			var err error
+			switch tc.wantEncoding {
+			case "gzip":
+				var gz *gzip.Reader
+				if gz, err = gzip.NewReader(w.Body); err == nil {
+					got, err = io.ReadAll(gz)
+				}
+			case "zstd":
+				var zr *zstd.Decoder
+				if zr, err = zstd.NewReader(w.Body); err == nil {
+					got, err = io.ReadAll(zr)
+					zr.Close()
+				}
+			default:
+				got = w.Body.Bytes()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != body {
+				t.Errorf("got body of %d bytes, want the %d bytes of the object", len(got), len(body))
+			}
+			if tc.wantEncoding == "gzip" || tc.wantEncoding == "zstd" {
+				if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+					t.Errorf("got strong ETag %s for a compressed body", etag)
+				}
+				if w.Header().Get("Accept-Ranges") != "" {
+					t.Error("got Accept-Ranges for a compressed body")
+				}
+			}
+		})
+	}
+}
+
+func TestPathRulesTraversal(t *testing.T) {
+	p := GcsProxy{
+		Bucket:       "test",
+		EnablePut:    true,
+		EnableDelete: true,
+		PutPaths:     []string{"/uploads/*"},
+		DeletePaths:  []string{"/uploads/*"},
+		log:          zap.NewNop(),
+		gcs:          &clientHolder{},
+	}
+	testCases := []struct {
+		method string
+		path   string
+	}{
+		{method: http.MethodPut, path: "/uploads/../index.html"},
+		{method: http.MethodPut, path: "/uploads/%2e%2e/index.html"},
+		{method: http.MethodDelete, path: "/uploads/a/../../index.html"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader("x"))
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			w := httptest.NewRecorder()
+			err := p.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+			var herr caddyhttp.HandlerError
+			if !errors.As(err, &herr) || herr.StatusCode != http.StatusMethodNotAllowed {
+				t.Errorf("got err %v, want 405", err)
+			}
+		})
+	}
+	if got := cleanPath("/uploads/../index.html"); got != "/index.html" {
+		t.Errorf("got cleaned path %q, want /index.html", got)
+	}
+	if got := cleanPath("//docs/./api/"); got != "/docs/api/" {
+		t.Errorf("got cleaned path %q, want /docs/api/", got)
+	}
+}
+
+func TestServeHTTPMethods(t *testing.T) {
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "site/a.txt") {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"name":"site/a.txt","bucket":"test","generation":"1","size":"1","contentType":"text/plain"}`)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", "1")
+		io.WriteString(w, "a")
+	})
+	p := GcsProxy{
+		Bucket:    "test",
+		Root:      "site",
+		EnablePut: true,
+		gcs:       gcs,
+		log:       zap.NewNop(),
+	}
+	readOnly := p
+	readOnly.Methods = []string{http.MethodGet, http.MethodHead}
+
+	testCases := []struct {
+		name   string
+		proxy  GcsProxy
+		method string
+		status int
+		allow  string
+	}{
+		{name: "delete disabled", proxy: p, method: http.MethodDelete, status: http.StatusMethodNotAllowed, allow: "GET, HEAD, PUT"},
+		{name: "options", proxy: p, method: http.MethodOptions, status: http.StatusMethodNotAllowed, allow: "GET, HEAD, PUT"},
+		{name: "put outside allowlist", proxy: readOnly, method: http.MethodPut, status: http.StatusMethodNotAllowed, allow: "GET, HEAD"},
+		{name: "options with allowlist", proxy: readOnly, method: http.MethodOptions, status: http.StatusMethodNotAllowed, allow: "GET, HEAD"},
+		{name: "get in allowlist", proxy: readOnly, method: http.MethodGet, status: http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/a.txt", strings.NewReader("x"))
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			w := httptest.NewRecorder()
+			err := tc.proxy.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+			status := w.Code
+			var herr caddyhttp.HandlerError
+			if errors.As(err, &herr) {
+				status = herr.StatusCode
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tc.status {
+				t.Errorf("got status %d, want %d", status, tc.status)
+			}
+			if got := w.Header().Get("Allow"); got != tc.allow {
+				t.Errorf("got Allow %q, want %q", got, tc.allow)
+			}
+		})
+	}
+}
+
+// newFakeGCS returns a client holder whose client sends its JSON API
+// requests to handler.
+func newFakeGCS(t *testing.T, handler http.HandlerFunc) *clientHolder {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	client, err := storage.NewClient(context.Background(), option.WithoutAuthentication(), option.WithEndpoint(srv.URL+"/storage/v1/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	holder := &clientHolder{}
+	holder.current.Store(client)
+	return holder
+}
+
+// clientRequest returns a request from the client identified as identity.
+func clientRequest(method, target, identity string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	repl := caddy.NewReplacer()
+	repl.Set("client.id", identity)
+	return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+}
+
+func TestClientPrefixSecondKey(t *testing.T) {
+	var requests []string
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/compose"):
+			io.WriteString(w, `{"name":"clients/app/out.txt","bucket":"test","generation":"1"}`)
+		case strings.Contains(r.URL.Path, "/rewriteTo/"):
+			io.WriteString(w, `{"done":true,"resource":{"name":"moved","bucket":"test","generation":"1"}}`)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			io.WriteString(w, `{"name":"test"}`)
+		}
+	})
+	p := GcsProxy{
+		Bucket:        "test",
+		Root:          "site",
+		EnablePut:     true,
+		EnableCompose: true,
+		EnableFolders: true,
+		ClientPrefixes: &ClientPrefixes{
+			Identity: "{client.id}",
+			Clients:  map[string]ClientPrefix{"*": {Prefix: "clients/{client.id}", Write: true}},
+		},
+		gcs: gcs,
+		hns: &hnsState{},
+		log: zap.NewNop(),
+	}
+
+	t.Run("compose sources", func(t *testing.T) {
+		requests = nil
+		r := clientRequest(http.MethodPost, "/out.txt?compose", "app", strings.NewReader(`{"sources":["/a.txt","/../other/secret.txt"]}`))
+		if err := p.ComposeHandler(httptest.NewRecorder(), r, "site/clients/app/out.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if len(requests) != 1 {
+			t.Fatalf("got requests %q, want one compose", requests)
+		}
+		if !strings.Contains(requests[0], `"name":"site/clients/app/a.txt"`) ||
+			!strings.Contains(requests[0], `"name":"site/clients/app/other/secret.txt"`) {
+			t.Errorf("got compose request %s, want sources under site/clients/app/", requests[0])
+		}
+	})
+
+	t.Run("protected compose source", func(t *testing.T) {
+		requests = nil
+		p := p
+		p.SignedURLs = &SignedURLs{Secret: "s3cret", Paths: []string{"/private/*"}}
+		r := clientRequest(http.MethodPost, "/out.txt?compose", "app", strings.NewReader(`{"sources":["/a.txt","/public/../private/secret.txt"]}`))
+		err := p.ComposeHandler(httptest.NewRecorder(), r, "site/clients/app/out.txt")
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusForbidden {
+			t.Fatalf("got %v, want 403", err)
+		}
+		if len(requests) != 0 {
+			t.Errorf("got requests %q, want none", requests)
+		}
+	})
+
+	t.Run("write-protected compose source", func(t *testing.T) {
+		requests = nil
+		p := p
+		p.Protect = []string{"site/clients/app/_redirects"}
+		r := clientRequest(http.MethodPost, "/out.txt?compose", "app", strings.NewReader(`{"sources":["/a.txt","/_redirects"]}`))
+		err := p.ComposeHandler(httptest.NewRecorder(), r, "site/clients/app/out.txt")
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusForbidden {
+			t.Fatalf("got %v, want 403", err)
+		}
+		if len(requests) != 0 {
+			t.Errorf("got requests %q, want none", requests)
+		}
+	})
+
+	t.Run("compose without put", func(t *testing.T) {
+		requests = nil
+		p := p
+		p.EnablePut = false
+		p.Methods = []string{http.MethodGet, http.MethodPost}
+		r := clientRequest(http.MethodPost, "/out.txt?compose", "app", strings.NewReader(`{"sources":["/a.txt"]}`))
+		err := p.PostHandler(httptest.NewRecorder(), r, "site/clients/app/out.txt")
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("got %v, want 405", err)
+		}
+		if len(requests) != 0 {
+			t.Errorf("got requests %q, want none", requests)
+		}
+	})
+
+	t.Run("move destination", func(t *testing.T) {
+		requests = nil
+		r := clientRequest(methodMove, "/a.txt", "app", nil)
+		r.Header.Set("Destination", "/../other/a.txt")
+		if err := p.MoveHandler(httptest.NewRecorder(), r, "site/clients/app/a.txt"); err != nil {
+			t.Fatal(err)
+		}
+		var rewrite string
+		for _, req := range requests {
+			if strings.Contains(req, "/rewriteTo/") {
+				rewrite = req
+			}
+		}
+		if !strings.Contains(rewrite, "/rewriteTo/b/test/o/site/clients/app/other/a.txt") {
+			t.Errorf("got requests %q, want a copy to site/clients/app/other/a.txt", requests)
+		}
+	})
+
+	t.Run("move destination outside put_paths", func(t *testing.T) {
+		requests = nil
+		p := p
+		p.PutPaths = []string{"/uploads/*"}
+		r := clientRequest(methodMove, "/uploads/a.txt", "app", nil)
+		r.Header.Set("Destination", "/uploads/../index.html")
+		err := p.MoveHandler(httptest.NewRecorder(), r, "site/clients/app/uploads/a.txt")
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusForbidden {
+			t.Fatalf("got %v, want 403", err)
+		}
+		if len(requests) != 0 {
+			t.Errorf("got requests %q, want none", requests)
+		}
+	})
+}
+
+func TestCompressRange(t *testing.T) {
+	body := strings.Repeat("compress me please ", 100)
+	attrs := &storage.ObjectAttrs{Name: "file.txt", Size: int64(len(body)), Generation: 3, ContentType: "text/plain", MD5: []byte("0123456789abcdef")}
+	p := GcsProxy{
+		Cache:  &Cache{},
+		cache:  newObjectCache(Cache{}),
+		Digest: true,
+		Compress: &Compress{
+			Encodings: compressEncodings,
+			Types:     defaultCompressTypes,
+			MinLength: defaultCompressMinLength,
+		},
+		log: zap.NewNop(),
+	}
+	p.cache.put(attrs.Name, attrs, []byte(body))
+
+	testCases := []struct {
+		desc     string
+		ifRange  string
+		wantCode int
+		wantBody string
+	}{
+		{desc: "range", wantCode: http.StatusPartialContent, wantBody: body[:10]},
+		{desc: "if-range mismatch", ifRange: `"other"`, wantCode: http.StatusOK, wantBody: body},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+			r.Header.Set("Range", "bytes=0-9")
+			r.Header.Set("Accept-Encoding", "gzip, zstd")
+			if tc.ifRange != "" {
+				r.Header.Set("If-Range", tc.ifRange)
+			}
+			w := httptest.NewRecorder()
+			if err := p.GetHandler(w, r, attrs.Name); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tc.wantCode || w.Body.String() != tc.wantBody {
+				t.Errorf("got status %d with %d bytes, want %d with %d", w.Code, w.Body.Len(), tc.wantCode, len(tc.wantBody))
+			}
+			if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+				t.Errorf("got Content-Encoding %q for a range request", encoding)
+			}
+			if w.Header().Get("Digest") == "" {
+				t.Error("got no Digest for the stored bytes")
+			}
+		})
+	}
+
+	// A compressed body gets no digest of the stored bytes
+	r := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	if err := p.GetHandler(w, r, attrs.Name); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Digest") != "" {
+		t.Errorf("got Content-Encoding %q and Digest %q, want gzip and no digest",
+			w.Header().Get("Content-Encoding"), w.Header().Get("Digest"))
+	}
+}
+
+func TestQuotaOverwrite(t *testing.T) {
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/b/test/o/users/a.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name":"users/a.txt","bucket":"test","size":"5"}`)
+	})
+	p := GcsProxy{
+		Bucket: "test",
+		Quotas: []Quota{{Prefix: "users/", MaxBytes: 10, MaxObjects: 1}},
+		quotas: newQuotaTracker(time.Hour),
+		gcs:    gcs,
+		log:    zap.NewNop(),
+	}
+	p.quotas.usage["users/"] = &quotaUsage{bytes: 5, objects: 1, scanned: time.Now()}
+
+	r := clientRequest(http.MethodPut, "/users/a.txt", "", strings.NewReader("12345678"))
+	qw, err := p.checkQuotas(context.Background(), httptest.NewRecorder(), r, "users/a.txt", r.ContentLength)
+	if err != nil {
+		t.Fatalf("overwrite at the object limit: %v", err)
+	}
+	if qw.remaining != 10 || qw.replaced != 5 {
+		t.Errorf("got remaining %d and replaced %d, want 10 and 5", qw.remaining, qw.replaced)
+	}
+	p.recordQuotaWrite(r, "users/a.txt", 8, qw.replaced)
+	qw.release()
+	if usage := p.quotas.usage["users/"]; usage.bytes != 8 || usage.objects != 1 {
+		t.Errorf("got usage of %d bytes in %d objects after overwrite, want 8 in 1", usage.bytes, usage.objects)
+	}
+
+	r = clientRequest(http.MethodPut, "/users/b.txt", "", strings.NewReader("1"))
+	_, err = p.checkQuotas(context.Background(), httptest.NewRecorder(), r, "users/b.txt", r.ContentLength)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("new object at the object limit: got %v, want 507", err)
+	}
+}
+
+func TestPublicOnlyListings(t *testing.T) {
+	for _, public := range []bool{false, true} {
+		var listed bool
+		gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/iam"):
+				members := `"user:admin@example.com"`
+				if public {
+					members += `,"allUsers"`
+				}
+				io.WriteString(w, `{"bindings":[{"role":"roles/storage.objectViewer","members":[`+members+`]}]}`)
+			default:
+				listed = true
+				io.WriteString(w, `{"items":[]}`)
+			}
+		})
+		p := GcsProxy{
+			Bucket:      "test",
+			PublicOnly:  true,
+			publicCheck: newPublicChecker(time.Minute, zap.NewNop()),
+			usage:       newUsageTracker(DiskUsage{}),
+			stats:       newStatsTracker(PrefixStats{}),
+			gcs:         gcs,
+			hns:         &hnsState{},
+			log:         zap.NewNop(),
+		}
+
+		handlers := map[string]func(http.ResponseWriter, *http.Request, string) error{
+			"browse":  p.BrowseHandler,
+			"ndjson":  p.NDJSONListHandler,
+			"du":      p.DiskUsageHandler,
+			"stats":   p.StatsHandler,
+			"deleted": p.DeletedHandler,
+		}
+		for name, handler := range handlers {
+			listed = false
+			r := clientRequest(http.MethodGet, "/docs/?format=json", "", nil)
+			err := handler(httptest.NewRecorder(), r, "docs/")
+			var handlerErr caddyhttp.HandlerError
+			forbidden := errors.As(err, &handlerErr) && handlerErr.StatusCode == http.StatusForbidden
+			if want := !public || name == "deleted"; forbidden != want || listed == want {
+				t.Errorf("%s with public bucket %t: got %v after listing %t", name, public, err, listed)
+			}
+		}
+	}
+}
+
+func TestBrowseEtag(t *testing.T) {
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"items":[{"name":"docs/a.txt","bucket":"test","size":"3","generation":"1"}]}`)
+	})
+	dirTemplate := &templateHolder{}
+	dirTemplate.current.Store(template.Must(template.New("default_listing").Parse(defaultBrowseTemplate)))
+	p := GcsProxy{Bucket: "test", gcs: gcs, hns: &hnsState{}, dirTemplate: dirTemplate, log: zap.NewNop()}
+
+	browse := func(target string, ifNoneMatch string) (*httptest.ResponseRecorder, error) {
+		r := clientRequest(http.MethodGet, target, "", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		return w, p.BrowseHandler(w, r, "docs/")
+	}
+
+	html, err := browse("/docs/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonPage, err := browse("/docs/?format=json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	htmlEtag, jsonEtag := html.Header().Get("ETag"), jsonPage.Header().Get("ETag")
+	if htmlEtag == "" || htmlEtag == jsonEtag {
+		t.Errorf("got ETag %s for HTML and %s for JSON, want different ones", htmlEtag, jsonEtag)
+	}
+
+	w, err := browse("/docs/?format=json", htmlEtag)
+	if err != nil || w.Body.Len() == 0 {
+		t.Errorf("JSON with the HTML ETag: got %v with %d bytes, want the page", err, w.Body.Len())
+	}
+
+	w, err = browse("/docs/", htmlEtag)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusNotModified {
+		t.Fatalf("got %v, want 304", err)
+	}
+	if w.Header().Get("Vary") != "Accept" {
+		t.Errorf("304 sent with Vary %q, want Accept", w.Header().Get("Vary"))
+	}
+}
+
+func TestIndexAndErrorPageKeys(t *testing.T) {
+	testCases := []struct {
+		root     string
+		expected []string
+	}{
+		{root: "{http.vars.root}", expected: []string{"/index.html", "errors/404.html"}},
+		{root: "{http.vars.root}/site", expected: []string{"/site/index.html", "errors/404.html"}},
+		{root: "site", expected: []string{"site/index.html", "errors/404.html"}},
+		{root: "users/{http.auth.user.id}", expected: []string{"errors/404.html"}},
+	}
+	for _, tc := range testCases {
+		p := GcsProxy{
+			Root:       tc.root,
+			IndexNames: []string{"index.html"},
+			ErrorPages: map[int]string{404: "errors/404.html"},
+			log:        zap.NewNop(),
+		}
+		if keys := p.indexAndErrorPageKeys(); !slices.Equal(keys, tc.expected) {
+			t.Errorf("root %s: got %q, want %q", tc.root, keys, tc.expected)
+		}
+	}
+}
+
+func TestDeletedHandler(t *testing.T) {
+	var maxResults []string
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		maxResults = append(maxResults, r.URL.Query().Get("maxResults"))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"items":[
+			{"name":"docs/secret.txt","bucket":"test","generation":"1"},
+			{"name":"docs/a.txt","bucket":"test","generation":"2"}
+		],"nextPageToken":"t2"}`)
+	})
+	p := GcsProxy{
+		Bucket:            "test",
+		EnableSoftDeleted: true,
+		Hide:              []string{"secret.txt"},
+		gcs:               gcs,
+		log:               zap.NewNop(),
+	}
+
+	r := clientRequest(http.MethodGet, "/docs/?deleted=1&max=2", "", nil)
+	err := p.DeletedHandler(httptest.NewRecorder(), r, "docs/")
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusForbidden {
+		t.Errorf("without restore allowed: got %v, want 403", err)
+	}
+
+	p.EnablePut = true
+	w := httptest.NewRecorder()
+	if err := p.DeletedHandler(w, r, "docs/"); err != nil {
+		t.Fatal(err)
+	}
+	var listing deletedListing
+	if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Objects) != 1 || listing.Objects[0].Key != "docs/a.txt" || listing.Next != "t2" {
+		t.Errorf("got %+v, want docs/a.txt and the next page token", listing)
+	}
+	if !slices.Equal(maxResults, []string{"2"}) {
+		t.Errorf("listed pages of %q, want a single page of 2", maxResults)
+	}
+}
+
+func TestGenerationAt(t *testing.T) {
+	var query url.Values
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"items":[
+			{"name":"a.txt","bucket":"test","generation":"1","timeCreated":"2024-01-01T00:00:00Z","timeDeleted":"2024-03-01T00:00:00Z"},
+			{"name":"a.txt","bucket":"test","generation":"2","timeCreated":"2024-03-01T00:00:00Z"}
+		]}`)
+	})
+	p := GcsProxy{Bucket: "test", gcs: gcs, log: zap.NewNop()}
+
+	attrs, err := p.generationAt(context.Background(), "a.txt", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs == nil || attrs.Generation != 1 {
+		t.Errorf("got %+v, want generation 1", attrs)
+	}
+	if query.Get("prefix") != "" || query.Get("startOffset") != "a.txt" || query.Get("endOffset") != "a.txt\x00" {
+		t.Errorf("listed with %v, want only a.txt", query)
+	}
+}
+
+func TestPrivateMetadata(t *testing.T) {
+	attrs := &storage.ObjectAttrs{
+		Name:       "report.pdf",
+		Generation: 1,
+		Metadata: map[string]string{
+			"link":                "</style.css>; rel=preload",
+			"gcsproxy-uploader":   "alice",
+			"Gcsproxy-Client-Ip":  "203.0.113.7",
+			"department-reviewed": "yes",
+		},
+	}
+	p := GcsProxy{log: zap.NewNop()}
+	r := httptest.NewRequest(http.MethodGet, "/report.pdf", nil)
+	w := httptest.NewRecorder()
+	if err := p.writeResponseFromGetObject(w, r, strings.NewReader("%PDF"), attrs); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"Gcsproxy-Uploader": "", "Gcsproxy-Client-Ip": "", "Department-Reviewed": "yes", "Link": "</style.css>; rel=preload"} {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("got %s header %q, want %q", name, got, value)
+		}
+	}
+
+	meta := newObjectMeta(attrs)
+	if len(meta.Metadata) != 2 || meta.Metadata["gcsproxy-uploader"] != "" {
+		t.Errorf("got metadata %v, want only link and department-reviewed", meta.Metadata)
+	}
+}
+
+func TestFormUploadChecksKeys(t *testing.T) {
+	var uploads []string
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		uploads = append(uploads, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name":"site/uploads/notes.txt","bucket":"test","generation":"1","size":"5"}`)
+	})
+	p := GcsProxy{
+		Bucket:      "test",
+		EnablePut:   true,
+		Protect:     []string{"site/uploads/_redirects"},
+		Hide:        []string{".env"},
+		PutPaths:    []string{"/uploads/*.txt", "/uploads/_redirects", "/uploads/.env"},
+		FormUploads: &FormUploads{MaxFiles: 1},
+		gcs:         gcs,
+		log:         zap.NewNop(),
+	}
+
+	form := func(filename string) *http.Request {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", filename)
+		io.WriteString(part, "hello")
+		mw.Close()
+		r := clientRequest(http.MethodPost, "/uploads/", "", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return r
+	}
+
+	for _, filename := range []string{"_redirects", ".env", "image.png"} {
+		uploads = nil
+		err := p.PostHandler(httptest.NewRecorder(), form(filename), "site/uploads/")
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: got %v, want 403", filename, err)
+		}
+		if len(uploads) != 0 {
+			t.Errorf("%s: got GCS requests %q, want none", filename, uploads)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if err := p.PostHandler(w, form("notes.txt"), "site/uploads/"); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/uploads/notes.txt" {
+		t.Errorf("got %d with Location %q, want 201 with /uploads/notes.txt", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestGzipStoredObject(t *testing.T) {
+	var stored bytes.Buffer
+	gz := gzip.NewWriter(&stored)
+	io.WriteString(gz, "hello, world")
+	gz.Close()
+
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"name":"site/hello.txt","bucket":"test","generation":"1","size":"%d","contentType":"text/plain","contentEncoding":"gzip"}`, stored.Len())
+			return
+		}
+		// GCS transcodes for readers that don't ask for the stored bytes
+		w.Header().Set("X-Goog-Generation", "1")
+		w.Header().Set("X-Goog-Stored-Content-Encoding", "gzip")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			io.WriteString(w, "hello, world")
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(stored.Bytes())
+	})
+
+	for _, tc := range []struct {
+		desc           string
+		acceptEncoding string
+		cache          bool
+	}{
+		{desc: "gzip client", acceptEncoding: "gzip"},
+		{desc: "identity client"},
+		{desc: "gzip client cached", acceptEncoding: "gzip", cache: true},
+		{desc: "identity client cached", cache: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := GcsProxy{Bucket: "test", gcs: gcs, log: zap.NewNop()}
+			if tc.cache {
+				p.Cache = &Cache{}
+				p.cache = newObjectCache(*p.Cache)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/hello.txt", nil)
+			if tc.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			if err := p.GetHandler(w, r, "site/hello.txt"); err != nil {
+				t.Fatal(err)
+			}
+
+			body := w.Body.Bytes()
+			if tc.acceptEncoding != "" {
+				if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+					t.Fatalf("got Content-Encoding %q, want gzip", got)
+				}
+				if !bytes.Equal(body, stored.Bytes()) {
+					t.Fatalf("got body %q, want the stored bytes", body)
+				}
+			} else {
+				if got := w.Header().Get("Content-Encoding"); got != "" {
+					t.Errorf("got Content-Encoding %q, want none", got)
+				}
+				if got := w.Header().Get("Content-Length"); got != "" {
+					t.Errorf("got Content-Length %q, want none", got)
+				}
+				if string(body) != "hello, world" {
+					t.Errorf("got body %q, want the decompressed object", body)
+				}
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("got Vary %q, want Accept-Encoding", got)
+			}
+			if tc.cache {
+				if cached, _ := p.cache.get("site/hello.txt"); cached == nil || int64(len(cached.body)) != cached.attrs.Size {
+					t.Errorf("got cached entry %v, want the stored bytes", cached)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchCredentials(t *testing.T) {
+	// Lay the file out like a Kubernetes secret volume, where an update
+	// swaps the ..data symlink to a new directory
+	dir := t.TempDir()
+	version := 0
+	rotate := func() {
+		version++
+		name := fmt.Sprintf("..v%d", version)
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf(`{"type":"authorized_user","client_id":"id","client_secret":"secret","refresh_token":"token-%d"}`, version)
+		if err := os.WriteFile(filepath.Join(dir, name, "key.json"), []byte(key), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(name, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate()
+	if err := os.Symlink(filepath.Join("..data", "key.json"), filepath.Join(dir, "key.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := GcsProxy{CredentialsFile: filepath.Join(dir, "key.json"), log: zap.NewNop()}
+	client, err := p.newStorageClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.gcs = &clientHolder{}
+	p.gcs.current.Store(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.watchCredentials(ctx)
+
+	// The watch may not be set up yet, so rotate until the client is
+	// rebuilt. Polling alone would take credentialsPollInterval.
+	deadline := time.Now().Add(credentialsPollInterval / 2)
+	for p.gcs.client() == client {
+		if time.Now().After(deadline) {
+			t.Fatal("client not rebuilt after the credentials changed")
+		}
+		rotate()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cancel()
+	p.gcs.mu.Lock()
+	retired := slices.Clone(p.gcs.retired)
+	p.gcs.mu.Unlock()
+	if !slices.Contains(retired, client) {
+		t.Errorf("got retired clients %v, want the replaced one", retired)
+	}
+	if err := p.gcs.close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.gcs.retired) != 0 {
+		t.Errorf("got %d retired clients after close, want none", len(p.gcs.retired))
+	}
+}
+
+func TestOpenObjectGeneration(t *testing.T) {
+	// The object is overwritten between opening the reader and fetching its
+	// attrs, so the latest attrs describe a different body
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("X-Goog-Generation", "1")
+			io.WriteString(w, "old")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("generation") == "1" {
+			io.WriteString(w, `{"name":"site/file.txt","bucket":"test","generation":"1","size":"3"}`)
+			return
+		}
+		io.WriteString(w, `{"name":"site/file.txt","bucket":"test","generation":"2","size":"9"}`)
+	})
+
+	for _, hedge := range []time.Duration{0, time.Second} {
+		p := GcsProxy{Bucket: "test", HedgeDelay: caddy.Duration(hedge), gcs: gcs, log: zap.NewNop()}
+		reader, attrs, err := p.openObject(context.Background(), "site/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(reader)
+		reader.Close()
+		if attrs.Generation != 1 || attrs.Size != int64(len(body)) {
+			t.Errorf("hedge %s: got generation %d of size %d for body %q, want the generation read", hedge, attrs.Generation, attrs.Size, body)
+		}
+	}
+}
+
+func TestReleasePrefixRefresh(t *testing.T) {
+	var reads atomic.Int32
+	pointer := "releases/blue/"
+	unblock := make(chan struct{})
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if reads.Add(1) > 1 {
+			<-unblock
+		}
+		io.WriteString(w, pointer)
+	})
+	p := GcsProxy{
+		Bucket:         "test",
+		ReleasePointer: &ReleasePointer{Key: "current", TTL: caddy.Duration(time.Hour)},
+		release:        &releaseState{},
+		gcs:            gcs,
+		log:            zap.NewNop(),
+	}
+
+	// The first request waits for the pointer
+	if prefix, err := p.releasePrefix(); err != nil || prefix != "releases/blue/" {
+		t.Fatalf("got %q, %v, want releases/blue/", prefix, err)
+	}
+
+	// While the pointer is read again the previous release is served
+	pointer = "releases/green/"
+	p.release.invalidate()
+	for range 3 {
+		if prefix, err := p.releasePrefix(); err != nil || prefix != "releases/blue/" {
+			t.Fatalf("got %q, %v during refresh, want releases/blue/", prefix, err)
+		}
+	}
+	close(unblock)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		prefix, err := p.releasePrefix()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefix == "releases/green/" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("release not switched after the pointer was read")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := reads.Load(); got != 2 {
+		t.Errorf("got %d reads of the pointer, want 2", got)
+	}
+}
+
+// hintRecorder records the Link headers of 103 responses.
+type hintRecorder struct {
+	*httptest.ResponseRecorder
+	hints []string
+}
+
+func (h *hintRecorder) WriteHeader(status int) {
+	if status == http.StatusEarlyHints {
+		h.hints = append(h.hints, h.Header().Values("Link")...)
+		return
+	}
+	h.ResponseRecorder.WriteHeader(status)
+}
+
+func TestEarlyHints(t *testing.T) {
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "site/docs/index.html") {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"name":"site/docs/index.html","bucket":"test","generation":"1","size":"4","contentType":"text/html","metadata":{"link":"</docs.js>; rel=preload; as=script"}}`)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", "1")
+		io.WriteString(w, "docs")
+	})
+	p := GcsProxy{
+		Bucket:     "test",
+		IndexNames: []string{"index.html"},
+		EarlyHints: &EarlyHints{Links: []string{"</app.css>; rel=preload; as=style"}},
+		gcs:        gcs,
+		log:        zap.NewNop(),
+	}
+
+	testCases := []struct {
+		method string
+		key    string
+		hints  []string
+	}{
+		{method: http.MethodGet, key: "site/docs/", hints: []string{"</app.css>; rel=preload; as=style", "</docs.js>; rel=preload; as=script"}},
+		{method: http.MethodHead, key: "site/docs/"},
+		{method: http.MethodGet, key: "site/empty/"},
+	}
+	for _, tc := range testCases {
+		w := &hintRecorder{ResponseRecorder: httptest.NewRecorder()}
+		p.GetHandler(w, httptest.NewRequest(tc.method, "/", nil), tc.key)
+		if !slices.Equal(w.hints, tc.hints) {
+			t.Errorf("%s %s: got hints %q, want %q", tc.method, tc.key, w.hints, tc.hints)
+		}
+	}
+}
+
+// chanSink delivers mutation events to a channel.
+type chanSink chan mutationEvent
+
+func (c chanSink) send(_ context.Context, ev mutationEvent) error {
+	c <- ev
+	return nil
+}
+
+func (c chanSink) String() string { return "chan" }
+
+func TestMoveQuota(t *testing.T) {
+	var rewrites int
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "/rewriteTo/"):
+			rewrites++
+			io.WriteString(w, `{"done":true,"resource":{"name":"moved","bucket":"test","generation":"2"}}`)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(r.URL.Path, "/o/site/inbox/a.txt"):
+			io.WriteString(w, `{"name":"site/inbox/a.txt","bucket":"test","generation":"1","size":"8"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	events := make(chanSink, 2)
+	p := GcsProxy{
+		Bucket:        "test",
+		Root:          "site",
+		EnableFolders: true,
+		Quotas:        []Quota{{Prefix: "site/users/", MaxBytes: 10}},
+		quotas:        newQuotaTracker(time.Hour),
+		sinks:         []eventSink{events},
+		gcs:           gcs,
+		hns:           &hnsState{},
+		log:           zap.NewNop(),
+	}
+
+	move := func(dest string) error {
+		r := clientRequest(methodMove, "/inbox/a.txt", "", nil)
+		r.Header.Set("Destination", dest)
+		return p.MoveHandler(httptest.NewRecorder(), r, "site/inbox/a.txt")
+	}
+
+	p.quotas.usage["site/users/"] = &quotaUsage{bytes: 5, objects: 1, scanned: time.Now()}
+	err := move("/users/a.txt")
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("move over the quota: got %v, want 507", err)
+	}
+	if rewrites != 0 {
+		t.Errorf("got %d copies, want none", rewrites)
+	}
+
+	p.quotas.usage["site/users/"] = &quotaUsage{bytes: 2, objects: 1, scanned: time.Now()}
+	if err := move("/users/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if usage := p.quotas.usage["site/users/"]; usage.bytes != 10 || usage.objects != 2 {
+		t.Errorf("got usage of %d bytes in %d objects after the move, want 10 in 2", usage.bytes, usage.objects)
+	}
+	got := map[string]string{}
+	for range 2 {
+		ev := <-events
+		got[ev.Key] = ev.Source
+	}
+	if source, ok := got["site/users/a.txt"]; !ok || source != "site/inbox/a.txt" || len(got) != 2 {
+		t.Errorf("got events %v, want ones for site/inbox/a.txt and site/users/a.txt from it", got)
+	}
+}
+
+func TestQuotaConcurrentPuts(t *testing.T) {
+	// Uploads are held until every PUT has been admitted or rejected
+	unblock := make(chan struct{})
+	var uploads atomic.Int32
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		uploads.Add(1)
+		<-unblock
+		if r.URL.Query().Get("name") == "users/fail.txt" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name":"users/a.txt","bucket":"test","generation":"1","size":"6"}`)
+	})
+	p := GcsProxy{
+		Bucket:    "test",
+		EnablePut: true,
+		Quotas:    []Quota{{Prefix: "users/", MaxBytes: 10}},
+		quotas:    newQuotaTracker(time.Hour),
+		gcs:       gcs,
+		log:       zap.NewNop(),
+	}
+	p.quotas.usage["users/"] = &quotaUsage{scanned: time.Now()}
+
+	// Either PUT fits on its own, only one fits alongside the other
+	errs := make(chan error, 2)
+	for _, key := range []string{"users/a.txt", "users/b.txt"} {
+		go func() {
+			r := clientRequest(http.MethodPut, "/"+key, "", strings.NewReader("123456"))
+			errs <- p.PutHandler(httptest.NewRecorder(), r, key)
+		}()
+	}
+	err := <-errs
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("second concurrent PUT: got %v, want 507", err)
+	}
+	close(unblock)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if got := uploads.Load(); got != 1 {
+		t.Errorf("got %d uploads, want 1", got)
+	}
+	if usage := p.quotas.usage["users/"]; usage.bytes != 6 || len(p.quotas.reserved) != 0 {
+		t.Errorf("got usage of %d bytes and reservations %v, want 6 bytes and none", usage.bytes, p.quotas.reserved)
+	}
+
+	// A failed upload gives its reservation back
+	r := clientRequest(http.MethodPut, "/users/fail.txt", "", strings.NewReader("1234"))
+	if err := p.PutHandler(httptest.NewRecorder(), r, "users/fail.txt"); err == nil {
+		t.Fatal("failed upload succeeded")
+	}
+	if len(p.quotas.reserved) != 0 {
+		t.Errorf("got reservations %v after a failed upload, want none", p.quotas.reserved)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan delivery, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{header: r.Header, body: body}
+	}))
+	defer srv.Close()
+
+	sink := newWebhookSink(Webhook{URL: srv.URL, Secret: "s3cret"})
+	ev := mutationEvent{Bucket: "test", Key: "a.txt", Method: http.MethodPut, Time: time.Now().UTC()}
+	if err := sink.send(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	d := <-deliveries
+
+	var got mutationEvent
+	if err := json.Unmarshal(d.body, &got); err != nil || got.Key != "a.txt" {
+		t.Errorf("got body %s, want the event", d.body)
+	}
+	timestamp := d.header.Get("X-Gcsproxy-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Errorf("got timestamp %q, want the time of delivery", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(d.body)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); d.header.Get("X-Gcsproxy-Signature") != want {
+		t.Errorf("got signature %q, want %q", d.header.Get("X-Gcsproxy-Signature"), want)
+	}
+}
+
+func TestFindIndex(t *testing.T) {
+	htmRequested := make(chan struct{})
+	var once sync.Once
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		if !strings.Contains(r.URL.Path, "site/docs/") {
+			name = ""
+		}
+		switch name {
+		case "index.html":
+			// Only answers once the next candidate is probed too
+			select {
+			case <-htmRequested:
+			case <-time.After(5 * time.Second):
+				t.Error("index.htm was not probed while index.html was pending")
+			}
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		case "index.htm":
+			once.Do(func() { close(htmRequested) })
+		case "default.html":
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"name":"site/docs/%s","bucket":"test","generation":"1","size":"%d","contentType":"text/html"}`, name, len(name))
+			return
+		}
+		w.Header().Set("X-Goog-Generation", "1")
+		io.WriteString(w, name)
+	})
+	p := GcsProxy{
+		Bucket:     "test",
+		IndexNames: []string{"index.html", "index.htm", "default.html"},
+		gcs:        gcs,
+		log:        zap.NewNop(),
+	}
+
+	reader, attrs, found := p.findIndex(context.Background(), "site/docs/")
+	if !found {
+		t.Fatal("got no index")
+	}
+	defer reader.Close()
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first existing candidate in configured order wins
+	if string(body) != "index.htm" || attrs.Name != "site/docs/index.htm" {
+		t.Errorf("got index %q (%s), want index.htm", body, attrs.Name)
+	}
+
+	if _, _, found := p.findIndex(context.Background(), "site/empty/"); found {
+		t.Error("got an index for a directory without one")
+	}
+}
+
+func TestCacheReload(t *testing.T) {
+	load := func(config Cache) *GcsProxy {
+		t.Helper()
+		p := &GcsProxy{Bucket: "reload", Cache: &config, log: zap.NewNop()}
+		if err := p.loadCache(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	old := load(Cache{TTL: caddy.Duration(time.Minute)})
+	old.cache.put("site/a.txt", &storage.ObjectAttrs{Name: "site/a.txt", Generation: 1}, []byte("a"))
+
+	// A reload provisions the new handlers before cleaning up the old ones
+	reloaded := load(Cache{TTL: caddy.Duration(time.Minute)})
+	if reloaded.cache != old.cache {
+		t.Error("got a new cache for the same config")
+	}
+	other := load(Cache{TTL: caddy.Duration(time.Hour)})
+	if other.cache == old.cache {
+		t.Error("got the same cache for a different config")
+	}
+	if err := old.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := reloaded.cache.get("site/a.txt"); cached == nil || string(cached.body) != "a" {
+		t.Errorf("got cached %v after reload, want the object cached before", cached)
+	}
+
+	if err := reloaded.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if fresh := load(Cache{TTL: caddy.Duration(time.Minute)}); fresh.cache == old.cache {
+		t.Error("got the released cache once every handler was cleaned up")
+	} else if err := fresh.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNDJSONListing(t *testing.T) {
+	var failPage string
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("pageToken")
+		if token == failPage {
+			http.Error(w, `{"error":{"code":403,"message":"denied"}}`, http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch token {
+		case "":
+			io.WriteString(w, `{"prefixes":["site/docs/img/"],"items":[{"name":"site/docs/a.txt","size":"3","contentType":"text/plain","generation":"7"}],"nextPageToken":"page2"}`)
+		case "page2":
+			io.WriteString(w, `{"items":[{"name":"site/docs/b.txt","size":"5","generation":"8"}]}`)
+		}
+	})
+	p := GcsProxy{
+		Bucket:       "test",
+		EnableBrowse: true,
+		gcs:          gcs,
+		log:          zap.NewNop(),
+	}
+	list := func() (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		err := p.GetHandler(w, httptest.NewRequest(http.MethodGet, "/docs/?format=ndjson", nil), "site/docs/")
+		return w, err
+	}
+
+	failPage = "none"
+	w, err := list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("got Content-Type %q, want application/x-ndjson", ct)
+	}
+	var entries []listEntry
+	dec := json.NewDecoder(w.Body)
+	for dec.More() {
+		var entry listEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	want := []listEntry{
+		{Name: "a.txt", Key: "site/docs/a.txt", Size: 3, ContentType: "text/plain", Generation: 7},
+		{Name: "img", Key: "site/docs/img/", IsDir: true},
+		{Name: "b.txt", Key: "site/docs/b.txt", Size: 5, Generation: 8},
+	}
+	if !slices.Equal(entries, want) {
+		t.Errorf("got entries %+v, want %+v", entries, want)
+	}
+
+	// A failure after the first entry can only be reported in the stream
+	failPage = "page2"
+	w, err = list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || len(lines) != 3 || !strings.HasPrefix(lines[2], `{"error":`) {
+		t.Errorf("got %d %q, want two entries and an error line", w.Code, lines)
+	}
+
+	failPage = ""
+	_, err = list()
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got %v, want 500 for a failure before any entry", err)
+	}
+}
+
+func TestRateLimitServeHTTP(t *testing.T) {
+	var requests atomic.Int64
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch {
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasPrefix(r.URL.Path, "/storage/v1/"):
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"name":"site/a.txt","bucket":"test","generation":"1","size":"1","contentType":"text/plain"}`)
+		default:
+			w.Header().Set("X-Goog-Generation", "1")
+			io.WriteString(w, "a")
+		}
+	})
+	p := GcsProxy{
+		Bucket:       "test",
+		Root:         "site",
+		EnableDelete: true,
+		gcs:          gcs,
+		log:          zap.NewNop(),
+		limiter:      newRateLimiter(RateLimit{Key: "{client.id}", ReadRate: 1.0 / 3600, ReadBurst: 2, WriteRate: 1.0 / 3600, WriteBurst: 1}),
+	}
+	serve := func(method, identity string) (*httptest.ResponseRecorder, int) {
+		w := httptest.NewRecorder()
+		err := p.ServeHTTP(w, clientRequest(method, "/a.txt", identity, nil), caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			return w, handlerErr.StatusCode
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return w, w.Code
+	}
+
+	testCases := []struct {
+		method   string
+		identity string
+		status   int
+	}{
+		{method: http.MethodGet, identity: "a", status: http.StatusOK},
+		{method: http.MethodHead, identity: "a", status: http.StatusOK},
+		{method: http.MethodGet, identity: "a", status: http.StatusTooManyRequests},
+		// Each client and each kind of operation has its own budget
+		{method: http.MethodGet, identity: "b", status: http.StatusOK},
+		{method: http.MethodDelete, identity: "a", status: http.StatusOK},
+		{method: http.MethodDelete, identity: "a", status: http.StatusTooManyRequests},
+	}
+	for i, tc := range testCases {
+		before := requests.Load()
+		w, status := serve(tc.method, tc.identity)
+		if status != tc.status {
+			t.Fatalf("%d: %s by %s: got status %d, want %d", i, tc.method, tc.identity, status, tc.status)
+		}
+		if tc.status != http.StatusTooManyRequests {
+			continue
+		}
+		if requests.Load() != before {
+			t.Errorf("%d: got a GCS request for a rate limited %s", i, tc.method)
+		}
+		if w.Header().Get("Retry-After") == "" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+			t.Errorf("%d: got headers %v, want Retry-After and X-RateLimit-Remaining: 0", i, w.Header())
+		}
+	}
+}
+
+func TestUploadValidatorServeHTTP(t *testing.T) {
+	var uploads []string
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/upload/") {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		uploads = append(uploads, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name":"site/doc.pdf","bucket":"test","generation":"1"}`)
+	})
+	var infos []uploadInfo
+	validator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info uploadInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			t.Error(err)
+		}
+		infos = append(infos, info)
+		if head, _ := base64.StdEncoding.DecodeString(info.Head); string(head) != "%PDF" {
+			http.Error(w, "not a pdf", http.StatusUnprocessableEntity)
+		}
+	}))
+	defer validator.Close()
+
+	p := GcsProxy{
+		Bucket:    "test",
+		Root:      "site",
+		EnablePut: true,
+		gcs:       gcs,
+		log:       zap.NewNop(),
+	}
+	put := func(p GcsProxy, body string) error {
+		r := clientRequest(http.MethodPut, "/doc.pdf", "app", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/pdf")
+		return p.ServeHTTP(httptest.NewRecorder(), r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+	}
+
+	testCases := []struct {
+		desc      string
+		validator UploadValidator
+		body      string
+		status    int
+	}{
+		{desc: "accepted", validator: UploadValidator{URL: validator.URL, PeekBytes: 4}, body: "%PDF-1.7 document", status: http.StatusOK},
+		{desc: "rejected", validator: UploadValidator{URL: validator.URL, PeekBytes: 4}, body: "MZ executable", status: http.StatusForbidden},
+		{desc: "unreachable", validator: UploadValidator{URL: "http://127.0.0.1:1"}, body: "%PDF-1.7 document", status: http.StatusServiceUnavailable},
+		{desc: "command rejected", validator: UploadValidator{Command: []string{"sh", "-c", "echo no uploads; exit 1"}}, body: "%PDF-1.7 document", status: http.StatusForbidden},
+		{desc: "command accepted", validator: UploadValidator{Command: []string{"sh", "-c", "grep -q '\"key\":\"site/doc.pdf\"'"}}, body: "%PDF-1.7 document", status: http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			uploads, infos = nil, nil
+			p := p
+			p.UploadValidator = &tc.validator
+			err := put(p, tc.body)
+			status := http.StatusOK
+			var handlerErr caddyhttp.HandlerError
+			if errors.As(err, &handlerErr) {
+				status = handlerErr.StatusCode
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tc.status {
+				t.Fatalf("got status %d (%v), want %d", status, err, tc.status)
+			}
+			if tc.status != http.StatusOK {
+				if len(uploads) != 0 {
+					t.Errorf("got %d uploads, want none", len(uploads))
+				}
+				return
+			}
+			// The peeked bytes are still part of the stored object
+			if len(uploads) != 1 || !strings.Contains(uploads[0], tc.body) {
+				t.Errorf("got uploads %q, want one containing %q", uploads, tc.body)
+			}
+			if tc.validator.URL != "" {
+				want := uploadInfo{Bucket: "test", Key: "site/doc.pdf", ContentType: "application/pdf", ContentLength: 17, Client: "192.0.2.1", Head: "JVBERg=="}
+				if len(infos) != 1 || infos[0] != want {
+					t.Errorf("got validator requests %+v, want %+v", infos, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteSpoolServeHTTP(t *testing.T) {
+	var status atomic.Int64
+	var uploads []string
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/upload/") {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if code := int(status.Load()); code != http.StatusOK {
+			http.Error(w, `{"error":{"code":`+strconv.Itoa(code)+`,"message":"failed"}}`, code)
+			return
+		}
+		uploads = append(uploads, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"name":"site/log.txt","bucket":"test","generation":"1","size":"5"}`)
+	})
+	dir := t.TempDir()
+	p := GcsProxy{
+		Bucket:     "test",
+		Root:       "site",
+		EnablePut:  true,
+		WriteSpool: &WriteSpool{Dir: dir, MaxRetryInterval: caddy.Duration(time.Minute), MaxAge: caddy.Duration(time.Hour)},
+		gcs:        gcs,
+		log:        zap.NewNop(),
+	}
+	put := func() (int, error) {
+		w := httptest.NewRecorder()
+		err := p.ServeHTTP(w, clientRequest(http.MethodPut, "/log.txt", "app", strings.NewReader("entry")), caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			return handlerErr.StatusCode, nil
+		}
+		return w.Code, err
+	}
+	spooled := func() []string {
+		names, _ := filepath.Glob(filepath.Join(dir, "*"))
+		for i, name := range names {
+			names[i] = filepath.Ext(name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	// A permanent error is returned to the client and nothing is spooled
+	status.Store(http.StatusForbidden)
+	if code, err := put(); err != nil || code == http.StatusAccepted {
+		t.Fatalf("got %d %v, want an error status", code, err)
+	}
+	if files := spooled(); len(files) != 0 {
+		t.Fatalf("got spooled files %q after a permanent error, want none", files)
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	if code, err := put(); err != nil || code != http.StatusAccepted {
+		t.Fatalf("got %d %v, want 202", code, err)
+	}
+	if files := spooled(); !slices.Equal(files, []string{".data", ".json"}) {
+		t.Fatalf("got spooled files %q, want the body and its sidecar", files)
+	}
+
+	status.Store(http.StatusOK)
+	p.retrySpooled(context.Background())
+	if len(uploads) != 1 || !strings.Contains(uploads[0], `"name":"site/log.txt"`) || !strings.Contains(uploads[0], "entry") {
+		t.Errorf("got uploads %q, want the spooled body", uploads)
+	}
+	if files := spooled(); len(files) != 0 {
+		t.Errorf("got spooled files %q after the retry, want none", files)
+	}
+}
+
+func TestOfflineServeHTTP(t *testing.T) {
+	var down atomic.Bool
+	var requests atomic.Int64
+	gcs := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if down.Load() {
+			// Never answers, so reads hit the first byte timeout
+			<-r.Context().Done()
+			return
+		}
+		name := strings.TrimPrefix(path.Base(r.URL.Path), "site%2F")
+		if strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"name":"site/%s","bucket":"test","generation":"1","size":"1","contentType":"text/plain"}`, name)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", "1")
+		io.WriteString(w, name[:1])
+	})
+	newProxy := func(config Offline) GcsProxy {
+		p := GcsProxy{
+			Bucket:           "test",
+			Root:             "site",
+			Cache:            &Cache{},
+			FirstByteTimeout: caddy.Duration(50 * time.Millisecond),
+			gcs:              gcs,
+			log:              zap.NewNop(),
+		}
+		p.cache = newObjectCache(*p.Cache)
+		p.offline = newOfflineState(config, p.log)
+		return p
+	}
+	get := func(p GcsProxy, target string) (int, string) {
+		w := httptest.NewRecorder()
+		err := p.ServeHTTP(w, clientRequest(http.MethodGet, target, "app", nil), caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			return handlerErr.StatusCode, ""
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, w.Body.String()
+	}
+
+	t.Run("auto", func(t *testing.T) {
+		down.Store(false)
+		p := newProxy(Offline{Mode: "auto", FailureThreshold: 2, Recheck: caddy.Duration(time.Hour), StatusCode: http.StatusNotFound})
+		if status, body := get(p, "/a.txt"); status != http.StatusOK || body != "a" {
+			t.Fatalf("got %d %q, want a.txt from GCS", status, body)
+		}
+
+		down.Store(true)
+		for range 2 {
+			if status, _ := get(p, "/b.txt"); status == http.StatusOK {
+				t.Fatal("got 200 while GCS is down")
+			}
+		}
+		if !p.offline.active() {
+			t.Fatal("still online after reaching the failure threshold")
+		}
+
+		// Offline, only the cache is used
+		before := requests.Load()
+		if status, body := get(p, "/a.txt"); status != http.StatusOK || body != "a" {
+			t.Errorf("got %d %q for a cached key, want a.txt from the cache", status, body)
+		}
+		if status, _ := get(p, "/b.txt"); status != http.StatusNotFound {
+			t.Errorf("got %d for an uncached key, want the configured 404", status)
+		}
+		if requests.Load() != before {
+			t.Errorf("got %d GCS requests while offline, want none", requests.Load()-before)
+		}
+	})
+
+	t.Run("on", func(t *testing.T) {
+		down.Store(false)
+		p := newProxy(Offline{Mode: "on"})
+		p.cache.put("site/a.txt", &storage.ObjectAttrs{Name: "site/a.txt", Generation: 1, Size: 1, ContentType: "text/plain"}, []byte("a"))
+		before := requests.Load()
+		if status, body := get(p, "/a.txt"); status != http.StatusOK || body != "a" {
+			t.Errorf("got %d %q for a cached key, want a.txt from the cache", status, body)
+		}
+		if status, _ := get(p, "/b.txt"); status != http.StatusServiceUnavailable {
+			t.Errorf("got %d for an uncached key, want 503", status)
+		}
+		if requests.Load() != before {
+			t.Errorf("got %d GCS requests in cache-only mode, want none", requests.Load()-before)
+		}
+	})
+}
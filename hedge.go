@@ -0,0 +1,76 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+type hedgeResult struct {
+	reader *storage.Reader
+	err    error
+	cancel context.CancelFunc
+}
+
+// newObjectReader opens a reader on obj and returns it with the generation
+// being read, so attrs can be fetched for that same generation. With a
+// HedgeDelay, a second identical read is issued if GCS hasn't responded
+// within the delay and whichever responds first is used.
+func (p GcsProxy) newObjectReader(ctx context.Context, obj *storage.ObjectHandle) (io.ReadCloser, int64, error) {
+	if p.HedgeDelay <= 0 {
+		reader, err := obj.NewReader(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		return reader, reader.Attrs.Generation, nil
+	}
+
+	results := make(chan hedgeResult, 2)
+	start := func() {
+		readCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			reader, err := obj.NewReader(readCtx)
+			results <- hedgeResult{reader: reader, err: err, cancel: cancel}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(time.Duration(p.HedgeDelay))
+	defer timer.Stop()
+
+	var res hedgeResult
+	select {
+	case res = <-results:
+		return hedgeReader(res)
+	case <-timer.C:
+		start()
+	}
+
+	res = <-results
+	if res.err != nil {
+		// Give the other read a chance before failing
+		res.cancel()
+		res = <-results
+		return hedgeReader(res)
+	}
+
+	// Abandon the slower read
+	go func() {
+		loser := <-results
+		loser.cancel()
+		if loser.err == nil {
+			loser.reader.Close()
+		}
+	}()
+	return hedgeReader(res)
+}
+
+func hedgeReader(res hedgeResult) (io.ReadCloser, int64, error) {
+	if res.err != nil {
+		res.cancel()
+		return nil, 0, res.err
+	}
+	return cancelReadCloser{ReadCloser: res.reader, cancel: res.cancel}, res.reader.Attrs.Generation, nil
+}
@@ -0,0 +1,68 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"sync"
+
+	control "cloud.google.com/go/storage/control/apiv2"
+	"go.uber.org/zap"
+)
+
+// hnsState remembers whether the bucket has hierarchical namespace enabled,
+// looked up on first use, along with the storage control client used for its
+// folders.
+type hnsState struct {
+	mu      sync.Mutex
+	checked bool
+	enabled bool
+	control *control.StorageControlClient
+}
+
+// hierarchical returns true if the bucket has hierarchical namespace enabled,
+// in which case directories are real folders managed through the storage
+// control API. A failed lookup is retried on the next call.
+func (p GcsProxy) hierarchical(ctx context.Context) bool {
+	p.hns.mu.Lock()
+	defer p.hns.mu.Unlock()
+	if p.hns.checked {
+		return p.hns.enabled
+	}
+
+	attrs, err := p.bucketHandle().Attrs(ctx)
+	if err != nil {
+		p.log.Warn("could not look up bucket namespace", zap.String("bucket", p.Bucket), zap.String("err", err.Error()))
+		return false
+	}
+	p.hns.checked = true
+	p.hns.enabled = attrs.HierarchicalNamespace != nil && attrs.HierarchicalNamespace.Enabled
+	if !p.hns.enabled {
+		return false
+	}
+
+	// The client is created with a background context as it outlives ctx
+	p.hns.control, err = control.NewStorageControlClient(context.Background(), p.storageOptions()...)
+	if err != nil {
+		p.log.Error("could not create storage control client, using flat namespace operations", zap.String("err", err.Error()))
+		p.hns.enabled = false
+	}
+	return p.hns.enabled
+}
+
+// folderParent is the storage control resource name of the bucket.
+func (p GcsProxy) folderParent() string {
+	return "projects/_/buckets/" + p.Bucket
+}
+
+// folderName is the storage control resource name of the folder at dir.
+func (p GcsProxy) folderName(dir string) string {
+	return p.folderParent() + "/folders/" + dir
+}
+
+func (h *hnsState) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.control == nil {
+		return nil
+	}
+	return h.control.Close()
+}
@@ -0,0 +1,76 @@
+package caddygcsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Request headers that set or clear object holds when EnableHolds is set.
+const (
+	temporaryHoldHeader  = "X-Temporary-Hold"
+	eventBasedHoldHeader = "X-Event-Based-Hold"
+)
+
+// holdHeader parses a hold header, returning nil if it is absent.
+func holdHeader(r *http.Request, name string) (*bool, error) {
+	value := r.Header.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	hold, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid %s header: %s", name, value))
+	}
+	return &hold, nil
+}
+
+// applyHolds sets the holds requested by r on the attrs of an object to be
+// written.
+func (p GcsProxy) applyHolds(r *http.Request, attrs *storage.ObjectAttrs) error {
+	if !p.EnableHolds {
+		return nil
+	}
+	temporary, err := holdHeader(r, temporaryHoldHeader)
+	if err != nil {
+		return err
+	}
+	eventBased, err := holdHeader(r, eventBasedHoldHeader)
+	if err != nil {
+		return err
+	}
+	if temporary != nil {
+		attrs.TemporaryHold = *temporary
+	}
+	if eventBased != nil {
+		attrs.EventBasedHold = *eventBased
+	}
+	return nil
+}
+
+// holdUpdate returns the update setting or clearing the holds requested by r
+// on an existing object, and whether there is anything to update.
+func (p GcsProxy) holdUpdate(r *http.Request) (storage.ObjectAttrsToUpdate, bool, error) {
+	var update storage.ObjectAttrsToUpdate
+	if !p.EnableHolds {
+		return update, false, nil
+	}
+	temporary, err := holdHeader(r, temporaryHoldHeader)
+	if err != nil {
+		return update, false, err
+	}
+	eventBased, err := holdHeader(r, eventBasedHoldHeader)
+	if err != nil {
+		return update, false, err
+	}
+	if temporary != nil {
+		update.TemporaryHold = *temporary
+	}
+	if eventBased != nil {
+		update.EventBasedHold = *eventBased
+	}
+	return update, temporary != nil || eventBased != nil, nil
+}
@@ -0,0 +1,100 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/text/language"
+)
+
+// Localization sets the browse template and error pages served to visitors
+// whose Accept-Language prefers a language.
+type Localization struct {
+	// BCP 47 language tag, e.g. `de` or `pt-BR`.
+	Language string `json:"language,omitempty"`
+
+	// Browse template in the same forms as BrowseTemplate. Empty means the
+	// handler's template.
+	BrowseTemplate string `json:"browse_template,omitempty"`
+
+	// Mapping of HTTP status codes to the keys of localized error pages.
+	ErrorPages map[int]string `json:"error_pages,omitempty"`
+
+	// Key of the localized error page for status codes without their own.
+	DefaultErrorPage string `json:"default_error_page,omitempty"`
+}
+
+// languageSet picks the localization for a request.
+type languageSet struct {
+	matcher language.Matcher
+
+	// Browse templates of the localizations, nil where a localization has
+	// none.
+	templates []*templateHolder
+}
+
+// newLanguageSet parses the localizations' languages and loads their browse
+// templates.
+func (p GcsProxy) newLanguageSet(ctx context.Context, client *storage.Client) (*languageSet, error) {
+	// The first tag is the fallback when no localization matches
+	tags := []language.Tag{language.Und}
+	set := &languageSet{}
+	for _, loc := range p.Localizations {
+		tag, err := language.Parse(loc.Language)
+		if err != nil {
+			return nil, fmt.Errorf("invalid localization language %q: %v", loc.Language, err)
+		}
+		tags = append(tags, tag)
+
+		var h *templateHolder
+		if loc.BrowseTemplate != "" && p.EnableBrowse {
+			if h, err = p.loadBrowseTemplate(ctx, client, loc.BrowseTemplate); err != nil {
+				return nil, fmt.Errorf("parsing browse template %s: %v", loc.BrowseTemplate, err)
+			}
+		}
+		set.templates = append(set.templates, h)
+	}
+	set.matcher = language.NewMatcher(tags)
+	return set, nil
+}
+
+// localization returns the index of the localization best matching the
+// request's Accept-Language, or -1 if none does.
+func (p GcsProxy) localization(r *http.Request) int {
+	if p.languages == nil {
+		return -1
+	}
+	accepted, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if err != nil || len(accepted) == 0 {
+		return -1
+	}
+	_, index, confidence := p.languages.matcher.Match(accepted...)
+	if index == 0 || confidence == language.No {
+		return -1
+	}
+	return index - 1
+}
+
+// errorPageFor returns the key of the error page for statusCode, preferring
+// the request's localization over the handler's pages and specific pages over
+// defaults. It returns "" if there is none.
+func (p GcsProxy) errorPageFor(r *http.Request, statusCode int) string {
+	var loc *Localization
+	if i := p.localization(r); i >= 0 {
+		loc = &p.Localizations[i]
+	}
+	if loc != nil {
+		if key, ok := loc.ErrorPages[statusCode]; ok {
+			return key
+		}
+	}
+	if key, ok := p.ErrorPages[statusCode]; ok {
+		return key
+	}
+	if loc != nil && loc.DefaultErrorPage != "" {
+		return loc.DefaultErrorPage
+	}
+	return p.DefaultErrorPage
+}
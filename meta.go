@@ -0,0 +1,80 @@
+package caddygcsproxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// objectMeta is the JSON document served for `?meta=json` requests.
+type objectMeta struct {
+	Key             string            `json:"key"`
+	Size            int64             `json:"size"`
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	CacheControl    string            `json:"cache_control,omitempty"`
+	Generation      int64             `json:"generation"`
+	Metageneration  int64             `json:"metageneration"`
+	MD5             string            `json:"md5,omitempty"`
+	CRC32C          string            `json:"crc32c"`
+	StorageClass    string            `json:"storage_class,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	TemporaryHold   bool              `json:"temporary_hold"`
+	EventBasedHold  bool              `json:"event_based_hold"`
+	RetainUntil     *time.Time        `json:"retain_until,omitempty"`
+	Created         time.Time         `json:"created"`
+	Updated         time.Time         `json:"updated"`
+}
+
+func newObjectMeta(attrs *storage.ObjectAttrs) objectMeta {
+	meta := objectMeta{
+		Key:             attrs.Name,
+		Size:            attrs.Size,
+		ContentType:     attrs.ContentType,
+		ContentEncoding: attrs.ContentEncoding,
+		CacheControl:    attrs.CacheControl,
+		Generation:      attrs.Generation,
+		Metageneration:  attrs.Metageneration,
+		CRC32C:          base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, attrs.CRC32C)),
+		StorageClass:    attrs.StorageClass,
+		Metadata:        publicMetadata(attrs.Metadata),
+		TemporaryHold:   attrs.TemporaryHold,
+		EventBasedHold:  attrs.EventBasedHold,
+		Created:         attrs.Created,
+		Updated:         attrs.Updated,
+	}
+	if !attrs.RetentionExpirationTime.IsZero() {
+		meta.RetainUntil = &attrs.RetentionExpirationTime
+	}
+	if len(attrs.MD5) > 0 {
+		meta.MD5 = base64.StdEncoding.EncodeToString(attrs.MD5)
+	}
+	return meta
+}
+
+// MetaHandler serves an object's attributes as JSON without its body.
+func (p GcsProxy) MetaHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opGet)
+	defer cancelOp()
+
+	attrs, err := p.objectFor(opGet, key).Attrs(ctx)
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+
+	if p.publicCheck != nil && !p.publicCheck.isPublic(ctx, p.bucketHandle(), attrs.Name) {
+		err = errors.New("object is not publicly readable")
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(newObjectMeta(attrs))
+}
@@ -0,0 +1,247 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultMirrorInterval   = time.Hour
+	defaultMirrorMaxObjects = 100000
+
+	// Keys of each kind of drift listed in a report, the counts are exact.
+	mirrorReportSamples = 100
+)
+
+// MirrorCheck configures a background job that compares the objects of the
+// bucket with a mirror bucket, reporting keys missing from either side or
+// whose checksums differ. A check can also be triggered with
+// `POST /gcs-proxy/mirror-check` on the admin API.
+type MirrorCheck struct {
+	// The mirror bucket.
+	Bucket string `json:"bucket,omitempty"`
+
+	// Key prefix compared, the same in both buckets. Empty means every key.
+	Prefix string `json:"prefix,omitempty"`
+
+	// How often the buckets are compared. Default is 1h.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// Most keys compared per check. Beyond it the report is marked as
+	// truncated. Default is 100000.
+	MaxObjects int64 `json:"max_objects,omitempty"`
+}
+
+// mirrorReport is the result of a mirror check.
+type mirrorReport struct {
+	Bucket          string    `json:"bucket"`
+	Mirror          string    `json:"mirror"`
+	Prefix          string    `json:"prefix,omitempty"`
+	Compared        int64     `json:"compared"`
+	MissingCount    int       `json:"missing_count"`
+	ExtraCount      int       `json:"extra_count"`
+	MismatchedCount int       `json:"mismatched_count"`
+	Missing         []string  `json:"missing,omitempty"`
+	Extra           []string  `json:"extra,omitempty"`
+	Mismatched      []string  `json:"mismatched,omitempty"`
+	Truncated       bool      `json:"truncated"`
+	Checked         time.Time `json:"checked"`
+}
+
+// mirrorDrift is the number of drifted keys found by the last check.
+var mirrorDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "caddy",
+	Subsystem: "gcs_proxy",
+	Name:      "mirror_drift",
+	Help:      "Keys missing from the mirror, extra in the mirror or with mismatched checksums, as of the last mirror check.",
+}, []string{"bucket", "mirror", "kind"})
+
+// registerMirrorMetrics adds the mirror metrics to the config's registry, if
+// another handler hasn't already.
+func registerMirrorMetrics(ctx caddy.Context) error {
+	registry := ctx.GetMetricsRegistry()
+	if registry == nil {
+		return nil
+	}
+	err := registry.Register(mirrorDrift)
+	if errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		return nil
+	}
+	return err
+}
+
+type mirrorChecker struct {
+	config  MirrorCheck
+	bucket  string
+	primary func() *storage.BucketHandle
+	mirror  func() *storage.BucketHandle
+	log     *zap.Logger
+}
+
+func (p GcsProxy) newMirrorChecker() *mirrorChecker {
+	config := *p.MirrorCheck
+	if config.Interval <= 0 {
+		config.Interval = caddy.Duration(defaultMirrorInterval)
+	}
+	if config.MaxObjects <= 0 {
+		config.MaxObjects = defaultMirrorMaxObjects
+	}
+	return &mirrorChecker{
+		config:  config,
+		bucket:  p.Bucket,
+		primary: p.bucketHandle,
+		mirror:  func() *storage.BucketHandle { return p.gcs.client().Bucket(config.Bucket) },
+		log:     p.log,
+	}
+}
+
+// run checks the mirror every Interval until ctx is done.
+func (m *mirrorChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(m.config.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := m.check(ctx); err != nil && ctx.Err() == nil {
+			m.log.Error("mirror check failed",
+				zap.String("mirror", m.config.Bucket),
+				zap.String("err", err.Error()),
+			)
+		}
+	}
+}
+
+// check compares both buckets, logs and records the drift found.
+func (m *mirrorChecker) check(ctx context.Context) (mirrorReport, error) {
+	report, err := m.compare(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	for kind, count := range map[string]int{
+		"missing":    report.MissingCount,
+		"extra":      report.ExtraCount,
+		"mismatched": report.MismatchedCount,
+	} {
+		mirrorDrift.WithLabelValues(m.bucket, m.config.Bucket, kind).Set(float64(count))
+	}
+
+	fields := []zap.Field{
+		zap.String("mirror", m.config.Bucket),
+		zap.String("prefix", m.config.Prefix),
+		zap.Int64("compared", report.Compared),
+		zap.Int("missing", report.MissingCount),
+		zap.Int("extra", report.ExtraCount),
+		zap.Int("mismatched", report.MismatchedCount),
+		zap.Bool("truncated", report.Truncated),
+	}
+	if report.MissingCount+report.ExtraCount+report.MismatchedCount > 0 {
+		m.log.Warn("mirror has drifted", append(fields, zap.Strings("sample_missing", report.Missing))...)
+	} else {
+		m.log.Info("mirror is consistent", fields...)
+	}
+	return report, nil
+}
+
+// compare walks both listings side by side, relying on GCS listing keys in
+// lexicographic order.
+func (m *mirrorChecker) compare(ctx context.Context) (mirrorReport, error) {
+	report := mirrorReport{
+		Bucket:  m.bucket,
+		Mirror:  m.config.Bucket,
+		Prefix:  m.config.Prefix,
+		Checked: time.Now().UTC(),
+	}
+
+	primary := newListing(ctx, m.primary(), m.config.Prefix)
+	mirror := newListing(ctx, m.mirror(), m.config.Prefix)
+	for primary.attrs != nil || mirror.attrs != nil {
+		if report.Compared >= m.config.MaxObjects {
+			report.Truncated = true
+			break
+		}
+		report.Compared++
+
+		switch {
+		case mirror.attrs == nil || (primary.attrs != nil && primary.attrs.Name < mirror.attrs.Name):
+			report.MissingCount++
+			report.Missing = appendSample(report.Missing, primary.attrs.Name)
+			primary.next()
+		case primary.attrs == nil || mirror.attrs.Name < primary.attrs.Name:
+			report.ExtraCount++
+			report.Extra = appendSample(report.Extra, mirror.attrs.Name)
+			mirror.next()
+		default:
+			if !sameContent(primary.attrs, mirror.attrs) {
+				report.MismatchedCount++
+				report.Mismatched = appendSample(report.Mismatched, primary.attrs.Name)
+			}
+			primary.next()
+			mirror.next()
+		}
+		if primary.err != nil {
+			return report, primary.err
+		}
+		if mirror.err != nil {
+			return report, mirror.err
+		}
+	}
+	return report, errors.Join(primary.err, mirror.err)
+}
+
+func appendSample(keys []string, key string) []string {
+	if len(keys) < mirrorReportSamples {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// sameContent compares objects by size and checksum, preferring CRC32C as
+// composite objects have no MD5.
+func sameContent(a, b *storage.ObjectAttrs) bool {
+	if a.Size != b.Size || a.CRC32C != b.CRC32C {
+		return false
+	}
+	if len(a.MD5) > 0 && len(b.MD5) > 0 {
+		return string(a.MD5) == string(b.MD5)
+	}
+	return true
+}
+
+// listing is an object iterator holding its current object.
+type listing struct {
+	it    *storage.ObjectIterator
+	attrs *storage.ObjectAttrs
+	err   error
+}
+
+func newListing(ctx context.Context, bucket *storage.BucketHandle, prefix string) *listing {
+	query := &storage.Query{Prefix: prefix}
+	query.SetAttrSelection([]string{"Name", "Size", "CRC32C", "MD5"})
+	l := &listing{it: bucket.Objects(ctx, query)}
+	l.next()
+	return l
+}
+
+func (l *listing) next() {
+	attrs, err := l.it.Next()
+	if err == iterator.Done {
+		l.attrs = nil
+		return
+	}
+	if err != nil {
+		l.attrs, l.err = nil, err
+		return
+	}
+	l.attrs = attrs
+}
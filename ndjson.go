@@ -0,0 +1,110 @@
+package caddygcsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// ndjsonFlushEvery is how many entries are written between flushes of a
+// streamed listing.
+const ndjsonFlushEvery = 100
+
+// listEntry is one line of a `?format=ndjson` listing.
+type listEntry struct {
+	Name        string    `json:"name"`
+	Key         string    `json:"key,omitempty"`
+	IsDir       bool      `json:"is_dir"`
+	Size        int64     `json:"size,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Generation  int64     `json:"generation,omitempty"`
+	Updated     time.Time `json:"updated,omitzero"`
+}
+
+// NDJSONListHandler streams the whole listing of a directory as one JSON
+// object per line, written as the listing is read from GCS rather than
+// buffered, so clients can walk prefixes of any size. The same `glob` as for
+// browse pages applies. An error after the first entry has been written ends
+// the stream with an `{"error": ...}` line.
+func (p GcsProxy) NDJSONListHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	if p.offline != nil && p.offline.active() {
+		return p.offlineError()
+	}
+
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opList)
+	defer cancelOp()
+
+	if err := p.checkPublicListing(ctx); err != nil {
+		return err
+	}
+
+	query := p.ConstructListParams(r, key)
+	if p.EnableFolders && p.hierarchical(ctx) {
+		query.IncludeFoldersAsPrefixes = true
+	}
+	defer recordPhase(ctx, "list", time.Now())
+	it := p.bucketFor(opList).Objects(ctx, query)
+	b := newPageBuilder(query.Prefix, p.FolderMarkers)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+
+	written := 0
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil && written == 0 {
+			var apiErr *googleapi.Error
+			if query.MatchGlob != "" && errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest {
+				return caddyhttp.Error(http.StatusBadRequest, err)
+			}
+			return convertToCaddyError(err)
+		}
+		if err != nil {
+			// The status has been sent, so the error can only be reported in band
+			p.log.Error("could not finish streamed listing", zap.String("prefix", query.Prefix), zap.String("err", err.Error()))
+			return enc.Encode(map[string]string{"error": err.Error()})
+		}
+		if fileHidden(attrs.Name, p.Hide) {
+			continue
+		}
+		item, ok := b.item(attrs)
+		if !ok {
+			continue
+		}
+
+		if written == 0 {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		entry := listEntry{Name: item.Name, Key: item.Key, IsDir: item.IsDir}
+		if !item.IsDir {
+			entry.Size = attrs.Size
+			entry.ContentType = attrs.ContentType
+			entry.Generation = attrs.Generation
+			entry.Updated = attrs.Updated
+		}
+		if err := enc.Encode(entry); err != nil {
+			// The client has gone away
+			return nil
+		}
+		if written++; written%ndjsonFlushEvery == 0 {
+			rc.Flush()
+		}
+	}
+
+	if written == 0 {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package caddygcsproxy
+
+import (
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizationForms are the Unicode normalization forms keys can be
+// normalized to.
+var normalizationForms = map[string]norm.Form{
+	"nfc": norm.NFC,
+	"nfd": norm.NFD,
+}
+
+// keyFor returns the object key for a request path under root, normalized to
+// NormalizeKeys if set.
+func (p GcsProxy) keyFor(root string, reqPath string) string {
+	key := joinPath(root, reqPath)
+	if form, ok := normalizationForms[p.NormalizeKeys]; ok {
+		key = form.String(key)
+	}
+	return key
+}
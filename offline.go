@@ -0,0 +1,104 @@
+package caddygcsproxy
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultOfflineFailureThreshold = 5
+	defaultOfflineRecheck          = 30 * time.Second
+)
+
+// errOffline is returned for uncached keys while serving from cache only.
+var errOffline = errors.New("object not cached and GCS is offline")
+
+// Offline configures cache-only serving. While offline, reads are served
+// exclusively from the cache (including expired entries) and uncached keys
+// get StatusCode, so a read-mostly site stays partially up during a GCS
+// incident.
+type Offline struct {
+	// Either `on`, to always serve from cache only, or `auto` to switch to
+	// cache-only serving after FailureThreshold consecutive transient GCS
+	// errors.
+	Mode string `json:"mode,omitempty"`
+
+	// Consecutive transient GCS errors that switch an `auto` handler to
+	// cache-only serving. Default is 5.
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+
+	// How long an `auto` handler stays offline before it tries GCS again.
+	// Default is 30s.
+	Recheck caddy.Duration `json:"recheck,omitempty"`
+
+	// Status returned for uncached keys while offline, 503 (default) or 404.
+	StatusCode int `json:"status_code,omitempty"`
+}
+
+// offlineState tracks whether the handler is currently serving from cache only.
+type offlineState struct {
+	mu       sync.Mutex
+	config   Offline
+	failures int
+	until    time.Time
+	log      *zap.Logger
+}
+
+func newOfflineState(config Offline, log *zap.Logger) *offlineState {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = defaultOfflineFailureThreshold
+	}
+	if config.Recheck <= 0 {
+		config.Recheck = caddy.Duration(defaultOfflineRecheck)
+	}
+	if config.StatusCode == 0 {
+		config.StatusCode = http.StatusServiceUnavailable
+	}
+	return &offlineState{config: config, log: log}
+}
+
+// active returns true if reads must not go to GCS.
+func (o *offlineState) active() bool {
+	if o.config.Mode == "on" {
+		return true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return time.Now().Before(o.until)
+}
+
+// failure records a transient GCS error, going offline once the threshold is
+// reached.
+func (o *offlineState) failure() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failures++
+	if o.failures >= o.config.FailureThreshold && !time.Now().Before(o.until) {
+		o.until = time.Now().Add(time.Duration(o.config.Recheck))
+		o.log.Warn("serving from cache only after repeated GCS errors",
+			zap.Int("failures", o.failures),
+			zap.Duration("recheck", time.Duration(o.config.Recheck)),
+		)
+	}
+}
+
+// success records a successful GCS read.
+func (o *offlineState) success() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failures >= o.config.FailureThreshold {
+		o.log.Info("GCS reachable again, leaving cache-only serving")
+	}
+	o.failures = 0
+}
+
+// offlineError converts errOffline to the configured status.
+func (p GcsProxy) offlineError() error {
+	return caddyhttp.Error(p.offline.config.StatusCode, errOffline)
+}
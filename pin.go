@@ -0,0 +1,158 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultPinCookie = "gcs_pin"
+	defaultPinParam  = "pin"
+	defaultPinMaxAge = time.Hour
+)
+
+// PinGenerations configures sessions pinned to the object generations that
+// were live when their first page was served. Once a browser got an HTML page
+// every object it requests is served in the generation that was current at
+// that time, so a deploy mid-session doesn't mix old pages with new assets.
+// Older generations are only available on buckets with object versioning.
+type PinGenerations struct {
+	// Name of the cookie holding the pin. Default is `gcs_pin`.
+	Cookie string `json:"cookie,omitempty"`
+
+	// Name of the query parameter that overrides the cookie for a request,
+	// e.g. `?pin=<time>` with the time in microseconds since the epoch.
+	// Default is `pin`.
+	Param string `json:"param,omitempty"`
+
+	// How long a session stays pinned. Default is 1h.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+}
+
+// sessionPin returns the time the request's session is pinned to, if any.
+func (p GcsProxy) sessionPin(r *http.Request) (time.Time, bool) {
+	value := r.URL.Query().Get(p.PinGenerations.Param)
+	if value == "" {
+		cookie, err := r.Cookie(p.PinGenerations.Cookie)
+		if err != nil {
+			return time.Time{}, false
+		}
+		value = cookie.Value
+	}
+	return parsePin(value, time.Duration(p.PinGenerations.MaxAge))
+}
+
+// parsePin parses a pin in microseconds since the epoch, rejecting pins in
+// the future or older than maxAge.
+func parsePin(value string, maxAge time.Duration) (time.Time, bool) {
+	micros, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	pin := time.UnixMicro(micros)
+	if pin.After(time.Now()) || time.Since(pin) > maxAge {
+		return time.Time{}, false
+	}
+	return pin, true
+}
+
+// pinSession sets the pin cookie to now.
+func (p GcsProxy) pinSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.PinGenerations.Cookie,
+		Value:    strconv.FormatInt(time.Now().UnixMicro(), 10),
+		Path:     "/",
+		MaxAge:   int(time.Duration(p.PinGenerations.MaxAge).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// pinnedObject returns a reader over the generation of the object that was
+// live when the session was pinned, or nil if the current one is to be
+// served. A session that isn't pinned yet is pinned when it gets an HTML page.
+func (p GcsProxy) pinnedObject(ctx context.Context, w http.ResponseWriter, r *http.Request, attrs *storage.ObjectAttrs) (io.ReadCloser, *storage.ObjectAttrs) {
+	pin, ok := p.sessionPin(r)
+	if !ok {
+		if mediaType, _, _ := mime.ParseMediaType(p.contentType(attrs)); mediaType == "text/html" {
+			p.pinSession(w)
+		}
+		return nil, nil
+	}
+	if !attrs.Created.After(pin) {
+		return nil, nil
+	}
+
+	pinned, err := p.generationAt(ctx, attrs.Name, pin)
+	if err != nil {
+		p.log.Warn("could not find pinned generation",
+			zap.String("key", attrs.Name),
+			zap.Time("pin", pin),
+			zap.String("err", err.Error()),
+		)
+		return nil, nil
+	}
+	if pinned == nil {
+		// The object didn't exist yet when the session was pinned
+		return nil, nil
+	}
+
+	ctx, cancel := p.opContext(ctx, opGet)
+	reader, _, err := p.newObjectReader(ctx, p.objectFor(opGet, attrs.Name).Generation(pinned.Generation).ReadCompressed(true))
+	if err != nil {
+		cancel()
+		p.log.Warn("could not read pinned generation",
+			zap.String("key", attrs.Name),
+			zap.Int64("generation", pinned.Generation),
+			zap.String("err", err.Error()),
+		)
+		return nil, nil
+	}
+
+	// The response depends on the session, so it may not be shared
+	pinned.CacheControl = "private, no-cache"
+	return cancelReadCloser{ReadCloser: reader, cancel: cancel}, pinned
+}
+
+// generationAt returns the attrs of the generation of key that was live at
+// pin, or nil if there was none.
+func (p GcsProxy) generationAt(ctx context.Context, key string, pin time.Time) (*storage.ObjectAttrs, error) {
+	ctx, cancel := p.opContext(ctx, opList)
+	defer cancel()
+
+	// Only key itself is listed, not every object it is a prefix of. No name
+	// sorts between key and key followed by a NUL byte.
+	var live *storage.ObjectAttrs
+	it := p.bucketFor(opList).Objects(ctx, &storage.Query{
+		StartOffset: key,
+		EndOffset:   key + "\x00",
+		Versions:    true,
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return live, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Name != key || attrs.Created.After(pin) {
+			continue
+		}
+		if !attrs.Deleted.IsZero() && !attrs.Deleted.After(pin) {
+			continue
+		}
+		if live == nil || attrs.Generation > live.Generation {
+			live = attrs
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package caddygcsproxy
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/uuid"
+)
+
+// PostHandler stores the body of a POST to a directory path under a newly
+// generated key in that directory and answers 201 with its Location. Form
+// uploads are stored under their filenames instead if FormUploads is set.
+func (p GcsProxy) PostHandler(w http.ResponseWriter, r *http.Request, dir string) error {
+	if !strings.HasSuffix(dir, "/") {
+		if _, compose := r.URL.Query()["compose"]; compose {
+			// Compose writes like a PUT, even if methods lets POST through
+			if !p.EnableCompose || !p.EnablePut {
+				return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("compose is not enabled"))
+			}
+			return p.ComposeHandler(w, r, dir)
+		}
+		if _, restore := r.URL.Query()["restore"]; restore {
+			if !p.EnableSoftDeleted {
+				return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("restoring soft-deleted objects is not enabled"))
+			}
+			return p.RestoreHandler(w, r, dir)
+		}
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("POST is only allowed to a directory"))
+	}
+
+	if p.isFormUpload(r) {
+		return p.FormUploadHandler(w, r, dir)
+	}
+
+	key, location, err := p.postedObject(r, dir, uuid.NewString()+uploadExtension(r))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", location)
+
+	sw := &statusWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+	if err := p.PutHandler(sw, r, key); err != nil {
+		w.Header().Del("Location")
+		return err
+	}
+	if !sw.wroteHeader {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return nil
+}
+
+// postedObject returns the key and request path of the object named name
+// POSTed to the directory dir. Like a PUT to its own path, it may not be
+// hidden, protected or outside PutPaths.
+func (p GcsProxy) postedObject(r *http.Request, dir string, name string) (string, string, error) {
+	key := p.keyFor(dir, name)
+	location := path.Join(r.URL.Path, name)
+	if fileHidden(key, p.Hide) || len(p.PutPaths) > 0 && !pathMatches(p.PutPaths, location) {
+		return "", "", caddyhttp.Error(http.StatusForbidden, fmt.Errorf("%s may not be written", location))
+	}
+	if err := p.checkProtected(r, key); err != nil {
+		return "", "", err
+	}
+	return key, location, nil
+}
+
+// uploadExtension returns the file extension for a POSTed body, from the
+// filename in its Content-Disposition or else its Content-Type.
+func uploadExtension(r *http.Request) string {
+	var ext string
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+		ext = path.Ext(params["filename"])
+	}
+	if ext == "" {
+		if exts, err := mime.ExtensionsByType(r.Header.Get("Content-Type")); err == nil && len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+
+	if len(ext) > 16 {
+		return ""
+	}
+	for _, c := range ext[min(1, len(ext)):] {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// statusWriter records whether a status has been written.
+type statusWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.wroteHeader = true
+	sw.ResponseWriterWrapper.WriteHeader(status)
+}
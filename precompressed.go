@@ -0,0 +1,113 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+
+	"cloud.google.com/go/storage"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
+	"go.uber.org/zap"
+)
+
+// precompressedSuffixes are the key suffixes of the sidecar objects holding
+// an object compressed with each encoding.
+var precompressedSuffixes = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// defaultPrecompressed are the encodings tried if `precompressed` is given
+// without any.
+var defaultPrecompressed = []string{"br", "gzip"}
+
+// compressedContentTypes are the types sidecar objects are commonly stored
+// with, which say nothing about the content they hold.
+var compressedContentTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-brotli",
+	"application/zstd",
+	"application/octet-stream",
+	"binary/octet-stream",
+}
+
+// precompressedSidecar is a sidecar object to try for a request.
+type precompressedSidecar struct {
+	encoding string
+	key      string
+}
+
+// precompressedSidecars returns the sidecars of key the client accepts, in
+// the order of its preference and then of the configured encodings.
+func (p GcsProxy) precompressedSidecars(r *http.Request, key string) []precompressedSidecar {
+	var sidecars []precompressedSidecar
+	for _, encoding := range encode.AcceptedEncodings(r, p.Precompressed) {
+		if !slices.Contains(p.Precompressed, encoding) {
+			continue
+		}
+		sidecars = append(sidecars, precompressedSidecar{
+			encoding: encoding,
+			key:      key + precompressedSuffixes[encoding],
+		})
+	}
+	return sidecars
+}
+
+// sidecarAttrs returns the attrs to serve a sidecar with: the encoding as
+// Content-Encoding, and the type of the object it compresses if the sidecar
+// was stored with the type of the compressed file or none at all.
+func sidecarAttrs(attrs *storage.ObjectAttrs, key, encoding string) *storage.ObjectAttrs {
+	served := *attrs
+	served.ContentEncoding = encoding
+
+	// ParseMediaType lowercases the type
+	mediaType, _, _ := mime.ParseMediaType(served.ContentType)
+	if served.ContentType == "" || slices.Contains(compressedContentTypes, mediaType) {
+		served.ContentType = mime.TypeByExtension(path.Ext(key))
+	}
+	return &served
+}
+
+// openPrecompressed returns the first sidecar of key that exists for the
+// encodings the client accepts, with attrs set up to serve it. The reader is
+// nil for HEAD requests. Sidecars stored with a Content-Encoding of their own
+// are skipped, since GCS would transcode them. It returns false if there is
+// no sidecar to serve, and the original object should be.
+func (p GcsProxy) openPrecompressed(ctx context.Context, r *http.Request, key string, headOnly bool) (io.ReadCloser, *storage.ObjectAttrs, bool) {
+	for _, sidecar := range p.precompressedSidecars(r, key) {
+		if fileHidden(sidecar.key, p.Hide) {
+			continue
+		}
+
+		var reader io.ReadCloser
+		var attrs *storage.ObjectAttrs
+		var err error
+		if headOnly {
+			attrs, err = p.objectAttrs(ctx, sidecar.key)
+		} else {
+			reader, attrs, err = p.openObject(ctx, sidecar.key)
+		}
+		if err != nil {
+			if err != storage.ErrObjectNotExist {
+				p.log.Warn("could not open precompressed object",
+					zap.String("key", sidecar.key),
+					zap.String("err", err.Error()),
+				)
+			}
+			continue
+		}
+		if attrs.ContentEncoding != "" {
+			if reader != nil {
+				reader.Close()
+			}
+			continue
+		}
+		return reader, sidecarAttrs(attrs, key, sidecar.encoding), true
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,197 @@
+package caddygcsproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+// Prewarm configures objects that are fetched into the cache ahead of the
+// first request, so the most important assets are hot right after a deploy
+// or restart. Requires Cache.
+type Prewarm struct {
+	// Local file listing object keys to warm, one per line. Blank lines and
+	// lines starting with `#` are ignored.
+	Manifest string `json:"manifest,omitempty"`
+
+	// Key prefix whose objects are warmed.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Glob pattern matched against the base name of each object under Prefix,
+	// e.g. `*.css`. Empty means every object under Prefix.
+	Glob string `json:"glob,omitempty"`
+
+	// Flag to also warm the index names under the root and every error page
+	// (default false). Index names are skipped if the root contains
+	// placeholders, since it can only be resolved per request.
+	IndexAndErrorPages bool `json:"index_and_error_pages,omitempty"`
+
+	// How often the objects are warmed again. Default is 0, meaning only once
+	// at provision.
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+// runPrewarm warms the cache now and then every Interval until ctx is done.
+func (p GcsProxy) runPrewarm(ctx context.Context) {
+	p.prewarm(ctx)
+	if p.Prewarm.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(p.Prewarm.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.prewarm(ctx)
+		}
+	}
+}
+
+func (p GcsProxy) prewarm(ctx context.Context) {
+	var keys []string
+	if p.Prewarm.Manifest != "" {
+		manifest, err := readManifest(p.Prewarm.Manifest)
+		if err != nil {
+			p.log.Error("could not read prewarm manifest",
+				zap.String("manifest", p.Prewarm.Manifest),
+				zap.String("err", err.Error()),
+			)
+		}
+		keys = append(keys, manifest...)
+	}
+	if p.Prewarm.Prefix != "" || p.Prewarm.Glob != "" {
+		listed, err := p.listPrewarmKeys(ctx)
+		if err != nil {
+			p.log.Error("could not list objects to prewarm",
+				zap.String("prefix", p.Prewarm.Prefix),
+				zap.String("err", err.Error()),
+			)
+		}
+		keys = append(keys, listed...)
+	}
+
+	if p.Prewarm.IndexAndErrorPages {
+		keys = append(keys, p.indexAndErrorPageKeys()...)
+	}
+
+	warmed := 0
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		if p.warmObject(ctx, key) {
+			warmed++
+		}
+	}
+	p.log.Info("prewarmed cache", zap.Int("objects", warmed), zap.Int("keys", len(keys)))
+}
+
+func readManifest(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, scanner.Err()
+}
+
+// indexAndErrorPageKeys returns the keys of the index names under the root
+// and of every configured error page.
+func (p GcsProxy) indexAndErrorPageKeys() []string {
+	var keys []string
+	if root, ok := p.staticRoot(); !ok {
+		p.log.Debug("not prewarming index names, root contains placeholders", zap.String("root", p.Root))
+	} else {
+		dir := joinPath(root, "/")
+		for _, name := range p.IndexNames {
+			keys = append(keys, path.Join(dir, name))
+		}
+	}
+
+	for _, page := range p.errorPageKeys() {
+		if strings.ToLower(page) != "pass_through" && !slices.Contains(keys, page) {
+			keys = append(keys, page)
+		}
+	}
+	return keys
+}
+
+// listPrewarmKeys returns the cacheable objects under Prefix matching Glob.
+func (p GcsProxy) listPrewarmKeys(ctx context.Context) ([]string, error) {
+	it := p.bucketHandle().Objects(ctx, &storage.Query{Prefix: p.Prewarm.Prefix})
+	var keys []string
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return keys, err
+		}
+		if strings.HasSuffix(attrs.Name, "/") || !p.cache.cacheable(attrs.Size) {
+			continue
+		}
+		if p.Prewarm.Glob != "" {
+			if match, _ := path.Match(p.Prewarm.Glob, path.Base(attrs.Name)); !match {
+				continue
+			}
+		}
+		keys = append(keys, attrs.Name)
+	}
+}
+
+// warmObject fetches key into the cache unless it is already fresh there or
+// too large to be cached. It returns true if the object was fetched.
+func (p GcsProxy) warmObject(ctx context.Context, key string) bool {
+	if _, fresh := p.cache.get(key); fresh {
+		return false
+	}
+
+	obj := p.bucketHandle().Object(key)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		p.log.Warn("could not prewarm object", zap.String("key", key), zap.String("err", err.Error()))
+		return false
+	}
+	if !p.cache.cacheable(attrs.Size) {
+		p.log.Debug("object too large to prewarm", zap.String("key", key), zap.Int64("size", attrs.Size))
+		return false
+	}
+
+	reader, err := obj.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		p.log.Warn("could not prewarm object", zap.String("key", key), zap.String("err", err.Error()))
+		return false
+	}
+	defer reader.Close()
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		p.log.Warn("could not prewarm object", zap.String("key", key), zap.String("err", err.Error()))
+		return false
+	}
+	p.cache.put(key, attrs, body)
+	return true
+}
@@ -0,0 +1,42 @@
+package caddygcsproxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// errProtected is returned for writes to keys matching Protect.
+var errProtected = errors.New("key is protected")
+
+// writeProtected returns true if writes may not touch key. A directory is
+// protected if it matches a pattern or any pattern lies within it, so moving
+// the directory would move a protected key.
+func (p GcsProxy) writeProtected(key string) bool {
+	if pathMatches(p.Protect, key) {
+		return true
+	}
+	if !strings.HasSuffix(key, "/") {
+		return false
+	}
+	for _, pattern := range p.Protect {
+		if strings.HasPrefix(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProtected returns a 403 error if a request with a method other than
+// GET or HEAD would write to a protected key.
+func (p GcsProxy) checkProtected(r *http.Request, key string) error {
+	if len(p.Protect) == 0 || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return nil
+	}
+	if p.writeProtected(key) {
+		return caddyhttp.Error(http.StatusForbidden, errProtected)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/storage"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPublicCacheTTL = time.Minute
+	maxPublicCacheEntries = 10000
+)
+
+// publicReaderRoles are the bucket IAM roles that make every object in the
+// bucket publicly readable when granted to allUsers.
+var publicReaderRoles = []iam.RoleName{
+	"roles/storage.objectViewer",
+	"roles/storage.legacyObjectReader",
+}
+
+type publicEntry struct {
+	public  bool
+	checked time.Time
+}
+
+// publicChecker determines, with caching, whether objects are publicly
+// readable through either bucket IAM or object ACLs.
+type publicChecker struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	bucket  *publicEntry
+	objects map[string]publicEntry
+	log     *zap.Logger
+}
+
+func newPublicChecker(ttl time.Duration, log *zap.Logger) *publicChecker {
+	if ttl <= 0 {
+		ttl = defaultPublicCacheTTL
+	}
+	return &publicChecker{
+		ttl:     ttl,
+		objects: make(map[string]publicEntry),
+		log:     log,
+	}
+}
+
+// isPublic returns true if the object at key can be read by allUsers.
+func (c *publicChecker) isPublic(ctx context.Context, bucket *storage.BucketHandle, key string) bool {
+	if c.bucketPublic(ctx, bucket) {
+		return true
+	}
+
+	c.mu.Lock()
+	entry, ok := c.objects[key]
+	c.mu.Unlock()
+	if ok && time.Since(entry.checked) < c.ttl {
+		return entry.public
+	}
+
+	entry = publicEntry{checked: time.Now()}
+	rules, err := bucket.Object(key).ACL().List(ctx)
+	if err != nil {
+		// Buckets with uniform bucket-level access have no object ACLs
+		c.log.Debug("could not list object ACL",
+			zap.String("key", key),
+			zap.String("err", err.Error()),
+		)
+	}
+	for _, rule := range rules {
+		if rule.Entity == storage.AllUsers && (rule.Role == storage.RoleReader || rule.Role == storage.RoleOwner) {
+			entry.public = true
+			break
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.objects) >= maxPublicCacheEntries {
+		c.objects = make(map[string]publicEntry)
+	}
+	c.objects[key] = entry
+	return entry.public
+}
+
+// bucketPublic returns true if the bucket IAM policy makes all objects public.
+func (c *publicChecker) bucketPublic(ctx context.Context, bucket *storage.BucketHandle) bool {
+	c.mu.Lock()
+	entry := c.bucket
+	c.mu.Unlock()
+	if entry != nil && time.Since(entry.checked) < c.ttl {
+		return entry.public
+	}
+
+	entry = &publicEntry{checked: time.Now()}
+	policy, err := bucket.IAM().Policy(ctx)
+	if err != nil {
+		c.log.Warn("could not read bucket IAM policy",
+			zap.String("err", err.Error()),
+		)
+	} else {
+		for _, role := range publicReaderRoles {
+			if policy.HasRole(iam.AllUsers, role) {
+				entry.public = true
+				break
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bucket = entry
+	return entry.public
+}
+
+// checkPublicListing returns a 403 if PublicOnly is set and the bucket IAM
+// policy doesn't make every object public. Listings, and the usage and stats
+// computed from them, name objects that may not be public themselves, and
+// GCS only lets allUsers list a bucket through the same roles.
+func (p GcsProxy) checkPublicListing(ctx context.Context) error {
+	if p.publicCheck != nil && !p.publicCheck.bucketPublic(ctx, p.bucketHandle()) {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("bucket is not publicly listable"))
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"google.golang.org/api/iterator"
+)
+
+const defaultQuotaRefresh = 5 * time.Minute
+
+// Quota limits how much may be stored under a key prefix.
+type Quota struct {
+	// The key prefix the quota applies to. May contain the same request
+	// placeholders as root, e.g. `/home/{http.auth.user.id}/`.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Maximum total bytes stored under the prefix, 0 for no limit.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// Maximum number of objects stored under the prefix, 0 for no limit.
+	MaxObjects int64 `json:"max_objects,omitempty"`
+}
+
+// errQuotaExceeded is returned by the body reader when an upload of unknown
+// length grows past the remaining quota.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+type quotaUsage struct {
+	bytes   int64
+	objects int64
+	scanned time.Time
+}
+
+// quotaTracker caches the usage of each quota prefix. Usage is refreshed with
+// a full prefix scan once it is older than refresh, and adjusted incrementally
+// for writes proxied in between. Writes in progress hold reservations, which
+// count as used but survive a rescan.
+type quotaTracker struct {
+	mu       sync.Mutex
+	refresh  time.Duration
+	usage    map[string]*quotaUsage
+	reserved map[string]*quotaUsage
+}
+
+func newQuotaTracker(refresh time.Duration) *quotaTracker {
+	if refresh <= 0 {
+		refresh = defaultQuotaRefresh
+	}
+	return &quotaTracker{
+		refresh:  refresh,
+		usage:    make(map[string]*quotaUsage),
+		reserved: make(map[string]*quotaUsage),
+	}
+}
+
+// quotaWrite is a write admitted by checkQuotas. Its bytes are reserved
+// until it is released, so concurrent writes can't each be admitted to the
+// same free space. Writes of unknown size reserve no bytes and are held to
+// remaining by a quotaReader instead.
+type quotaWrite struct {
+	tracker  *quotaTracker
+	prefixes []string
+	bytes    int64
+	objects  int64
+	released bool
+
+	// Bytes that may still be written, -1 for no limit
+	remaining int64
+	// Size of the object the write replaces, -1 for none
+	replaced int64
+}
+
+// release drops the reservation once the write has been recorded or has
+// failed. It may be called more than once.
+func (q *quotaWrite) release() {
+	if q.tracker == nil || q.released {
+		return
+	}
+	q.released = true
+	q.tracker.mu.Lock()
+	defer q.tracker.mu.Unlock()
+	for _, prefix := range q.prefixes {
+		if res, ok := q.tracker.reserved[prefix]; ok {
+			res.bytes -= q.bytes
+			res.objects -= q.objects
+			if res.bytes == 0 && res.objects == 0 {
+				delete(q.tracker.reserved, prefix)
+			}
+		}
+	}
+}
+
+// get returns the usage of prefix, scanning the bucket if the cached value
+// is missing or stale.
+func (t *quotaTracker) get(ctx context.Context, bucket *storage.BucketHandle, prefix string) (quotaUsage, error) {
+	t.mu.Lock()
+	u, ok := t.usage[prefix]
+	if ok && time.Since(u.scanned) < t.refresh {
+		defer t.mu.Unlock()
+		return *u, nil
+	}
+	t.mu.Unlock()
+
+	scanned := quotaUsage{scanned: time.Now()}
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return quotaUsage{}, err
+		}
+		scanned.bytes += attrs.Size
+		scanned.objects++
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.usage[prefix] = &scanned
+	return scanned, nil
+}
+
+// add adjusts the cached usage of prefix for a proxied write.
+func (t *quotaTracker) add(prefix string, bytes int64, objects int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u, ok := t.usage[prefix]; ok {
+		u.bytes += bytes
+		u.objects += objects
+	}
+}
+
+// invalidate forces the next lookup of prefix to rescan the bucket.
+func (t *quotaTracker) invalidate(prefix string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.usage, prefix)
+}
+
+// matchingQuotas returns the quotas that apply to key along with their
+// resolved prefixes.
+func (p GcsProxy) matchingQuotas(r *http.Request, key string) ([]Quota, []string) {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	var quotas []Quota
+	var prefixes []string
+	for _, q := range p.Quotas {
+		prefix, err := p.resolveKeyTemplate(repl, q.Prefix)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		quotas = append(quotas, q)
+		prefixes = append(prefixes, prefix)
+	}
+	return quotas, prefixes
+}
+
+// checkQuotas verifies that writing an object of size bytes, -1 if unknown,
+// to key will not exceed any quota, and reserves the bytes. It returns the
+// admitted write, whose release must be called once the write has been
+// recorded or has failed. An overwrite frees the bytes of the object it
+// replaces and doesn't add to the object count. Rejections carry
+// X-RateLimit-* headers for the quota that was hit.
+func (p GcsProxy) checkQuotas(ctx context.Context, w http.ResponseWriter, r *http.Request, key string, size int64) (*quotaWrite, error) {
+	quotas, prefixes := p.matchingQuotas(r, key)
+	return p.checkQuotaUsage(ctx, w, key, quotas, prefixes, size, 1)
+}
+
+// checkQuotaUsage verifies that writing objects of size bytes in total to
+// key will not exceed any of quotas, covering prefixes, like checkQuotas.
+func (p GcsProxy) checkQuotaUsage(ctx context.Context, w http.ResponseWriter, key string, quotas []Quota, prefixes []string, size int64, objects int64) (*quotaWrite, error) {
+	qw := &quotaWrite{remaining: -1, replaced: -1}
+	if len(quotas) == 0 {
+		return qw, nil
+	}
+	attrs, err := p.objectFor(opGet, key).Attrs(ctx)
+	if err == nil {
+		qw.replaced = attrs.Size
+	} else if !errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, convertToCaddyError(err)
+	}
+
+	scanned := make([]quotaUsage, len(quotas))
+	for i := range quotas {
+		if scanned[i], err = p.quotas.get(ctx, p.bucketHandle(), prefixes[i]); err != nil {
+			return nil, convertToCaddyError(err)
+		}
+	}
+
+	// Checking and reserving under one lock admits concurrent writes one at
+	// a time
+	t := p.quotas
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if qw.replaced >= 0 {
+		objects = 0
+	}
+	for i, q := range quotas {
+		usage := scanned[i]
+		if cached, ok := t.usage[prefixes[i]]; ok {
+			usage = *cached
+		}
+		if res, ok := t.reserved[prefixes[i]]; ok {
+			usage.bytes += res.bytes
+			usage.objects += res.objects
+		}
+
+		if q.MaxObjects > 0 && objects > 0 && usage.objects+objects > q.MaxObjects {
+			err := fmt.Errorf("object count quota of %d reached for %s", q.MaxObjects, prefixes[i])
+			setRateLimitHeaders(w.Header(), q.MaxObjects, 0, -1)
+			return nil, caddyhttp.Error(http.StatusInsufficientStorage, err)
+		}
+		if q.MaxBytes <= 0 {
+			continue
+		}
+		if size > q.MaxBytes {
+			err := fmt.Errorf("upload of %d bytes is larger than the %d byte quota for %s", size, q.MaxBytes, prefixes[i])
+			setRateLimitHeaders(w.Header(), q.MaxBytes, q.MaxBytes-usage.bytes, -1)
+			return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+		}
+		left := max(q.MaxBytes-usage.bytes+max(qw.replaced, 0), 0)
+		if size > left {
+			err := fmt.Errorf("byte quota of %d reached for %s", q.MaxBytes, prefixes[i])
+			setRateLimitHeaders(w.Header(), q.MaxBytes, left, -1)
+			return nil, caddyhttp.Error(http.StatusInsufficientStorage, err)
+		}
+		if qw.remaining < 0 || left < qw.remaining {
+			qw.remaining = left
+		}
+	}
+
+	// An overwrite only adds what it grows the object by
+	qw.tracker, qw.prefixes, qw.objects = t, prefixes, objects
+	if size > 0 {
+		qw.bytes = max(size-max(qw.replaced, 0), 0)
+	}
+	for _, prefix := range prefixes {
+		res, ok := t.reserved[prefix]
+		if !ok {
+			res = &quotaUsage{}
+			t.reserved[prefix] = res
+		}
+		res.bytes += qw.bytes
+		res.objects += qw.objects
+	}
+	return qw, nil
+}
+
+// checkMoveQuotas verifies that moving key to destKey will not exceed any
+// quota covering destKey. Quotas that also cover key are skipped, as the
+// move doesn't change their usage. A directory is moved with every object
+// under it. It returns the size of what is moved, -1 if no quota applies,
+// and the admitted write like checkQuotas.
+func (p GcsProxy) checkMoveQuotas(ctx context.Context, w http.ResponseWriter, r *http.Request, key string, destKey string) (int64, *quotaWrite, error) {
+	var quotas []Quota
+	var prefixes []string
+	destQuotas, destPrefixes := p.matchingQuotas(r, destKey)
+	for i, prefix := range destPrefixes {
+		if !strings.HasPrefix(key, prefix) {
+			quotas = append(quotas, destQuotas[i])
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(quotas) == 0 {
+		return -1, &quotaWrite{remaining: -1, replaced: -1}, nil
+	}
+
+	var size, objects int64
+	if strings.HasSuffix(key, "/") {
+		it := p.bucketFor(opList).Objects(ctx, &storage.Query{Prefix: key})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return 0, nil, convertToCaddyError(err)
+			}
+			size += attrs.Size
+			objects++
+		}
+	} else {
+		attrs, err := p.objectFor(opGet, key).Attrs(ctx)
+		if err != nil {
+			return 0, nil, convertToCaddyError(err)
+		}
+		size, objects = attrs.Size, 1
+	}
+	qw, err := p.checkQuotaUsage(ctx, w, destKey, quotas, prefixes, size, objects)
+	return size, qw, err
+}
+
+// recordQuotaWrite accounts for a completed write of size bytes to key,
+// replacing an object of replaced bytes, or none if replaced is -1.
+func (p GcsProxy) recordQuotaWrite(r *http.Request, key string, size int64, replaced int64) {
+	_, prefixes := p.matchingQuotas(r, key)
+	for _, prefix := range prefixes {
+		if replaced >= 0 {
+			p.quotas.add(prefix, size-replaced, 0)
+		} else {
+			p.quotas.add(prefix, size, 1)
+		}
+	}
+}
+
+// recordQuotaDelete marks the usage of quotas covering key as stale.
+func (p GcsProxy) recordQuotaDelete(r *http.Request, key string) {
+	_, prefixes := p.matchingQuotas(r, key)
+	for _, prefix := range prefixes {
+		p.quotas.invalidate(prefix)
+	}
+}
+
+// quotaReader fails once more than remaining bytes have been read, so uploads
+// of unknown length can't overrun a quota.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(b []byte) (int, error) {
+	n, err := q.r.Read(b)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
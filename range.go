@@ -0,0 +1,200 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// maxRanges is the most ranges served for one request. Requests for more
+// get the whole object.
+const maxRanges = 16
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a range of an object, from start for length bytes.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+// parseRange parses a Range header for an object of size bytes. It returns
+// nil if the header should be ignored, and errRangeNotSatisfiable if none of
+// the ranges overlap the object.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || size == 0 {
+		return nil, nil
+	}
+	var ranges []byteRange
+	satisfiable := false
+	for part := range strings.SplitSeq(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, nil
+		}
+		var br byteRange
+		if first == "" {
+			// Suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			n = min(n, size)
+			br = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, nil
+				}
+			}
+			if start >= size {
+				continue
+			}
+			br = byteRange{start: start, length: min(end, size-1) - start + 1}
+		}
+		satisfiable = true
+		ranges = append(ranges, br)
+	}
+	if !satisfiable {
+		return nil, errRangeNotSatisfiable
+	}
+	if len(ranges) > maxRanges {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether an If-Range header allows serving a range of
+// the object. It holds either a strong ETag or a Last-Modified date.
+func (p GcsProxy) ifRangeMatches(r *http.Request, attrs *storage.ObjectAttrs) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == p.etag(r.URL.Path, attrs.Generation)
+	}
+	date, err := http.ParseTime(ifRange)
+	return err == nil && !attrs.Updated.IsZero() && attrs.Updated.Truncate(time.Second).Equal(date)
+}
+
+// objectAttrs returns the attrs of the object at key, from the cache if it
+// holds them fresh.
+func (p GcsProxy) objectAttrs(ctx context.Context, key string) (*storage.ObjectAttrs, error) {
+	offline := p.offline != nil && p.offline.active()
+	mode, _ := ctx.Value(cacheModeCtxKey{}).(cacheMode)
+	if p.cache != nil && (mode == cacheNormal || offline) {
+		cached, fresh := p.cache.get(key)
+		if cached != nil && !fresh && !offline {
+			fresh = p.serveStale(key, cached.attrs.Generation, cached.expires, mode)
+		}
+		if cached != nil && (fresh || offline) {
+			return cached.attrs, nil
+		}
+	}
+	if offline {
+		return nil, errOffline
+	}
+
+	ctx, cancel := p.opContext(ctx, opGet)
+	defer cancel()
+	attrs, err := p.objectFor(opGet, key).Attrs(ctx)
+	if err != nil {
+		p.recordReadError(err)
+		return nil, err
+	}
+	if p.offline != nil {
+		p.offline.success()
+	}
+	return attrs, nil
+}
+
+// serveRange responds to a request with a Range header with the requested
+// ranges of the object, or the whole object if the Range or If-Range header
+// rules that out. Multiple ranges are sent as multipart/byteranges.
+func (p GcsProxy) serveRange(ctx context.Context, w http.ResponseWriter, r *http.Request, attrs *storage.ObjectAttrs) error {
+	var ranges []byteRange
+	var err error
+	if attrs.ContentEncoding == "" && p.ifRangeMatches(r, attrs) {
+		ranges, err = parseRange(r.Header.Get("Range"), attrs.Size)
+	}
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", attrs.Size))
+		return caddyhttp.Error(http.StatusRequestedRangeNotSatisfiable, err)
+	}
+	if ranges == nil {
+		ranges = []byteRange{{start: 0, length: attrs.Size}}
+	}
+
+	if err := p.writeResponseFromGetObject(w, r, nil, attrs); err != nil {
+		return err
+	}
+	defer recordPhase(ctx, "transfer", time.Now())
+
+	if len(ranges) == 1 {
+		br := ranges[0]
+		reader, err := p.openRange(ctx, attrs, br.start, br.length)
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+		defer reader.Close()
+		w.Header().Set("Content-Length", strconv.FormatInt(br.length, 10))
+		if br.length != attrs.Size {
+			w.Header().Set("Content-Range", br.contentRange(attrs.Size))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		_, err = io.Copy(w, reader)
+		return err
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+	for _, br := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {contentType},
+			"Content-Range": {br.contentRange(attrs.Size)},
+		})
+		if err != nil {
+			return err
+		}
+		reader, err := p.openRange(ctx, attrs, br.start, br.length)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
@@ -0,0 +1,108 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// chunkKey returns the cache key of chunk i of an object generation. Chunk
+// keys start with the object key, so purging the key's prefix drops them.
+func chunkKey(key string, generation int64, i int64) string {
+	return fmt.Sprintf("%s\x00%d\x00%d", key, generation, i)
+}
+
+// openRange returns a reader over length bytes of the object generation
+// described by attrs, starting at offset. With Cache.ChunkSize set, large
+// objects are read in chunks which are cached, so popular ranges are served
+// without caching the whole object.
+func (p GcsProxy) openRange(ctx context.Context, attrs *storage.ObjectAttrs, offset int64, length int64) (io.ReadCloser, error) {
+	if p.cache != nil {
+		if cached, _ := p.cache.get(attrs.Name); cached != nil && cached.attrs.Generation == attrs.Generation {
+			return io.NopCloser(bytes.NewReader(cached.body[offset : offset+length])), nil
+		}
+	}
+
+	obj := p.objectFor(opGet, attrs.Name).Generation(attrs.Generation)
+	if p.cache == nil || p.cache.config.ChunkSize <= 0 || p.cache.cacheable(attrs.Size) {
+		return obj.NewRangeReader(ctx, offset, length)
+	}
+	return &chunkReader{
+		ctx:   ctx,
+		cache: p.cache,
+		obj:   obj,
+		attrs: attrs,
+		pos:   offset,
+		end:   offset + length,
+	}, nil
+}
+
+// chunkReader reads a range of an object chunk by chunk, serving chunks from
+// the cache when possible. On the first missing chunk it streams the rest of
+// the range in a single request, caching each chunk as it goes.
+type chunkReader struct {
+	ctx    context.Context
+	cache  *objectCache
+	obj    *storage.ObjectHandle
+	attrs  *storage.ObjectAttrs
+	pos    int64
+	end    int64
+	buf    []byte
+	stream io.ReadCloser
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	if len(c.buf) == 0 {
+		if c.pos >= c.end {
+			return 0, io.EOF
+		}
+		if err := c.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	c.pos += int64(n)
+	return n, nil
+}
+
+// fill loads the chunk holding pos into buf.
+func (c *chunkReader) fill() error {
+	size := c.cache.config.ChunkSize
+	i := c.pos / size
+	start := i * size
+	chunkEnd := min(start+size, c.attrs.Size)
+	key := chunkKey(c.attrs.Name, c.attrs.Generation, i)
+
+	var chunk []byte
+	if cached, _ := c.cache.get(key); cached != nil && c.stream == nil {
+		chunk = cached.body
+	} else {
+		if c.stream == nil {
+			// Read whole chunks up to the end of the range
+			streamEnd := min((c.end+size-1)/size*size, c.attrs.Size)
+			stream, err := c.obj.NewRangeReader(c.ctx, start, streamEnd-start)
+			if err != nil {
+				return err
+			}
+			c.stream = stream
+		}
+		chunk = make([]byte, chunkEnd-start)
+		if _, err := io.ReadFull(c.stream, chunk); err != nil {
+			return err
+		}
+		c.cache.put(key, nil, chunk)
+	}
+	c.buf = chunk[c.pos-start : min(chunkEnd, c.end)-start]
+	return nil
+}
+
+func (c *chunkReader) Close() error {
+	if c.stream != nil {
+		return c.stream.Close()
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package caddygcsproxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultRateLimitKey = "{http.request.remote.host}"
+	rateLimiterIdle     = 10 * time.Minute
+)
+
+// RateLimit configures per-client token bucket limits applied before any GCS
+// call is made, with separate budgets for reads and writes.
+type RateLimit struct {
+	// Placeholder the limits are keyed on. Default is `{http.request.remote.host}`.
+	Key string `json:"key,omitempty"`
+
+	// Read (GET, HEAD) requests allowed per second, 0 for no limit.
+	ReadRate float64 `json:"read_rate,omitempty"`
+
+	// Maximum burst of read requests.
+	ReadBurst int `json:"read_burst,omitempty"`
+
+	// Write (PUT, POST, DELETE) requests allowed per second, 0 for no limit.
+	WriteRate float64 `json:"write_rate,omitempty"`
+
+	// Maximum burst of write requests.
+	WriteBurst int `json:"write_burst,omitempty"`
+}
+
+// parseRate parses a rate of the form `<events>/<duration>`, e.g. `100/1m`,
+// into events per second and the event count to use as a default burst.
+func parseRate(s string) (float64, int, error) {
+	eventsStr, durStr, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("rate must be of the form <events>/<duration>")
+	}
+	events, err := strconv.Atoi(eventsStr)
+	if err != nil || events <= 0 {
+		return 0, 0, fmt.Errorf("invalid event count: %s", eventsStr)
+	}
+	dur, err := caddy.ParseDuration(durStr)
+	if err != nil || dur <= 0 {
+		return 0, 0, fmt.Errorf("invalid duration: %s", durStr)
+	}
+	return float64(events) / dur.Seconds(), events, nil
+}
+
+type clientLimiters struct {
+	read     *rate.Limiter
+	write    *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter holds the token buckets of every client seen recently.
+type rateLimiter struct {
+	mu      sync.Mutex
+	config  RateLimit
+	clients map[string]*clientLimiters
+	swept   time.Time
+}
+
+func newRateLimiter(config RateLimit) *rateLimiter {
+	if config.Key == "" {
+		config.Key = defaultRateLimitKey
+	}
+	return &rateLimiter{
+		config:  config,
+		clients: make(map[string]*clientLimiters),
+		swept:   time.Now(),
+	}
+}
+
+// limiterFor returns the limiter for the client and operation, or nil if that
+// kind of operation is not limited.
+func (l *rateLimiter) limiterFor(client string, write bool) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) > rateLimiterIdle {
+		for key, c := range l.clients {
+			if now.Sub(c.lastSeen) > rateLimiterIdle {
+				delete(l.clients, key)
+			}
+		}
+		l.swept = now
+	}
+
+	c, ok := l.clients[client]
+	if !ok {
+		c = &clientLimiters{}
+		if l.config.ReadRate > 0 {
+			c.read = rate.NewLimiter(rate.Limit(l.config.ReadRate), max(l.config.ReadBurst, 1))
+		}
+		if l.config.WriteRate > 0 {
+			c.write = rate.NewLimiter(rate.Limit(l.config.WriteRate), max(l.config.WriteBurst, 1))
+		}
+		l.clients[client] = c
+	}
+	c.lastSeen = now
+
+	if write {
+		return c.write
+	}
+	return c.read
+}
+
+// allow takes a token for the request, returning a 429 error with a
+// Retry-After header set if the client has exhausted its budget.
+func (l *rateLimiter) allow(w http.ResponseWriter, r *http.Request) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	client := repl.ReplaceAll(l.config.Key, "")
+
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead
+	limiter := l.limiterFor(client, write)
+	if limiter == nil {
+		return nil
+	}
+
+	reservation := limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		setRateLimitHeaders(w.Header(), int64(limiter.Burst()), 0, delay)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		return caddyhttp.Error(http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+	}
+	return nil
+}
+
+// setRateLimitHeaders sets the X-RateLimit-* headers on a rejected request,
+// so clients can back off instead of retrying blindly. The reset header is
+// left out if reset is negative, e.g. for quotas that only free up when
+// objects are deleted.
+func setRateLimitHeaders(h http.Header, limit int64, remaining int64, reset time.Duration) {
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(max(remaining, 0), 10))
+	if reset >= 0 {
+		h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	}
+}
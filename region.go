@@ -0,0 +1,115 @@
+package caddygcsproxy
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// RegionRouting serves reads from a bucket near the client, e.g. regional
+// copies of the bucket kept in sync by a transfer job. Writes always go to
+// Bucket.
+type RegionRouting struct {
+	// Placeholder resolving to the client's region, e.g. a GeoIP variable
+	// or `{http.request.header.X-Client-Region}` set by the load balancer.
+	Region string `json:"region,omitempty"`
+
+	// Bucket serving each region. Requests from other regions are served
+	// from Bucket.
+	Buckets map[string]string `json:"buckets,omitempty"`
+}
+
+// regionBucket returns the bucket serving the client's region, or Bucket.
+func (p GcsProxy) regionBucket(r *http.Request) string {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if bucket, ok := p.Regions.Buckets[repl.ReplaceAll(p.Regions.Region, "")]; ok {
+		return bucket
+	}
+	return p.Bucket
+}
+
+// regionalGetHandler serves a GET from the client's regional bucket, falling
+// back to Bucket if the object is missing there or the bucket fails.
+func (p GcsProxy) regionalGetHandler(w http.ResponseWriter, r *http.Request, fullPath string) error {
+	if p.Regions == nil {
+		return p.GetHandler(w, r, fullPath)
+	}
+	bucket := p.regionBucket(r)
+	if bucket == p.Bucket {
+		return p.GetHandler(w, r, fullPath)
+	}
+
+	regional := p
+	regional.Bucket = bucket
+	rw := &regionalWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		header:                w.Header().Clone(),
+	}
+	err := regional.GetHandler(rw, r, fullPath)
+	if rw.written || !regionFallback(err) {
+		return err
+	}
+	p.log.Debug("falling back from regional bucket",
+		zap.String("bucket", bucket),
+		zap.String("key", fullPath),
+		zap.String("err", err.Error()),
+	)
+	return p.GetHandler(w, r, fullPath)
+}
+
+// regionFallback returns true if a GET failing with err can be retried on the
+// primary bucket, if nothing was written for it yet.
+func regionFallback(err error) bool {
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) {
+		return false
+	}
+	return handlerErr.StatusCode == http.StatusNotFound || handlerErr.StatusCode >= http.StatusInternalServerError
+}
+
+// regionalWriter keeps the headers set while serving from the regional
+// bucket apart until the response is written, so a fallback to Bucket starts
+// from the headers the request came in with.
+type regionalWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	header  http.Header
+	written bool
+}
+
+func (rw *regionalWriter) Header() http.Header {
+	if rw.written {
+		return rw.ResponseWriterWrapper.Header()
+	}
+	return rw.header
+}
+
+// WriteHeader commits the headers, after which the request can't fall back.
+// That includes 1xx responses, which the client has already acted on.
+func (rw *regionalWriter) WriteHeader(status int) {
+	if !rw.written {
+		rw.written = true
+		header := rw.ResponseWriterWrapper.Header()
+		clear(header)
+		maps.Copy(header, rw.header)
+	}
+	rw.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (rw *regionalWriter) Write(b []byte) (int, error) {
+	if !rw.written {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.ResponseWriterWrapper.Write(b)
+}
+
+func (rw *regionalWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !rw.written {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.ResponseWriterWrapper.ReadFrom(r)
+}
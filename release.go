@@ -0,0 +1,152 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultReleaseTTL     = 5 * time.Second
+	releaseFetchTimeout   = 5 * time.Second
+	maxReleasePointerSize = 1024
+)
+
+// errNoRelease is returned when the release pointer has never been read, so
+// there is no root to serve from.
+var errNoRelease = errors.New("release pointer unavailable")
+
+// ReleasePointer configures blue/green releases. The content of the object at
+// Key names the active release prefix, e.g. `releases/2024-06-01/`, which is
+// appended to Root. A deploy uploads the release and then switches to it
+// atomically by rewriting the pointer.
+type ReleasePointer struct {
+	// Key of the pointer object.
+	Key string `json:"key,omitempty"`
+
+	// How long the pointer is cached. Default is 5s. The admin API's purge
+	// of the pointer key switches as soon as the pointer is read again.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+// releaseState caches the active release prefix.
+type releaseState struct {
+	mu      sync.Mutex
+	prefix  string
+	fetched time.Time
+	stale   bool
+	// Error of the last read of the pointer
+	err error
+	// Closed when the running read of the pointer is done, nil if none is
+	// running
+	refreshing chan struct{}
+}
+
+// invalidate forces the pointer to be read again on the next request.
+func (s *releaseState) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stale = true
+}
+
+// releasePrefix returns the active release prefix, reading the pointer in
+// the background if the cached one has expired. The cached prefix keeps
+// being served while the pointer is read and if it can't be, only the first
+// requests wait for the pointer.
+func (p GcsProxy) releasePrefix() (string, error) {
+	s := p.release
+	s.mu.Lock()
+	prefix := s.prefix
+	if prefix != "" && !s.stale && time.Since(s.fetched) < time.Duration(p.ReleasePointer.TTL) {
+		s.mu.Unlock()
+		return prefix, nil
+	}
+
+	// Requests share one read of the pointer rather than each reading it
+	done := s.refreshing
+	if done == nil {
+		done = make(chan struct{})
+		s.refreshing = done
+		s.stale = false
+		go p.refreshRelease(done)
+	}
+	s.mu.Unlock()
+	if prefix != "" {
+		return prefix, nil
+	}
+
+	<-done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prefix == "" {
+		return "", fmt.Errorf("%w: %v", errNoRelease, s.err)
+	}
+	return s.prefix, nil
+}
+
+// refreshRelease reads the pointer into the release state and closes done.
+func (p GcsProxy) refreshRelease(done chan struct{}) {
+	defer close(done)
+	ctx, cancel := context.WithTimeout(context.Background(), releaseFetchTimeout)
+	defer cancel()
+	prefix, err := p.readReleasePointer(ctx)
+
+	s := p.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshing = nil
+	// On failure, try again after another TTL
+	s.fetched = time.Now()
+	s.err = err
+	if err != nil {
+		if s.prefix != "" {
+			p.log.Warn("could not read release pointer, serving the previous release",
+				zap.String("key", p.ReleasePointer.Key),
+				zap.String("release", s.prefix),
+				zap.String("err", err.Error()),
+			)
+		}
+		return
+	}
+	if prefix != s.prefix {
+		p.log.Info("switched release", zap.String("from", s.prefix), zap.String("to", prefix))
+	}
+	s.prefix = prefix
+}
+
+// readReleasePointer reads the release prefix from the pointer object.
+func (p GcsProxy) readReleasePointer(ctx context.Context) (string, error) {
+	reader, err := p.objectFor(opGet, p.ReleasePointer.Key).NewReader(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(io.LimitReader(reader, maxReleasePointerSize))
+	if err != nil {
+		return "", err
+	}
+	return cleanReleasePrefix(string(content))
+}
+
+// cleanReleasePrefix validates the content of a release pointer and returns
+// it as a prefix without leading slash.
+func cleanReleasePrefix(content string) (string, error) {
+	prefix := strings.TrimSpace(content)
+	if prefix == "" || strings.ContainsAny(prefix, "\n{}") {
+		return "", fmt.Errorf("invalid release pointer content: %q", content)
+	}
+	for segment := range strings.SplitSeq(prefix, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("release pointer may not contain '..': %q", content)
+		}
+	}
+	return strings.TrimPrefix(path.Clean("/"+prefix), "/") + "/", nil
+}
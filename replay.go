@@ -0,0 +1,146 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"go.uber.org/zap"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultReplayMaxSize     = 8 << 20
+	defaultReplayMaxAttempts = 3
+	replayMemoryLimit        = 1 << 20
+	replayInitialBackoff     = 250 * time.Millisecond
+)
+
+// ReplayablePut configures buffering of small PUT bodies so that an upload
+// failing with a transient GCS error is retried by the proxy instead of the
+// client. Retried uploads carry a generation precondition so a retry never
+// overwrites a concurrent write.
+type ReplayablePut struct {
+	// Largest body, by Content-Length, that is buffered. Bodies up to 1MiB are
+	// kept in memory, larger ones in a temp file. Default is 8MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Maximum number of upload attempts, including the first. Default is 3.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+}
+
+// replayable is an upload body that can be read more than once.
+type replayable interface {
+	Reader() (io.Reader, error)
+}
+
+type memoryBody []byte
+
+func (b memoryBody) Reader() (io.Reader, error) {
+	return bytes.NewReader(b), nil
+}
+
+// bufferBody reads r into memory or a temp file, depending on size.
+func bufferBody(r io.Reader, size int64) (replayable, func(), error) {
+	if size <= replayMemoryLimit {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return memoryBody(body), func() {}, nil
+	}
+
+	spooled, err := spoolBody(r, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return spooled, func() { spooled.Close() }, nil
+}
+
+// writeObject uploads body to obj with the given attrs, aborting the upload
+// rather than finalizing it if the body can't be read in full.
+func (p GcsProxy) writeObject(ctx context.Context, obj *storage.ObjectHandle, attrs storage.ObjectAttrs, body io.Reader) (*storage.ObjectAttrs, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := obj.NewWriter(ctx)
+	writer.ContentType = attrs.ContentType
+	writer.ContentEncoding = attrs.ContentEncoding
+	writer.Metadata = attrs.Metadata
+	writer.TemporaryHold = attrs.TemporaryHold
+	writer.EventBasedHold = attrs.EventBasedHold
+	writer.CustomTime = attrs.CustomTime
+	p.ResumableUploads.applyTo(writer)
+	if _, err := io.Copy(writer, body); err != nil {
+		// Cancelling the context aborts the upload rather than finalizing it
+		cancel()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return writer.Attrs(), nil
+}
+
+// writeReplayable uploads body, retrying transient failures with backoff. The
+// upload is conditioned on the object's generation before the first attempt,
+// so a retry can't overwrite a concurrent write, and a retry failing its
+// precondition after an attempt that did land is recognised by its CRC32C.
+func (p GcsProxy) writeReplayable(ctx context.Context, obj *storage.ObjectHandle, attrs storage.ObjectAttrs, body replayable, onAttempt func(io.Reader) io.Reader) (*storage.ObjectAttrs, error) {
+	cond := storage.Conditions{DoesNotExist: true}
+	current, err := obj.Attrs(ctx)
+	if err == nil {
+		cond = storage.Conditions{GenerationMatch: current.Generation}
+	} else if err != storage.ErrObjectNotExist {
+		return nil, err
+	}
+	conditional := obj.If(cond)
+
+	maxAttempts := p.ReplayablePut.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultReplayMaxAttempts
+	}
+
+	backoff := replayInitialBackoff
+	for attempt := 1; ; attempt++ {
+		reader, err := body.Reader()
+		if err != nil {
+			return nil, err
+		}
+		crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		reader = io.TeeReader(onAttempt(reader), crc)
+
+		written, err := p.writeObject(ctx, conditional, attrs, reader)
+		if err == nil {
+			return written, nil
+		}
+
+		var apiErr *googleapi.Error
+		if attempt > 1 && errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			// An earlier attempt may have landed without us seeing the response
+			if landed, attrsErr := obj.Attrs(ctx); attrsErr == nil && landed.CRC32C == crc.Sum32() {
+				return landed, nil
+			}
+		}
+
+		if attempt >= maxAttempts || !isTransient(err) {
+			return nil, err
+		}
+		p.log.Warn("retrying upload after transient error",
+			zap.String("key", attrs.Name),
+			zap.Int("attempt", attempt),
+			zap.String("err", err.Error()),
+		)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
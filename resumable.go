@@ -0,0 +1,310 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	// GCS requires chunk sizes to be a multiple of 256KiB.
+	uploadChunkMultiple = 256 << 10
+
+	defaultStagedUploadMaxAge  = 24 * time.Hour
+	defaultStagedUploadMaxSize = 5 << 30
+	stagedUploadSweepInterval  = time.Hour
+
+	// uploadSessionHeader carries the session of a chunked upload, given in
+	// the answer to its first chunk and required on the ones after it.
+	uploadSessionHeader = "X-Upload-Session"
+
+	// statusResumeIncomplete answers a chunk of an unfinished upload, as in
+	// the GCS resumable upload protocol.
+	statusResumeIncomplete = http.StatusPermanentRedirect
+)
+
+// ResumableUploads configures how large uploads are sent to GCS and lets
+// clients send an upload in chunks with Content-Range, like the GCS
+// resumable upload protocol, so an interrupted multi-GB upload can be resumed
+// instead of restarted.
+type ResumableUploads struct {
+	// Size of the chunks uploads are sent to GCS in, a multiple of 256KiB.
+	// Each chunk is retried on its own. Default is the client library's
+	// 16MiB.
+	ChunkSize int64 `json:"chunk_size,omitempty"`
+
+	// How long a failing chunk is retried for. Default is the client
+	// library's 32s.
+	ChunkRetryDeadline caddy.Duration `json:"chunk_retry_deadline,omitempty"`
+
+	// Directory the chunks of a PUT with a Content-Range header are staged
+	// in until the upload is complete. Empty means chunked PUTs aren't
+	// accepted. Checksum trailers sent with a chunk are verified against
+	// that chunk.
+	Dir string `json:"dir,omitempty"`
+
+	// How long an incomplete upload is kept after its last chunk. Default
+	// is 24h.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// Largest upload accepted in chunks, in bytes, since it is staged on
+	// local disk until complete. Default is 5GiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// applyTo sets the chunking options on an object writer.
+func (u *ResumableUploads) applyTo(writer *storage.Writer) {
+	if u == nil {
+		return
+	}
+	if u.ChunkSize > 0 {
+		writer.ChunkSize = int(u.ChunkSize)
+	}
+	if u.ChunkRetryDeadline > 0 {
+		writer.ChunkRetryDeadline = time.Duration(u.ChunkRetryDeadline)
+	}
+}
+
+// contentRange is a parsed `Content-Range: bytes <first>-<last>/<total>`
+// header. first is -1 for a status query (`bytes */<total>`) and total is -1
+// if it is still unknown (`bytes <first>-<last>/*`).
+type contentRange struct {
+	first, last, total int64
+}
+
+func parseContentRange(header string) (contentRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return contentRange{}, fmt.Errorf("unsupported Content-Range %q", header)
+	}
+	rng, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return contentRange{}, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	cr := contentRange{first: -1, last: -1, total: -1}
+	var err error
+	if total != "*" {
+		if cr.total, err = strconv.ParseInt(total, 10, 64); err != nil || cr.total < 0 {
+			return contentRange{}, fmt.Errorf("invalid Content-Range %q", header)
+		}
+	}
+	if rng == "*" {
+		if cr.total < 0 {
+			return contentRange{}, fmt.Errorf("invalid Content-Range %q", header)
+		}
+		return cr, nil
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return contentRange{}, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	cr.first, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || cr.first < 0 {
+		return contentRange{}, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	cr.last, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || cr.last < cr.first || (cr.total >= 0 && cr.last >= cr.total) {
+		return contentRange{}, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	return cr, nil
+}
+
+// stagedUploads tracks the staged uploads receiving a chunk, so two chunks of
+// the same upload can't be appended at once.
+type stagedUploads struct {
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func (s *stagedUploads) lock(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[name] {
+		return false
+	}
+	s.active[name] = true
+	return true
+}
+
+func (s *stagedUploads) unlock(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, name)
+}
+
+// stagedUploadPath returns the file the chunks of the upload session to key
+// are staged in.
+func (p GcsProxy) stagedUploadPath(key string, session string) string {
+	sum := sha256.Sum256([]byte(p.Bucket + "\x00" + key + "\x00" + session))
+	return filepath.Join(p.ResumableUploads.Dir, hex.EncodeToString(sum[:])+".part")
+}
+
+func newUploadSession() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ChunkedPutHandler appends a chunk of an upload sent with Content-Range to
+// its staged file, answering 308 with the Range received so far until the
+// last chunk, which stores the whole upload like a PUT. The first chunk
+// starts a session, returned in X-Upload-Session, that the chunks after it
+// and status queries must send, so clients uploading to the same key don't
+// share a staged file. A chunk that doesn't start where the staged file
+// ends, or a `bytes */<total>` query, is only answered with the Range
+// received so far.
+func (p GcsProxy) ChunkedPutHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	cr, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if maxSize := p.ResumableUploads.MaxSize; maxSize > 0 && (cr.total > maxSize || cr.last >= maxSize) {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("chunked uploads are limited to %d bytes", maxSize))
+	}
+
+	flags := os.O_RDWR
+	session := r.Header.Get(uploadSessionHeader)
+	if session == "" {
+		if cr.first != 0 {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("missing %s header", uploadSessionHeader))
+		}
+		session = newUploadSession()
+		flags |= os.O_CREATE | os.O_EXCL
+	}
+	if p.quotas != nil && cr.first >= 0 {
+		// Every chunk is checked against the quotas with the size of the
+		// whole upload so far, so the staged file can't outgrow them
+		ctx, cancel := p.gcsContext(r)
+		defer cancel()
+		qw, err := p.checkQuotas(ctx, w, r, key, max(cr.total, cr.last+1))
+		if err != nil {
+			return err
+		}
+		// Staged bytes aren't in the bucket, the reservation only covers
+		// this chunk
+		defer qw.release()
+	}
+
+	name := p.stagedUploadPath(key, session)
+	if !p.staged.lock(name) {
+		return caddyhttp.Error(http.StatusConflict, errors.New("another chunk of this upload is in progress"))
+	}
+	defer p.staged.unlock(name)
+
+	file, err := os.OpenFile(name, flags, 0o600)
+	if errors.Is(err, os.ErrNotExist) {
+		return caddyhttp.Error(http.StatusNotFound, errors.New("unknown or expired upload session"))
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w.Header().Set(uploadSessionHeader, session)
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	if cr.first >= 0 && cr.first == size {
+		if _, err := file.Seek(size, io.SeekStart); err != nil {
+			return err
+		}
+		// Checksum trailers sent with a chunk cover that chunk. They are
+		// verified once the body ends, so it is read up to a byte past the
+		// range to reach its end.
+		length := cr.last - cr.first + 1
+		n, err := io.Copy(file, io.LimitReader(newChecksumReader(r), length+1))
+		if err == nil && n != length {
+			err = fmt.Errorf("chunk of %d bytes doesn't match its range of %d", n, length)
+		}
+		if err != nil {
+			// Drop the partial chunk so the client can send it again
+			file.Truncate(size)
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		size += n
+	}
+
+	if cr.total < 0 || size < cr.total {
+		if size > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+		}
+		w.WriteHeader(statusResumeIncomplete)
+		return nil
+	}
+	if size > cr.total {
+		file.Close()
+		os.Remove(name)
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("upload is larger than its total of %d bytes", cr.total))
+	}
+
+	// The upload is complete. If storing it fails, the staged file is kept
+	// so that a status query retries it.
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	complete := r.Clone(r.Context())
+	complete.Body = file
+	// The last chunk's checksums were verified against the chunk
+	complete.Trailer = nil
+	complete.ContentLength = size
+	complete.Header.Del("Content-Range")
+	complete.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	if err := p.PutHandler(w, complete, key); err != nil {
+		return err
+	}
+	file.Close()
+	os.Remove(name)
+	return nil
+}
+
+// runStagedUploadSweeper removes staged uploads not added to for MaxAge until
+// ctx is done.
+func (p GcsProxy) runStagedUploadSweeper(ctx context.Context) {
+	ticker := time.NewTicker(stagedUploadSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.sweepStagedUploads()
+		}
+	}
+}
+
+func (p GcsProxy) sweepStagedUploads() {
+	names, err := filepath.Glob(filepath.Join(p.ResumableUploads.Dir, "*.part"))
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil || time.Since(info.ModTime()) < time.Duration(p.ResumableUploads.MaxAge) {
+			continue
+		}
+		if p.staged.lock(name) {
+			os.Remove(name)
+			p.staged.unlock(name)
+			p.log.Info("removed abandoned staged upload", zap.String("file", name))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/googleapis/gax-go/v2"
+	"go.uber.org/zap"
+)
+
+// Kinds of GCS operations a RetryPolicy can be set for.
+const (
+	opGet    = "get"
+	opPut    = "put"
+	opDelete = "delete"
+	opList   = "list"
+)
+
+var retryOps = []string{opGet, opPut, opDelete, opList}
+
+// RetryPolicy configures the retries and timeout of one kind of GCS operation.
+type RetryPolicy struct {
+	// When failed calls are retried: `always`, `idempotent` or `never`.
+	// Default is `idempotent`, the GCS client's own policy, which only retries
+	// writes made with preconditions.
+	Policy string `json:"policy,omitempty"`
+
+	// Maximum number of attempts, including the first. Default is unlimited
+	// within the timeout.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+
+	// Backoff before the first retry. Default is 1s.
+	InitialBackoff caddy.Duration `json:"initial_backoff,omitempty"`
+
+	// Upper bound on the backoff between retries. Default is 30s.
+	MaxBackoff caddy.Duration `json:"max_backoff,omitempty"`
+
+	// Timeout for the whole operation, retries included. For reads and writes
+	// this covers streaming the body. Default is no timeout.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+func (rp RetryPolicy) options() []storage.RetryOption {
+	var opts []storage.RetryOption
+	switch rp.Policy {
+	case "always":
+		opts = append(opts, storage.WithPolicy(storage.RetryAlways))
+	case "never":
+		opts = append(opts, storage.WithPolicy(storage.RetryNever))
+	}
+	if rp.MaxAttempts > 0 {
+		opts = append(opts, storage.WithMaxAttempts(rp.MaxAttempts))
+	}
+	if rp.InitialBackoff > 0 || rp.MaxBackoff > 0 {
+		opts = append(opts, storage.WithBackoff(gax.Backoff{
+			Initial:    time.Duration(rp.InitialBackoff),
+			Max:        time.Duration(rp.MaxBackoff),
+			Multiplier: 2,
+		}))
+	}
+	return opts
+}
+
+// objectFor returns a handle to key using the retry policy for op.
+func (p GcsProxy) objectFor(op string, key string) *storage.ObjectHandle {
+	obj := p.bucketHandle().Object(key)
+	if rp, ok := p.RetryPolicies[op]; ok {
+		obj = obj.Retryer(rp.options()...)
+	}
+	return obj
+}
+
+// bucketFor returns a handle to the bucket using the retry policy for op.
+func (p GcsProxy) bucketFor(op string) *storage.BucketHandle {
+	bucket := p.bucketHandle()
+	if rp, ok := p.RetryPolicies[op]; ok {
+		bucket = bucket.Retryer(rp.options()...)
+	}
+	return bucket
+}
+
+// defaultDeadlineHeader is the request header read by deadline_header if no
+// name is given.
+const defaultDeadlineHeader = "X-Request-Timeout"
+
+// gcsContext returns the context for a request's GCS operations. It is
+// cancelled when the client goes away, and has a deadline of RequestTimeout
+// or the one the client asked for through DeadlineHeader, whichever is
+// sooner.
+func (p GcsProxy) gcsContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx := r.Context()
+	if mode := p.requestCacheMode(r); mode != cacheNormal {
+		ctx = context.WithValue(ctx, cacheModeCtxKey{}, mode)
+	}
+	timeout := time.Duration(p.RequestTimeout)
+	if requested := p.requestedTimeout(r); requested > 0 && (timeout <= 0 || requested < timeout) {
+		timeout = requested
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// requestedTimeout returns the timeout the client asked for through
+// DeadlineHeader, or 0. The header holds a duration such as `2s` or `500ms`,
+// or a number of seconds.
+func (p GcsProxy) requestedTimeout(r *http.Request) time.Duration {
+	if p.DeadlineHeader == "" {
+		return 0
+	}
+	value := r.Header.Get(p.DeadlineHeader)
+	if value == "" {
+		return 0
+	}
+	timeout, err := caddy.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			p.log.Debug("ignoring invalid request timeout", zap.String("value", value))
+			return 0
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	return max(timeout, 0)
+}
+
+// opContext applies the timeout of the retry policy for op to ctx.
+func (p GcsProxy) opContext(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	if rp, ok := p.RetryPolicies[op]; ok && rp.Timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(rp.Timeout))
+	}
+	return context.WithCancel(ctx)
+}
+
+// errFirstByteTimeout is returned for reads GCS didn't start answering within
+// FirstByteTimeout.
+var errFirstByteTimeout = fmt.Errorf("GCS did not respond within the first byte timeout: %w", context.DeadlineExceeded)
+
+// readContext applies TransferTimeout to a read from GCS, and FirstByteTimeout
+// until the returned stop function is called once GCS has started answering.
+// stop returns false if the first byte timeout has already expired.
+func (p GcsProxy) readContext(ctx context.Context) (context.Context, context.CancelFunc, func() bool) {
+	cancelTransfer := context.CancelFunc(func() {})
+	if p.TransferTimeout > 0 {
+		ctx, cancelTransfer = context.WithTimeout(ctx, time.Duration(p.TransferTimeout))
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := func() bool { return true }
+	if p.FirstByteTimeout > 0 {
+		timer := time.AfterFunc(time.Duration(p.FirstByteTimeout), func() { cancel(errFirstByteTimeout) })
+		stop = timer.Stop
+	}
+	return ctx, func() {
+		cancel(nil)
+		cancelTransfer()
+	}, stop
+}
+
+// readError returns errFirstByteTimeout if err is due to it, and err otherwise.
+func readError(ctx context.Context, err error) error {
+	if context.Cause(ctx) == errFirstByteTimeout {
+		return errFirstByteTimeout
+	}
+	return err
+}
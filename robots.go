@@ -0,0 +1,58 @@
+package caddygcsproxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Robots configures what search engines are told about the content.
+type Robots struct {
+	// Flag to serve a generated robots.txt at `/robots.txt` if the bucket has
+	// none (default false).
+	Txt bool `json:"txt,omitempty"`
+
+	// Paths disallowed in the generated robots.txt. Empty allows everything.
+	Disallow []string `json:"disallow,omitempty"`
+
+	// Sitemap URL listed in the generated robots.txt.
+	Sitemap string `json:"sitemap,omitempty"`
+
+	// Path patterns served with `X-Robots-Tag: noindex`, e.g. `/drafts/*`.
+	NoIndex []string `json:"noindex,omitempty"`
+
+	// Flag to serve browse listings with `X-Robots-Tag: noindex` (default
+	// false).
+	NoIndexBrowse bool `json:"noindex_browse,omitempty"`
+}
+
+// robotsTxt returns the generated robots.txt.
+func (rb Robots) robotsTxt() string {
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	if len(rb.Disallow) == 0 {
+		b.WriteString("Disallow:\n")
+	}
+	for _, disallow := range rb.Disallow {
+		b.WriteString("Disallow: " + disallow + "\n")
+	}
+	if rb.Sitemap != "" {
+		b.WriteString("\nSitemap: " + rb.Sitemap + "\n")
+	}
+	return b.String()
+}
+
+// serveRobotsTxt writes the generated robots.txt.
+func (p GcsProxy) serveRobotsTxt(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := io.WriteString(w, p.Robots.robotsTxt())
+	return err
+}
+
+// setRobotsTag adds `X-Robots-Tag: noindex` to responses for reqPath if it
+// matches a NoIndex pattern.
+func (p GcsProxy) setRobotsTag(w http.ResponseWriter, reqPath string) {
+	if p.Robots != nil && pathMatches(p.Robots.NoIndex, reqPath) {
+		w.Header().Set("X-Robots-Tag", "noindex")
+	}
+}
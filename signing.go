@@ -0,0 +1,252 @@
+package caddygcsproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	signatureParam = "signature"
+	expiresParam   = "expires"
+)
+
+// SignedURLs configures validation of proxy-issued signed URLs, letting
+// private objects be shared through expiring links.
+type SignedURLs struct {
+	// The shared secret used to compute the HMAC-SHA256 signature.
+	Secret string `json:"secret,omitempty"`
+
+	// Request path patterns that require a valid signature. Empty means
+	// every request does.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// SignURL returns a copy of u with `expires` and `signature` query parameters
+// added so that it will be accepted for method by a handler configured with
+// secret until the expiry time. A URL signed for GET is also good for HEAD.
+func SignURL(secret string, method string, u *url.URL, expires time.Time) *url.URL {
+	signed := *u
+	query := signed.Query()
+	query.Del(signatureParam)
+	query.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(signatureParam, computeSignature(secret, method, signed.Path, query))
+	signed.RawQuery = query.Encode()
+	return &signed
+}
+
+// computeSignature signs the method, path and every query parameter other
+// than the signature itself, so a link to read an object can't be replayed
+// to overwrite or delete it.
+func computeSignature(secret string, method string, urlPath string, query url.Values) string {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	params := url.Values{}
+	for k, v := range query {
+		if k != signatureParam {
+			params[k] = v
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.ToUpper(method) + "\n" + urlPath + "?" + params.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedURL checks the signature and expiry of a signed request.
+func (s SignedURLs) verifySignedURL(r *http.Request, now time.Time) error {
+	query := r.URL.Query()
+	signature := query.Get(signatureParam)
+	if signature == "" {
+		return errors.New("missing signature")
+	}
+
+	expected := computeSignature(s.Secret, r.Method, r.URL.Path, query)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errors.New("invalid signature")
+	}
+
+	expires, err := strconv.ParseInt(query.Get(expiresParam), 10, 64)
+	if err != nil {
+		return errors.New("invalid expiry")
+	}
+	if now.Unix() > expires {
+		return errors.New("signature expired")
+	}
+
+	return nil
+}
+
+// requiresSignature returns true if the request path is protected by signed URLs.
+func (s SignedURLs) requiresSignature(reqPath string) bool {
+	return len(s.Paths) == 0 || pathMatches(s.Paths, reqPath)
+}
+
+// SignedCookie configures access to whole path prefixes through a signed
+// cookie, the usual pattern for gated media and download areas.
+type SignedCookie struct {
+	// The shared secret used to compute the HMAC-SHA256 signature.
+	Secret string `json:"secret,omitempty"`
+
+	// The cookie name. Default is `gcsproxy_access`.
+	Name string `json:"name,omitempty"`
+
+	// Request path patterns that require a valid cookie. Empty means every
+	// request does.
+	Paths []string `json:"paths,omitempty"`
+
+	// Request path that mints a cookie for an authenticated user, scoped to
+	// the `prefix` query parameter. Default is the first of MintPrefixes.
+	MintPath string `json:"mint_path,omitempty"`
+
+	// Path prefixes a cookie may be minted for, required with MintPath.
+	// Placeholders are resolved per request, with request values confined
+	// to one path segment, e.g. `/media/{http.auth.user.id}/`. The minted
+	// prefix must be one of them or a directory under one.
+	MintPrefixes []string `json:"mint_prefixes,omitempty"`
+
+	// How long a minted cookie is valid for. Default is 1h.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+const (
+	defaultSignedCookieName = "gcsproxy_access"
+	defaultSignedCookieTTL  = time.Hour
+)
+
+// protects returns true if the request path requires a signed cookie.
+func (c SignedCookie) protects(reqPath string) bool {
+	return len(c.Paths) == 0 || pathMatches(c.Paths, reqPath)
+}
+
+// cookieValue encodes a grant for prefix until expires as
+// `<base64 prefix>.<expires>.<signature>`.
+func (c SignedCookie) cookieValue(prefix string, expires time.Time) string {
+	encodedPrefix := base64.RawURLEncoding.EncodeToString([]byte(prefix))
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return encodedPrefix + "." + exp + "." + c.sign(prefix, exp)
+}
+
+func (c SignedCookie) sign(prefix string, expires string) string {
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	mac.Write([]byte(prefix + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCookie checks the request carries a valid, unexpired cookie granting
+// access to a prefix of the request path.
+func (c SignedCookie) verifyCookie(r *http.Request, now time.Time) error {
+	cookie, err := r.Cookie(c.Name)
+	if err != nil {
+		return errors.New("missing access cookie")
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed access cookie")
+	}
+	prefix, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("malformed access cookie")
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(c.sign(string(prefix), parts[1]))) {
+		return errors.New("invalid access cookie signature")
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.New("malformed access cookie")
+	}
+	if now.Unix() > expires {
+		return errors.New("access cookie expired")
+	}
+	if !pathWithin(cleanPath(r.URL.Path), string(prefix)) {
+		return errors.New("access cookie does not cover path")
+	}
+
+	return nil
+}
+
+// mintCookie issues a signed cookie to an authenticated user.
+func (c SignedCookie) mintCookie(w http.ResponseWriter, r *http.Request) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if user, _ := repl.GetString("http.auth.user.id"); user == "" {
+		return caddyhttp.Error(http.StatusUnauthorized, errors.New("authentication required to mint an access cookie"))
+	}
+
+	prefix, err := c.mintPrefix(r, repl)
+	if err != nil {
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+	expires := time.Now().Add(time.Duration(c.TTL))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.Name,
+		Value:    c.cookieValue(prefix, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// mintPrefix returns the prefix requested in the `prefix` query parameter,
+// cleaned, if it is within one of MintPrefixes.
+func (c SignedCookie) mintPrefix(r *http.Request, repl *caddy.Replacer) (string, error) {
+	requested := r.URL.Query().Get("prefix")
+	for _, tmpl := range c.MintPrefixes {
+		allowed, err := resolvePathTemplate(repl, tmpl)
+		if err != nil {
+			return "", err
+		}
+		allowed = cleanPath(allowed)
+		if requested == "" {
+			return allowed, nil
+		}
+		if prefix := cleanPath(requested); pathWithin(prefix, allowed) {
+			return prefix, nil
+		}
+	}
+	return "", fmt.Errorf("may not mint an access cookie for %q", requested)
+}
+
+// pathWithin returns true if the cleaned reqPath is prefix or below it.
+// Prefixes match whole segments, so `/a` covers `/a` and `/a/b` but not
+// `/ab`.
+func pathWithin(reqPath string, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(reqPath, prefix)
+	}
+	return reqPath == prefix || strings.HasPrefix(reqPath, prefix+"/")
+}
+
+// authorize checks the request against the configured signed access policies.
+// A protected request is let through by any one valid credential.
+func (p GcsProxy) authorize(r *http.Request) error {
+	now := time.Now()
+
+	var err error
+	if p.SignedCookie != nil && p.SignedCookie.protects(r.URL.Path) {
+		if err = p.SignedCookie.verifyCookie(r, now); err == nil {
+			return nil
+		}
+	}
+	if p.SignedURLs != nil && p.SignedURLs.requiresSignature(r.URL.Path) {
+		return p.SignedURLs.verifySignedURL(r, now)
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+func TestSignedURLs(t *testing.T) {
+	s := SignedURLs{Secret: "s3cret"}
+	now := time.Unix(1700000000, 0)
+	u, _ := url.Parse("/private/report.pdf?download=1")
+	signed := SignURL(s.Secret, http.MethodGet, u, now.Add(time.Hour)).String()
+
+	testCases := []struct {
+		desc      string
+		method    string
+		target    string
+		now       time.Time
+		shouldErr bool
+	}{
+		{"valid", "GET", signed, now, false},
+		{"head of a GET signature", "HEAD", signed, now, false},
+		{"other method", "DELETE", signed, now, true},
+		{"expired", "GET", signed, now.Add(2 * time.Hour), true},
+		{"missing signature", "GET", "/private/report.pdf?download=1", now, true},
+		{"tampered params", "GET", signed + "&download=2", now, true},
+		{"other path", "GET", "/private/other.pdf?" + mustParse(t, signed).RawQuery, now, true},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		err := s.verifySignedURL(r, tc.now)
+		if tc.shouldErr && err == nil {
+			t.Errorf("Test case '%s' expected an err and did not get one", tc.desc)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Errorf("Test case '%s' unexpected err '%s'", tc.desc, err.Error())
+		}
+	}
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestSignedCookie(t *testing.T) {
+	c := SignedCookie{Secret: "s3cret", Name: defaultSignedCookieName}
+	now := time.Unix(1700000000, 0)
+	value := c.cookieValue("/media/", now.Add(time.Hour))
+
+	testCases := []struct {
+		desc      string
+		target    string
+		value     string
+		now       time.Time
+		shouldErr bool
+	}{
+		{"valid", "/media/movie.mp4", value, now, false},
+		{"expired", "/media/movie.mp4", value, now.Add(2 * time.Hour), true},
+		{"outside prefix", "/private/movie.mp4", value, now, true},
+		{"climbing out of prefix", "/media/../private/movie.mp4", value, now, true},
+		{"sibling of prefix", "/media-private/movie.mp4", c.cookieValue("/media", now.Add(time.Hour)), now, true},
+		{"segment prefix", "/media/movie.mp4", c.cookieValue("/media", now.Add(time.Hour)), now, false},
+		{"missing cookie", "/media/movie.mp4", "", now, true},
+		{"forged prefix", "/private/movie.mp4", "L3ByaXZhdGUv" + value[strings.Index(value, "."):], now, true},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", tc.target, nil)
+		if tc.value != "" {
+			r.AddCookie(&http.Cookie{Name: c.Name, Value: tc.value})
+		}
+		err := c.verifyCookie(r, tc.now)
+		if tc.shouldErr && err == nil {
+			t.Errorf("Test case '%s' expected an err and did not get one", tc.desc)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Errorf("Test case '%s' unexpected err '%s'", tc.desc, err.Error())
+		}
+	}
+}
+
+func TestMintCookie(t *testing.T) {
+	c := SignedCookie{
+		Secret:       "s3cret",
+		Name:         defaultSignedCookieName,
+		MintPrefixes: []string{"/media/{http.auth.user.id}/"},
+		TTL:          caddy.Duration(time.Hour),
+	}
+
+	testCases := []struct {
+		desc   string
+		user   string
+		prefix string
+		want   string
+	}{
+		{desc: "default prefix", user: "alice", want: "/media/alice/"},
+		{desc: "directory under prefix", user: "alice", prefix: "/media/alice/films/", want: "/media/alice/films/"},
+		{desc: "root", user: "alice", prefix: "/"},
+		{desc: "other user", user: "alice", prefix: "/media/bob/"},
+		{desc: "climbing out", user: "alice", prefix: "/media/alice/../bob/"},
+		{desc: "user id climbing out", user: "..", prefix: "/media/"},
+		{desc: "anonymous"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/auth/cookie?prefix="+url.QueryEscape(tc.prefix), nil)
+			repl := caddy.NewReplacer()
+			if tc.user != "" {
+				repl.Set("http.auth.user.id", tc.user)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+			w := httptest.NewRecorder()
+			err := c.mintCookie(w, r)
+			if tc.want == "" {
+				if err == nil {
+					t.Fatal("expected an err and did not get one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("got %d cookies, want 1", len(cookies))
+			}
+			prefix, _ := base64.RawURLEncoding.DecodeString(strings.Split(cookies[0].Value, ".")[0])
+			if string(prefix) != tc.want {
+				t.Errorf("got cookie for %q, want %q", prefix, tc.want)
+			}
+		})
+	}
+}
+
+func TestProvisionRequiresSecret(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	for _, p := range []GcsProxy{
+		{Bucket: "test", SignedURLs: &SignedURLs{}},
+		{Bucket: "test", SignedCookie: &SignedCookie{}},
+	} {
+		err := p.Provision(ctx)
+		if err == nil || !strings.Contains(err.Error(), "requires a secret") {
+			t.Errorf("got %v, want a missing secret error", err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+type timingsCtxKey struct{}
+
+// requestTimings collects how long the GCS phases of a request took, for
+// logging requests slower than SlowRequestThreshold.
+type requestTimings struct {
+	mu     sync.Mutex
+	start  time.Time
+	phases []phaseTiming
+}
+
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// withTimings attaches a new requestTimings to the request's context.
+func withTimings(r *http.Request) (*http.Request, *requestTimings) {
+	t := &requestTimings{start: time.Now()}
+	return r.WithContext(context.WithValue(r.Context(), timingsCtxKey{}, t)), t
+}
+
+// timingsFrom returns the requestTimings in ctx, or nil if slow requests
+// aren't being logged.
+func timingsFrom(ctx context.Context) *requestTimings {
+	t, _ := ctx.Value(timingsCtxKey{}).(*requestTimings)
+	return t
+}
+
+// recordPhase records that phase of the request in ctx started at start and
+// has just ended. Repeated phases, e.g. opening an index and then an error
+// page, add up.
+func recordPhase(ctx context.Context, phase string, start time.Time) {
+	t := timingsFrom(ctx)
+	if t == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.phases {
+		if t.phases[i].name == phase {
+			t.phases[i].duration += elapsed
+			return
+		}
+	}
+	t.phases = append(t.phases, phaseTiming{name: phase, duration: elapsed})
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
+// slowRequestLogger measures a request and logs it if it takes longer than
+// SlowRequestThreshold.
+type slowRequestLogger struct {
+	timings *requestTimings
+	w       *countingWriter
+	body    *countingReader
+}
+
+// trackSlowRequest wraps the request and response to measure them.
+func (p GcsProxy) trackSlowRequest(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, *slowRequestLogger) {
+	r, timings := withTimings(r)
+	l := &slowRequestLogger{
+		timings: timings,
+		w:       &countingWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}},
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		l.body = &countingReader{ReadCloser: r.Body}
+		r.Body = l.body
+	}
+	return l.w, r, l
+}
+
+// finishSlowRequest logs the request if it was slow.
+func (p GcsProxy) finishSlowRequest(l *slowRequestLogger, r *http.Request, key string) {
+	elapsed := time.Since(l.timings.start)
+	if elapsed < time.Duration(p.SlowRequestThreshold) {
+		return
+	}
+
+	l.timings.mu.Lock()
+	var phases []zap.Field
+	for _, phase := range l.timings.phases {
+		phases = append(phases, zap.Duration(phase.name, phase.duration))
+	}
+	l.timings.mu.Unlock()
+
+	fields := []zap.Field{
+		zap.String("method", r.Method),
+		zap.String("key", key),
+		zap.Duration("duration", elapsed),
+		zap.Int64("bytes_written", l.w.n),
+	}
+	if l.body != nil {
+		fields = append(fields, zap.Int64("bytes_read", l.body.n))
+	}
+	fields = append(fields, zap.Dict("phases", phases...))
+	p.log.Warn("slow request", fields...)
+}
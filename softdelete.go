@@ -0,0 +1,116 @@
+package caddygcsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+// deletedObject is a soft-deleted object as listed for `?deleted=1` requests.
+type deletedObject struct {
+	Key            string    `json:"key"`
+	Generation     int64     `json:"generation"`
+	Size           int64     `json:"size"`
+	ContentType    string    `json:"content_type,omitempty"`
+	SoftDeleteTime time.Time `json:"soft_delete_time"`
+	HardDeleteTime time.Time `json:"hard_delete_time"`
+}
+
+type deletedListing struct {
+	Prefix  string          `json:"prefix"`
+	Objects []deletedObject `json:"objects"`
+	Next    string          `json:"next,omitempty"`
+}
+
+// DeletedHandler lists the soft-deleted objects under the directory prefix as
+// JSON, with the generation to pass to `POST <key>?restore=<generation>`.
+// Only clients that may restore objects in the directory can list them.
+func (p GcsProxy) DeletedHandler(w http.ResponseWriter, r *http.Request, prefix string) error {
+	if p.PublicOnly {
+		// Soft-deleted objects are never publicly readable
+		return caddyhttp.Error(http.StatusForbidden, errors.New("soft-deleted objects are not public"))
+	}
+	if !p.methodAllowed(http.MethodPost, r.URL.Path) {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("listing soft-deleted objects requires restoring them to be allowed"))
+	}
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opList)
+	defer cancelOp()
+
+	it := p.bucketFor(opList).Objects(ctx, &storage.Query{Prefix: prefix, SoftDeleted: true})
+
+	// Read exactly one page, so hidden objects leave it short instead of
+	// pulling in part of the next one
+	var page []*storage.ObjectAttrs
+	token, err := iterator.NewPager(it, p.pageSize(r), r.URL.Query().Get("next")).NextPage(&page)
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+
+	listing := deletedListing{Prefix: prefix, Objects: []deletedObject{}, Next: token}
+	for _, attrs := range page {
+		if fileHidden(attrs.Name, p.Hide) {
+			continue
+		}
+		listing.Objects = append(listing.Objects, deletedObject{
+			Key:            attrs.Name,
+			Generation:     attrs.Generation,
+			Size:           attrs.Size,
+			ContentType:    attrs.ContentType,
+			SoftDeleteTime: attrs.SoftDeleteTime,
+			HardDeleteTime: attrs.HardDeleteTime,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	return json.NewEncoder(w).Encode(listing)
+}
+
+// RestoreHandler restores the soft-deleted generation of the object at key
+// given in the `restore` query parameter, and responds with the restored
+// object's attributes as JSON.
+func (p GcsProxy) RestoreHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	generation, err := strconv.ParseInt(r.URL.Query().Get("restore"), 10, 64)
+	if err != nil || generation <= 0 {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("restore requires the generation to restore"))
+	}
+	if fileHidden(key, p.Hide) {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opPut)
+	defer cancelOp()
+
+	attrs, err := p.objectFor(opPut, key).Generation(generation).Restore(ctx, nil)
+	if err != nil {
+		p.log.Error("failed to restore object",
+			zap.String("bucket", p.Bucket),
+			zap.String("key", key),
+			zap.Int64("generation", generation),
+			zap.String("err", err.Error()),
+		)
+		return convertToCaddyError(err)
+	}
+
+	if p.quotas != nil {
+		p.recordQuotaWrite(r, key, attrs.Size, -1)
+	}
+	if p.cache != nil {
+		p.cache.delete(key)
+	}
+	p.notify(p.newMutationEvent(r, key, attrs))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(newObjectMeta(attrs))
+}
@@ -0,0 +1,242 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSpoolMaxRetryInterval = 5 * time.Minute
+	defaultSpoolMaxAge           = 24 * time.Hour
+	spoolScanInterval            = 15 * time.Second
+)
+
+// WriteSpool configures a local disk spool for uploads. If a PUT fails with a
+// transient GCS error its body is kept on disk, the client gets a 202 and the
+// upload is retried in the background with backoff.
+type WriteSpool struct {
+	// Directory the spooled uploads are kept in.
+	Dir string `json:"dir,omitempty"`
+
+	// Upper bound on the backoff between retries. Default is 5m.
+	MaxRetryInterval caddy.Duration `json:"max_retry_interval,omitempty"`
+
+	// How long a spooled upload is retried before it is given up on and
+	// left in the spool with a `.failed` suffix. Default is 24h.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+}
+
+// pendingUpload is the sidecar describing a spooled upload body.
+type pendingUpload struct {
+	Key             string            `json:"key"`
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Holds           []string          `json:"holds,omitempty"`
+	CustomTime      time.Time         `json:"custom_time,omitzero"`
+	Created         time.Time         `json:"created"`
+	Attempts        int               `json:"attempts"`
+	NextAttempt     time.Time         `json:"next_attempt"`
+}
+
+// isTransient returns true for errors worth retrying the upload for.
+func isTransient(err error) bool {
+	return storage.ShouldRetry(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func newSpoolID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// spoolUpload moves an upload body that failed to write into the spool.
+func (s WriteSpool) spoolUpload(body *spooledBody, attrs storage.ObjectAttrs) error {
+	id := newSpoolID()
+	entry := pendingUpload{
+		Key:             attrs.Name,
+		ContentType:     attrs.ContentType,
+		ContentEncoding: attrs.ContentEncoding,
+		Metadata:        attrs.Metadata,
+		CustomTime:      attrs.CustomTime,
+		Created:         time.Now(),
+		NextAttempt:     time.Now(),
+	}
+	if attrs.TemporaryHold {
+		entry.Holds = append(entry.Holds, "temporary")
+	}
+	if attrs.EventBasedHold {
+		entry.Holds = append(entry.Holds, "event_based")
+	}
+	if err := body.persist(filepath.Join(s.Dir, id+".data")); err != nil {
+		return err
+	}
+	return writePendingUpload(filepath.Join(s.Dir, id+".json"), entry)
+}
+
+func writePendingUpload(name string, entry pendingUpload) error {
+	doc, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, doc, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// spoolFailedUpload keeps an upload that failed with a transient error for a
+// background retry and tells the client it has been accepted.
+func (p GcsProxy) spoolFailedUpload(w http.ResponseWriter, body *spooledBody, attrs storage.ObjectAttrs, cause error) error {
+	if err := p.WriteSpool.spoolUpload(body, attrs); err != nil {
+		p.log.Error("could not spool failed upload",
+			zap.String("key", attrs.Name),
+			zap.String("err", err.Error()),
+		)
+		return convertToCaddyError(cause)
+	}
+
+	p.log.Warn("spooled upload after transient error",
+		zap.String("key", attrs.Name),
+		zap.String("err", cause.Error()),
+	)
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// runSpool retries spooled uploads until ctx is done.
+func (p GcsProxy) runSpool(ctx context.Context) {
+	ticker := time.NewTicker(spoolScanInterval)
+	defer ticker.Stop()
+
+	for {
+		p.retrySpooled(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p GcsProxy) retrySpooled(ctx context.Context) {
+	sidecars, err := filepath.Glob(filepath.Join(p.WriteSpool.Dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, sidecar := range sidecars {
+		if ctx.Err() != nil {
+			return
+		}
+		p.retrySpooledUpload(ctx, sidecar)
+	}
+}
+
+func (p GcsProxy) retrySpooledUpload(ctx context.Context, sidecar string) {
+	doc, err := os.ReadFile(sidecar)
+	if err != nil {
+		return
+	}
+	var entry pendingUpload
+	if err := json.Unmarshal(doc, &entry); err != nil {
+		p.log.Error("invalid spooled upload", zap.String("file", sidecar), zap.String("err", err.Error()))
+		return
+	}
+	if time.Now().Before(entry.NextAttempt) {
+		return
+	}
+
+	// Claim the body by renaming it, so that another instance sharing the
+	// spool directory (e.g. during a config reload) can't retry it concurrently.
+	base := strings.TrimSuffix(sidecar, ".json")
+	claimed := base + ".uploading"
+	if err := os.Rename(base+".data", claimed); err != nil {
+		return
+	}
+
+	err = p.uploadSpooledBody(ctx, claimed, entry)
+	if err == nil {
+		os.Remove(claimed)
+		os.Remove(sidecar)
+		p.log.Info("uploaded spooled object", zap.String("key", entry.Key), zap.Int("attempts", entry.Attempts+1))
+		return
+	}
+
+	entry.Attempts++
+	if time.Since(entry.Created) > time.Duration(p.WriteSpool.MaxAge) || !isTransient(err) {
+		p.log.Error("giving up on spooled upload",
+			zap.String("key", entry.Key),
+			zap.Int("attempts", entry.Attempts),
+			zap.String("err", err.Error()),
+		)
+		os.Rename(claimed, base+".data.failed")
+		os.Rename(sidecar, sidecar+".failed")
+		return
+	}
+
+	backoff := min(spoolScanInterval<<min(entry.Attempts, 16), time.Duration(p.WriteSpool.MaxRetryInterval))
+	entry.NextAttempt = time.Now().Add(backoff)
+	p.log.Warn("retrying spooled upload later",
+		zap.String("key", entry.Key),
+		zap.Int("attempts", entry.Attempts),
+		zap.Duration("backoff", backoff),
+		zap.String("err", err.Error()),
+	)
+	writePendingUpload(sidecar, entry)
+	os.Rename(claimed, base+".data")
+}
+
+func (p GcsProxy) uploadSpooledBody(ctx context.Context, name string, entry pendingUpload) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := p.bucketHandle().Object(entry.Key).NewWriter(ctx)
+	writer.ContentType = entry.ContentType
+	writer.ContentEncoding = entry.ContentEncoding
+	writer.Metadata = entry.Metadata
+	writer.TemporaryHold = slices.Contains(entry.Holds, "temporary")
+	writer.EventBasedHold = slices.Contains(entry.Holds, "event_based")
+	writer.CustomTime = entry.CustomTime
+	if _, err := io.Copy(writer, file); err != nil {
+		cancel()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	if p.cache != nil {
+		p.cache.delete(entry.Key)
+	}
+
+	p.notify(mutationEvent{
+		Bucket:     p.Bucket,
+		Key:        entry.Key,
+		Method:     http.MethodPut,
+		Size:       writer.Attrs().Size,
+		Generation: writer.Attrs().Generation,
+		Time:       time.Now().UTC(),
+	})
+	return nil
+}
@@ -0,0 +1,196 @@
+package caddygcsproxy
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	caddy "github.com/caddyserver/caddy/v2"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultStatsMaxObjects = 100000
+	defaultStatsTTL        = 5 * time.Minute
+	defaultStatsLargest    = 10
+)
+
+// PrefixStats configures `GET <dir>/?stats=1` requests, which break down the
+// objects under the directory's prefix by content type and storage class.
+type PrefixStats struct {
+	// Most objects looked at per request. Beyond it the result is marked as
+	// truncated. Default is 100000.
+	MaxObjects int64 `json:"max_objects,omitempty"`
+
+	// How long a result is reused for the same prefix. Default is 5m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// Number of largest objects listed. Default is 10.
+	Largest int `json:"largest,omitempty"`
+}
+
+// groupStats is the size and number of objects sharing a property.
+type groupStats struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+type statsObject struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+// prefixStats is the JSON document served for `?stats=1` requests.
+type prefixStats struct {
+	Prefix         string                 `json:"prefix"`
+	Bytes          int64                  `json:"bytes"`
+	Objects        int64                  `json:"objects"`
+	ContentTypes   map[string]*groupStats `json:"content_types"`
+	StorageClasses map[string]*groupStats `json:"storage_classes"`
+	Largest        []statsObject          `json:"largest"`
+	Newest         *statsObject           `json:"newest,omitempty"`
+	Oldest         *statsObject           `json:"oldest,omitempty"`
+	Truncated      bool                   `json:"truncated"`
+	Scanned        time.Time              `json:"scanned"`
+}
+
+// add accounts for one object, keeping at most largest of the biggest ones.
+func (s *prefixStats) add(attrs *storage.ObjectAttrs, largest int) {
+	s.Bytes += attrs.Size
+	s.Objects++
+
+	contentType := attrs.ContentType
+	if contentType == "" {
+		contentType = "unknown"
+	}
+	addToGroup(s.ContentTypes, contentType, attrs.Size)
+	addToGroup(s.StorageClasses, attrs.StorageClass, attrs.Size)
+
+	obj := statsObject{Key: attrs.Name, Size: attrs.Size, Updated: attrs.Updated}
+	if s.Newest == nil || obj.Updated.After(s.Newest.Updated) {
+		s.Newest = &obj
+	}
+	if s.Oldest == nil || obj.Updated.Before(s.Oldest.Updated) {
+		s.Oldest = &obj
+	}
+
+	if len(s.Largest) < largest || obj.Size > s.Largest[len(s.Largest)-1].Size {
+		// Largest is kept sorted by descending size
+		i, _ := slices.BinarySearchFunc(s.Largest, obj.Size, func(o statsObject, size int64) int {
+			return cmp.Compare(size, o.Size)
+		})
+		s.Largest = slices.Insert(s.Largest, i, obj)
+		if len(s.Largest) > largest {
+			s.Largest = s.Largest[:largest]
+		}
+	}
+}
+
+func addToGroup(groups map[string]*groupStats, name string, size int64) {
+	if groups[name] == nil {
+		groups[name] = &groupStats{}
+	}
+	groups[name].Bytes += size
+	groups[name].Objects++
+}
+
+// statsTracker caches the stats of each prefix for TTL.
+type statsTracker struct {
+	mu     sync.Mutex
+	config PrefixStats
+	stats  map[string]*prefixStats
+}
+
+func newStatsTracker(config PrefixStats) *statsTracker {
+	if config.MaxObjects <= 0 {
+		config.MaxObjects = defaultStatsMaxObjects
+	}
+	if config.TTL <= 0 {
+		config.TTL = caddy.Duration(defaultStatsTTL)
+	}
+	if config.Largest <= 0 {
+		config.Largest = defaultStatsLargest
+	}
+	return &statsTracker{
+		config: config,
+		stats:  make(map[string]*prefixStats),
+	}
+}
+
+// get returns the stats of prefix, scanning the bucket if the cached value
+// is missing or stale. Hidden objects are left out.
+func (t *statsTracker) get(ctx context.Context, bucket *storage.BucketHandle, prefix string, hide []string) (*prefixStats, error) {
+	t.mu.Lock()
+	s, ok := t.stats[prefix]
+	t.mu.Unlock()
+	if ok && time.Since(s.Scanned) < time.Duration(t.config.TTL) {
+		return s, nil
+	}
+
+	scanned := &prefixStats{
+		Prefix:         prefix,
+		ContentTypes:   make(map[string]*groupStats),
+		StorageClasses: make(map[string]*groupStats),
+		Largest:        []statsObject{},
+		Scanned:        time.Now().UTC(),
+	}
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size", "ContentType", "StorageClass", "Updated"}); err != nil {
+		return nil, err
+	}
+	it := bucket.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fileHidden(attrs.Name, hide) {
+			continue
+		}
+		if scanned.Objects >= t.config.MaxObjects {
+			scanned.Truncated = true
+			break
+		}
+		scanned.add(attrs, t.config.Largest)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats[prefix] = scanned
+	return scanned, nil
+}
+
+// StatsHandler responds with a breakdown of the objects under the directory
+// prefix as JSON.
+func (p GcsProxy) StatsHandler(w http.ResponseWriter, r *http.Request, prefix string) error {
+	if p.offline != nil && p.offline.active() {
+		return p.offlineError()
+	}
+
+	ctx, cancel := p.gcsContext(r)
+	defer cancel()
+	ctx, cancelOp := p.opContext(ctx, opList)
+	defer cancelOp()
+
+	if err := p.checkPublicListing(ctx); err != nil {
+		return err
+	}
+
+	stats, err := p.stats.get(ctx, p.bucketFor(opList), prefix, p.Hide)
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	return json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,184 @@
+package caddygcsproxy
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTemplateRefresh     = 5 * time.Minute
+	defaultTemplateFileRefresh = 10 * time.Second
+)
+
+// BrowseTemplateRule sets the browse template for some request paths.
+type BrowseTemplateRule struct {
+	// Template file or GCS key, in the same forms as BrowseTemplate.
+	Template string `json:"template,omitempty"`
+
+	// Request path patterns the rule applies to.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// templateHolder holds a parsed browse template, so it can be swapped when
+// the template is reloaded.
+type templateHolder struct {
+	location string
+	current  atomic.Pointer[template.Template]
+}
+
+func (h *templateHolder) get() *template.Template {
+	return h.current.Load()
+}
+
+// gcsTemplateLocation splits a template location of the form
+// `gs://<bucket>/<key>`, or `gs:<key>` for a key in defaultBucket, into
+// bucket and key. It returns false for a local file.
+func gcsTemplateLocation(location string, defaultBucket string) (string, string, bool) {
+	if rest, ok := strings.CutPrefix(location, "gs://"); ok {
+		bucket, key, _ := strings.Cut(rest, "/")
+		return bucket, key, true
+	}
+	if key, ok := strings.CutPrefix(location, "gs:"); ok {
+		return defaultBucket, key, true
+	}
+	return "", "", false
+}
+
+// readBrowseTemplate reads and parses the browse template at location, which
+// is either a local file or a GCS object. An empty location gives the default
+// template.
+func readBrowseTemplate(ctx context.Context, client *storage.Client, location string, defaultBucket string) (*template.Template, error) {
+	if location == "" {
+		return template.New("default_listing").Parse(defaultBrowseTemplate)
+	}
+	bucket, key, ok := gcsTemplateLocation(location, defaultBucket)
+	if !ok {
+		return template.ParseFiles(location)
+	}
+
+	reader, err := client.Bucket(bucket).Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(path.Base(key)).Parse(string(body))
+}
+
+// templateVersion returns a value that changes whenever the template at
+// location does: the modification time and size of a local file, or the
+// generation of a GCS object.
+func templateVersion(ctx context.Context, client *storage.Client, location string, defaultBucket string) (string, error) {
+	bucket, key, ok := gcsTemplateLocation(location, defaultBucket)
+	if !ok {
+		info, err := os.Stat(location)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+	}
+	attrs, err := client.Bucket(bucket).Object(key).Attrs(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(attrs.Generation, 10), nil
+}
+
+// loadBrowseTemplate reads and parses the browse template at location and,
+// unless it is the default template, keeps reloading it as it changes until
+// ctx is done.
+func (p GcsProxy) loadBrowseTemplate(ctx context.Context, client *storage.Client, location string) (*templateHolder, error) {
+	// The version is taken first so a change while reading is picked up
+	var version string
+	if location != "" {
+		version, _ = templateVersion(ctx, client, location, p.Bucket)
+	}
+	tpl, err := readBrowseTemplate(ctx, client, location, p.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	h := &templateHolder{location: location}
+	h.current.Store(tpl)
+	if location != "" {
+		go p.watchBrowseTemplate(ctx, h, version)
+	}
+	return h, nil
+}
+
+// browseTemplateFor returns the browse template for the request, from the
+// first rule matching its path, else from its localization, or else the
+// handler's default.
+func (p GcsProxy) browseTemplateFor(r *http.Request) *template.Template {
+	for i, rule := range p.BrowseTemplates {
+		if pathMatches(rule.Paths, r.URL.Path) {
+			return p.templates[i].get()
+		}
+	}
+	if i := p.localization(r); i >= 0 && p.languages.templates[i] != nil {
+		return p.languages.templates[i].get()
+	}
+	return p.dirTemplate.get()
+}
+
+// templateRefresh returns how often the template at location is checked for
+// changes.
+func (p GcsProxy) templateRefresh(location string) time.Duration {
+	if p.BrowseTemplateRefresh > 0 {
+		return time.Duration(p.BrowseTemplateRefresh)
+	}
+	if _, _, inGCS := gcsTemplateLocation(location, p.Bucket); inGCS {
+		return defaultTemplateRefresh
+	}
+	return defaultTemplateFileRefresh
+}
+
+// watchBrowseTemplate checks the template in h for changes until ctx is
+// done, and parses it again when it has changed. A template that can't be
+// read or parsed is logged and the last good one kept.
+func (p GcsProxy) watchBrowseTemplate(ctx context.Context, h *templateHolder, version string) {
+	ticker := time.NewTicker(p.templateRefresh(h.location))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		client := p.gcs.client()
+		newVersion, err := templateVersion(ctx, client, h.location, p.Bucket)
+		if err != nil || newVersion == version {
+			continue
+		}
+		tpl, err := readBrowseTemplate(ctx, client, h.location, p.Bucket)
+		if err != nil {
+			if ctx.Err() == nil {
+				p.log.Error("could not reload browse template, serving the previous one",
+					zap.String("template", h.location),
+					zap.String("err", err.Error()),
+				)
+			}
+			// Don't retry until the template changes again
+			version = newVersion
+			continue
+		}
+		version = newVersion
+		h.current.Store(tpl)
+		p.log.Info("reloaded browse template", zap.String("template", h.location))
+	}
+}
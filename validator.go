@@ -0,0 +1,138 @@
+package caddygcsproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+const defaultValidatorTimeout = 10 * time.Second
+
+// UploadValidator configures an external policy check that can veto a PUT
+// before anything is written to the bucket. Exactly one of URL or Command
+// should be set.
+type UploadValidator struct {
+	// URL that is POSTed the upload's metadata as JSON. Any non 2xx response
+	// rejects the upload.
+	URL string `json:"url,omitempty"`
+
+	// Command that is run with the upload's metadata as JSON on stdin. A non
+	// zero exit status rejects the upload, stdout is used as the reason.
+	Command []string `json:"command,omitempty"`
+
+	// Number of leading body bytes included in the metadata (base64 encoded),
+	// for checks such as magic byte sniffing. Default is 0.
+	PeekBytes int `json:"peek_bytes,omitempty"`
+
+	// Timeout for a single validation. Default is 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// uploadInfo is the document sent to an upload validator.
+type uploadInfo struct {
+	Bucket        string `json:"bucket"`
+	Key           string `json:"key"`
+	ContentType   string `json:"content_type,omitempty"`
+	ContentLength int64  `json:"content_length"`
+	Client        string `json:"client,omitempty"`
+	User          string `json:"user,omitempty"`
+	Head          string `json:"head,omitempty"`
+}
+
+// validationError is returned when a validator rejects an upload.
+type validationError struct {
+	reason string
+}
+
+func (e validationError) Error() string {
+	return "upload rejected by validator: " + e.reason
+}
+
+// validate peeks at the start of body and asks the validator whether the
+// upload may proceed. The returned reader yields the complete body.
+func (v UploadValidator) validate(ctx context.Context, info uploadInfo, body io.Reader) (io.Reader, error) {
+	if v.PeekBytes > 0 {
+		head := make([]byte, v.PeekBytes)
+		n, err := io.ReadFull(body, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		head = head[:n]
+		info.Head = base64.StdEncoding.EncodeToString(head)
+		body = io.MultiReader(bytes.NewReader(head), body)
+	}
+
+	doc, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(v.Timeout)
+	if timeout == 0 {
+		timeout = defaultValidatorTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if v.URL != "" {
+		err = v.validateHTTP(ctx, doc)
+	} else {
+		err = v.validateCommand(ctx, doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (v UploadValidator) validateHTTP(ctx context.Context, doc []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.URL, bytes.NewReader(doc))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling upload validator: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if len(reason) == 0 {
+			reason = []byte(resp.Status)
+		}
+		return validationError{reason: strings.TrimSpace(string(reason))}
+	}
+	return nil
+}
+
+func (v UploadValidator) validateCommand(ctx context.Context, doc []byte) error {
+	cmd := exec.CommandContext(ctx, v.Command[0], v.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(doc)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	if _, isExit := err.(*exec.ExitError); isExit {
+		reason := strings.TrimSpace(stdout.String())
+		if reason == "" {
+			reason = err.Error()
+		}
+		return validationError{reason: reason}
+	}
+	if err != nil {
+		return fmt.Errorf("running upload validator: %v", err)
+	}
+	return nil
+}